@@ -0,0 +1,171 @@
+package functionality
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// domainMatches is whether the domain is the breached domain or one of its subdomains
+func domainMatches(domain, breachedDomain string) bool {
+	domain, breachedDomain = strings.ToLower(domain), strings.ToLower(breachedDomain)
+
+	return breachedDomain != "" && (domain == breachedDomain || strings.HasSuffix(domain, "."+breachedDomain))
+}
+
+// isSubscriberRelevantToBreach is whether the subscriber could be in the breach: either their
+// email is on the breached domain, or the breached service is one they monitor; breaches without
+// a domain (like most spam lists) are only relevant to subscribers monitoring them by name
+func isSubscriberRelevantToBreach(subscriber Subscriber, breach PwnInfo) bool {
+	if at := strings.LastIndexByte(subscriber.Email, '@'); at != -1 && domainMatches(subscriber.Email[at+1:], breach.Domain) {
+		return true
+	}
+
+	for _, service := range subscriber.MonitoredServices {
+		if strings.EqualFold(service, breach.Name) || domainMatches(service, breach.Domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsBreach(pwnInfo []PwnInfo, name string) bool {
+	for _, breach := range pwnInfo {
+		if breach.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// alertSubscribersOfNewBreaches re-checks only the subscribers relevant to the breaches newly added to
+// HIBP, rather than every subscriber, along with those whose earlier re-checks failed (the breach names
+// by subscriber ID), and notifies the ones found in them; it returns the re-checks which failed again
+func alertSubscribersOfNewBreaches(ctx context.Context, added []PwnInfo, failedAlerts map[string][]string) (map[string][]string, error) {
+	if len(added) == 0 && len(failedAlerts) == 0 {
+		return nil, nil
+	}
+
+	if subscribers == nil {
+		return nil, ErrSubscriberStoreUnavailable
+	}
+
+	subscriberList, err := subscribers.list()
+
+	if err != nil {
+		return nil, err
+	}
+
+	log := loggerFromContext(ctx)
+	rechecked, notified := 0, 0
+	stillFailing := make(map[string][]string)
+
+	// The most severe breaches are alerted first
+	addedBreaches := scoreBreaches(added)
+
+	for _, subscriber := range subscriberList {
+		var relevantBreaches []PwnInfo
+
+		for _, breach := range addedBreaches {
+			if isSubscriberRelevantToBreach(subscriber, breach.PwnInfo) {
+				relevantBreaches = append(relevantBreaches, breach.PwnInfo)
+			}
+		}
+
+		for _, name := range failedAlerts[subscriber.ID] {
+			if !containsBreach(relevantBreaches, name) {
+				relevantBreaches = append(relevantBreaches, cataloguedBreach(name))
+			}
+		}
+
+		if len(relevantBreaches) == 0 {
+			continue
+		}
+
+		rechecked++
+
+		pwnInfo, lookupErr := getPwnageForEmail(ctx, subscriber.Email)
+
+		if lookupErr != nil && lookupErr != ErrNoPwns {
+			log.Error("could not re-check subscriber for new breaches", "email", subscriber.Email, "error", lookupErr)
+
+			for _, breach := range relevantBreaches {
+				stillFailing[subscriber.ID] = append(stillFailing[subscriber.ID], breach.Name)
+			}
+
+			continue
+		}
+
+		for _, breach := range relevantBreaches {
+			if !containsBreach(pwnInfo, breach.Name) {
+				continue
+			}
+
+			if err = notifySubscriberOfNewBreach(ctx, subscriber, breach); err != nil {
+				log.Error("could not notify subscriber of new breach", "email", subscriber.Email, "breach", breach.Name, "error", err)
+
+				continue
+			}
+
+			notified++
+		}
+
+		if lookupErr == nil && !subscriber.IsPwned {
+			err = subscribers.updateDetails(subscriber.ID, func(details *subscriberDetails) { details.IsPwned = true })
+
+			if err != nil {
+				log.Error("could not mark subscriber as pwned", "email", subscriber.Email, "error", err)
+			}
+		}
+	}
+
+	log.Info("alerted subscribers of new breaches", "breaches", len(added), "retried", len(failedAlerts), "rechecked", rechecked, "notified", notified, "failed", len(stillFailing))
+
+	if len(stillFailing) == 0 {
+		return nil, nil
+	}
+
+	return stillFailing, nil
+}
+
+// notifySubscriberOfNewBreach notifies the subscriber unless their notification policy ignores the breach
+func notifySubscriberOfNewBreach(ctx context.Context, subscriber Subscriber, breach PwnInfo) error {
+	decision := evaluatePolicy([]PwnInfo{breach}, subscriber.PolicyRules)
+
+	if len(decision.Breaches) == 0 {
+		loggerFromContext(ctx).Info("new breach was ignored by the notification policy", "email", subscriber.Email, "breach", breach.Name)
+
+		return nil
+	}
+
+	scored := decision.Breaches[0]
+
+	if queued, err := queueForDigest(ctx, subscriber, digestItemsFor(decision, time.Now().UTC())); queued || err != nil {
+		return err
+	}
+
+	subject := pwnageSubject(scored.Severity)
+
+	ctx = contextWithLogger(ctx, loggerFromContext(ctx).With("severity", scored.Severity.String()))
+
+	body := fmt.Sprintf(
+		"Your email was found in the %s breach (%s), which has just been added to Have I Been Pwned. The data exposed was: %s. We rate this breach as %s severity.",
+		breach.Title,
+		breach.BreachDate,
+		strings.Join(breach.DataClasses, ", "),
+		scored.Severity,
+	)
+
+	return notifyDecision(ctx, subscriber, decision, func(breaches []scoredBreach) notification {
+		return notification{
+			Type:     notificationBreach,
+			Title:    subject,
+			Body:     body,
+			Severity: scored.Severity,
+			Breaches: breaches,
+		}
+	})
+}
@@ -0,0 +1,126 @@
+package functionality
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/the-rileyj/pwned-api/functionality/hibptest"
+)
+
+// Need to test the following:
+// Subscribers with emails on the breached domain, or its subdomains, are relevant
+// Subscribers monitoring the breached domain or the breach's name are relevant
+// Other subscribers, and every subscriber for a breach without a domain they don't monitor, are not
+func TestIsSubscriberRelevantToBreach(t *testing.T) {
+	adobe := PwnInfo{Name: "Adobe", Domain: "adobe.com"}
+	spamList := PwnInfo{Name: "Onliner"}
+
+	tests := []struct {
+		Subscriber Subscriber
+		Breach     PwnInfo
+		Expected   bool
+	}{
+		{Subscriber: Subscriber{Email: "someone@Adobe.com"}, Breach: adobe, Expected: true},
+		{Subscriber: Subscriber{Email: "someone@corp.adobe.com"}, Breach: adobe, Expected: true},
+		{Subscriber: Subscriber{Email: "someone@notadobe.com"}, Breach: adobe, Expected: false},
+		{Subscriber: Subscriber{Email: "someone@example.com", subscriberDetails: subscriberDetails{MonitoredServices: []string{"adobe.com"}}}, Breach: adobe, Expected: true},
+		{Subscriber: Subscriber{Email: "someone@example.com", subscriberDetails: subscriberDetails{MonitoredServices: []string{"adobe"}}}, Breach: adobe, Expected: true},
+		{Subscriber: Subscriber{Email: "someone@example.com"}, Breach: spamList, Expected: false},
+		{Subscriber: Subscriber{Email: "someone@example.com", subscriberDetails: subscriberDetails{MonitoredServices: []string{"onliner"}}}, Breach: spamList, Expected: true},
+	}
+
+	for _, test := range tests {
+		if relevant := isSubscriberRelevantToBreach(test.Subscriber, test.Breach); relevant != test.Expected {
+			t.Errorf("isSubscriberRelevantToBreach(%s monitoring %v, %s) = %t; expected: %t", test.Subscriber.Email, test.Subscriber.MonitoredServices, test.Breach.Name, relevant, test.Expected)
+		}
+	}
+}
+
+// Need to test the following:
+// Subscribers relevant to a breach added by a sync are re-checked against HIBP and alerted when they are in it
+// Re-checks which fail are saved with the catalogue and retried after the next sync, rather than being lost
+func TestAlertPendingBreaches(t *testing.T) {
+	tempDirectory, err := ioutil.TempDir("", "breachalerts")
+
+	if err != nil {
+		t.Fatal("could not create the temporary data directory")
+	}
+
+	defer os.RemoveAll(tempDirectory)
+
+	server, restoreHIBP := useFakeHIBP(hibptest.Fixtures{
+		Breaches: []hibptest.Breach{
+			{Name: "Adobe", Title: "Adobe", Domain: "adobe.com", BreachDate: "2013-10-04", DataClasses: []string{"Email addresses", "Passwords"}},
+			{Name: "Dropbox", Title: "Dropbox", Domain: "dropbox.com", BreachDate: "2012-07-01", DataClasses: []string{"Email addresses", "Passwords"}},
+		},
+		Accounts: map[string][]string{"someone@dropbox.com": {"Dropbox"}},
+	})
+
+	defer restoreHIBP()
+
+	kr := newTestKeyring(t, "1", map[string]string{"1": newTestKey(t)}, newTestKey(t))
+
+	subscribers, _ = openSubscriberStore(filepath.Join(tempDirectory, "subscribers.json"), kr)
+
+	defer func() { subscribers = nil }()
+
+	subscriber, _ := subscribers.add(Subscriber{Email: "someone@dropbox.com"})
+	subscribers.add(Subscriber{Email: "someone@example.com"})
+
+	fileLocation := filepath.Join(tempDirectory, "breaches.json")
+	catalogue, _ := openBreachCatalogue(fileLocation)
+
+	catalogue.LastSynced = time.Now().Add(-24 * time.Hour)
+	catalogue.Breaches = map[string]PwnInfo{"Adobe": {Name: "Adobe"}}
+
+	breaches = catalogue
+
+	defer func() { breaches = nil }()
+
+	sent, restoreNotifiers := useRecordingNotifiers("", channelEmail)
+
+	defer restoreNotifiers()
+
+	server.SetFault(hibptest.BreachedAccount, hibptest.Fault{StatusCode: http.StatusServiceUnavailable})
+
+	if _, err = catalogue.sync(context.Background(), server.Client()); err != nil {
+		t.Fatalf("breachCatalogue.sync() = %v; expected: <nil>", err)
+	}
+
+	if err = catalogue.alertPending(context.Background()); err == nil || len(sent()) != 0 {
+		t.Errorf("breachCatalogue.alertPending() while HIBP is down = %v, sent %+v; expected: an error, nothing sent", err, sent())
+	}
+
+	if requests := server.Requests(hibptest.BreachedAccount); requests != 1 {
+		t.Errorf("fake HIBP breachedaccount requests = %d; expected: 1, for only the subscriber on dropbox.com", requests)
+	}
+
+	if catalogue, err = openBreachCatalogue(fileLocation); err != nil || len(catalogue.UnalertedBreaches) != 0 || !equalStrings(catalogue.FailedAlerts[subscriber.ID], []string{"Dropbox"}) {
+		t.Fatalf("openBreachCatalogue() after the re-check failed = %v, %v, %v; expected: the failed alert to be saved", catalogue.UnalertedBreaches, catalogue.FailedAlerts, err)
+	}
+
+	breaches = catalogue
+
+	server.ClearFaults()
+
+	if _, err = catalogue.sync(context.Background(), server.Client()); err != nil {
+		t.Fatalf("breachCatalogue.sync() = %v; expected: <nil>", err)
+	}
+
+	if err = catalogue.alertPending(context.Background()); err != nil {
+		t.Errorf("breachCatalogue.alertPending() once HIBP is back = %v; expected: <nil>", err)
+	}
+
+	if notifications := sent(); len(notifications) != 1 || notifications[0].To != "someone@dropbox.com" || notifications[0].Breaches[0].Name != "Dropbox" {
+		t.Errorf("notifications once HIBP is back = %+v; expected: someone@dropbox.com alerted of Dropbox", notifications)
+	}
+
+	if catalogue, err = openBreachCatalogue(fileLocation); err != nil || len(catalogue.FailedAlerts) != 0 {
+		t.Errorf("openBreachCatalogue() after the retry = %v, %v; expected: no failed alerts", catalogue.FailedAlerts, err)
+	}
+}
@@ -0,0 +1,443 @@
+package functionality
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrBreachNotFound             = errors.New("there is no breach with the name provided")
+	ErrBreachCatalogueUnavailable = errors.New("the breach catalogue has not been opened")
+	ErrBreachCatalogueNeverSynced = errors.New("the breach catalogue has not been synced with HIBP yet")
+	ErrInvalidBreachFilter        = errors.New("dates must be YYYY-MM-DD and flags must be true or false")
+)
+
+// breachCatalogueChanges are the breaches which were added to or modified in HIBP between two
+// syncs; on the initial sync every breach is new to the catalogue, so none are reported
+type breachCatalogueChanges struct {
+	Initial  bool
+	Added    []PwnInfo
+	Modified []PwnInfo
+}
+
+// breachCatalogue is the local copy of every breach in HIBP, kept in a JSON file in the data directory
+type breachCatalogue struct {
+	mu           sync.RWMutex
+	fileLocation string
+	LastSynced   time.Time          `json:"last_synced"`
+	Breaches     map[string]PwnInfo `json:"breaches"`
+
+	// UnalertedBreaches are the names of the breaches added by a sync whose subscribers are yet to be
+	// alerted, and FailedAlerts the names of the breaches by the ID of each subscriber whose re-check
+	// failed; they are saved with the breaches so that an alert isn't lost when it can't be made
+	UnalertedBreaches []string            `json:"unalerted_breaches,omitempty"`
+	FailedAlerts      map[string][]string `json:"failed_alerts,omitempty"`
+}
+
+var (
+	breaches           *breachCatalogue
+	breachSyncInterval = 24 * time.Hour
+)
+
+// InitializeBreachCatalogue opens the breach catalogue in the data directory and schedules
+// it to be synced with HIBP every breachSyncInterval (a duration like 6h, defaulting to a day)
+func InitializeBreachCatalogue() error {
+	if interval, exists := os.LookupEnv("breachSyncInterval"); exists {
+		parsedInterval, err := time.ParseDuration(interval)
+
+		if err != nil {
+			return err
+		}
+
+		breachSyncInterval = parsedInterval
+	}
+
+	catalogue, err := openBreachCatalogue(filepath.Join(dataDirectory, "breaches.json"))
+
+	registerReadinessCheck("breach_catalogue", func() error { return err })
+
+	if err != nil {
+		return err
+	}
+
+	breaches = catalogue
+
+	registerScheduledJob("breach_catalogue_sync", breachSyncInterval, func(ctx context.Context) error {
+		if _, err := breaches.sync(ctx, http.DefaultClient); err != nil {
+			return err
+		}
+
+		return breaches.alertPending(ctx)
+	})
+
+	return nil
+}
+
+func openBreachCatalogue(fileLocation string) (*breachCatalogue, error) {
+	catalogue := &breachCatalogue{
+		fileLocation: fileLocation,
+		Breaches:     make(map[string]PwnInfo),
+	}
+
+	catalogueBytes, err := ioutil.ReadFile(fileLocation)
+
+	if os.IsNotExist(err) {
+		return catalogue, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return catalogue, json.Unmarshal(catalogueBytes, catalogue)
+}
+
+// save must be called with the lock held
+func (bc *breachCatalogue) save() error {
+	catalogueBytes, err := json.Marshal(bc)
+
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(bc.fileLocation), ".breaches")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(catalogueBytes)
+
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), bc.fileLocation)
+}
+
+func getBreachesWithClient(ctx context.Context, client *http.Client) ([]PwnInfo, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+
+	defer cancel()
+
+	breachesRequest, err := http.NewRequest("GET", fmt.Sprintf("%s/breaches", hibpBaseURL), nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	breachesRequest.Header.Set("User-Agent", "RJ-And-Friends-Nightly-Pwnage-Checker")
+
+	resp, err := client.Do(breachesRequest.WithContext(ctx))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the HIBP breaches API responded with HTTP/%d", resp.StatusCode)
+	}
+
+	var allBreaches []PwnInfo
+
+	return allBreaches, json.NewDecoder(resp.Body).Decode(&allBreaches)
+}
+
+// sync replaces the catalogue with the breaches currently in HIBP, returning what changed
+func (bc *breachCatalogue) sync(ctx context.Context, client *http.Client) (breachCatalogueChanges, error) {
+	allBreaches, err := getBreachesWithClient(ctx, client)
+
+	if err != nil {
+		return breachCatalogueChanges{}, err
+	}
+
+	bc.mu.Lock()
+
+	defer bc.mu.Unlock()
+
+	changes := breachCatalogueChanges{Initial: bc.LastSynced.IsZero()}
+	syncedBreaches := make(map[string]PwnInfo, len(allBreaches))
+
+	for _, breach := range allBreaches {
+		syncedBreaches[breach.Name] = breach
+
+		if changes.Initial {
+			continue
+		}
+
+		if existing, exists := bc.Breaches[breach.Name]; !exists {
+			changes.Added = append(changes.Added, breach)
+		} else if !reflect.DeepEqual(existing, breach) {
+			changes.Modified = append(changes.Modified, breach)
+		}
+	}
+
+	bc.Breaches = syncedBreaches
+	bc.LastSynced = time.Now().UTC()
+
+	for _, breach := range changes.Added {
+		bc.UnalertedBreaches = append(bc.UnalertedBreaches, breach.Name)
+	}
+
+	loggerFromContext(ctx).Info("synced breach catalogue", "breaches", len(syncedBreaches), "added", len(changes.Added), "modified", len(changes.Modified))
+
+	return changes, bc.save()
+}
+
+// alertPending alerts the subscribers of the breaches added since they were last alerted and retries
+// the alerts which failed before, the ones which fail again are kept to be retried after the next sync
+func (bc *breachCatalogue) alertPending(ctx context.Context) error {
+	bc.mu.RLock()
+
+	unalerted := append([]string(nil), bc.UnalertedBreaches...)
+	failedAlerts := bc.FailedAlerts
+
+	var addedBreaches []PwnInfo
+
+	for _, name := range unalerted {
+		if breach, exists := bc.Breaches[name]; exists {
+			addedBreaches = append(addedBreaches, breach)
+		}
+	}
+
+	bc.mu.RUnlock()
+
+	if len(unalerted) == 0 && len(failedAlerts) == 0 {
+		return nil
+	}
+
+	stillFailing, err := alertSubscribersOfNewBreaches(ctx, addedBreaches, failedAlerts)
+
+	if err != nil {
+		return err
+	}
+
+	bc.mu.Lock()
+
+	defer bc.mu.Unlock()
+
+	var remaining []string
+
+	for _, name := range bc.UnalertedBreaches {
+		if !containsFold(unalerted, name) {
+			remaining = append(remaining, name)
+		}
+	}
+
+	bc.UnalertedBreaches, bc.FailedAlerts = remaining, stillFailing
+
+	if err = bc.save(); err != nil {
+		return err
+	}
+
+	if len(stillFailing) != 0 {
+		return fmt.Errorf("could not re-check %d subscribers for new breaches, they will be retried after the next sync", len(stillFailing))
+	}
+
+	return nil
+}
+
+func (bc *breachCatalogue) get(name string) (PwnInfo, error) {
+	bc.mu.RLock()
+
+	defer bc.mu.RUnlock()
+
+	for breachName, breach := range bc.Breaches {
+		if strings.EqualFold(breachName, name) {
+			return breach, nil
+		}
+	}
+
+	return PwnInfo{}, ErrBreachNotFound
+}
+
+// breachFilter narrows down the breaches listed, fields which are unset don't filter anything out
+type breachFilter struct {
+	domain, dataClass, from, to                                  string
+	isVerified, isFabricated, isSensitive, isRetired, isSpamList *bool
+}
+
+func parseBreachFilter(c *gin.Context) (breachFilter, error) {
+	filter := breachFilter{
+		domain:    c.Query("domain"),
+		dataClass: c.Query("data_class"),
+		from:      c.Query("from"),
+		to:        c.Query("to"),
+	}
+
+	for _, date := range []string{filter.from, filter.to} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			return filter, ErrInvalidBreachFilter
+		}
+	}
+
+	flags := map[string]**bool{
+		"verified":   &filter.isVerified,
+		"fabricated": &filter.isFabricated,
+		"sensitive":  &filter.isSensitive,
+		"retired":    &filter.isRetired,
+		"spam_list":  &filter.isSpamList,
+	}
+
+	for name, flag := range flags {
+		value, exists := c.GetQuery(name)
+
+		if !exists {
+			continue
+		}
+
+		parsedValue, err := strconv.ParseBool(value)
+
+		if err != nil {
+			return filter, ErrInvalidBreachFilter
+		}
+
+		*flag = &parsedValue
+	}
+
+	return filter, nil
+}
+
+func (bf breachFilter) matches(breach PwnInfo) bool {
+	if bf.domain != "" && !strings.EqualFold(bf.domain, breach.Domain) {
+		return false
+	}
+
+	// BreachDate is YYYY-MM-DD, so the dates compare correctly as strings
+	if (bf.from != "" && breach.BreachDate < bf.from) || (bf.to != "" && breach.BreachDate > bf.to) {
+		return false
+	}
+
+	if bf.dataClass != "" && !containsFold(breach.DataClasses, bf.dataClass) {
+		return false
+	}
+
+	flags := []struct {
+		filter *bool
+		value  bool
+	}{
+		{bf.isVerified, breach.IsVerified},
+		{bf.isFabricated, breach.IsFabricated},
+		{bf.isSensitive, breach.IsSensitive},
+		{bf.isRetired, breach.IsRetired},
+		{bf.isSpamList, breach.IsSpamList},
+	}
+
+	for _, flag := range flags {
+		if flag.filter != nil && *flag.filter != flag.value {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (bc *breachCatalogue) list(filter breachFilter) []PwnInfo {
+	bc.mu.RLock()
+
+	defer bc.mu.RUnlock()
+
+	matches := make([]PwnInfo, 0)
+
+	for _, breach := range bc.Breaches {
+		if filter.matches(breach) {
+			matches = append(matches, breach)
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Name < matches[j].Name })
+
+	return matches
+}
+
+func availableBreachCatalogue(c *gin.Context) (*breachCatalogue, bool) {
+	if breaches == nil {
+		respondWithError(c, http.StatusServiceUnavailable, ErrBreachCatalogueUnavailable)
+
+		return nil, false
+	}
+
+	breaches.mu.RLock()
+	neverSynced := breaches.LastSynced.IsZero()
+	breaches.mu.RUnlock()
+
+	if neverSynced {
+		respondWithError(c, http.StatusServiceUnavailable, ErrBreachCatalogueNeverSynced)
+
+		return nil, false
+	}
+
+	return breaches, true
+}
+
+// ListBreaches responds with the breaches in the local catalogue, filtered by the
+// domain, data_class, from and to (breach dates), and verified, fabricated,
+// sensitive, retired and spam_list (true or false) query parameters
+func ListBreaches(c *gin.Context) {
+	catalogue, ok := availableBreachCatalogue(c)
+
+	if !ok {
+		return
+	}
+
+	filter, err := parseBreachFilter(c)
+
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, catalogue.list(filter))
+}
+
+// GetBreach responds with the breach in the local catalogue with the name in the path
+func GetBreach(c *gin.Context) {
+	catalogue, ok := availableBreachCatalogue(c)
+
+	if !ok {
+		return
+	}
+
+	breach, err := catalogue.get(c.Param("name"))
+
+	if err != nil {
+		respondWithError(c, http.StatusNotFound, err)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, breach)
+}
@@ -0,0 +1,130 @@
+package functionality
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Need to test the following:
+// The initial sync fills the catalogue without reporting any changes
+// Later syncs report breaches which are new as added and ones which changed as modified
+// The catalogue is persisted, so reopening it has the synced breaches
+func TestBreachCatalogueSync(t *testing.T) {
+	tempDirectory, err := ioutil.TempDir("", "breaches")
+
+	if err != nil {
+		t.Fatal("could not create the temporary data directory")
+	}
+
+	defer os.RemoveAll(tempDirectory)
+
+	hibpBreaches := []PwnInfo{{Name: "Adobe", PwnCount: 152445165}, {Name: "LinkedIn", PwnCount: 164611595}}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(hibpBreaches)
+	}))
+
+	defer server.Close()
+
+	originalBaseURL := hibpBaseURL
+	hibpBaseURL = server.URL
+
+	defer func() { hibpBaseURL = originalBaseURL }()
+
+	fileLocation := filepath.Join(tempDirectory, "breaches.json")
+	catalogue, _ := openBreachCatalogue(fileLocation)
+
+	changes, err := catalogue.sync(context.Background(), server.Client())
+
+	if err != nil || !changes.Initial || len(changes.Added) != 0 || len(changes.Modified) != 0 {
+		t.Errorf("breachCatalogue.sync() = %+v, %v; expected: an initial sync without changes", changes, err)
+	}
+
+	hibpBreaches = []PwnInfo{{Name: "Adobe", PwnCount: 152445165}, {Name: "LinkedIn", PwnCount: 164611596}, {Name: "Dropbox"}}
+
+	if catalogue, err = openBreachCatalogue(fileLocation); err != nil || len(catalogue.Breaches) != 2 {
+		t.Fatalf("openBreachCatalogue() = %d breaches, %v; expected: 2 breaches, <nil>", len(catalogue.Breaches), err)
+	}
+
+	changes, err = catalogue.sync(context.Background(), server.Client())
+
+	if err != nil || changes.Initial || len(changes.Added) != 1 || changes.Added[0].Name != "Dropbox" || len(changes.Modified) != 1 || changes.Modified[0].Name != "LinkedIn" {
+		t.Errorf("breachCatalogue.sync() = %+v, %v; expected: Dropbox added and LinkedIn modified", changes, err)
+	}
+}
+
+// Need to test the following:
+// Each filter only lets through the breaches matching it
+// An invalid filter returns a HTTP/400 status
+func TestListBreaches(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	breaches = &breachCatalogue{LastSynced: time.Now(), Breaches: map[string]PwnInfo{
+		"Adobe":     {Name: "Adobe", Domain: "adobe.com", BreachDate: "2013-10-04", DataClasses: []string{"Email addresses", "Passwords"}, IsVerified: true},
+		"Onliner":   {Name: "Onliner", BreachDate: "2017-08-28", DataClasses: []string{"Email addresses"}, IsSpamList: true},
+		"Ashley":    {Name: "Ashley", Domain: "ashleymadison.com", BreachDate: "2015-07-19", DataClasses: []string{"Passwords"}, IsVerified: true, IsSensitive: true},
+		"Fabricate": {Name: "Fabricate", BreachDate: "2016-01-01", IsFabricated: true},
+	}}
+
+	defer func() { breaches = nil }()
+
+	router := gin.New()
+	router.GET("/breaches", ListBreaches)
+
+	tests := []struct {
+		Query              string
+		ExpectedStatusCode int
+		ExpectedNames      []string
+	}{
+		{Query: "", ExpectedStatusCode: 200, ExpectedNames: []string{"Adobe", "Ashley", "Fabricate", "Onliner"}},
+		{Query: "?domain=ADOBE.com", ExpectedStatusCode: 200, ExpectedNames: []string{"Adobe"}},
+		{Query: "?data_class=passwords", ExpectedStatusCode: 200, ExpectedNames: []string{"Adobe", "Ashley"}},
+		{Query: "?from=2015-01-01&to=2016-12-31", ExpectedStatusCode: 200, ExpectedNames: []string{"Ashley", "Fabricate"}},
+		{Query: "?spam_list=false&fabricated=false&sensitive=false", ExpectedStatusCode: 200, ExpectedNames: []string{"Adobe"}},
+		{Query: "?verified=maybe", ExpectedStatusCode: 400},
+		{Query: "?from=04/10/2013", ExpectedStatusCode: 400},
+	}
+
+	for _, test := range tests {
+		mockResponseWriter := httptest.NewRecorder()
+
+		router.ServeHTTP(mockResponseWriter, httptest.NewRequest(http.MethodGet, "/breaches"+test.Query, nil))
+
+		var listed []PwnInfo
+
+		json.Unmarshal(mockResponseWriter.Body.Bytes(), &listed)
+
+		names := make([]string, 0, len(listed))
+
+		for _, breach := range listed {
+			names = append(names, breach.Name)
+		}
+
+		if mockResponseWriter.Code != test.ExpectedStatusCode || (test.ExpectedStatusCode == 200 && !equalStrings(names, test.ExpectedNames)) {
+			t.Errorf("GET /breaches%s = HTTP/%d, %v; expected: HTTP/%d, %v", test.Query, mockResponseWriter.Code, names, test.ExpectedStatusCode, test.ExpectedNames)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
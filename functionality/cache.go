@@ -0,0 +1,104 @@
+package functionality
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type pwnageCacheEntry struct {
+	pwnInfo []PwnInfo
+	err     error
+	expires time.Time
+}
+
+// pwnageCache holds the results of recent pwnage lookups so
+// that repeated checks of an email don't go back to HIBP
+type pwnageCache struct {
+	mu      sync.Mutex
+	entries map[string]pwnageCacheEntry
+	ttl     time.Duration
+}
+
+var cache = newPwnageCache(time.Hour)
+
+func newPwnageCache(ttl time.Duration) *pwnageCache {
+	return &pwnageCache{
+		entries: make(map[string]pwnageCacheEntry),
+		ttl:     ttl,
+	}
+}
+
+func cacheKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func (pc *pwnageCache) get(email string) (pwnageCacheEntry, bool) {
+	pc.mu.Lock()
+
+	defer pc.mu.Unlock()
+
+	entry, exists := pc.entries[cacheKey(email)]
+
+	if !exists {
+		return entry, false
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(pc.entries, cacheKey(email))
+
+		return entry, false
+	}
+
+	return entry, true
+}
+
+func (pc *pwnageCache) set(email string, pwnInfo []PwnInfo, err error) {
+	pc.mu.Lock()
+
+	defer pc.mu.Unlock()
+
+	pc.entries[cacheKey(email)] = pwnageCacheEntry{
+		pwnInfo: pwnInfo,
+		err:     err,
+		expires: time.Now().Add(pc.ttl),
+	}
+}
+
+func (pc *pwnageCache) delete(email string) {
+	pc.mu.Lock()
+
+	defer pc.mu.Unlock()
+
+	delete(pc.entries, cacheKey(email))
+}
+
+// getPwnageForEmailWithCache only goes to HIBP when there is no
+// unexpired result cached, only successful lookups are cached
+func getPwnageForEmailWithCache(ctx context.Context, email string) ([]PwnInfo, error) {
+	_, span := tracer.Start(ctx, "pwnage_cache.lookup")
+
+	entry, exists := cache.get(email)
+
+	span.SetAttributes(attribute.Bool("cache.hit", exists))
+	span.End()
+
+	if exists {
+		pwnageCacheLookups.WithLabelValues("hit").Inc()
+
+		return entry.pwnInfo, entry.err
+	}
+
+	pwnageCacheLookups.WithLabelValues("miss").Inc()
+
+	pwnInfo, err := getPwnageForEmail(ctx, email)
+
+	if err == nil || err == ErrNoPwns {
+		cache.set(email, pwnInfo, err)
+	}
+
+	return pwnInfo, err
+}
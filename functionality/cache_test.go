@@ -0,0 +1,34 @@
+package functionality
+
+import (
+	"testing"
+	"time"
+)
+
+// Need to test the following:
+// A set entry is returned for the same email regardless of case and whitespace
+// An expired entry is not returned
+// A deleted entry is not returned
+func TestPwnageCache(t *testing.T) {
+	pc := newPwnageCache(time.Hour)
+
+	pc.set("Someone@Example.com", []PwnInfo{{Name: "Adobe"}}, nil)
+
+	if entry, exists := pc.get(" someone@example.com "); !exists || len(entry.pwnInfo) != 1 || entry.pwnInfo[0].Name != "Adobe" {
+		t.Errorf(`pwnageCache.get(" someone@example.com ") = %v, %t; expected: the Adobe breach, true`, entry.pwnInfo, exists)
+	}
+
+	pc.delete("someone@example.com")
+
+	if _, exists := pc.get("someone@example.com"); exists {
+		t.Error(`pwnageCache.get("someone@example.com") after delete = true; expected: false`)
+	}
+
+	pc = newPwnageCache(-time.Second)
+
+	pc.set("someone@example.com", nil, ErrNoPwns)
+
+	if _, exists := pc.get("someone@example.com"); exists {
+		t.Error(`pwnageCache.get("someone@example.com") for an expired entry = true; expected: false`)
+	}
+}
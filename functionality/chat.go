@@ -0,0 +1,407 @@
+package functionality
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	channelSlack    = "slack"
+	channelTeams    = "teams"
+	channelDiscord  = "discord"
+	channelTelegram = "telegram"
+	channelMatrix   = "matrix"
+)
+
+const (
+	slackMaxBlocks   = 50
+	slackHeaderLimit = 150
+	slackTextLimit   = 3000
+	slackMaxFields   = 10
+	slackFieldLimit  = 2000
+)
+
+// chatDestinations are the subscriber's own chat channels, which are
+// notified as well as any team channels in the chat secret file
+type chatDestinations struct {
+	SlackWebhookURL string `json:"slack_webhook_url,omitempty"`
+	SlackChannel    string `json:"slack_channel,omitempty"`
+	TeamsWebhookURL string `json:"teams_webhook_url,omitempty"`
+
+	DiscordWebhookURL string `json:"discord_webhook_url,omitempty"`
+	TelegramChatID    string `json:"telegram_chat_id,omitempty"`
+	MatrixRoomID      string `json:"matrix_room_id,omitempty"`
+}
+
+// chatInfo is the chat secret file, the team channels: Slack through an incoming webhook
+// or, with a bot token, a channel ID; Telegram and Matrix need the bot token and access token
+// for subscribers' own chats too. The team channels are only posted breach findings, naming
+// the subscriber they are about, and only once TeamBreachAlerts opts the team in to them
+type chatInfo struct {
+	TeamBreachAlerts bool `json:"team_breach_alerts"`
+
+	SlackWebhookURL string `json:"slack_webhook_url"`
+	SlackBotToken   string `json:"slack_bot_token"`
+	SlackChannel    string `json:"slack_channel"`
+	TeamsWebhookURL string `json:"teams_webhook_url"`
+
+	DiscordWebhookURL string `json:"discord_webhook_url"`
+
+	TelegramBotToken string `json:"telegram_bot_token"`
+	TelegramChatID   string `json:"telegram_chat_id"`
+
+	MatrixHomeserverURL string `json:"matrix_homeserver_url"`
+	MatrixAccessToken   string `json:"matrix_access_token"`
+	MatrixRoomID        string `json:"matrix_room_id"`
+}
+
+var (
+	chat chatInfo
+
+	// slackAPIBaseURL can be changed to point at a local stand-in, like the HIBP base URLs
+	slackAPIBaseURL = "https://slack.com/api"
+	chatClient      = &http.Client{Timeout: 10 * time.Second}
+)
+
+func init() {
+	loadSecretFile("chatFile", InitializeChatWithJSON)
+
+	if baseURL, exists := os.LookupEnv("slackAPIBaseURL"); exists {
+		slackAPIBaseURL = strings.TrimSuffix(baseURL, "/")
+	}
+
+	registerNotifier(channelSlack, slackNotifier{})
+	registerNotifier(channelTeams, teamsNotifier{})
+	registerNotifier(channelDiscord, discordNotifier{})
+	registerNotifier(channelTelegram, telegramNotifier{})
+	registerNotifier(channelMatrix, matrixNotifier{})
+}
+
+// InitializeChatWithJSON is used for initializing the team chat channels for the package
+func InitializeChatWithJSON(reader io.Reader) error {
+	return json.NewDecoder(reader).Decode(&chat)
+}
+
+func validateWebhookURL(webhookURL string) error {
+	parsedURL, err := url.Parse(webhookURL)
+
+	if err != nil || parsedURL.Scheme != "https" || parsedURL.Host == "" {
+		return fmt.Errorf("webhook and server URLs must be absolute https URLs, not %q", webhookURL)
+	}
+
+	return nil
+}
+
+func (cd chatDestinations) validate() error {
+	for _, webhookURL := range []string{cd.SlackWebhookURL, cd.TeamsWebhookURL, cd.DiscordWebhookURL} {
+		if webhookURL == "" {
+			continue
+		}
+
+		if err := validateWebhookURL(webhookURL); err != nil {
+			return err
+		}
+	}
+
+	if cd.TelegramChatID != "" && !telegramChatIDPattern.MatchString(cd.TelegramChatID) {
+		return fmt.Errorf("telegram chat IDs must be numeric or an @channel, not %q", cd.TelegramChatID)
+	}
+
+	if cd.MatrixRoomID != "" && !matrixRoomIDPattern.MatchString(cd.MatrixRoomID) {
+		return fmt.Errorf("matrix room IDs must look like !room:example.org, not %q", cd.MatrixRoomID)
+	}
+
+	return nil
+}
+
+// postChatJSON POSTs the message to the chat webhook or API, with the bearer token when there is one
+func postChatJSON(ctx context.Context, postURL, bearerToken string, message interface{}) ([]byte, error) {
+	return sendChatJSON(ctx, "POST", postURL, bearerToken, message)
+}
+
+// withoutURL strips the URL from a request's error, since chat webhook and push topic URLs are
+// credentials (and API URLs like Telegram's have tokens in them) which mustn't be logged or traced
+func withoutURL(err error) error {
+	var urlErr *url.Error
+
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+
+	return err
+}
+
+// sendChatJSON sends the message to the chat webhook or API, any error is without the URL
+func sendChatJSON(ctx context.Context, method, requestURL, bearerToken string, message interface{}) ([]byte, error) {
+	messageBytes, err := json.Marshal(message)
+
+	if err != nil {
+		return nil, err
+	}
+
+	chatRequest, err := http.NewRequest(method, requestURL, bytes.NewReader(messageBytes))
+
+	if err != nil {
+		return nil, withoutURL(err)
+	}
+
+	chatRequest.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	if bearerToken != "" {
+		chatRequest.Header.Set("Authorization", "Bearer "+bearerToken)
+	}
+
+	resp, err := chatClient.Do(chatRequest.WithContext(ctx))
+
+	if err != nil {
+		return nil, withoutURL(err)
+	}
+
+	defer resp.Body.Close()
+
+	responseBytes, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return responseBytes, fmt.Errorf("the chat webhook responded with HTTP/%d", resp.StatusCode)
+	}
+
+	return responseBytes, nil
+}
+
+// chatFact is a labelled value shown for a breach or paste, rendered as a Slack
+// field or an Adaptive Card fact, so both platforms show the same details
+type chatFact struct {
+	label, value string
+}
+
+// chatSection is a breach or paste in a chat message
+type chatSection struct {
+	heading  string
+	severity severity
+	facts    []chatFact
+}
+
+// chatSections breaks the notification down into a section for each breach or paste it is about
+func chatSections(n notification) []chatSection {
+	var sections []chatSection
+
+	for _, breach := range n.Breaches {
+		sections = append(sections, chatSection{
+			heading:  breach.Title,
+			severity: breach.Severity,
+			facts: []chatFact{
+				{"Breach date", breach.BreachDate},
+				{"Severity", breach.Severity.String()},
+				{"Data exposed", strings.Join(breach.DataClasses, ", ")},
+			},
+		})
+	}
+
+	for _, paste := range n.Pastes {
+		facts := []chatFact{{"Emails in paste", fmt.Sprint(paste.EmailCount)}}
+
+		if paste.Date != nil {
+			facts = append(facts, chatFact{"Date", paste.Date.Format("2006-01-02")})
+		}
+
+		sections = append(sections, chatSection{heading: fmt.Sprintf("%s paste %s", paste.Source, paste.ID), severity: n.Severity, facts: facts})
+	}
+
+	return sections
+}
+
+type slackNotifier struct{}
+
+// slackDestination is the webhook URL, or the channel when there is a bot token to post to it with
+func slackDestination(webhookURL, channel string) (string, bool) {
+	for _, to := range []string{webhookURL, channel} {
+		if to != "" && (strings.HasPrefix(to, "https://") || chat.SlackBotToken != "") {
+			return to, true
+		}
+	}
+
+	return "", false
+}
+
+// recipient is the subscriber's Slack webhook URL or channel
+func (slackNotifier) recipient(subscriber Subscriber) (string, bool) {
+	return slackDestination(subscriber.Chat.SlackWebhookURL, subscriber.Chat.SlackChannel)
+}
+
+// teamRecipient is the team's Slack webhook URL or channel
+func (slackNotifier) teamRecipient() (string, bool) {
+	if !chat.TeamBreachAlerts {
+		return "", false
+	}
+
+	return slackDestination(chat.SlackWebhookURL, chat.SlackChannel)
+}
+
+func (slackNotifier) deferrable() bool {
+	return true
+}
+
+// slackBlocks renders the notification as Block Kit blocks, up to Slack's limits on blocks and
+// their text; the breaches or pastes which don't fit are counted in a last block instead
+func slackBlocks(n notification) []interface{} {
+	blocks := []interface{}{
+		map[string]interface{}{"type": "header", "text": map[string]interface{}{"type": "plain_text", "text": truncate(n.Title, slackHeaderLimit)}},
+	}
+
+	sections := chatSections(n)
+
+	if len(sections) == 0 && n.Body != "" {
+		blocks = append(blocks, map[string]interface{}{"type": "section", "text": map[string]interface{}{"type": "mrkdwn", "text": truncate(n.Body, slackTextLimit)}})
+	}
+
+	// Each section takes a divider and a section block, and a block is kept for counting the rest
+	fitting := (slackMaxBlocks - len(blocks)) / 2
+
+	if fitting < len(sections) {
+		fitting = (slackMaxBlocks - len(blocks) - 1) / 2
+	}
+
+	for i, section := range sections {
+		if i == fitting {
+			note := strings.TrimPrefix(moreBreachesNote(len(sections)-fitting), "\n")
+
+			blocks = append(blocks, map[string]interface{}{"type": "context", "elements": []interface{}{map[string]interface{}{"type": "mrkdwn", "text": note}}})
+
+			break
+		}
+
+		fields := make([]interface{}, 0, len(section.facts))
+
+		for _, fact := range section.facts {
+			if len(fields) == slackMaxFields {
+				break
+			}
+
+			fields = append(fields, map[string]interface{}{"type": "mrkdwn", "text": truncate(fmt.Sprintf("*%s*\n%s", fact.label, fact.value), slackFieldLimit)})
+		}
+
+		blocks = append(blocks,
+			map[string]interface{}{"type": "divider"},
+			map[string]interface{}{"type": "section", "text": map[string]interface{}{"type": "mrkdwn", "text": truncate("*"+section.heading+"*", slackTextLimit)}, "fields": fields},
+		)
+	}
+
+	return blocks
+}
+
+func (slackNotifier) send(ctx context.Context, n notification) error {
+	ctx, span := tracer.Start(ctx, "notify.slack")
+
+	message := map[string]interface{}{"text": n.Title, "blocks": slackBlocks(n)}
+
+	var err error
+
+	if strings.HasPrefix(n.To, "https://") {
+		_, err = postChatJSON(ctx, n.To, "", message)
+	} else {
+		message["channel"] = n.To
+
+		var responseBytes []byte
+
+		if responseBytes, err = postChatJSON(ctx, slackAPIBaseURL+"/chat.postMessage", chat.SlackBotToken, message); err == nil {
+			// The Web API responds with HTTP/200 even when the message wasn't posted
+			slackResponse := struct {
+				OK    bool   `json:"ok"`
+				Error string `json:"error"`
+			}{}
+
+			if err = json.Unmarshal(responseBytes, &slackResponse); err == nil && !slackResponse.OK {
+				err = errors.New("slack could not post the message: " + slackResponse.Error)
+			}
+		}
+	}
+
+	recordNotification(channelSlack, err)
+	logNotification(ctx, channelSlack, n.Email, n.Title, err)
+	endSpan(span, err)
+
+	return err
+}
+
+type teamsNotifier struct{}
+
+// recipient is the subscriber's Teams webhook URL
+func (teamsNotifier) recipient(subscriber Subscriber) (string, bool) {
+	return subscriber.Chat.TeamsWebhookURL, subscriber.Chat.TeamsWebhookURL != ""
+}
+
+// teamRecipient is the team channel's Teams webhook URL
+func (teamsNotifier) teamRecipient() (string, bool) {
+	return chat.TeamsWebhookURL, chat.TeamBreachAlerts && chat.TeamsWebhookURL != ""
+}
+
+func (teamsNotifier) deferrable() bool {
+	return true
+}
+
+// teamsCard renders the notification as an Adaptive Card in a message for an incoming webhook
+func teamsCard(n notification) map[string]interface{} {
+	body := []interface{}{
+		map[string]interface{}{"type": "TextBlock", "text": n.Title, "size": "Large", "weight": "Bolder", "wrap": true},
+	}
+
+	sections := chatSections(n)
+
+	if len(sections) == 0 && n.Body != "" {
+		body = append(body, map[string]interface{}{"type": "TextBlock", "text": n.Body, "wrap": true})
+	}
+
+	for _, section := range sections {
+		facts := make([]interface{}, 0, len(section.facts))
+
+		for _, fact := range section.facts {
+			facts = append(facts, map[string]interface{}{"title": fact.label, "value": fact.value})
+		}
+
+		body = append(body,
+			map[string]interface{}{"type": "TextBlock", "text": section.heading, "weight": "Bolder", "separator": true, "wrap": true},
+			map[string]interface{}{"type": "FactSet", "facts": facts},
+		)
+	}
+
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []interface{}{
+			map[string]interface{}{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"content": map[string]interface{}{
+					"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+					"type":    "AdaptiveCard",
+					"version": "1.4",
+					"body":    body,
+				},
+			},
+		},
+	}
+}
+
+func (teamsNotifier) send(ctx context.Context, n notification) error {
+	ctx, span := tracer.Start(ctx, "notify.teams")
+
+	_, err := postChatJSON(ctx, n.To, "", teamsCard(n))
+
+	recordNotification(channelTeams, err)
+	logNotification(ctx, channelTeams, n.Email, n.Title, err)
+	endSpan(span, err)
+
+	return err
+}
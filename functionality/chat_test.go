@@ -0,0 +1,308 @@
+package functionality
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func chatTestNotification(to string) notification {
+	return notification{
+		Type:     notificationBreach,
+		Email:    "someone@example.com",
+		To:       to,
+		Title:    "You've been pwned",
+		Severity: severityHigh,
+		Breaches: []scoredBreach{{
+			PwnInfo:  PwnInfo{Name: "Adobe", Title: "Adobe", BreachDate: "2013-10-04", DataClasses: []string{"Email addresses", "Passwords"}},
+			Severity: severityHigh,
+		}},
+	}
+}
+
+// Need to test the following:
+// Incoming webhooks are sent the breach's title, date, data classes and severity as blocks
+// Channels are posted to through chat.postMessage with the bot token
+// Slack API errors in an HTTP/200 response are an error
+// HTTP errors from the webhook are an error
+// Breaches past Slack's block limit are counted in the last block, and the header is cut down to its limit
+func TestSlackNotifier(t *testing.T) {
+	var (
+		received      map[string]interface{}
+		authorization string
+		slackResponse = `{"ok": true}`
+	)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+
+		body, _ := ioutil.ReadAll(r.Body)
+
+		received = nil
+
+		json.Unmarshal(body, &received)
+
+		switch r.URL.Path {
+		case "/webhook":
+		case "/api/chat.postMessage":
+			w.Write([]byte(slackResponse))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	defer server.Close()
+
+	originalChat, originalBaseURL := chat, slackAPIBaseURL
+	chat, slackAPIBaseURL = chatInfo{SlackBotToken: "xoxb-token"}, server.URL+"/api"
+
+	defer func() { chat, slackAPIBaseURL = originalChat, originalBaseURL }()
+
+	originalClient := chatClient
+	chatClient = server.Client()
+
+	defer func() { chatClient = originalClient }()
+
+	if err := (slackNotifier{}).send(context.Background(), chatTestNotification(server.URL+"/webhook")); err != nil {
+		t.Fatalf("slackNotifier.send() to a webhook = %v; expected: <nil>", err)
+	}
+
+	blocks, _ := json.Marshal(received["blocks"])
+
+	for _, expected := range []string{`"header"`, "Adobe", "2013-10-04", "Email addresses, Passwords", "high"} {
+		if !strings.Contains(string(blocks), expected) {
+			t.Errorf("slack blocks = %s; expected them to contain %s", blocks, expected)
+		}
+	}
+
+	if authorization != "" || received["channel"] != nil {
+		t.Errorf("slack webhook request = %q, %v; expected: no bot token or channel", authorization, received["channel"])
+	}
+
+	manyBreaches := manyBreachesNotification(server.URL+"/webhook", 30)
+	manyBreaches.Title = strings.Repeat("Your email was found in breaches ", 10)
+
+	if err := (slackNotifier{}).send(context.Background(), manyBreaches); err != nil {
+		t.Fatalf("slackNotifier.send() of 30 breaches = %v; expected: <nil>", err)
+	}
+
+	var manyBlocks []struct {
+		Type string `json:"type"`
+		Text struct {
+			Text string `json:"text"`
+		} `json:"text"`
+		Elements []struct {
+			Text string `json:"text"`
+		} `json:"elements"`
+	}
+
+	blocks, _ = json.Marshal(received["blocks"])
+
+	json.Unmarshal(blocks, &manyBlocks)
+
+	shown := 0
+
+	for _, block := range manyBlocks {
+		if block.Type == "divider" {
+			shown++
+		}
+	}
+
+	if len(manyBlocks) > slackMaxBlocks || utf8.RuneCountInString(manyBlocks[0].Text.Text) > slackHeaderLimit {
+		t.Errorf("slack message for 30 breaches = %d blocks, a %d rune header; expected them within Slack's limits", len(manyBlocks), utf8.RuneCountInString(manyBlocks[0].Text.Text))
+	}
+
+	if last := manyBlocks[len(manyBlocks)-1]; last.Type != "context" || len(last.Elements) != 1 || last.Elements[0].Text != fmt.Sprintf("…and %d more", 30-shown) {
+		t.Errorf("last slack block for 30 breaches = %+v; expected: the %d breaches left out to be counted", last, 30-shown)
+	}
+
+	if err := (slackNotifier{}).send(context.Background(), chatTestNotification("C0123456")); err != nil {
+		t.Fatalf("slackNotifier.send() to a channel = %v; expected: <nil>", err)
+	}
+
+	if authorization != "Bearer xoxb-token" || received["channel"] != "C0123456" {
+		t.Errorf("slack chat.postMessage request = %q, %v; expected: the bot token and channel", authorization, received["channel"])
+	}
+
+	slackResponse = `{"ok": false, "error": "channel_not_found"}`
+
+	if err := (slackNotifier{}).send(context.Background(), chatTestNotification("C0123456")); err == nil || !strings.Contains(err.Error(), "channel_not_found") {
+		t.Errorf("slackNotifier.send() to a missing channel = %v; expected: channel_not_found", err)
+	}
+
+	if err := (slackNotifier{}).send(context.Background(), chatTestNotification(server.URL+"/missing")); err == nil {
+		t.Error("slackNotifier.send() to a missing webhook = <nil>; expected: an error")
+	}
+}
+
+// Need to test the following:
+// Subscribers are only reached on their own destinations, never on the team channels
+// The team channels are only reachable once the team has opted in to breach alerts
+// Slack channels are only used with a bot token
+func TestChatRecipients(t *testing.T) {
+	originalChat := chat
+
+	defer func() { chat = originalChat }()
+
+	teamChat := chatInfo{SlackWebhookURL: "https://hooks.slack.com/team", TeamsWebhookURL: "https://example.webhook.office.com/team"}
+	optedInTeamChat := teamChat
+	optedInTeamChat.TeamBreachAlerts = true
+
+	tests := []struct {
+		Chat              chatInfo
+		Destinations      chatDestinations
+		ExpectedSlack     string
+		ExpectedTeams     string
+		ExpectedTeamSlack string
+		ExpectedTeamTeams string
+	}{
+		{
+			Chat:          teamChat,
+			Destinations:  chatDestinations{SlackWebhookURL: "https://hooks.slack.com/own", TeamsWebhookURL: "https://example.webhook.office.com/own"},
+			ExpectedSlack: "https://hooks.slack.com/own",
+			ExpectedTeams: "https://example.webhook.office.com/own",
+		},
+		{
+			Chat: teamChat,
+		},
+		{
+			Chat:              optedInTeamChat,
+			ExpectedTeamSlack: "https://hooks.slack.com/team",
+			ExpectedTeamTeams: "https://example.webhook.office.com/team",
+		},
+		{
+			Chat:              chatInfo{TeamBreachAlerts: true, SlackBotToken: "xoxb-token", SlackChannel: "CTEAM"},
+			Destinations:      chatDestinations{SlackChannel: "COWN"},
+			ExpectedSlack:     "COWN",
+			ExpectedTeamSlack: "CTEAM",
+		},
+		{
+			Chat:         chatInfo{TeamBreachAlerts: true, SlackChannel: "CTEAM"},
+			Destinations: chatDestinations{SlackChannel: "COWN"},
+		},
+		{},
+	}
+
+	for _, test := range tests {
+		chat = test.Chat
+		subscriber := Subscriber{Chat: test.Destinations}
+
+		slackTo, slackReachable := slackNotifier{}.recipient(subscriber)
+		teamsTo, teamsReachable := teamsNotifier{}.recipient(subscriber)
+
+		if slackTo != test.ExpectedSlack || slackReachable != (test.ExpectedSlack != "") || teamsTo != test.ExpectedTeams || teamsReachable != (test.ExpectedTeams != "") {
+			t.Errorf("recipients for %+v with %+v = %q, %q; expected: %q, %q", test.Destinations, test.Chat, slackTo, teamsTo, test.ExpectedSlack, test.ExpectedTeams)
+		}
+
+		teamSlackTo, teamSlackReachable := slackNotifier{}.teamRecipient()
+		teamTeamsTo, teamTeamsReachable := teamsNotifier{}.teamRecipient()
+
+		if (teamSlackReachable && teamSlackTo != test.ExpectedTeamSlack) || teamSlackReachable != (test.ExpectedTeamSlack != "") || (teamTeamsReachable && teamTeamsTo != test.ExpectedTeamTeams) || teamTeamsReachable != (test.ExpectedTeamTeams != "") {
+			t.Errorf("team recipients with %+v = %q, %q; expected: %q, %q", test.Chat, teamSlackTo, teamTeamsTo, test.ExpectedTeamSlack, test.ExpectedTeamTeams)
+		}
+	}
+}
+
+// Need to test the following:
+// The breach is sent as an Adaptive Card with a fact for each detail
+// HTTP errors from the webhook are an error
+func TestTeamsNotifier(t *testing.T) {
+	var received map[string]interface{}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/webhook" {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+
+		json.Unmarshal(body, &received)
+	}))
+
+	defer server.Close()
+
+	originalClient := chatClient
+	chatClient = server.Client()
+
+	defer func() { chatClient = originalClient }()
+
+	if err := (teamsNotifier{}).send(context.Background(), chatTestNotification(server.URL+"/webhook")); err != nil {
+		t.Fatalf("teamsNotifier.send() = %v; expected: <nil>", err)
+	}
+
+	attachments, _ := received["attachments"].([]interface{})
+
+	if len(attachments) != 1 {
+		t.Fatalf("teams message = %v; expected: 1 attachment", received)
+	}
+
+	card, _ := json.Marshal(attachments[0])
+
+	for _, expected := range []string{"application/vnd.microsoft.card.adaptive", `"AdaptiveCard"`, `"FactSet"`, "Adobe", "2013-10-04", "Email addresses, Passwords", "high"} {
+		if !strings.Contains(string(card), expected) {
+			t.Errorf("teams card = %s; expected it to contain %s", card, expected)
+		}
+	}
+
+	if err := (teamsNotifier{}).send(context.Background(), chatTestNotification(server.URL+"/missing")); err == nil {
+		t.Error("teamsNotifier.send() to a failing webhook = <nil>; expected: an error")
+	}
+}
+
+// Need to test the following:
+// Only absolute https webhook URLs are accepted
+// Telegram chat IDs and Matrix room IDs must be well formed
+func TestChatDestinationsValidate(t *testing.T) {
+	tests := []struct {
+		Destinations chatDestinations
+		ExpectError  bool
+	}{
+		{Destinations: chatDestinations{SlackWebhookURL: "https://hooks.slack.com/services/T/B/X", SlackChannel: "C0123456"}},
+		{Destinations: chatDestinations{TeamsWebhookURL: "http://example.webhook.office.com/webhookb2/x"}, ExpectError: true},
+		{Destinations: chatDestinations{SlackWebhookURL: "/services/T/B/X"}, ExpectError: true},
+		{Destinations: chatDestinations{DiscordWebhookURL: "https://discord.com/api/webhooks/1/token", TelegramChatID: "-1001234", MatrixRoomID: "!room:example.org"}},
+		{Destinations: chatDestinations{TelegramChatID: "@pw"}, ExpectError: true},
+		{Destinations: chatDestinations{MatrixRoomID: "#room:example.org"}, ExpectError: true},
+		{},
+	}
+
+	for _, test := range tests {
+		if err := test.Destinations.validate(); (err != nil) != test.ExpectError {
+			t.Errorf("chatDestinations.validate() for %+v = %v; expected an error: %t", test.Destinations, err, test.ExpectError)
+		}
+	}
+}
+
+// Need to test the following:
+// Errors reaching a webhook or topic don't have its URL in them, since the URL is a credential
+func TestChatErrorsWithoutURL(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	secretURL := server.URL + "/services/T000/B000/secret-token"
+
+	server.Close()
+
+	tests := []struct {
+		Name     string
+		Notifier notifier
+	}{
+		{Name: "slack", Notifier: slackNotifier{}},
+		{Name: "teams", Notifier: teamsNotifier{}},
+		{Name: "discord", Notifier: discordNotifier{}},
+		{Name: "ntfy", Notifier: ntfyNotifier{}},
+		{Name: "gotify", Notifier: gotifyNotifier{}},
+	}
+
+	for _, test := range tests {
+		if err := test.Notifier.send(context.Background(), chatTestNotification(secretURL)); err == nil || strings.Contains(err.Error(), "secret-token") {
+			t.Errorf("%s send() to an unreachable webhook = %v; expected: an error without the URL", test.Name, err)
+		}
+	}
+}
@@ -0,0 +1,536 @@
+package functionality
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/mail"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Contact import formats
+const (
+	contactFormatCSV   = "csv"
+	contactFormatJSONL = "jsonl"
+	contactFormatVCard = "vcard"
+)
+
+// maxContactImportBytes is the largest contact file the import endpoint accepts
+const maxContactImportBytes = 10 << 20
+
+var (
+	ErrUnknownContactFormat = errors.New(`the format must be "csv", "jsonl" or "vcard"`)
+	ErrInvalidOptInToken    = errors.New("the opt-in token is invalid or has already been used")
+	ErrPublicURLNotSet      = errors.New("publicURL must be set to send confirmation emails")
+
+	optInNotificationTitle = "Confirm your pwnage checks"
+)
+
+// ContactColumns are the headers of the CSV columns contacts are read from, matched in any case,
+// only the email column has to be in the CSV
+type ContactColumns struct {
+	Email        string
+	Phone        string
+	AlwaysNotify string
+}
+
+// DefaultContactColumns are the columns contacts are read from unless others are given
+var DefaultContactColumns = ContactColumns{Email: "email", Phone: "phone", AlwaysNotify: "always_notify"}
+
+// ContactImportError is why a row of a contact import wasn't imported, for a vCard
+// the line is the one the card begins on
+type ContactImportError struct {
+	Line  int    `json:"line"`
+	Email string `json:"email,omitempty"`
+	Error string `json:"error"`
+}
+
+// ContactImportResult is what a contact import did, with an error for every row it didn't import
+type ContactImportResult struct {
+	Imported   int                  `json:"imported"`
+	Duplicates int                  `json:"duplicates"`
+	Existing   int                  `json:"existing"`
+	Invalid    int                  `json:"invalid"`
+	OptInsSent int                  `json:"opt_ins_sent"`
+	Errors     []ContactImportError `json:"errors"`
+}
+
+// contact is a row of a contact file, the email is validated after parsing
+type contact struct {
+	line         int
+	email        string
+	phone        string
+	alwaysNotify bool
+}
+
+// ContactFormat is the contact format for the name given, or the one the file extension
+// or content type suggests when no name is given
+func ContactFormat(name, fileName, contentType string) (string, error) {
+	if name == "" {
+		switch strings.ToLower(filepath.Ext(fileName)) {
+		case ".csv":
+			name = contactFormatCSV
+		case ".jsonl", ".ndjson":
+			name = contactFormatJSONL
+		case ".vcf", ".vcard":
+			name = contactFormatVCard
+		}
+	}
+
+	if name == "" {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+
+		switch mediaType {
+		case "text/csv":
+			name = contactFormatCSV
+		case "application/jsonl", "application/x-ndjson", "application/x-jsonlines":
+			name = contactFormatJSONL
+		case "text/vcard", "text/x-vcard":
+			name = contactFormatVCard
+		}
+	}
+
+	switch strings.ToLower(name) {
+	case contactFormatCSV:
+		return contactFormatCSV, nil
+	case contactFormatJSONL, "ndjson":
+		return contactFormatJSONL, nil
+	case contactFormatVCard, "vcf":
+		return contactFormatVCard, nil
+	default:
+		return "", ErrUnknownContactFormat
+	}
+}
+
+// parseContacts reads the contacts from the file, rows which can't be read are returned as
+// errors, while a file which can't be read at all is the error
+func parseContacts(reader io.Reader, format string, columns ContactColumns) ([]contact, []ContactImportError, error) {
+	switch format {
+	case contactFormatCSV:
+		return parseCSVContacts(reader, columns)
+	case contactFormatJSONL:
+		return parseJSONLContacts(reader)
+	case contactFormatVCard:
+		return parseVCardContacts(reader)
+	default:
+		return nil, nil, ErrUnknownContactFormat
+	}
+}
+
+// parseCSVContacts reads contacts from a CSV with a header row naming the columns
+func parseCSVContacts(reader io.Reader, columns ContactColumns) ([]contact, []ContactImportError, error) {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+	csvReader.TrimLeadingSpace = true
+
+	header, err := csvReader.Read()
+
+	if err == io.EOF {
+		return nil, nil, nil
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	columnIndex := func(name string) int {
+		for i, heading := range header {
+			if name != "" && strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(heading, "\ufeff")), name) {
+				return i
+			}
+		}
+
+		return -1
+	}
+
+	emailColumn, phoneColumn, alwaysNotifyColumn := columnIndex(columns.Email), columnIndex(columns.Phone), columnIndex(columns.AlwaysNotify)
+
+	if emailColumn == -1 {
+		return nil, nil, fmt.Errorf("the CSV has no %q column for the email", columns.Email)
+	}
+
+	field := func(record []string, column int) string {
+		if column == -1 || column >= len(record) {
+			return ""
+		}
+
+		return strings.TrimSpace(record[column])
+	}
+
+	var (
+		contacts  []contact
+		rowErrors []ContactImportError
+	)
+
+	for {
+		record, err := csvReader.Read()
+
+		if err == io.EOF {
+			return contacts, rowErrors, nil
+		}
+
+		if parseErr, isParseErr := err.(*csv.ParseError); isParseErr {
+			rowErrors = append(rowErrors, ContactImportError{Line: parseErr.StartLine, Error: parseErr.Err.Error()})
+
+			continue
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		line, _ := csvReader.FieldPos(0)
+		imported := contact{line: line, email: field(record, emailColumn), phone: field(record, phoneColumn)}
+
+		if alwaysNotify := field(record, alwaysNotifyColumn); alwaysNotify != "" {
+			if imported.alwaysNotify, err = strconv.ParseBool(alwaysNotify); err != nil {
+				rowErrors = append(rowErrors, ContactImportError{Line: line, Email: imported.email, Error: fmt.Sprintf("%q is not true or false", alwaysNotify)})
+
+				continue
+			}
+		}
+
+		contacts = append(contacts, imported)
+	}
+}
+
+// parseJSONLContacts reads contacts from lines of JSON objects, blank lines are skipped
+func parseJSONLContacts(reader io.Reader) ([]contact, []ContactImportError, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+
+	var (
+		contacts  []contact
+		rowErrors []ContactImportError
+	)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+
+		if text == "" {
+			continue
+		}
+
+		row := struct {
+			Email        string `json:"email"`
+			Phone        string `json:"phone"`
+			AlwaysNotify bool   `json:"always_notify"`
+		}{}
+
+		if err := json.Unmarshal([]byte(text), &row); err != nil {
+			rowErrors = append(rowErrors, ContactImportError{Line: line, Error: err.Error()})
+
+			continue
+		}
+
+		contacts = append(contacts, contact{line: line, email: strings.TrimSpace(row.Email), phone: strings.TrimSpace(row.Phone), alwaysNotify: row.AlwaysNotify})
+	}
+
+	return contacts, rowErrors, scanner.Err()
+}
+
+// parseVCardContacts reads a contact from each card, taking the card's first email and
+// phone number, or the ones marked as preferred
+func parseVCardContacts(reader io.Reader) ([]contact, []ContactImportError, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+
+	var (
+		contacts  []contact
+		rowErrors []ContactImportError
+
+		card                     *contact
+		emailIsPref, phoneIsPref bool
+		properties               []string
+		propertyLines            []int
+	)
+
+	// Long lines are folded onto the lines after them, which begin with a space or tab
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+
+		if len(properties) != 0 && (strings.HasPrefix(text, " ") || strings.HasPrefix(text, "\t")) {
+			properties[len(properties)-1] += text[1:]
+
+			continue
+		}
+
+		if strings.TrimSpace(text) != "" {
+			properties = append(properties, text)
+			propertyLines = append(propertyLines, line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for i, property := range properties {
+		separator := strings.IndexByte(property, ':')
+
+		if separator == -1 {
+			continue
+		}
+
+		parameters := strings.Split(property[:separator], ";")
+		name := strings.ToUpper(parameters[0][strings.LastIndexByte(parameters[0], '.')+1:])
+		value := strings.TrimSpace(property[separator+1:])
+		isPref := false
+
+		for _, parameter := range parameters[1:] {
+			// PREF=1 in version 4, TYPE=pref in version 3 and a bare PREF in version 2.1
+			isPref = isPref || strings.Contains(strings.ToUpper(parameter), "PREF")
+		}
+
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VCARD"):
+			card, emailIsPref, phoneIsPref = &contact{line: propertyLines[i]}, false, false
+		case card == nil:
+		case name == "END" && strings.EqualFold(value, "VCARD"):
+			if card.email == "" {
+				rowErrors = append(rowErrors, ContactImportError{Line: card.line, Error: "the card has no email"})
+			} else {
+				contacts = append(contacts, *card)
+			}
+
+			card = nil
+		case name == "EMAIL" && (card.email == "" || (isPref && !emailIsPref)):
+			card.email, emailIsPref = strings.TrimPrefix(value, "mailto:"), isPref
+		case name == "TEL" && (card.phone == "" || (isPref && !phoneIsPref)):
+			card.phone, phoneIsPref = strings.TrimPrefix(value, "tel:"), isPref
+		}
+	}
+
+	if card != nil {
+		rowErrors = append(rowErrors, ContactImportError{Line: card.line, Error: "the card has no END:VCARD"})
+	}
+
+	return contacts, rowErrors, nil
+}
+
+// importContacts validates the contacts and adds those which aren't duplicates or already subscribed,
+// when optIn is set they are only checked once they confirm with the token emailed to them
+func importContacts(ctx context.Context, contacts []contact, rowErrors []ContactImportError, optIn bool, baseURL string) (ContactImportResult, error) {
+	result := ContactImportResult{Invalid: len(rowErrors), Errors: rowErrors}
+
+	if subscribers == nil {
+		return result, ErrSubscriberStoreUnavailable
+	}
+
+	var (
+		newSubscribers []Subscriber
+		newContacts    []contact
+		tokens         []string
+		firstLines     = make(map[string]int)
+	)
+
+	for _, imported := range contacts {
+		address, err := mail.ParseAddress(imported.email)
+
+		if err != nil {
+			result.Invalid++
+			result.Errors = append(result.Errors, ContactImportError{Line: imported.line, Email: imported.email, Error: err.Error()})
+
+			continue
+		}
+
+		if firstLine, exists := firstLines[strings.ToLower(address.Address)]; exists {
+			result.Duplicates++
+			result.Errors = append(result.Errors, ContactImportError{Line: imported.line, Email: address.Address, Error: fmt.Sprintf("the email is a duplicate of line %d", firstLine)})
+
+			continue
+		}
+
+		firstLines[strings.ToLower(address.Address)] = imported.line
+
+		subscriber := Subscriber{Email: address.Address, Phone: imported.phone, subscriberDetails: subscriberDetails{AlwaysNotify: imported.alwaysNotify}}
+		token := ""
+
+		if optIn {
+			token = newID() + newID()
+
+			subscriber.PendingOptIn, subscriber.OptInTokenHash = true, hashPrivacyToken(token)
+		}
+
+		newSubscribers = append(newSubscribers, subscriber)
+		newContacts = append(newContacts, contact{line: imported.line, email: address.Address})
+		tokens = append(tokens, token)
+	}
+
+	if len(newSubscribers) == 0 {
+		return result.sorted(), nil
+	}
+
+	_, errs, err := subscribers.addMany(newSubscribers)
+
+	if err != nil {
+		return result, err
+	}
+
+	for i, addErr := range errs {
+		switch {
+		case addErr == ErrSubscriberExists:
+			result.Existing++
+		case addErr != nil:
+			result.Invalid++
+		default:
+			result.Imported++
+		}
+
+		if addErr != nil {
+			result.Errors = append(result.Errors, ContactImportError{Line: newContacts[i].line, Email: newContacts[i].email, Error: addErr.Error()})
+
+			continue
+		}
+
+		if !optIn {
+			continue
+		}
+
+		if err := sendOptInEmail(ctx, newContacts[i].email, tokens[i], baseURL); err != nil {
+			result.Errors = append(result.Errors, ContactImportError{Line: newContacts[i].line, Email: newContacts[i].email, Error: "the opt-in email could not be sent: " + err.Error()})
+
+			continue
+		}
+
+		result.OptInsSent++
+	}
+
+	loggerFromContext(ctx).Info("imported contacts", "imported", result.Imported, "duplicates", result.Duplicates, "existing", result.Existing, "invalid", result.Invalid, "opt_ins_sent", result.OptInsSent)
+
+	return result.sorted(), nil
+}
+
+// sorted puts the errors, which are found in several passes, in the order of the file
+func (cir ContactImportResult) sorted() ContactImportResult {
+	sort.SliceStable(cir.Errors, func(i, j int) bool { return cir.Errors[i].Line < cir.Errors[j].Line })
+
+	return cir
+}
+
+// ImportContacts adds the contacts in the file to the subscribers checked for pwnage, which
+// needs the subscriber store to have been opened, opt-in emails need publicURL to be set
+func ImportContacts(ctx context.Context, reader io.Reader, format string, columns ContactColumns, optIn bool) (ContactImportResult, error) {
+	var baseURL string
+
+	if optIn {
+		var err error
+
+		if baseURL, err = publicURL(); err != nil {
+			return ContactImportResult{}, err
+		}
+	}
+
+	contacts, rowErrors, err := parseContacts(reader, format, columns)
+
+	if err != nil {
+		return ContactImportResult{}, err
+	}
+
+	return importContacts(ctx, contacts, rowErrors, optIn, baseURL)
+}
+
+// ImportToPwnageCheck adds every contact in the CSV, JSON Lines or vCard file in the body to the subscribers
+// checked for pwnage; the format comes from the format parameter or the content type, CSV columns can be
+// renamed with the email_column, phone_column and always_notify_column parameters, and opt_in=true emails
+// each new subscriber a token to confirm with before they are checked
+func ImportToPwnageCheck(c *gin.Context) {
+	format, err := ContactFormat(c.Query("format"), "", c.ContentType())
+
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	}
+
+	columns := ContactColumns{
+		Email:        c.DefaultQuery("email_column", DefaultContactColumns.Email),
+		Phone:        c.DefaultQuery("phone_column", DefaultContactColumns.Phone),
+		AlwaysNotify: c.DefaultQuery("always_notify_column", DefaultContactColumns.AlwaysNotify),
+	}
+
+	optIn := c.Query("opt_in") == "true"
+
+	var baseURL string
+
+	if optIn {
+		if baseURL, err = publicURL(); err != nil {
+			respondWithError(c, http.StatusServiceUnavailable, err)
+
+			return
+		}
+	}
+
+	contacts, rowErrors, err := parseContacts(http.MaxBytesReader(c.Writer, c.Request.Body, maxContactImportBytes), format, columns)
+
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	}
+
+	result, err := importContacts(c.Request.Context(), contacts, rowErrors, optIn, baseURL)
+
+	if err != nil {
+		respondWithError(c, subscriberErrorStatusCode(err), err)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"error": false, "result": result})
+}
+
+// sendOptInEmail emails the token the subscriber has to confirm with before they start being checked
+func sendOptInEmail(ctx context.Context, email, token, baseURL string) error {
+	body := fmt.Sprintf(
+		"This address was added to the nightly check for it appearing in data breaches. To start being checked, confirm it by sending {\"token\": \"%s\"} to %s/api/opt-in/confirm, otherwise you can ignore this email.",
+		token,
+		baseURL,
+	)
+
+	return notifyEmailOfPwnage(ctx, email, optInNotificationTitle, body, "opt_in")
+}
+
+// ConfirmOptIn starts checking the imported subscriber the opt-in token was emailed to
+func ConfirmOptIn(c *gin.Context) {
+	confirmRequest := struct {
+		Token string `json:"token"`
+	}{}
+
+	if err := json.NewDecoder(c.Request.Body).Decode(&confirmRequest); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	}
+
+	if subscribers == nil {
+		respondWithError(c, http.StatusServiceUnavailable, ErrSubscriberStoreUnavailable)
+
+		return
+	}
+
+	if err := subscribers.confirmOptIn(hashPrivacyToken(confirmRequest.Token)); err != nil {
+		statusCode := subscriberErrorStatusCode(err)
+
+		if err == ErrInvalidOptInToken {
+			statusCode = http.StatusForbidden
+		}
+
+		respondWithError(c, statusCode, err)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"error": false})
+}
@@ -0,0 +1,228 @@
+package functionality
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Need to test the following:
+// The format is taken from its name, then the file extension, then the content type
+// Unknown formats are rejected
+func TestContactFormat(t *testing.T) {
+	tests := []struct {
+		Name, FileName, ContentType string
+		ExpectedFormat              string
+		ExpectError                 bool
+	}{
+		{Name: "CSV", FileName: "contacts.vcf", ExpectedFormat: contactFormatCSV},
+		{FileName: "contacts.ndjson", ExpectedFormat: contactFormatJSONL},
+		{FileName: "Contacts.VCF", ExpectedFormat: contactFormatVCard},
+		{ContentType: "text/csv; charset=utf-8", ExpectedFormat: contactFormatCSV},
+		{ContentType: "text/vcard", ExpectedFormat: contactFormatVCard},
+		{Name: "xlsx", ExpectError: true},
+		{FileName: "contacts.txt", ExpectError: true},
+	}
+
+	for _, test := range tests {
+		format, err := ContactFormat(test.Name, test.FileName, test.ContentType)
+
+		if format != test.ExpectedFormat || (err != nil) != test.ExpectError {
+			t.Errorf("ContactFormat(%q, %q, %q) = %q, %v; expected: %q, an error: %t", test.Name, test.FileName, test.ContentType, format, err, test.ExpectedFormat, test.ExpectError)
+		}
+	}
+}
+
+// Need to test the following:
+// CSV columns are found by their header in any order and case, with the columns renamed
+// A CSV without the email column can't be read at all
+// JSON Lines and vCards are read, vCards unfolding lines and preferring the preferred email
+// Rows which can't be read are errors on the line they are on, without stopping the others
+func TestParseContacts(t *testing.T) {
+	tests := []struct {
+		Name               string
+		Format             string
+		Columns            ContactColumns
+		Contents           string
+		ExpectedEmails     []string
+		ExpectedPhone      string
+		ExpectedErrorLines []int
+		ExpectError        bool
+	}{
+		{
+			Name:           "CSV",
+			Format:         contactFormatCSV,
+			Columns:        DefaultContactColumns,
+			Contents:       "Name,Phone,EMAIL,Always_Notify\nSomeone,+15558675309,someone@example.com,true\nNobody,,nobody@example.com,sometimes\nAnyone,,anyone@example.com\n",
+			ExpectedEmails: []string{"someone@example.com", "anyone@example.com"},
+			ExpectedPhone:  "+15558675309", ExpectedErrorLines: []int{3},
+		},
+		{
+			Name:           "renamed CSV columns",
+			Format:         contactFormatCSV,
+			Columns:        ContactColumns{Email: "E-mail Address", Phone: "Mobile"},
+			Contents:       "\ufeffE-mail Address,Mobile\r\nsomeone@example.com,+15558675309\r\n",
+			ExpectedEmails: []string{"someone@example.com"},
+			ExpectedPhone:  "+15558675309",
+		},
+		{
+			Name:        "CSV without the email column",
+			Format:      contactFormatCSV,
+			Columns:     DefaultContactColumns,
+			Contents:    "name,phone\nSomeone,+15558675309\n",
+			ExpectError: true,
+		},
+		{
+			Name:           "JSON Lines",
+			Format:         contactFormatJSONL,
+			Contents:       `{"email": "someone@example.com", "phone": "+15558675309", "always_notify": true}` + "\n\n{not json}\n" + `{"email": "anyone@example.com"}` + "\n",
+			ExpectedEmails: []string{"someone@example.com", "anyone@example.com"},
+			ExpectedPhone:  "+15558675309", ExpectedErrorLines: []int{3},
+		},
+		{
+			Name:   "vCard",
+			Format: contactFormatVCard,
+			Contents: strings.Join([]string{
+				"BEGIN:VCARD", "VERSION:3.0", "FN:Someone", "EMAIL;TYPE=INTERNET:old@example.com", "item1.EMAIL;TYPE=INTERNET,pref:some", " one@example.com", "TEL;TYPE=CELL:+15558675309", "END:VCARD",
+				"BEGIN:VCARD", "VERSION:4.0", "FN:Nobody", "END:VCARD",
+				"BEGIN:VCARD", "VERSION:4.0", "EMAIL:anyone@example.com", "END:VCARD",
+			}, "\r\n"),
+			ExpectedEmails: []string{"someone@example.com", "anyone@example.com"},
+			ExpectedPhone:  "+15558675309", ExpectedErrorLines: []int{9},
+		},
+	}
+
+	for _, test := range tests {
+		contacts, rowErrors, err := parseContacts(strings.NewReader(test.Contents), test.Format, test.Columns)
+
+		if (err != nil) != test.ExpectError {
+			t.Errorf("parseContacts() of the %s = %v; expected an error: %t", test.Name, err, test.ExpectError)
+
+			continue
+		}
+
+		var emails []string
+
+		for _, imported := range contacts {
+			emails = append(emails, imported.email)
+		}
+
+		var errorLines []int
+
+		for _, rowErr := range rowErrors {
+			errorLines = append(errorLines, rowErr.Line)
+		}
+
+		if strings.Join(emails, ",") != strings.Join(test.ExpectedEmails, ",") || (len(contacts) != 0 && contacts[0].phone != test.ExpectedPhone) {
+			t.Errorf("parseContacts() of the %s = %+v; expected: %v with the first phone %s", test.Name, contacts, test.ExpectedEmails, test.ExpectedPhone)
+		}
+
+		if len(errorLines) != len(test.ExpectedErrorLines) || (len(errorLines) != 0 && errorLines[0] != test.ExpectedErrorLines[0]) {
+			t.Errorf("parseContacts() of the %s row errors = %+v; expected: on lines %v", test.Name, rowErrors, test.ExpectedErrorLines)
+		}
+	}
+}
+
+// Need to test the following:
+// New contacts are imported, while duplicates, existing subscribers and invalid emails are reported by line
+// Contacts imported to opt in are emailed a token and aren't checked until they confirm with it
+// An opt-in token can only be used once
+func TestImportToPwnageCheck(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tempDirectory, err := ioutil.TempDir("", "contacts")
+
+	if err != nil {
+		t.Fatal("could not create the temporary data directory")
+	}
+
+	defer os.RemoveAll(tempDirectory)
+
+	kr := newTestKeyring(t, "1", map[string]string{"1": newTestKey(t)}, newTestKey(t))
+
+	subscribers, _ = openSubscriberStore(filepath.Join(tempDirectory, "subscribers.json"), kr)
+
+	defer func() { subscribers = nil }()
+
+	subscribers.add(Subscriber{Email: "existing@example.com"})
+
+	recorder, restore := useRecordingEmailSender()
+
+	defer restore()
+
+	restorePublicURL := usePublicURL("https://pwned.example.com")
+
+	defer restorePublicURL()
+
+	router := gin.New()
+	router.POST("/import", ImportToPwnageCheck)
+	router.POST("/opt-in/confirm", ConfirmOptIn)
+
+	post := func(path, contentType, body string) (int, string) {
+		mockRequest := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		mockRequest.Header.Set("Content-Type", contentType)
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		router.ServeHTTP(mockResponseWriter, mockRequest)
+
+		return mockResponseWriter.Code, mockResponseWriter.Body.String()
+	}
+
+	statusCode, body := post("/import?email_column=mail", "text/csv", "mail\nsomeone@example.com\nSOMEONE@example.com\nexisting@example.com\nnot an email\n")
+
+	expectedResult := `{"imported":1,"duplicates":1,"existing":1,"invalid":1,"opt_ins_sent":0,"errors":[{"line":3,"email":"SOMEONE@example.com","error":"the email is a duplicate of line 2"},{"line":4,"email":"existing@example.com","error":"the email is already being checked for pwnage"},{"line":5,"email":"not an email","error":"mail: no angle-addr"}]}`
+
+	if statusCode != http.StatusOK || !strings.Contains(body, expectedResult) {
+		t.Errorf("POST /import of a CSV = HTTP/%d %s; expected: HTTP/200 %s", statusCode, body, expectedResult)
+	}
+
+	if statusCode, body = post("/import?opt_in=true", "application/x-ndjson", `{"email": "optin@example.com"}`); statusCode != http.StatusOK || !strings.Contains(body, `"opt_ins_sent":1`) {
+		t.Fatalf("POST /import?opt_in=true = HTTP/%d %s; expected: HTTP/200 with an opt-in sent", statusCode, body)
+	}
+
+	isChecked := func(email string) bool {
+		subscriberList, _ := subscribers.list()
+
+		for _, subscriber := range subscriberList {
+			if subscriber.Email == email {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if isChecked("optin@example.com") {
+		t.Error("subscriberStore.list() before opting in includes optin@example.com; expected it to be left out")
+	}
+
+	messages := recorder.messages()
+	token := regexp.MustCompile(`"token": "([0-9a-f]+)"`).FindStringSubmatch(messages[len(messages)-1].Body)
+
+	if len(token) != 2 {
+		t.Fatalf("opt-in email = %+v; expected: a token", messages)
+	}
+
+	confirmBody, _ := json.Marshal(gin.H{"token": token[1]})
+
+	if statusCode, body = post("/opt-in/confirm", "application/json", string(confirmBody)); statusCode != http.StatusOK || !isChecked("optin@example.com") {
+		t.Errorf("POST /opt-in/confirm = HTTP/%d %s; expected: HTTP/200 with optin@example.com checked", statusCode, body)
+	}
+
+	if statusCode, _ = post("/opt-in/confirm", "application/json", string(confirmBody)); statusCode != http.StatusForbidden {
+		t.Errorf("POST /opt-in/confirm with a used token = HTTP/%d; expected: HTTP/403", statusCode)
+	}
+
+	if statusCode, _ = post("/import", "application/pdf", "%PDF"); statusCode != http.StatusBadRequest {
+		t.Errorf("POST /import of an unknown format = HTTP/%d; expected: HTTP/400", statusCode)
+	}
+}
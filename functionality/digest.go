@@ -0,0 +1,291 @@
+package functionality
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"text/template"
+	"time"
+
+	// The image has no zoneinfo, so the timezone database is compiled in for the digest timezones
+	_ "time/tzdata"
+)
+
+// The cadences a subscriber can get digests on, no cadence means every finding is sent immediately
+const (
+	digestNone   = ""
+	digestDaily  = "daily"
+	digestWeekly = "weekly"
+)
+
+// digestItem is a finding waiting for the subscriber's next digest, either a breach or a paste,
+// Channels are the channels the notification policy routed it to, every channel when there are none
+type digestItem struct {
+	DetectedAt time.Time     `json:"detected_at"`
+	Breach     *scoredBreach `json:"breach,omitempty"`
+	Paste      *PasteInfo    `json:"paste,omitempty"`
+	Channels   []string      `json:"channels,omitempty"`
+}
+
+// key identifies the finding, so the same one isn't queued twice for a digest
+func (di digestItem) key() string {
+	if di.Breach != nil {
+		return "breach/" + di.Breach.Name
+	}
+
+	if di.Paste != nil {
+		return "paste/" + di.Paste.key()
+	}
+
+	return ""
+}
+
+// digestItemsFor are the breaches the policy decided to notify, with the channels it routed each of them to
+func digestItemsFor(decision policyDecision, detectedAt time.Time) []digestItem {
+	items := make([]digestItem, 0, len(decision.Breaches))
+
+	for i := range decision.Breaches {
+		item := digestItem{DetectedAt: detectedAt, Breach: &decision.Breaches[i]}
+
+		for _, channel := range allChannels {
+			for _, routed := range decision.Channels[channel] {
+				if routed.Name == item.Breach.Name {
+					item.Channels = append(item.Channels, channel)
+
+					break
+				}
+			}
+		}
+
+		items = append(items, item)
+	}
+
+	return items
+}
+
+var (
+	// Digests are sent from digestHour in the subscriber's timezone, on digestWeekday for weekly ones
+	digestHour    = 8
+	digestWeekday = time.Monday
+
+	// Findings of at least digestImmediateSeverity are sent immediately, even to digest subscribers
+	digestImmediateSeverity = severityHigh
+
+	digestTitle    = "YOUR PWNAGE DIGEST"
+	digestTemplate = template.Must(template.New("digest").Parse(
+		`Here is what Have I Been Pwned found for your email since your last digest:
+{{range .}}{{if .Breach}}
+- Breach: {{.Breach.Title}} ({{.Breach.BreachDate}}, {{.Breach.Severity}} severity), exposing {{range $i, $dataClass := .Breach.DataClasses}}{{if $i}}, {{end}}{{$dataClass}}{{end}}
+{{- else if .Paste}}
+- Paste: {{.Paste.Source}} paste {{.Paste.ID}}{{if .Paste.Title}} "{{.Paste.Title}}"{{end}}, with {{.Paste.EmailCount}} emails in it
+{{- end}}{{end}}
+`))
+)
+
+func init() {
+	registerScheduledJob("digest", time.Hour, sendDueDigests)
+}
+
+func validateDigestSettings(digest, timezone string) error {
+	if digest != digestNone && digest != digestDaily && digest != digestWeekly {
+		return fmt.Errorf("unknown digest %q, expected daily or weekly", digest)
+	}
+
+	_, err := time.LoadLocation(timezone)
+
+	return err
+}
+
+// location is the subscriber's timezone, defaulting to UTC when they haven't got one
+func (sd subscriberDetails) location() *time.Location {
+	location, err := time.LoadLocation(sd.Timezone)
+
+	if err != nil {
+		return time.UTC
+	}
+
+	return location
+}
+
+// digestDue is whether the subscriber's digest should be sent at the time, which is once
+// a day (or week) from digestHour in their timezone, when there is something to send
+func (sd subscriberDetails) digestDue(now time.Time) bool {
+	if sd.Digest == digestNone || len(sd.PendingDigest) == 0 {
+		return false
+	}
+
+	localNow := now.In(sd.location())
+
+	if localNow.Hour() < digestHour || (sd.Digest == digestWeekly && localNow.Weekday() != digestWeekday) {
+		return false
+	}
+
+	lastDigest := sd.LastDigestAt.In(sd.location())
+
+	return lastDigest.Year() != localNow.Year() || lastDigest.YearDay() != localNow.YearDay()
+}
+
+// queueForDigest adds the findings to the subscriber's next digest, unless they get findings
+// immediately; it reports whether they were queued, in which case nothing else needs sending
+func queueForDigest(ctx context.Context, subscriber Subscriber, items []digestItem) (bool, error) {
+	if subscriber.Digest == digestNone || subscribers == nil {
+		return false, nil
+	}
+
+	for _, item := range items {
+		if item.Breach != nil && item.Breach.Severity >= digestImmediateSeverity {
+			return false, nil
+		}
+	}
+
+	// The same findings come up on every check, so ones already waiting for
+	// the digest, or sent in an earlier one, aren't queued again
+	err := subscribers.updateDetails(subscriber.ID, func(details *subscriberDetails) {
+		pending := make(map[string]bool, len(details.PendingDigest)+len(details.DigestedBreaches))
+
+		for _, item := range details.PendingDigest {
+			pending[item.key()] = true
+		}
+
+		for _, name := range details.DigestedBreaches {
+			pending[digestItem{Breach: &scoredBreach{PwnInfo: PwnInfo{Name: name}}}.key()] = true
+		}
+
+		for _, item := range items {
+			if !pending[item.key()] {
+				details.PendingDigest = append(details.PendingDigest, item)
+			}
+		}
+	})
+
+	if err == nil {
+		loggerFromContext(ctx).Info("queued findings for digest", "email", subscriber.Email, "findings", len(items))
+	}
+
+	return err == nil, err
+}
+
+// sendDueDigests sends every digest which is due, only the findings which were sent are
+// cleared, so ones queued while the digest was being sent are kept for the next one; like
+// pastes, they are cleared once the digest reached the subscriber on any of their channels
+func sendDueDigests(ctx context.Context) error {
+	if subscribers == nil {
+		return ErrSubscriberStoreUnavailable
+	}
+
+	subscriberList, err := subscribers.list()
+
+	if err != nil {
+		return err
+	}
+
+	log := loggerFromContext(ctx)
+	now := time.Now()
+	sent := 0
+
+	for _, subscriber := range subscriberList {
+		if !subscriber.digestDue(now) {
+			continue
+		}
+
+		delivered, err := sendDigest(ctx, subscriber)
+
+		if err != nil {
+			log.Error("could not send digest", "email", subscriber.Email, "error", err)
+		}
+
+		if err != nil && !delivered {
+			continue
+		}
+
+		sent++
+
+		digested := len(subscriber.PendingDigest)
+
+		err = subscribers.updateDetails(subscriber.ID, func(details *subscriberDetails) {
+			for _, item := range details.PendingDigest[:digested] {
+				if item.Breach != nil && !containsFold(details.DigestedBreaches, item.Breach.Name) {
+					details.DigestedBreaches = append(details.DigestedBreaches, item.Breach.Name)
+				}
+			}
+
+			details.PendingDigest = details.PendingDigest[digested:]
+			details.LastDigestAt = now.UTC()
+		})
+
+		if err != nil {
+			log.Error("could not clear sent digest", "email", subscriber.Email, "error", err)
+		}
+	}
+
+	log.Info("sent due digests", "subscribers", len(subscriberList), "sent", sent)
+
+	return nil
+}
+
+// sendDigest sends each channel the subscriber's pending findings which were routed to it, returning
+// whether the digest was delivered on any of them; a channel failing doesn't stop the others
+func sendDigest(ctx context.Context, subscriber Subscriber) (bool, error) {
+	ctx = contextWithLogger(ctx, loggerFromContext(ctx).With("notification_type", "digest"))
+
+	var firstErr error
+
+	delivered := false
+
+	for _, channel := range allChannels {
+		var items []digestItem
+
+		for _, item := range subscriber.PendingDigest {
+			if len(item.Channels) == 0 || containsFold(item.Channels, channel) {
+				items = append(items, item)
+			}
+		}
+
+		if len(items) == 0 {
+			continue
+		}
+
+		n, err := digestNotification(items)
+
+		if err != nil {
+			return delivered, err
+		}
+
+		channelDelivered, err := notifySubscriberOnAny(ctx, subscriber, map[string]bool{channel: true}, n)
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		delivered = delivered || channelDelivered
+	}
+
+	return delivered, firstErr
+}
+
+// digestNotification is the digest of the findings, at the severity of the worst breach in it
+func digestNotification(items []digestItem) (notification, error) {
+	var body bytes.Buffer
+
+	if err := digestTemplate.Execute(&body, items); err != nil {
+		return notification{}, err
+	}
+
+	n := notification{Type: notificationDigest, Title: digestTitle, Body: body.String()}
+
+	for _, item := range items {
+		if item.Breach != nil {
+			n.Breaches = append(n.Breaches, *item.Breach)
+
+			if item.Breach.Severity > n.Severity {
+				n.Severity = item.Breach.Severity
+			}
+		}
+
+		if item.Paste != nil {
+			n.Pastes = append(n.Pastes, *item.Paste)
+		}
+	}
+
+	return n, nil
+}
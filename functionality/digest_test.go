@@ -0,0 +1,223 @@
+package functionality
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Need to test the following:
+// Digests are only due from digestHour in the subscriber's timezone, once a day
+// Weekly digests are only due on digestWeekday
+// Digests with nothing in them are never due
+func TestDigestDue(t *testing.T) {
+	pending := []digestItem{{Paste: &PasteInfo{Source: "Pastebin", ID: "1"}}}
+
+	// 2024-06-03 was a Monday
+	mondayMorningUTC := time.Date(2024, 6, 3, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		Name        string
+		Details     subscriberDetails
+		Now         time.Time
+		ExpectedDue bool
+	}{
+		{Name: "daily after the digest hour", Details: subscriberDetails{Digest: digestDaily, PendingDigest: pending}, Now: mondayMorningUTC, ExpectedDue: true},
+		{Name: "daily before the digest hour in the subscriber's timezone", Details: subscriberDetails{Digest: digestDaily, Timezone: "America/Chicago", PendingDigest: pending}, Now: mondayMorningUTC, ExpectedDue: false},
+		{Name: "daily already sent today", Details: subscriberDetails{Digest: digestDaily, PendingDigest: pending, LastDigestAt: mondayMorningUTC.Add(-time.Hour)}, Now: mondayMorningUTC, ExpectedDue: false},
+		{Name: "daily sent yesterday", Details: subscriberDetails{Digest: digestDaily, PendingDigest: pending, LastDigestAt: mondayMorningUTC.Add(-24 * time.Hour)}, Now: mondayMorningUTC, ExpectedDue: true},
+		{Name: "weekly on the digest weekday", Details: subscriberDetails{Digest: digestWeekly, PendingDigest: pending}, Now: mondayMorningUTC, ExpectedDue: true},
+		{Name: "weekly on another weekday", Details: subscriberDetails{Digest: digestWeekly, PendingDigest: pending}, Now: mondayMorningUTC.Add(24 * time.Hour), ExpectedDue: false},
+		{Name: "nothing pending", Details: subscriberDetails{Digest: digestDaily}, Now: mondayMorningUTC, ExpectedDue: false},
+		{Name: "no digest", Details: subscriberDetails{PendingDigest: pending}, Now: mondayMorningUTC, ExpectedDue: false},
+	}
+
+	for _, test := range tests {
+		if due := test.Details.digestDue(test.Now); due != test.ExpectedDue {
+			t.Errorf("digestDue() %s = %t; expected: %t", test.Name, due, test.ExpectedDue)
+		}
+	}
+}
+
+// Need to test the following:
+// Findings for digest subscribers are queued, and survive reopening the store
+// Findings of digestImmediateSeverity or above are never queued
+// Findings already waiting for the digest aren't queued again
+// Subscribers without a digest get everything immediately
+func TestQueueForDigest(t *testing.T) {
+	tempDirectory, err := ioutil.TempDir("", "digest")
+
+	if err != nil {
+		t.Fatal("could not create the temporary data directory")
+	}
+
+	defer os.RemoveAll(tempDirectory)
+
+	fileLocation := filepath.Join(tempDirectory, "subscribers.json")
+	kr := newTestKeyring(t, "1", map[string]string{"1": newTestKey(t)}, newTestKey(t))
+
+	subscribers, _ = openSubscriberStore(fileLocation, kr)
+
+	defer func() { subscribers = nil }()
+
+	digester, _ := subscribers.add(Subscriber{Email: "digest@example.com", subscriberDetails: subscriberDetails{Digest: digestDaily}})
+	immediate, _ := subscribers.add(Subscriber{Email: "immediate@example.com"})
+
+	minor := &scoredBreach{PwnInfo: PwnInfo{Name: "Minor"}, Severity: severityMedium}
+	major := &scoredBreach{PwnInfo: PwnInfo{Name: "Major"}, Severity: severityCritical}
+
+	tests := []struct {
+		Subscriber     Subscriber
+		Breach         *scoredBreach
+		ExpectedQueued bool
+	}{
+		{Subscriber: digester, Breach: minor, ExpectedQueued: true},
+		{Subscriber: digester, Breach: minor, ExpectedQueued: true},
+		{Subscriber: digester, Breach: major, ExpectedQueued: false},
+		{Subscriber: immediate, Breach: minor, ExpectedQueued: false},
+	}
+
+	for _, test := range tests {
+		if queued, err := queueForDigest(context.Background(), test.Subscriber, []digestItem{{Breach: test.Breach}}); err != nil || queued != test.ExpectedQueued {
+			t.Errorf("queueForDigest(%s, %s) = %t, %v; expected: %t, <nil>", test.Subscriber.Email, test.Breach.Name, queued, err, test.ExpectedQueued)
+		}
+	}
+
+	reopened, _ := openSubscriberStore(fileLocation, kr)
+	reopenedDigester, err := reopened.get("digest@example.com")
+
+	if err != nil || len(reopenedDigester.PendingDigest) != 1 || reopenedDigester.PendingDigest[0].Breach.Name != "Minor" || reopenedDigester.PendingDigest[0].Breach.Severity != severityMedium {
+		t.Errorf("pending digest after reopening = %+v, %v; expected: only the medium severity Minor breach", reopenedDigester.PendingDigest, err)
+	}
+}
+
+// Need to test the following:
+// The digest lists both the breaches and the pastes waiting in it
+func TestDigestTemplate(t *testing.T) {
+	var body bytes.Buffer
+
+	err := digestTemplate.Execute(&body, []digestItem{
+		{Breach: &scoredBreach{PwnInfo: PwnInfo{Title: "Adobe", BreachDate: "2013-10-04", DataClasses: []string{"Email addresses", "Password hints"}}, Severity: severityMedium}},
+		{Paste: &PasteInfo{Source: "Pastebin", ID: "8Q0BvKD8", EmailCount: 139}},
+	})
+
+	expectedLines := []string{
+		"- Breach: Adobe (2013-10-04, medium severity), exposing Email addresses, Password hints",
+		"- Paste: Pastebin paste 8Q0BvKD8, with 139 emails in it",
+	}
+
+	for _, expectedLine := range expectedLines {
+		if err != nil || !strings.Contains(body.String(), expectedLine) {
+			t.Errorf("digestTemplate = %q, %v; expected it to contain %q", body.String(), err, expectedLine)
+		}
+	}
+}
+
+// Need to test the following:
+// Findings from the nightly check are queued for digest subscribers rather than sent
+// Each channel's digest only has the findings routed to it, and findings without channels go to every channel
+// The sent findings are cleared once the digest reached the subscriber
+// Breaches already sent in a digest aren't queued again, so a digest only has what is new since the last one
+func TestSendDueDigests(t *testing.T) {
+	tempDirectory, err := ioutil.TempDir("", "digest")
+
+	if err != nil {
+		t.Fatal("could not create the temporary data directory")
+	}
+
+	defer os.RemoveAll(tempDirectory)
+
+	kr := newTestKeyring(t, "1", map[string]string{"1": newTestKey(t)}, newTestKey(t))
+
+	subscribers, _ = openSubscriberStore(filepath.Join(tempDirectory, "subscribers.json"), kr)
+
+	defer func() { subscribers = nil }()
+
+	originalDigestHour := digestHour
+	digestHour = 0
+
+	defer func() { digestHour = originalDigestHour }()
+
+	sent, restore := useRecordingNotifiers("", channelEmail, channelSMS)
+
+	defer restore()
+
+	digester, _ := subscribers.add(Subscriber{Email: "digest@example.com", subscriberDetails: subscriberDetails{
+		Digest: digestDaily,
+		PolicyRules: []policyRule{
+			{When: policyConditions{DataClasses: []string{"Usernames"}}, Action: policyActionNotify, Channels: []string{channelSMS}},
+			{Action: policyActionNotify, Channels: []string{channelEmail}},
+		},
+	}})
+
+	lookup := func(ctx context.Context, email string) ([]PwnInfo, error) {
+		return []PwnInfo{
+			{Name: "Emails", Title: "Emails", DataClasses: []string{"Email addresses"}},
+			{Name: "Usernames", Title: "Usernames", DataClasses: []string{"Email addresses", "Usernames"}},
+		}, nil
+	}
+
+	if err = notifyOfPwnageWithLookup(context.Background(), digester.Email, "", false, lookup); err != nil || len(sent()) != 0 {
+		t.Fatalf("notifyOfPwnageWithLookup() for a digest subscriber = %v, sent %d notifications; expected: <nil>, nothing sent", err, len(sent()))
+	}
+
+	paste := PasteInfo{Source: "Pastebin", ID: "8Q0BvKD8"}
+
+	if queued, err := queueForDigest(context.Background(), digester, []digestItem{{Paste: &paste}}); !queued || err != nil {
+		t.Fatalf("queueForDigest() of a paste = %t, %v; expected: true, <nil>", queued, err)
+	}
+
+	if err = sendDueDigests(context.Background()); err != nil {
+		t.Fatalf("sendDueDigests() = %v; expected: <nil>", err)
+	}
+
+	expected := map[string][]string{channelEmail: {"Emails", "Pastebin"}, channelSMS: {"Usernames", "Pastebin"}}
+
+	for _, n := range sent() {
+		var findings []string
+
+		for _, breach := range n.Breaches {
+			findings = append(findings, breach.Name)
+		}
+
+		for _, paste := range n.Pastes {
+			findings = append(findings, paste.Source)
+		}
+
+		if n.Type != notificationDigest || !equalStrings(findings, expected[n.Channel]) {
+			t.Errorf("%s digest = %s with %v; expected: a digest with %v", n.Channel, n.Type, findings, expected[n.Channel])
+		}
+
+		delete(expected, n.Channel)
+	}
+
+	if len(expected) != 0 {
+		t.Errorf("digests weren't sent through %v; expected: a digest through every channel", expected)
+	}
+
+	if digester, _ = subscribers.get(digester.Email); len(digester.PendingDigest) != 0 || digester.LastDigestAt.IsZero() {
+		t.Errorf("pending digest after sending it = %+v; expected: it to be cleared", digester.PendingDigest)
+	}
+
+	// The next day's check finds the same breaches, so the next digest has nothing in it
+	subscribers.updateDetails(digester.ID, func(details *subscriberDetails) { details.LastDigestAt = time.Now().Add(-48 * time.Hour) })
+
+	if err = notifyOfPwnageWithLookup(context.Background(), digester.Email, "", false, lookup); err != nil {
+		t.Fatalf("notifyOfPwnageWithLookup() for the second digest = %v; expected: <nil>", err)
+	}
+
+	if digester, _ = subscribers.get(digester.Email); len(digester.PendingDigest) != 0 {
+		t.Errorf("pending digest after the same breaches were found again = %+v; expected: nothing", digester.PendingDigest)
+	}
+
+	sentBefore := len(sent())
+
+	if err = sendDueDigests(context.Background()); err != nil || len(sent()) != sentBefore {
+		t.Errorf("sendDueDigests() without new findings = %v, sent %d more; expected: <nil>, nothing sent", err, len(sent())-sentBefore)
+	}
+}
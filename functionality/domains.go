@@ -0,0 +1,673 @@
+package functionality
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrDomainNotFound      = errors.New("the domain has not been registered")
+	ErrDomainNotVerified   = errors.New("the domain has not been verified")
+	ErrDomainVerification  = errors.New("the verification TXT record was not found on the domain")
+	ErrDomainStoreUnopened = errors.New("the domain store has not been opened")
+)
+
+const domainVerificationPrefix = "pwned-api-verification="
+
+// monitoredDomain is a domain registered for domain-wide breach searches, which are only
+// made once it has been verified by the verification token being put in a TXT record on it
+type monitoredDomain struct {
+	Domain            string    `json:"domain"`
+	VerificationToken string    `json:"verification_token"`
+	Verified          bool      `json:"verified"`
+	VerifiedAt        time.Time `json:"verified_at,omitempty"`
+	LastSearched      time.Time `json:"last_searched,omitempty"`
+
+	// BreachedAliases is the alias to breach names map from the last search, it is
+	// encrypted with the subscriber keyring since the aliases are email addresses
+	BreachedAliases *envelope `json:"breached_aliases,omitempty"`
+
+	// ErasedAliases are the blind indexes of the emails on the domain which have been erased,
+	// they are left out of every later search so that they aren't stored or notified again
+	ErasedAliases []string `json:"erased_aliases,omitempty"`
+}
+
+// domainStore keeps the monitored domains in a JSON file in the data directory
+type domainStore struct {
+	mu           sync.Mutex
+	fileLocation string
+	keyring      *keyring
+	domains      map[string]monitoredDomain
+}
+
+var (
+	domains            *domainStore
+	domainSearchPeriod = 24 * time.Hour
+
+	// lookupTXT is swapped out in tests so that verification doesn't depend on DNS
+	lookupTXT = net.DefaultResolver.LookupTXT
+)
+
+func init() {
+	registerKeyringRotation("domain_store", func(kr *keyring) error {
+		if domains == nil {
+			return nil
+		}
+
+		return domains.rotate(kr)
+	})
+}
+
+// InitializeDomainSearch opens the domain store in the data directory and schedules
+// the verified domains to be searched daily, it needs the subscriber keys file
+func InitializeDomainSearch() error {
+	kr, err := loadKeyringFromFile(subscriberKeysFileLocation())
+
+	if err == nil {
+		domains, err = openDomainStore(filepath.Join(dataDirectory, "domains.json"), kr)
+	}
+
+	registerReadinessCheck("domain_store", func() error { return err })
+
+	if err != nil {
+		return err
+	}
+
+	registerScheduledJob("domain_search", domainSearchPeriod, func(ctx context.Context) error {
+		return domains.searchAll(ctx, http.DefaultClient)
+	})
+
+	registerPersonalDataSource("domain_search", personalDataSource{
+		export: func(email string) (interface{}, error) {
+			alias, breachNames, err := domains.aliasBreaches(email)
+
+			if err != nil || breachNames == nil {
+				return nil, err
+			}
+
+			return gin.H{"alias": alias, "breaches": breachNames}, nil
+		},
+		erase: domains.eraseAlias,
+	})
+
+	return nil
+}
+
+func openDomainStore(fileLocation string, kr *keyring) (*domainStore, error) {
+	store := &domainStore{
+		fileLocation: fileLocation,
+		keyring:      kr,
+		domains:      make(map[string]monitoredDomain),
+	}
+
+	storeBytes, err := ioutil.ReadFile(fileLocation)
+
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return store, json.Unmarshal(storeBytes, &store.domains)
+}
+
+// save must be called with the lock held
+func (ds *domainStore) save() error {
+	storeBytes, err := json.Marshal(ds.domains)
+
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(ds.fileLocation), ".domains")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(storeBytes)
+
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), ds.fileLocation)
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+// register returns the registered domain, registering it if it hasn't been already
+func (ds *domainStore) register(domain string) (monitoredDomain, error) {
+	ds.mu.Lock()
+
+	defer ds.mu.Unlock()
+
+	domain = normalizeDomain(domain)
+
+	if registered, exists := ds.domains[domain]; exists {
+		return registered, nil
+	}
+
+	registered := monitoredDomain{Domain: domain, VerificationToken: newID() + newID()}
+
+	ds.domains[domain] = registered
+
+	return registered, ds.save()
+}
+
+func (ds *domainStore) verify(ctx context.Context, domain string) (monitoredDomain, error) {
+	ds.mu.Lock()
+
+	registered, exists := ds.domains[normalizeDomain(domain)]
+
+	ds.mu.Unlock()
+
+	if !exists {
+		return registered, ErrDomainNotFound
+	}
+
+	if registered.Verified {
+		return registered, nil
+	}
+
+	records, err := lookupTXT(ctx, registered.Domain)
+
+	if err != nil {
+		return registered, err
+	}
+
+	for _, record := range records {
+		if strings.TrimSpace(record) == domainVerificationPrefix+registered.VerificationToken {
+			ds.mu.Lock()
+
+			defer ds.mu.Unlock()
+
+			// The domain is read again since it could have been searched during the lookup
+			current, exists := ds.domains[registered.Domain]
+
+			if !exists || current.VerificationToken != registered.VerificationToken {
+				return registered, ErrDomainNotFound
+			}
+
+			if !current.Verified {
+				current.Verified = true
+				current.VerifiedAt = time.Now().UTC()
+
+				ds.domains[current.Domain] = current
+			}
+
+			return current, ds.save()
+		}
+	}
+
+	return registered, ErrDomainVerification
+}
+
+func domainAdditionalData(domain string) []byte {
+	return []byte("domain/" + domain)
+}
+
+// breachedAliases must be called with the lock held
+func (ds *domainStore) breachedAliases(registered monitoredDomain) (map[string][]string, error) {
+	aliases := make(map[string][]string)
+
+	if registered.BreachedAliases == nil {
+		return aliases, nil
+	}
+
+	aliasesBytes, err := ds.keyring.decrypt(*registered.BreachedAliases, domainAdditionalData(registered.Domain))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return aliases, json.Unmarshal(aliasesBytes, &aliases)
+}
+
+// setBreachedAliases must be called with the lock held
+func (ds *domainStore) setBreachedAliases(registered monitoredDomain, aliases map[string][]string) error {
+	aliasesBytes, err := json.Marshal(aliases)
+
+	if err != nil {
+		return err
+	}
+
+	encryptedAliases, err := ds.keyring.encrypt(aliasesBytes, domainAdditionalData(registered.Domain))
+
+	if err != nil {
+		return err
+	}
+
+	registered.BreachedAliases = &encryptedAliases
+
+	ds.domains[registered.Domain] = registered
+
+	return ds.save()
+}
+
+func splitEmail(email string) (string, string) {
+	at := strings.LastIndexByte(email, '@')
+
+	if at == -1 {
+		return email, ""
+	}
+
+	return strings.ToLower(email[:at]), normalizeDomain(email[at+1:])
+}
+
+// aliasBreaches returns the breach names found for the email in the last search of its domain
+func (ds *domainStore) aliasBreaches(email string) (string, []string, error) {
+	alias, domain := splitEmail(email)
+
+	ds.mu.Lock()
+
+	defer ds.mu.Unlock()
+
+	registered, exists := ds.domains[domain]
+
+	if !exists {
+		return alias, nil, nil
+	}
+
+	aliases, err := ds.breachedAliases(registered)
+
+	return alias, aliases[alias], err
+}
+
+// eraseAlias removes the email from the last search of its domain and keeps its blind
+// index, so that the alias is left out of every later search of the domain
+func (ds *domainStore) eraseAlias(email string) (bool, error) {
+	alias, domain := splitEmail(email)
+
+	ds.mu.Lock()
+
+	defer ds.mu.Unlock()
+
+	registered, exists := ds.domains[domain]
+
+	if !exists {
+		return false, nil
+	}
+
+	aliases, err := ds.breachedAliases(registered)
+
+	if err != nil {
+		return false, err
+	}
+
+	_, held := aliases[alias]
+
+	delete(aliases, alias)
+
+	if erasedIndex := ds.keyring.blindIndex(alias + "@" + domain); !containsFold(registered.ErasedAliases, erasedIndex) {
+		registered.ErasedAliases = append(registered.ErasedAliases, erasedIndex)
+	}
+
+	return held, ds.setBreachedAliases(registered, aliases)
+}
+
+// withoutErasedAliases removes the aliases which have been erased from the searched aliases
+func (ds *domainStore) withoutErasedAliases(registered monitoredDomain, aliases map[string][]string) map[string][]string {
+	for alias := range aliases {
+		if containsFold(registered.ErasedAliases, ds.keyring.blindIndex(alias+"@"+registered.Domain)) {
+			delete(aliases, alias)
+		}
+	}
+
+	return aliases
+}
+
+// rotate re-encrypts the breached aliases of every domain with the active key of the keyring,
+// which replaces the store's; erased aliases are kept as blind indexes which can't be recomputed,
+// so they are only left out of searches for as long as the keyring's index key isn't changed
+func (ds *domainStore) rotate(kr *keyring) error {
+	ds.mu.Lock()
+
+	defer ds.mu.Unlock()
+
+	ds.keyring = kr
+
+	for _, registered := range ds.domains {
+		aliases, err := ds.breachedAliases(registered)
+
+		if err != nil {
+			return err
+		}
+
+		if err = ds.setBreachedAliases(registered, aliases); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getBreachedDomainWithClient returns the breach names for every breached alias on the domain,
+// HIBP only answers for domains which have also been verified in its own dashboard
+func getBreachedDomainWithClient(ctx context.Context, domain string, client *http.Client) (map[string][]string, error) {
+	waited, err := hibpLimiter.Wait(ctx)
+
+	hibpRateLimiterWait.Observe(waited.Seconds())
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+
+	defer cancel()
+
+	domainRequest, err := http.NewRequest("GET", fmt.Sprintf("%s/breacheddomain/%s", hibpBaseURL, url.PathEscape(domain)), nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	domainRequest.Header.Set("User-Agent", "RJ-And-Friends-Nightly-Pwnage-Checker")
+	domainRequest.Header.Set("hibp-api-key", hibpAPIKey)
+
+	requestStart := time.Now()
+
+	resp, err := client.Do(domainRequest.WithContext(ctx))
+
+	statusCode := 0
+
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+
+	hibpRequests.WithLabelValues(statusCodeLabel(statusCode)).Inc()
+	hibpRequestDuration.WithLabelValues(statusCodeLabel(statusCode)).Observe(time.Since(requestStart).Seconds())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	aliases := make(map[string][]string)
+
+	if resp.StatusCode == http.StatusNotFound {
+		return aliases, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the HIBP domain search API responded with HTTP/%d", resp.StatusCode)
+	}
+
+	return aliases, json.NewDecoder(resp.Body).Decode(&aliases)
+}
+
+// search searches the domain and notifies every alias of the breaches it is newly in,
+// the first search of a domain only records the aliases without notifying them
+func (ds *domainStore) search(ctx context.Context, domain string, client *http.Client) error {
+	aliases, err := getBreachedDomainWithClient(ctx, domain, client)
+
+	if err != nil {
+		return err
+	}
+
+	ds.mu.Lock()
+
+	registered := ds.domains[domain]
+	aliases = ds.withoutErasedAliases(registered, aliases)
+	previousAliases, err := ds.breachedAliases(registered)
+	firstSearch := registered.LastSearched.IsZero()
+
+	registered.LastSearched = time.Now().UTC()
+
+	if err == nil {
+		err = ds.setBreachedAliases(registered, aliases)
+	}
+
+	ds.mu.Unlock()
+
+	if err != nil || firstSearch {
+		return err
+	}
+
+	ctx = contextWithLogger(ctx, loggerFromContext(ctx).With("notification_type", "domain_breach"))
+
+	for alias, breachNames := range aliases {
+		var newBreaches []PwnInfo
+
+		for _, breachName := range breachNames {
+			if !containsFold(previousAliases[alias], breachName) {
+				newBreaches = append(newBreaches, cataloguedBreach(breachName))
+			}
+		}
+
+		if len(newBreaches) == 0 {
+			continue
+		}
+
+		// Aliases which are subscribed are notified with their own settings, like any other subscriber
+		subscriber := subscriberForEmail(alias + "@" + domain)
+
+		if err = notifySubscriberOfBreaches(ctx, subscriber, newBreaches); err != nil {
+			loggerFromContext(ctx).Error("could not notify breached alias", "email", subscriber.Email, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// cataloguedBreach is the breach with the name from the breach catalogue, with just
+// its name as its title when the breach isn't catalogued (or there is no catalogue)
+func cataloguedBreach(name string) PwnInfo {
+	if breaches != nil {
+		if catalogued, err := breaches.get(name); err == nil {
+			return catalogued
+		}
+	}
+
+	return PwnInfo{Name: name, Title: name}
+}
+
+func (ds *domainStore) searchAll(ctx context.Context, client *http.Client) error {
+	ds.mu.Lock()
+
+	var verifiedDomains []string
+
+	for domain, registered := range ds.domains {
+		if registered.Verified {
+			verifiedDomains = append(verifiedDomains, domain)
+		}
+	}
+
+	ds.mu.Unlock()
+
+	var failed []string
+
+	for _, domain := range verifiedDomains {
+		if err := ds.search(ctx, domain, client); err != nil {
+			loggerFromContext(ctx).Error("could not search domain", "domain", domain, "error", err)
+
+			failed = append(failed, domain)
+		}
+	}
+
+	if len(failed) != 0 {
+		return fmt.Errorf("could not search: %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+func availableDomainStore(c *gin.Context) (*domainStore, bool) {
+	if domains == nil {
+		respondWithError(c, http.StatusServiceUnavailable, ErrDomainStoreUnopened)
+
+		return nil, false
+	}
+
+	return domains, true
+}
+
+// RegisterDomain registers a domain for domain-wide breach searches, responding with
+// the TXT record which needs to be added to the domain before it can be verified
+func RegisterDomain(c *gin.Context) {
+	store, ok := availableDomainStore(c)
+
+	if !ok {
+		return
+	}
+
+	domainRequest := struct {
+		Domain string `json:"domain"`
+	}{}
+
+	if err := json.NewDecoder(c.Request.Body).Decode(&domainRequest); err != nil || normalizeDomain(domainRequest.Domain) == "" {
+		respondWithError(c, http.StatusBadRequest, errors.New("a domain must be provided"))
+
+		return
+	}
+
+	registered, err := store.register(domainRequest.Domain)
+
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"error":      false,
+		"domain":     registered.Domain,
+		"verified":   registered.Verified,
+		"txt_record": domainVerificationPrefix + registered.VerificationToken,
+	})
+}
+
+// VerifyDomain checks the domain in the path for its verification TXT record
+func VerifyDomain(c *gin.Context) {
+	store, ok := availableDomainStore(c)
+
+	if !ok {
+		return
+	}
+
+	registered, err := store.verify(c.Request.Context(), c.Param("domain"))
+
+	switch err {
+	case nil:
+		c.JSON(http.StatusOK, gin.H{"error": false, "domain": registered.Domain, "verified": true})
+	case ErrDomainNotFound:
+		respondWithError(c, http.StatusNotFound, err)
+	default:
+		respondWithError(c, http.StatusUnprocessableEntity, err)
+	}
+}
+
+type breachedAliasReport struct {
+	Alias    string    `json:"alias"`
+	Email    string    `json:"email"`
+	Breaches []PwnInfo `json:"breaches"`
+}
+
+// DomainReport responds with every breached alias on the verified domain in the path and its
+// breaches, from the last search unless the refresh query parameter is true, refreshing only
+// reports the breached aliases and leaves the stored ones for the daily search to notify
+func DomainReport(c *gin.Context) {
+	store, ok := availableDomainStore(c)
+
+	if !ok {
+		return
+	}
+
+	domain := normalizeDomain(c.Param("domain"))
+
+	store.mu.Lock()
+	registered, exists := store.domains[domain]
+	store.mu.Unlock()
+
+	if !exists {
+		respondWithError(c, http.StatusNotFound, ErrDomainNotFound)
+
+		return
+	}
+
+	if !registered.Verified {
+		respondWithError(c, http.StatusForbidden, ErrDomainNotVerified)
+
+		return
+	}
+
+	var aliases map[string][]string
+	var err error
+
+	switch {
+	case c.Query("refresh") == "true":
+		if aliases, err = getBreachedDomainWithClient(c.Request.Context(), domain, http.DefaultClient); err != nil {
+			respondWithError(c, http.StatusBadGateway, err)
+
+			return
+		}
+
+		store.mu.Lock()
+		aliases = store.withoutErasedAliases(store.domains[domain], aliases)
+		store.mu.Unlock()
+
+		registered.LastSearched = time.Now().UTC()
+	case registered.LastSearched.IsZero():
+		// The first search of a domain only records its aliases, so it doesn't notify them
+		if err = store.search(c.Request.Context(), domain, http.DefaultClient); err != nil {
+			respondWithError(c, http.StatusBadGateway, err)
+
+			return
+		}
+
+		fallthrough
+	default:
+		store.mu.Lock()
+		registered = store.domains[domain]
+		aliases, err = store.breachedAliases(registered)
+		store.mu.Unlock()
+
+		if err != nil {
+			respondWithError(c, http.StatusInternalServerError, err)
+
+			return
+		}
+	}
+
+	report := make([]breachedAliasReport, 0, len(aliases))
+
+	for alias, breachNames := range aliases {
+		aliasReport := breachedAliasReport{Alias: alias, Email: alias + "@" + domain}
+
+		for _, breachName := range breachNames {
+			aliasReport.Breaches = append(aliasReport.Breaches, cataloguedBreach(breachName))
+		}
+
+		report = append(report, aliasReport)
+	}
+
+	sort.Slice(report, func(i, j int) bool { return report[i].Alias < report[j].Alias })
+
+	c.JSON(http.StatusOK, gin.H{"error": false, "domain": domain, "last_searched": registered.LastSearched, "aliases": report})
+}
@@ -0,0 +1,245 @@
+package functionality
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newTestDomainStore(t *testing.T) (*domainStore, func()) {
+	tempDirectory, err := ioutil.TempDir("", "domains")
+
+	if err != nil {
+		t.Fatal("could not create the temporary data directory")
+	}
+
+	key := newTestKey(t)
+	store, err := openDomainStore(filepath.Join(tempDirectory, "domains.json"), newTestKeyring(t, "1", map[string]string{"1": key}, newTestKey(t)))
+
+	if err != nil {
+		t.Fatalf("openDomainStore() = %v; expected: <nil>", err)
+	}
+
+	return store, func() { os.RemoveAll(tempDirectory) }
+}
+
+// Need to test the following:
+// A domain is only verified once its TXT record has the verification token
+// A domain which hasn't been registered can't be verified
+// Registering a domain again keeps its verification token
+func TestDomainVerification(t *testing.T) {
+	store, cleanup := newTestDomainStore(t)
+
+	defer cleanup()
+
+	txtRecords := map[string][]string{}
+
+	originalLookupTXT := lookupTXT
+	lookupTXT = func(ctx context.Context, domain string) ([]string, error) {
+		return txtRecords[domain], nil
+	}
+
+	defer func() { lookupTXT = originalLookupTXT }()
+
+	registered, err := store.register("Example.com.")
+
+	if err != nil || registered.Domain != "example.com" || registered.Verified {
+		t.Fatalf("domainStore.register() = %+v, %v; expected: an unverified example.com", registered, err)
+	}
+
+	if _, err = store.verify(context.Background(), "example.com"); err != ErrDomainVerification {
+		t.Errorf("domainStore.verify() without the TXT record = %v; expected: %v", err, ErrDomainVerification)
+	}
+
+	txtRecords["example.com"] = []string{"v=spf1 -all", domainVerificationPrefix + registered.VerificationToken}
+
+	if verified, err := store.verify(context.Background(), "example.com"); err != nil || !verified.Verified {
+		t.Errorf("domainStore.verify() with the TXT record = %+v, %v; expected: a verified domain", verified, err)
+	}
+
+	if _, err = store.verify(context.Background(), "example.org"); err != ErrDomainNotFound {
+		t.Errorf("domainStore.verify() of an unregistered domain = %v; expected: %v", err, ErrDomainNotFound)
+	}
+
+	if reregistered, _ := store.register("example.com"); reregistered.VerificationToken != registered.VerificationToken || !reregistered.Verified {
+		t.Errorf("domainStore.register() again = %+v; expected: the verified registration", reregistered)
+	}
+}
+
+// Need to test the following:
+// Searching a domain stores its breached aliases encrypted
+// A domain HIBP has no breaches for is searched without an error
+// Aliases newly in a breach are notified of only the new breaches, like any other subscriber
+// Erasing an alias removes it from the stored aliases
+// Erased aliases aren't stored or notified by later searches
+func TestDomainSearch(t *testing.T) {
+	store, cleanup := newTestDomainStore(t)
+
+	defer cleanup()
+
+	hibpDomains := map[string]map[string][]string{
+		"example.com": {"alice": {"Adobe"}, "bob": {"Adobe", "LinkedIn"}},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		aliases, exists := hibpDomains[filepath.Base(r.URL.Path)]
+
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		json.NewEncoder(w).Encode(aliases)
+	}))
+
+	defer server.Close()
+
+	originalBaseURL := hibpBaseURL
+	hibpBaseURL = server.URL
+
+	defer func() { hibpBaseURL = originalBaseURL }()
+
+	for _, domain := range []string{"example.com", "example.org"} {
+		store.domains[domain] = monitoredDomain{Domain: domain, Verified: true}
+	}
+
+	if err := store.searchAll(context.Background(), server.Client()); err != nil {
+		t.Fatalf("domainStore.searchAll() = %v; expected: <nil>", err)
+	}
+
+	if alias, breachNames, err := store.aliasBreaches("Bob@example.com"); err != nil || alias != "bob" || !equalStrings(breachNames, []string{"Adobe", "LinkedIn"}) {
+		t.Errorf("domainStore.aliasBreaches() = %s, %v, %v; expected: bob, [Adobe LinkedIn], <nil>", alias, breachNames, err)
+	}
+
+	sent, restore := useRecordingNotifiers("", channelEmail)
+
+	defer restore()
+
+	hibpDomains["example.com"]["alice"] = []string{"Adobe", "LinkedIn"}
+
+	if err := store.search(context.Background(), "example.com", server.Client()); err != nil {
+		t.Fatalf("domainStore.search() = %v; expected: <nil>", err)
+	}
+
+	if notifications := sent(); len(notifications) != 1 || notifications[0].To != "alice@example.com" || len(notifications[0].Breaches) != 1 || notifications[0].Breaches[0].Name != "LinkedIn" {
+		t.Errorf("notifications after alice was found in LinkedIn = %+v; expected: alice notified of only LinkedIn", notifications)
+	}
+
+	if erased, err := store.eraseAlias("bob@example.com"); err != nil || !erased {
+		t.Errorf("domainStore.eraseAlias() = %t, %v; expected: true, <nil>", erased, err)
+	}
+
+	if _, breachNames, err := store.aliasBreaches("bob@example.com"); err != nil || breachNames != nil {
+		t.Errorf("domainStore.aliasBreaches() after erasure = %v, %v; expected: [], <nil>", breachNames, err)
+	}
+
+	hibpDomains["example.com"]["bob"] = []string{"Adobe", "LinkedIn", "Dropbox"}
+
+	if err := store.search(context.Background(), "example.com", server.Client()); err != nil {
+		t.Fatalf("domainStore.search() after erasure = %v; expected: <nil>", err)
+	}
+
+	if notifications := sent(); len(notifications) != 1 {
+		t.Errorf("notifications after the erased bob was found in Dropbox = %+v; expected: bob not to be notified", notifications[1:])
+	}
+
+	if _, breachNames, err := store.aliasBreaches("bob@example.com"); err != nil || breachNames != nil {
+		t.Errorf("domainStore.aliasBreaches() after searching again = %v, %v; expected: [], <nil>", breachNames, err)
+	}
+
+	if store.domains["example.org"].LastSearched.IsZero() {
+		t.Error("example.org was not searched; expected: it to be searched without any breached aliases")
+	}
+}
+
+// Need to test the following:
+// The report lists every breached alias with the catalogued details of its breaches
+// Domains which haven't been verified have no report
+// Refreshing the report neither notifies nor stores the breached aliases
+func TestDomainReport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	store, cleanup := newTestDomainStore(t)
+
+	defer cleanup()
+
+	searched := monitoredDomain{Domain: "example.com", Verified: true, LastSearched: time.Now()}
+
+	if err := store.setBreachedAliases(searched, map[string][]string{"bob": {"Adobe"}, "alice": {"Unknown"}}); err != nil {
+		t.Fatalf("domainStore.setBreachedAliases() = %v; expected: <nil>", err)
+	}
+
+	store.domains["example.org"] = monitoredDomain{Domain: "example.org"}
+
+	domains = store
+	breaches = &breachCatalogue{Breaches: map[string]PwnInfo{"Adobe": {Name: "Adobe", Title: "Adobe"}}}
+
+	defer func() { domains, breaches = nil, nil }()
+
+	router := gin.New()
+	router.GET("/domains/:domain/report", DomainReport)
+
+	mockResponseWriter := httptest.NewRecorder()
+
+	router.ServeHTTP(mockResponseWriter, httptest.NewRequest(http.MethodGet, "/domains/example.com/report", nil))
+
+	report := struct {
+		Aliases []breachedAliasReport `json:"aliases"`
+	}{}
+
+	if err := json.Unmarshal(mockResponseWriter.Body.Bytes(), &report); err != nil || mockResponseWriter.Code != http.StatusOK {
+		t.Fatalf("GET /domains/example.com/report = HTTP/%d, %v; expected: HTTP/200", mockResponseWriter.Code, err)
+	}
+
+	if len(report.Aliases) != 2 || report.Aliases[0].Email != "alice@example.com" || report.Aliases[0].Breaches[0].Name != "Unknown" || report.Aliases[1].Breaches[0].Title != "Adobe" {
+		t.Errorf("GET /domains/example.com/report = %+v; expected: alice in Unknown and bob in the catalogued Adobe", report.Aliases)
+	}
+
+	mockResponseWriter = httptest.NewRecorder()
+
+	router.ServeHTTP(mockResponseWriter, httptest.NewRequest(http.MethodGet, "/domains/example.org/report", nil))
+
+	if mockResponseWriter.Code != http.StatusForbidden {
+		t.Errorf("GET /domains/example.org/report = HTTP/%d; expected: HTTP/%d", mockResponseWriter.Code, http.StatusForbidden)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]string{"bob": {"Adobe", "LinkedIn"}, "alice": {"Unknown"}})
+	}))
+
+	defer server.Close()
+
+	originalBaseURL := hibpBaseURL
+	hibpBaseURL = server.URL
+
+	defer func() { hibpBaseURL = originalBaseURL }()
+
+	sent, restore := useRecordingNotifiers("", channelEmail)
+
+	defer restore()
+
+	mockResponseWriter = httptest.NewRecorder()
+
+	router.ServeHTTP(mockResponseWriter, httptest.NewRequest(http.MethodGet, "/domains/example.com/report?refresh=true", nil))
+
+	if err := json.Unmarshal(mockResponseWriter.Body.Bytes(), &report); err != nil || len(report.Aliases) != 2 || len(report.Aliases[1].Breaches) != 2 {
+		t.Errorf("GET /domains/example.com/report?refresh=true = %+v, %v; expected: bob in Adobe and LinkedIn", report.Aliases, err)
+	}
+
+	if notifications := sent(); len(notifications) != 0 {
+		t.Errorf("notifications after refreshing the report = %+v; expected: none", notifications)
+	}
+
+	if _, breachNames, err := store.aliasBreaches("bob@example.com"); err != nil || !equalStrings(breachNames, []string{"Adobe"}) {
+		t.Errorf("domainStore.aliasBreaches() after refreshing the report = %v, %v; expected: [Adobe], <nil>", breachNames, err)
+	}
+}
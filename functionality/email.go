@@ -0,0 +1,426 @@
+package functionality
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	mailgun "github.com/mailgun/mailgun-go/v3"
+)
+
+// The email backends which can be listed in the emailBackend environment variable
+const (
+	emailBackendMailgun = "mailgun"
+	emailBackendSMTP    = "smtp"
+	emailBackendSES     = "ses"
+)
+
+const (
+	defaultEmailFrom = "robot@mail.therileyjohnson.com"
+
+	smtpTimeout     = 30 * time.Second
+	smtpIdleTimeout = time.Minute
+	smtpPoolSize    = 2
+)
+
+// emailMessage is a plain text email, sent from the backend's from address when From is empty,
+// Tags label the email for the providers which support them, like Mailgun
+type emailMessage struct {
+	From    string
+	To      string
+	Subject string
+	Body    string
+	Tags    []string
+}
+
+// emailSender sends email through a provider
+type emailSender interface {
+	sendEmail(ctx context.Context, message emailMessage) error
+}
+
+// smtpInfo is the SMTP secret file, TLS is "starttls" (the default), "implicit" or "none",
+// Auth is "plain" (the default when there is a username) or "login"
+type smtpInfo struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+	TLS      string `json:"tls"`
+	From     string `json:"from"`
+	PoolSize int    `json:"pool_size"`
+}
+
+var (
+	mailgunEmail emailSender
+	smtpEmail    *smtpSender
+)
+
+func init() {
+	loadSecretFile("smtpFile", InitializeSMTPWithJSON)
+}
+
+// InitializeSMTPWithJSON is used for initializing the SMTP email backend for the package
+func InitializeSMTPWithJSON(reader io.Reader) error {
+	var smtpJSON smtpInfo
+
+	if err := json.NewDecoder(reader).Decode(&smtpJSON); err != nil {
+		return err
+	}
+
+	sender, err := newSMTPSender(smtpJSON)
+
+	if err != nil {
+		return err
+	}
+
+	smtpEmail = sender
+
+	return nil
+}
+
+// mailgunClient is the part of the Mailgun SDK that email is sent through
+type mailgunClient interface {
+	NewMessage(from, subject, text string, to ...string) *mailgun.Message
+	Send(ctx context.Context, message *mailgun.Message) (string, string, error)
+}
+
+type mailgunSender struct {
+	client mailgunClient
+}
+
+func newMailgunSender(domain, apiKey string) mailgunSender {
+	return mailgunSender{client: mailgun.NewMailgun(domain, apiKey)}
+}
+
+func (ms mailgunSender) sendEmail(ctx context.Context, message emailMessage) error {
+	if message.From == "" {
+		message.From = defaultEmailFrom
+	}
+
+	mailgunMessage := ms.client.NewMessage(message.From, message.Subject, message.Body, message.To)
+
+	if len(message.Tags) > 0 {
+		if err := mailgunMessage.AddTag(message.Tags...); err != nil {
+			return err
+		}
+	}
+
+	_, _, err := ms.client.Send(ctx, mailgunMessage)
+
+	return err
+}
+
+// smtpSender sends email through an SMTP server, keeping up to poolSize
+// connections open between messages rather than dialing for every one
+type smtpSender struct {
+	config smtpInfo
+	idle   chan *smtpConnection
+
+	// rootCAs are the CAs the server's certificate is checked against, the system's when nil
+	rootCAs *x509.CertPool
+}
+
+// smtpConnection is a connection to the SMTP server, conn is kept to set deadlines on
+type smtpConnection struct {
+	client   *smtp.Client
+	conn     net.Conn
+	lastUsed time.Time
+}
+
+// setDeadline limits how long the next exchange with the server can take
+func (sc *smtpConnection) setDeadline(ctx context.Context) {
+	deadline := time.Now().Add(smtpTimeout)
+
+	if ctxDeadline, exists := ctx.Deadline(); exists && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	sc.conn.SetDeadline(deadline)
+}
+
+func newSMTPSender(config smtpInfo) (*smtpSender, error) {
+	if config.Host == "" {
+		return nil, errors.New("the SMTP server needs a host")
+	}
+
+	config.TLS = strings.ToLower(config.TLS)
+	config.Auth = strings.ToLower(config.Auth)
+
+	switch config.TLS {
+	case "":
+		config.TLS = "starttls"
+	case "starttls", "implicit", "none":
+	default:
+		return nil, fmt.Errorf("unknown SMTP TLS mode %q", config.TLS)
+	}
+
+	switch config.Auth {
+	case "":
+		if config.Username != "" {
+			config.Auth = "plain"
+		}
+	case "plain", "login":
+	default:
+		return nil, fmt.Errorf("unknown SMTP auth mechanism %q", config.Auth)
+	}
+
+	if config.Port == 0 {
+		config.Port = 587
+
+		if config.TLS == "implicit" {
+			config.Port = 465
+		}
+	}
+
+	if config.From == "" {
+		config.From = defaultEmailFrom
+	}
+
+	if config.PoolSize <= 0 {
+		config.PoolSize = smtpPoolSize
+	}
+
+	return &smtpSender{config: config, idle: make(chan *smtpConnection, config.PoolSize)}, nil
+}
+
+func (ss *smtpSender) tlsConfig() *tls.Config {
+	return &tls.Config{ServerName: ss.config.Host, RootCAs: ss.rootCAs, MinVersion: tls.VersionTLS12}
+}
+
+// dial connects and authenticates to the SMTP server
+func (ss *smtpSender) dial(ctx context.Context) (*smtpConnection, error) {
+	address := net.JoinHostPort(ss.config.Host, strconv.Itoa(ss.config.Port))
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ss.config.TLS == "implicit" {
+		conn = tls.Client(conn, ss.tlsConfig())
+	}
+
+	connection := &smtpConnection{conn: conn}
+	connection.setDeadline(ctx)
+
+	client, err := smtp.NewClient(conn, ss.config.Host)
+
+	if err != nil {
+		conn.Close()
+
+		return nil, err
+	}
+
+	if ss.config.TLS == "starttls" {
+		if err = client.StartTLS(ss.tlsConfig()); err != nil {
+			client.Close()
+
+			return nil, err
+		}
+	}
+
+	if ss.config.Auth != "" {
+		var auth smtp.Auth
+
+		if ss.config.Auth == "login" {
+			auth = &loginAuth{host: ss.config.Host, username: ss.config.Username, password: ss.config.Password}
+		} else {
+			auth = smtp.PlainAuth("", ss.config.Username, ss.config.Password, ss.config.Host)
+		}
+
+		if err = client.Auth(auth); err != nil {
+			client.Close()
+
+			return nil, err
+		}
+	}
+
+	connection.client = client
+
+	return connection, nil
+}
+
+// get takes an idle connection which is still alive, or dials a new one when there isn't one
+func (ss *smtpSender) get(ctx context.Context) (*smtpConnection, error) {
+	for {
+		select {
+		case connection := <-ss.idle:
+			connection.setDeadline(ctx)
+
+			if time.Since(connection.lastUsed) < smtpIdleTimeout && connection.client.Noop() == nil {
+				return connection, nil
+			}
+
+			connection.client.Close()
+		default:
+			return ss.dial(ctx)
+		}
+	}
+}
+
+// put returns the connection to the pool, or closes it when the pool is full
+func (ss *smtpSender) put(connection *smtpConnection) {
+	if connection.client.Reset() != nil {
+		connection.client.Close()
+
+		return
+	}
+
+	connection.lastUsed = time.Now()
+
+	select {
+	case ss.idle <- connection:
+	default:
+		connection.client.Quit()
+	}
+}
+
+func (ss *smtpSender) sendEmail(ctx context.Context, message emailMessage) error {
+	if message.From == "" {
+		message.From = ss.config.From
+	}
+
+	to, err := mail.ParseAddress(message.To)
+
+	if err != nil {
+		return err
+	}
+
+	from, err := mail.ParseAddress(message.From)
+
+	if err != nil {
+		return err
+	}
+
+	data, err := formatEmail(message, from, to)
+
+	if err != nil {
+		return err
+	}
+
+	connection, err := ss.get(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if err = ss.transmit(connection.client, from.Address, to.Address, data); err != nil {
+		// The connection may be part way through a command, so it can't be reused
+		connection.client.Close()
+
+		return err
+	}
+
+	ss.put(connection)
+
+	return nil
+}
+
+func (ss *smtpSender) transmit(client *smtp.Client, from, to string, data []byte) error {
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+
+	writer, err := client.Data()
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = writer.Write(data); err != nil {
+		writer.Close()
+
+		return err
+	}
+
+	return writer.Close()
+}
+
+// formatEmail renders the message with its headers, the body quoted-printable so any line length and charset is safe
+func formatEmail(message emailMessage, from, to *mail.Address) ([]byte, error) {
+	var data bytes.Buffer
+
+	fromDomain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+
+	headers := [][2]string{
+		{"From", from.String()},
+		{"To", to.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", message.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", "<" + newID() + newID() + "@" + fromDomain + ">"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+
+	for _, header := range headers {
+		fmt.Fprintf(&data, "%s: %s\r\n", header[0], header[1])
+	}
+
+	data.WriteString("\r\n")
+
+	body := quotedprintable.NewWriter(&data)
+
+	if _, err := body.Write([]byte(strings.Replace(message.Body, "\n", "\r\n", -1))); err != nil {
+		return nil, err
+	}
+
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+
+	return data.Bytes(), nil
+}
+
+// loginAuth is the LOGIN mechanism, which net/smtp doesn't have, for servers without PLAIN
+type loginAuth struct {
+	host, username, password string
+}
+
+func (la *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	// Like PlainAuth, the password is only sent over TLS or to the local machine
+	if !server.TLS && server.Name != "localhost" && server.Name != "127.0.0.1" && server.Name != "::1" {
+		return "", nil, errors.New("the SMTP connection is unencrypted")
+	}
+
+	if server.Name != la.host {
+		return "", nil, errors.New("the SMTP server's name is not the configured host")
+	}
+
+	return "LOGIN", nil, nil
+}
+
+func (la *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(la.username), nil
+	case "password:":
+		return []byte(la.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected SMTP LOGIN challenge %q", fromServer)
+	}
+}
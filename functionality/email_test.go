@@ -0,0 +1,291 @@
+package functionality
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// smtpSink is a local SMTP server which accepts every message from the client with its credentials
+type smtpSink struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	implicit  bool
+	username  string
+	password  string
+
+	mu          sync.Mutex
+	connections int
+	messages    []string
+}
+
+// newSMTPSink starts a sink, with the test certificate for STARTTLS or implicit TLS
+// when tlsMode is either, returning the CAs which trust the certificate
+func newSMTPSink(t *testing.T, tlsMode, username, password string) (*smtpSink, *x509.CertPool) {
+	certificateServer := httptest.NewTLSServer(http.NotFoundHandler())
+	certificateServer.Close()
+
+	tlsConfig := &tls.Config{Certificates: certificateServer.TLS.Certificates}
+	rootCAs := certificateServer.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("could not listen for SMTP: %v", err)
+	}
+
+	sink := &smtpSink{listener: listener, username: username, password: password}
+
+	switch tlsMode {
+	case "implicit":
+		sink.listener, sink.implicit = tls.NewListener(listener, tlsConfig), true
+	case "starttls":
+		sink.tlsConfig = tlsConfig
+	}
+
+	go sink.serve()
+
+	return sink, rootCAs
+}
+
+func (sink *smtpSink) port() int {
+	return sink.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (sink *smtpSink) serve() {
+	for {
+		conn, err := sink.listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		sink.mu.Lock()
+		sink.connections++
+		sink.mu.Unlock()
+
+		go sink.handle(conn)
+	}
+}
+
+func (sink *smtpSink) handle(conn net.Conn) {
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	isTLS := sink.implicit
+	authenticated := sink.username == ""
+
+	text.PrintfLine("220 localhost ESMTP sink")
+
+	for {
+		line, err := text.ReadLine()
+
+		if err != nil {
+			return
+		}
+
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch {
+		case command == "EHLO":
+			extensions := []string{"250-localhost", "250-AUTH PLAIN LOGIN"}
+
+			if sink.tlsConfig != nil && !isTLS {
+				extensions = append(extensions, "250-STARTTLS")
+			}
+
+			for _, extension := range extensions {
+				text.PrintfLine("%s", extension)
+			}
+
+			text.PrintfLine("250 8BITMIME")
+		case command == "STARTTLS":
+			text.PrintfLine("220 ready to start TLS")
+
+			conn = tls.Server(conn, sink.tlsConfig)
+			text = textproto.NewConn(conn)
+			isTLS = true
+		case strings.HasPrefix(strings.ToUpper(line), "AUTH PLAIN "):
+			credentials, _ := base64.StdEncoding.DecodeString(line[len("AUTH PLAIN "):])
+			authenticated = string(credentials) == "\x00"+sink.username+"\x00"+sink.password
+
+			sink.replyToAuth(text, authenticated)
+		case strings.ToUpper(line) == "AUTH LOGIN":
+			text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Username:")))
+			username, _ := text.ReadLine()
+			text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte("Password:")))
+			password, _ := text.ReadLine()
+
+			decodedUsername, _ := base64.StdEncoding.DecodeString(username)
+			decodedPassword, _ := base64.StdEncoding.DecodeString(password)
+			authenticated = string(decodedUsername) == sink.username && string(decodedPassword) == sink.password
+
+			sink.replyToAuth(text, authenticated)
+		case command == "MAIL" && !authenticated:
+			text.PrintfLine("530 authentication required")
+		case command == "MAIL", command == "RCPT", command == "RSET", command == "NOOP":
+			text.PrintfLine("250 OK")
+		case command == "DATA":
+			text.PrintfLine("354 go ahead")
+
+			message, err := ioutil.ReadAll(text.DotReader())
+
+			if err != nil {
+				return
+			}
+
+			sink.mu.Lock()
+			sink.messages = append(sink.messages, string(message))
+			sink.mu.Unlock()
+
+			text.PrintfLine("250 queued")
+		case command == "QUIT":
+			text.PrintfLine("221 bye")
+
+			return
+		default:
+			text.PrintfLine("502 unrecognised command")
+		}
+	}
+}
+
+func (sink *smtpSink) replyToAuth(text *textproto.Conn, authenticated bool) {
+	if authenticated {
+		text.PrintfLine("235 authenticated")
+	} else {
+		text.PrintfLine("535 bad credentials")
+	}
+}
+
+// Need to test the following:
+// Messages are sent over plain connections, STARTTLS and implicit TLS, with PLAIN and LOGIN auth
+// Connections are reused between messages
+// The message has the subject, sender and recipient, with the body intact
+// Bad credentials are an error
+func TestSMTPSender(t *testing.T) {
+	tests := []struct {
+		TLS      string
+		Auth     string
+		Password string
+		ExpectOK bool
+	}{
+		{TLS: "none", Auth: "plain", Password: "hunter2", ExpectOK: true},
+		{TLS: "starttls", Auth: "login", Password: "hunter2", ExpectOK: true},
+		{TLS: "implicit", Auth: "plain", Password: "hunter2", ExpectOK: true},
+		{TLS: "starttls", Auth: "plain", Password: "wrong", ExpectOK: false},
+	}
+
+	for _, test := range tests {
+		sink, rootCAs := newSMTPSink(t, test.TLS, "robot", "hunter2")
+
+		sender, err := newSMTPSender(smtpInfo{Host: "127.0.0.1", Port: sink.port(), Username: "robot", Password: test.Password, Auth: test.Auth, TLS: test.TLS, From: "Pwned API <robot@pwned.example.com>"})
+
+		if err != nil {
+			t.Fatalf("newSMTPSender() = %v; expected: <nil>", err)
+		}
+
+		sender.rootCAs = rootCAs
+
+		for _, subject := range []string{"You've been pwned", "Du wurdest gepwnt – schon wieder"} {
+			err = sender.sendEmail(context.Background(), emailMessage{To: "someone@example.com", Subject: subject, Body: "Adobe\n" + strings.Repeat("Passwords ", 20)})
+
+			if (err == nil) != test.ExpectOK {
+				t.Fatalf("smtpSender.sendEmail() over %s with %s = %v; expected success: %t", test.TLS, test.Auth, err, test.ExpectOK)
+			}
+		}
+
+		sink.listener.Close()
+
+		if !test.ExpectOK {
+			continue
+		}
+
+		if sink.connections != 1 || len(sink.messages) != 2 {
+			t.Errorf("smtp sink over %s = %d connections, %d messages; expected: 1 connection, 2 messages", test.TLS, sink.connections, len(sink.messages))
+
+			continue
+		}
+
+		message, err := mail.ReadMessage(strings.NewReader(sink.messages[1]))
+
+		if err != nil {
+			t.Fatalf("could not parse the sent message: %v", err)
+		}
+
+		subject, _ := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+		body, _ := ioutil.ReadAll(quotedprintable.NewReader(message.Body))
+
+		if subject != "Du wurdest gepwnt – schon wieder" || message.Header.Get("From") != `"Pwned API" <robot@pwned.example.com>` || message.Header.Get("To") != "<someone@example.com>" {
+			t.Errorf("sent message headers = %v; expected: the subject, sender and recipient", message.Header)
+		}
+
+		// The sink's dot reader has already turned the line endings back into \n
+		if strings.TrimSuffix(string(body), "\n") != "Adobe\n"+strings.Repeat("Passwords ", 20) {
+			t.Errorf("sent message body = %q; expected it intact", body)
+		}
+	}
+}
+
+// Need to test the following:
+// Line breaks in the subject can't add headers
+func TestFormatEmail(t *testing.T) {
+	from, to := &mail.Address{Address: "robot@pwned.example.com"}, &mail.Address{Address: "someone@example.com"}
+
+	data, err := formatEmail(emailMessage{Subject: "Pwned\r\nBcc: everyone@example.com", Body: "Adobe"}, from, to)
+
+	if err != nil {
+		t.Fatalf("formatEmail() = %v; expected: <nil>", err)
+	}
+
+	message, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(string(data))))
+
+	if err != nil || message.Header.Get("Bcc") != "" {
+		t.Errorf("formatEmail() with a line break in the subject = %q; expected: no Bcc header", data)
+	}
+}
+
+// Need to test the following:
+// The TLS mode, auth mechanism and port default sensibly
+// Unknown TLS modes and auth mechanisms are rejected
+func TestNewSMTPSender(t *testing.T) {
+	tests := []struct {
+		Config       smtpInfo
+		ExpectError  bool
+		ExpectedTLS  string
+		ExpectedAuth string
+		ExpectedPort int
+	}{
+		{Config: smtpInfo{Host: "smtp.example.com", Username: "robot"}, ExpectedTLS: "starttls", ExpectedAuth: "plain", ExpectedPort: 587},
+		{Config: smtpInfo{Host: "smtp.example.com", TLS: "IMPLICIT"}, ExpectedTLS: "implicit", ExpectedPort: 465},
+		{Config: smtpInfo{Host: "smtp.example.com", TLS: "ssl"}, ExpectError: true},
+		{Config: smtpInfo{Host: "smtp.example.com", Auth: "cram-md5"}, ExpectError: true},
+		{Config: smtpInfo{}, ExpectError: true},
+	}
+
+	for _, test := range tests {
+		sender, err := newSMTPSender(test.Config)
+
+		if (err != nil) != test.ExpectError {
+			t.Errorf("newSMTPSender(%+v) = %v; expected an error: %t", test.Config, err, test.ExpectError)
+
+			continue
+		}
+
+		if err == nil && (sender.config.TLS != test.ExpectedTLS || sender.config.Auth != test.ExpectedAuth || sender.config.Port != test.ExpectedPort) {
+			t.Errorf("newSMTPSender(%+v) = %+v; expected: %s, %s, %d", test.Config, sender.config, test.ExpectedTLS, test.ExpectedAuth, test.ExpectedPort)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package functionality
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The circuit breaker around each email provider opens after emailCircuitThreshold failures in a row,
+// skipping the provider for the cooldown, which doubles for every failed retry up to the maximum
+const (
+	emailCircuitThreshold   = 3
+	emailCircuitCooldown    = 30 * time.Second
+	emailCircuitMaxCooldown = 10 * time.Minute
+)
+
+var (
+	ErrNoEmailProviders   error = errors.New("no email provider is configured")
+	ErrEmailCircuitsOpen  error = errors.New("every email provider's circuit is open")
+	ErrEmailProvidersDown error = errors.New("every email provider failed")
+
+	// emailBackends are the email providers in the order they are tried, from the comma
+	// separated emailBackend environment variable, later ones are only used when earlier ones fail
+	emailBackends = []string{emailBackendMailgun}
+
+	emailCircuitsMutex sync.Mutex
+	emailCircuits      = map[string]*circuitBreaker{}
+)
+
+func init() {
+	backends, exists := os.LookupEnv("emailBackend")
+
+	if !exists {
+		return
+	}
+
+	emailBackends = nil
+
+	for _, backend := range strings.Split(backends, ",") {
+		if backend = strings.ToLower(strings.TrimSpace(backend)); backend != "" {
+			emailBackends = append(emailBackends, backend)
+		}
+	}
+}
+
+// emailSenderFor is the sender for the email backend, false when it isn't configured
+func emailSenderFor(backend string) (emailSender, bool, error) {
+	switch backend {
+	case emailBackendMailgun:
+		return mailgunEmail, mailgunEmail != nil, nil
+	case emailBackendSMTP:
+		return smtpEmail, smtpEmail != nil, nil
+	case emailBackendSES:
+		return sesEmail, sesEmail != nil, nil
+	default:
+		return nil, false, fmt.Errorf("unknown email backend %q", backend)
+	}
+}
+
+// circuitBreaker tracks the health of an email provider, skipping it while it is failing
+type circuitBreaker struct {
+	mu                  sync.Mutex
+	consecutiveFailures int
+	openUntil           time.Time
+}
+
+func emailCircuitFor(backend string) *circuitBreaker {
+	emailCircuitsMutex.Lock()
+
+	defer emailCircuitsMutex.Unlock()
+
+	circuit, exists := emailCircuits[backend]
+
+	if !exists {
+		circuit = &circuitBreaker{}
+		emailCircuits[backend] = circuit
+	}
+
+	return circuit
+}
+
+// allow is whether the provider can be tried, once the circuit's cooldown is over a single
+// attempt is let through (and the circuit held open for the others) to see if it has recovered
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	cb.mu.Lock()
+
+	defer cb.mu.Unlock()
+
+	if cb.consecutiveFailures < emailCircuitThreshold {
+		return true
+	}
+
+	if now.Before(cb.openUntil) {
+		return false
+	}
+
+	cb.openUntil = now.Add(emailCircuitCooldown)
+
+	return true
+}
+
+func (cb *circuitBreaker) isOpen(now time.Time) bool {
+	cb.mu.Lock()
+
+	defer cb.mu.Unlock()
+
+	return cb.consecutiveFailures >= emailCircuitThreshold && now.Before(cb.openUntil)
+}
+
+// record updates the circuit with the result of an attempt
+func (cb *circuitBreaker) record(now time.Time, err error) {
+	cb.mu.Lock()
+
+	defer cb.mu.Unlock()
+
+	if err == nil {
+		cb.consecutiveFailures = 0
+		cb.openUntil = time.Time{}
+
+		return
+	}
+
+	cb.consecutiveFailures++
+
+	if cb.consecutiveFailures < emailCircuitThreshold {
+		return
+	}
+
+	cooldown := emailCircuitCooldown
+
+	for retries := cb.consecutiveFailures - emailCircuitThreshold; retries > 0 && cooldown < emailCircuitMaxCooldown; retries-- {
+		cooldown *= 2
+	}
+
+	if cooldown > emailCircuitMaxCooldown {
+		cooldown = emailCircuitMaxCooldown
+	}
+
+	cb.openUntil = now.Add(cooldown)
+}
+
+// sendEmailWithFailover tries each configured email provider in order until one sends the
+// message, skipping those whose circuit is open, returning the provider which delivered it
+func sendEmailWithFailover(ctx context.Context, message emailMessage, now time.Time) (string, error) {
+	// A bad address would fail on every provider, so it isn't allowed to open their circuits
+	if _, err := mail.ParseAddress(message.To); err != nil {
+		return "", err
+	}
+
+	var (
+		configured int
+		failures   []string
+	)
+
+	for _, backend := range emailBackends {
+		sender, isConfigured, err := emailSenderFor(backend)
+
+		if err != nil || !isConfigured {
+			continue
+		}
+
+		configured++
+
+		circuit := emailCircuitFor(backend)
+
+		if !circuit.allow(now) {
+			emailProviderSends.WithLabelValues(backend, "skipped").Inc()
+
+			continue
+		}
+
+		err = sender.sendEmail(ctx, message)
+
+		// A send which was cancelled, or timed out, says nothing about the provider's health
+		if err != nil && ctx.Err() != nil {
+			emailProviderSends.WithLabelValues(backend, "failed").Inc()
+
+			return "", err
+		}
+
+		circuit.record(now, err)
+		emailCircuitOpen.WithLabelValues(backend).Set(boolGauge(circuit.isOpen(now)))
+
+		if err == nil {
+			emailProviderSends.WithLabelValues(backend, "sent").Inc()
+
+			return backend, nil
+		}
+
+		emailProviderSends.WithLabelValues(backend, "failed").Inc()
+
+		loggerFromContext(ctx).Warn("email provider failed", "email_provider", backend, "error", err)
+
+		failures = append(failures, backend+": "+err.Error())
+	}
+
+	switch {
+	case configured == 0:
+		return "", ErrNoEmailProviders
+	case len(failures) == 0:
+		return "", ErrEmailCircuitsOpen
+	default:
+		return "", fmt.Errorf("%w: %s", ErrEmailProvidersDown, strings.Join(failures, "; "))
+	}
+}
+
+func boolGauge(value bool) float64 {
+	if value {
+		return 1
+	}
+
+	return 0
+}
+
+// checkEmailConfigured is ready when every email backend listed is known and one
+// of them is configured with its circuit closed
+func checkEmailConfigured() error {
+	now := time.Now()
+	usable := false
+
+	for _, backend := range emailBackends {
+		_, isConfigured, err := emailSenderFor(backend)
+
+		if err != nil {
+			return err
+		}
+
+		if isConfigured && !emailCircuitFor(backend).isOpen(now) {
+			usable = true
+		}
+	}
+
+	if !usable {
+		for _, backend := range emailBackends {
+			if _, isConfigured, _ := emailSenderFor(backend); isConfigured {
+				return ErrEmailCircuitsOpen
+			}
+		}
+
+		return ErrNoEmailProviders
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package functionality
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Need to test the following:
+// Email fails over to the next provider when the first fails, recording which delivered it
+// A provider's circuit opens after emailCircuitThreshold failures, skipping it until the cooldown is over
+// A provider which recovers is used again once its cooldown is over
+// Every provider failing, none being configured and bad addresses are errors
+// Sends which are cancelled aren't counted against the provider's circuit
+func TestSendEmailWithFailover(t *testing.T) {
+	sesStatusCode, sesRequests := http.StatusInternalServerError, 0
+
+	sesServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sesRequests++
+
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") {
+			t.Errorf("SES Authorization = %s; expected it to be signed", r.Header.Get("Authorization"))
+		}
+
+		w.WriteHeader(sesStatusCode)
+		w.Write([]byte(`{"message": "service unavailable"}`))
+	}))
+
+	defer sesServer.Close()
+
+	sink, _ := newSMTPSink(t, "none", "", "")
+
+	defer sink.listener.Close()
+
+	originalBackends, originalSES, originalSMTP, originalMailgun := emailBackends, sesEmail, smtpEmail, mailgunEmail
+
+	defer func() {
+		emailBackends, sesEmail, smtpEmail, mailgunEmail = originalBackends, originalSES, originalSMTP, originalMailgun
+		emailCircuits = map[string]*circuitBreaker{}
+	}()
+
+	emailBackends, emailCircuits, mailgunEmail = []string{emailBackendMailgun, emailBackendSES, emailBackendSMTP}, map[string]*circuitBreaker{}, nil
+	sesEmail, _ = newSESSender(sesInfo{Endpoint: sesServer.URL, Region: "us-east-1", AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"})
+	smtpEmail, _ = newSMTPSender(smtpInfo{Host: "127.0.0.1", Port: sink.port(), TLS: "none"})
+
+	message := emailMessage{To: "someone@example.com", Subject: "You've been pwned", Body: "Adobe"}
+	now := time.Now()
+
+	for i := 0; i <= emailCircuitThreshold; i++ {
+		provider, err := sendEmailWithFailover(context.Background(), message, now)
+
+		if provider != emailBackendSMTP || err != nil {
+			t.Fatalf("sendEmailWithFailover() with SES failing = %s, %v; expected: smtp, <nil>", provider, err)
+		}
+	}
+
+	if sesRequests != emailCircuitThreshold || len(sink.messages) != emailCircuitThreshold+1 {
+		t.Errorf("SES requests = %d, SMTP messages = %d; expected: SES skipped once its circuit opened", sesRequests, len(sink.messages))
+	}
+
+	sesStatusCode = http.StatusOK
+
+	if provider, err := sendEmailWithFailover(context.Background(), message, now.Add(emailCircuitCooldown)); provider != emailBackendSES || err != nil {
+		t.Errorf("sendEmailWithFailover() once SES recovered = %s, %v; expected: ses, <nil>", provider, err)
+	}
+
+	sesStatusCode = http.StatusInternalServerError
+	sink.listener.Close()
+	smtpEmail, _ = newSMTPSender(smtpInfo{Host: "127.0.0.1", Port: sink.port(), TLS: "none"})
+
+	if _, err := sendEmailWithFailover(context.Background(), message, now.Add(emailCircuitCooldown)); !errors.Is(err, ErrEmailProvidersDown) || !strings.Contains(err.Error(), "service unavailable") {
+		t.Errorf("sendEmailWithFailover() with every provider failing = %v; expected: %v with the errors", err, ErrEmailProvidersDown)
+	}
+
+	sesRequests = 0
+
+	if _, err := sendEmailWithFailover(context.Background(), emailMessage{To: "not an email"}, now); err == nil || sesRequests != 0 {
+		t.Errorf("sendEmailWithFailover() to a bad address = %v, %d SES requests; expected: an error without trying SES", err, sesRequests)
+	}
+
+	emailCircuits = map[string]*circuitBreaker{}
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+
+	cancel()
+
+	for i := 0; i <= emailCircuitThreshold; i++ {
+		if _, err := sendEmailWithFailover(cancelledCtx, message, now); !errors.Is(err, context.Canceled) {
+			t.Errorf("sendEmailWithFailover() once cancelled = %v; expected: %v", err, context.Canceled)
+		}
+	}
+
+	if circuit := emailCircuitFor(emailBackendSES); circuit.consecutiveFailures != 0 || !circuit.allow(now) {
+		t.Errorf("SES circuit after cancelled sends = %d failures; expected: none, with the circuit closed", circuit.consecutiveFailures)
+	}
+
+	sesEmail, smtpEmail = nil, nil
+
+	if _, err := sendEmailWithFailover(context.Background(), message, now); err != ErrNoEmailProviders {
+		t.Errorf("sendEmailWithFailover() with no providers = %v; expected: %v", err, ErrNoEmailProviders)
+	}
+}
+
+// Need to test the following:
+// The circuit stays closed until emailCircuitThreshold failures in a row
+// The cooldown doubles with every failed retry, up to emailCircuitMaxCooldown
+// Only one attempt is let through once the cooldown is over
+// A success closes the circuit
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	failure := errors.New("service unavailable")
+	circuit := &circuitBreaker{}
+
+	for i := 1; i < emailCircuitThreshold; i++ {
+		circuit.record(now, failure)
+	}
+
+	if !circuit.allow(now) {
+		t.Fatal("circuitBreaker.allow() below the threshold = false; expected: true")
+	}
+
+	circuit.record(now, failure)
+
+	if circuit.allow(now.Add(emailCircuitCooldown - time.Second)) {
+		t.Error("circuitBreaker.allow() during the cooldown = true; expected: false")
+	}
+
+	if !circuit.allow(now.Add(emailCircuitCooldown)) || circuit.allow(now.Add(emailCircuitCooldown)) {
+		t.Error("circuitBreaker.allow() after the cooldown = false, or true twice; expected: a single attempt")
+	}
+
+	retried := now.Add(emailCircuitCooldown)
+	circuit.record(retried, failure)
+
+	if circuit.allow(retried.Add(2*emailCircuitCooldown-time.Second)) || !circuit.allow(retried.Add(2*emailCircuitCooldown)) {
+		t.Error("circuitBreaker cooldown after a failed retry; expected it to double")
+	}
+
+	for i := 0; i < 20; i++ {
+		circuit.record(retried, failure)
+	}
+
+	if !circuit.allow(retried.Add(emailCircuitMaxCooldown)) {
+		t.Errorf("circuitBreaker.allow() after %s; expected the cooldown to be capped", emailCircuitMaxCooldown)
+	}
+
+	circuit.record(retried, nil)
+
+	if circuit.isOpen(retried) || !circuit.allow(retried) {
+		t.Error("circuitBreaker after a success = open; expected: closed")
+	}
+}
+
+// Need to test the following:
+// Requests are signed like the AWS Signature Version 4 test suite's example
+func TestSignAWSRequest(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+
+	signAWSRequest(request, nil, sesInfo{Region: "us-east-1", AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}, "iam", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+
+	if authorization := request.Header.Get("Authorization"); authorization != expected {
+		t.Errorf("signAWSRequest() Authorization = %s; expected: %s", authorization, expected)
+	}
+}
+
+// Need to test the following:
+// The message is sent to SES as a simple UTF-8 email
+func TestSESSender(t *testing.T) {
+	var body string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bodyBytes, _ := ioutil.ReadAll(r.Body)
+		body = r.URL.Path + " " + string(bodyBytes)
+
+		w.Write([]byte(`{"MessageId": "message"}`))
+	}))
+
+	defer server.Close()
+
+	sender, _ := newSESSender(sesInfo{Endpoint: server.URL + "/", Region: "eu-west-1", AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"})
+
+	if err := sender.sendEmail(context.Background(), emailMessage{To: "someone@example.com", Subject: "You've been pwned", Body: "Adobe"}); err != nil {
+		t.Fatalf("sesSender.sendEmail() = %v; expected: <nil>", err)
+	}
+
+	for _, expected := range []string{"/v2/email/outbound-emails ", `"ToAddresses":["someone@example.com"]`, `"FromEmailAddress":"` + defaultEmailFrom, `"Subject":{"Charset":"UTF-8","Data":"You've been pwned"}`} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("SES request = %s; expected it to contain %s", body, expected)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package functionality
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	ErrUnknownEncryptionKey = errors.New("the key the data was encrypted with is not in the keyring")
+	ErrMalformedCiphertext  = errors.New("the ciphertext is too short to have been produced by the keyring")
+)
+
+// keyringInfo is the format of the subscriber keys file, keys are base64 encoded
+// and 32 bytes long; old keys must be kept in the file until a rotation has
+// re-encrypted everything under the active key
+type keyringInfo struct {
+	ActiveKey string            `json:"active_key"`
+	Keys      map[string]string `json:"keys"`
+	IndexKey  string            `json:"index_key"`
+}
+
+// keyring does envelope encryption: every piece of data is encrypted with its
+// own data key, and that data key is encrypted (wrapped) with a key encryption key
+// from the keyring, so only the small wrapped keys depend on the keyring's keys
+type keyring struct {
+	activeKeyID string
+	keys        map[string][]byte
+	indexKey    []byte
+}
+
+// envelope is a piece of data encrypted with a data key, which is wrapped by the keyring key with KeyID
+type envelope struct {
+	KeyID      string `json:"key_id"`
+	WrappedKey []byte `json:"wrapped_key"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func loadKeyring(reader io.Reader) (*keyring, error) {
+	var keyringJSON keyringInfo
+
+	err := json.NewDecoder(reader).Decode(&keyringJSON)
+
+	if err != nil {
+		return nil, err
+	}
+
+	kr := &keyring{
+		activeKeyID: keyringJSON.ActiveKey,
+		keys:        make(map[string][]byte, len(keyringJSON.Keys)),
+	}
+
+	for keyID, encodedKey := range keyringJSON.Keys {
+		kr.keys[keyID], err = decodeKey(encodedKey)
+
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", keyID, err)
+		}
+	}
+
+	if _, exists := kr.keys[kr.activeKeyID]; !exists {
+		return nil, fmt.Errorf("the active key %q is not in the keyring", kr.activeKeyID)
+	}
+
+	kr.indexKey, err = decodeKey(keyringJSON.IndexKey)
+
+	if err != nil {
+		return nil, fmt.Errorf("index key: %v", err)
+	}
+
+	return kr, nil
+}
+
+func loadKeyringFromFile(fileLocation string) (*keyring, error) {
+	keyringFile, err := os.Open(fileLocation)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer keyringFile.Close()
+
+	return loadKeyring(keyringFile)
+}
+
+func decodeKey(encodedKey string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("keys must be 32 bytes, not %d", len(key))
+	}
+
+	return key, nil
+}
+
+func sealAESGCM(key, plaintext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openAESGCM(key, ciphertext, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, ErrMalformedCiphertext
+	}
+
+	return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], additionalData)
+}
+
+// encrypt seals the plaintext under a new data key wrapped with the active key, the
+// additional data (like the ID of the record the data belongs to) must match to decrypt
+func (kr *keyring) encrypt(plaintext, additionalData []byte) (envelope, error) {
+	dataKey := make([]byte, 32)
+
+	if _, err := rand.Read(dataKey); err != nil {
+		return envelope{}, err
+	}
+
+	ciphertext, err := sealAESGCM(dataKey, plaintext, additionalData)
+
+	if err != nil {
+		return envelope{}, err
+	}
+
+	wrappedKey, err := sealAESGCM(kr.keys[kr.activeKeyID], dataKey, []byte(kr.activeKeyID))
+
+	if err != nil {
+		return envelope{}, err
+	}
+
+	return envelope{KeyID: kr.activeKeyID, WrappedKey: wrappedKey, Ciphertext: ciphertext}, nil
+}
+
+func (kr *keyring) decrypt(e envelope, additionalData []byte) ([]byte, error) {
+	keyEncryptionKey, exists := kr.keys[e.KeyID]
+
+	if !exists {
+		return nil, ErrUnknownEncryptionKey
+	}
+
+	dataKey, err := openAESGCM(keyEncryptionKey, e.WrappedKey, []byte(e.KeyID))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return openAESGCM(dataKey, e.Ciphertext, additionalData)
+}
+
+// blindIndex is a keyed hash of the email which lets records be looked up by email
+// without storing the email in plaintext, or a hash of it anyone could brute force
+func (kr *keyring) blindIndex(email string) string {
+	mac := hmac.New(sha256.New, kr.indexKey)
+
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,84 @@
+package functionality
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func newTestKey(t *testing.T) string {
+	key := make([]byte, 32)
+
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal("could not generate a test key")
+	}
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func newTestKeyring(t *testing.T, activeKey string, keys map[string]string, indexKey string) *keyring {
+	keysJSON := make([]string, 0, len(keys))
+
+	for keyID, key := range keys {
+		keysJSON = append(keysJSON, fmt.Sprintf("%q: %q", keyID, key))
+	}
+
+	kr, err := loadKeyring(strings.NewReader(fmt.Sprintf(`{"active_key": %q, "keys": {%s}, "index_key": %q}`, activeKey, strings.Join(keysJSON, ", "), indexKey)))
+
+	if err != nil {
+		t.Fatalf("could not load the test keyring: %v", err)
+	}
+
+	return kr
+}
+
+// Need to test the following:
+// Encrypted data decrypts back to the plaintext with the same additional data
+// Encrypted data does not decrypt with different additional data
+// Data encrypted under an old key decrypts with a keyring where that key is no longer active
+// Data encrypted under a key which is not in the keyring returns ErrUnknownEncryptionKey
+func TestKeyringEncryptDecrypt(t *testing.T) {
+	oldKey, newKey, indexKey := newTestKey(t), newTestKey(t), newTestKey(t)
+
+	oldKeyring := newTestKeyring(t, "old", map[string]string{"old": oldKey}, indexKey)
+	rotatedKeyring := newTestKeyring(t, "new", map[string]string{"old": oldKey, "new": newKey}, indexKey)
+	newKeyring := newTestKeyring(t, "new", map[string]string{"new": newKey}, indexKey)
+
+	plaintext := []byte("someone@example.com")
+
+	e, err := oldKeyring.encrypt(plaintext, []byte("id/email"))
+
+	if err != nil {
+		t.Fatalf("keyring.encrypt(plaintext) = %v; expected: <nil>", err)
+	}
+
+	if bytes.Contains(e.Ciphertext, plaintext) {
+		t.Error("keyring.encrypt(plaintext) has the plaintext in its ciphertext")
+	}
+
+	tests := []struct {
+		Keyring        *keyring
+		AdditionalData string
+		ExpectError    bool
+	}{
+		{Keyring: oldKeyring, AdditionalData: "id/email"},
+		{Keyring: oldKeyring, AdditionalData: "other-id/email", ExpectError: true},
+		{Keyring: rotatedKeyring, AdditionalData: "id/email"},
+		{Keyring: newKeyring, AdditionalData: "id/email", ExpectError: true},
+	}
+
+	for _, test := range tests {
+		decrypted, err := test.Keyring.decrypt(e, []byte(test.AdditionalData))
+
+		if (err != nil) != test.ExpectError || (err == nil && !bytes.Equal(decrypted, plaintext)) {
+			t.Errorf("keyring.decrypt(envelope, %q) = %q, %v; expected an error: %t", test.AdditionalData, decrypted, err, test.ExpectError)
+		}
+	}
+
+	if _, err := newKeyring.decrypt(e, []byte("id/email")); err != ErrUnknownEncryptionKey {
+		t.Errorf("keyring.decrypt(envelope with an unknown key) = %v; expected: %v", err, ErrUnknownEncryptionKey)
+	}
+}
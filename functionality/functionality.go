@@ -10,11 +10,11 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 
-	mailgun "github.com/mailgun/mailgun-go/v3"
-
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type PwnInfo struct {
@@ -37,46 +37,63 @@ type PwnInfo struct {
 
 type mailgunInfo struct {
 	Domain        string `json:"domain"`
-	PrivateAPIKey string `json:"private_api_key`
-	PublicAPIKey  string `json:"public_api_key`
+	PrivateAPIKey string `json:"private_api_key"`
+}
+
+type hibpInfo struct {
+	APIKey string `json:"api_key"`
 }
 
 var (
-	ErrNoPwns error = errors.New("there is no pwnage for the email provided")
-	mg        mailgun.Mailgun
+	ErrNoPwns           error = errors.New("there is no pwnage for the email provided")
+	ErrSMSNotConfigured error = errors.New("no SMS provider is configured")
+	hibpAPIKey          string
+
+	// The base URLs of the HIBP APIs, which can be changed to point at a local stand-in
+	hibpBaseURL           = "https://haveibeenpwned.com/api/v3"
+	pwnedPasswordsBaseURL = "https://api.pwnedpasswords.com"
 )
 
 func init() {
-	fileLocation, exists := os.LookupEnv("mailgunFile")
+	loadSecretFile("mailgunFile", InitializeMailgunWithJSON)
+	loadSecretFile("hibpFile", InitializeHIBPWithJSON)
 
-	var (
-		err         error
-		mailgunFile *os.File
-		mailgunJSON mailgunInfo
-	)
+	if baseURL, exists := os.LookupEnv("hibpBaseURL"); exists {
+		hibpBaseURL = strings.TrimSuffix(baseURL, "/")
+	}
 
-	if exists {
-		mailgunFile, err = os.Open(fileLocation)
-	} else {
-		mailgunFile, err = os.Open(fileLocation)
+	if baseURL, exists := os.LookupEnv("pwnedPasswordsBaseURL"); exists {
+		pwnedPasswordsBaseURL = strings.TrimSuffix(baseURL, "/")
 	}
+}
 
-	json.NewDecoder(mailgunFile).Decode(&mailgunJSON)
+// loadSecretFile initializes part of the package with the secret file at the location
+// in the provided environment variable, the file is removed once it has been read;
+// a secret which cannot be loaded is left unset and reported by Readiness
+func loadSecretFile(envName string, initialize func(io.Reader) error) {
+	fileLocation, exists := os.LookupEnv(envName)
 
-	if exists {
-		err = os.Remove(fileLocation)
+	if !exists {
+		return
+	}
 
-		if err != nil {
-			panic(err)
-		}
+	secretFile, err := os.Open(fileLocation)
+
+	if err == nil {
+		err = initialize(secretFile)
+
+		secretFile.Close()
 	}
 
-	mg := mailgun.NewMailgun(mailgunJSON.Domain, mailgunJSON.PrivateAPIKey, mailgunJSON.PublicAPIKey)
-}
+	if err != nil {
+		logger.Error("could not load secret file", "env", envName, "error", err)
+	}
+
+	err = os.Remove(fileLocation)
 
-// InitializeMailgunWithMailgun is used for mocking the mailgun client during tests
-func InitializeMailgunWithMailgun(nmg mailgun.Mailgun) {
-	mg = nmg
+	if err != nil && !os.IsNotExist(err) {
+		panic(err)
+	}
 }
 
 // InitializeMailgunWithJSON is used for initializing the mailgun client for the package
@@ -89,17 +106,65 @@ func InitializeMailgunWithJSON(reader io.Reader) error {
 		return err
 	}
 
-	mg = mailgun.NewMailgun(mailgunJSON.Domain, mailgunJSON.PrivateAPIKey, mailgunJSON.PublicAPIKey)
+	mailgunEmail = newMailgunSender(mailgunJSON.Domain, mailgunJSON.PrivateAPIKey)
+
+	return nil
+}
+
+// InitializeHIBPWithJSON is used for initializing the HIBP API key for the package
+func InitializeHIBPWithJSON(reader io.Reader) error {
+	var hibpJSON hibpInfo
+
+	err := json.NewDecoder(reader).Decode(&hibpJSON)
+
+	if err != nil {
+		return err
+	}
+
+	hibpAPIKey = hibpJSON.APIKey
 
 	return nil
 }
 
-func getPwnageForEmail(email string) ([]PwnInfo, error) {
-	return getPwnageForEmailWithClient(email, http.DefaultClient)
+func getPwnageForEmail(ctx context.Context, email string) ([]PwnInfo, error) {
+	return getPwnageForEmailWithClient(ctx, email, http.DefaultClient)
 }
 
-func getPwnageForEmailWithClient(email string, client *http.Client) (pwnInfo []PwnInfo, err error) {
-	pwnageInfoRequest, err := http.NewRequest("GET", fmt.Sprintf("https://haveibeenpwned.com/api/v2/breachedaccount/%s", url.QueryEscape(email)), nil)
+func getPwnageForEmailWithClient(ctx context.Context, email string, client *http.Client) (pwnInfo []PwnInfo, err error) {
+	log := loggerFromContext(ctx).With("email", email)
+
+	ctx, span := tracer.Start(ctx, "hibp.breachedaccount")
+
+	span.SetAttributes(attribute.String("email.hash", hashPII("email", email)))
+
+	defer func() {
+		recordPwnageLookup(err)
+
+		if err != nil && err != ErrNoPwns {
+			log.Error("pwnage lookup failed", "error", err)
+
+			endSpan(span, err)
+
+			return
+		}
+
+		span.SetAttributes(attribute.Bool("pwned", err == nil))
+		span.End()
+	}()
+
+	_, waitSpan := tracer.Start(ctx, "hibp.rate_limit_wait")
+
+	waited, err := hibpLimiter.Wait(ctx)
+
+	hibpRateLimiterWait.Observe(waited.Seconds())
+	endSpan(waitSpan, err)
+
+	if err != nil {
+		return pwnInfo, err
+	}
+
+	// v3 only returns the names of the breaches unless it is asked not to truncate them
+	pwnageInfoRequest, err := http.NewRequest("GET", fmt.Sprintf("%s/breachedaccount/%s?truncateResponse=false", hibpBaseURL, url.QueryEscape(email)), nil)
 
 	if err != nil {
 		return pwnInfo, err
@@ -107,69 +172,154 @@ func getPwnageForEmailWithClient(email string, client *http.Client) (pwnInfo []P
 
 	pwnageInfoRequest.Header.Set("User-Agent", "RJ-And-Friends-Nightly-Pwnage-Checker")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 7*time.Second)
+	if hibpAPIKey != "" {
+		pwnageInfoRequest.Header.Set("hibp-api-key", hibpAPIKey)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 7*time.Second)
 
 	defer cancel()
 
 	pwnageInfoRequest = pwnageInfoRequest.WithContext(ctx)
 
-	responseErrChan := make(chan error)
+	// The channel is buffered so that the request can still finish, rather than be leaked,
+	// once the lookup has given up on it
+	responseChan := make(chan pwnageResponse, 1)
 
 	go func() {
-		resp, err := client.Do(pwnageInfoRequest)
+		requestStart := time.Now()
 
-		if err != nil {
-			responseErrChan <- err
+		response := requestPwnage(client, pwnageInfoRequest)
 
-			return
-		}
+		hibpRequests.WithLabelValues(statusCodeLabel(response.statusCode)).Inc()
+		hibpRequestDuration.WithLabelValues(statusCodeLabel(response.statusCode)).Observe(time.Since(requestStart).Seconds())
 
-		responseBytes, err := ioutil.ReadAll(resp.Body)
+		log.Debug("requested pwnage from HIBP", "status", response.statusCode, "duration", time.Since(requestStart), "rate_limit_wait", waited)
 
-		if err != nil {
-			responseErrChan <- err
+		responseChan <- response
+	}()
 
-			return
-		}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case response := <-responseChan:
+		span.SetAttributes(attribute.Int("http.response.status_code", response.statusCode))
 
-		if len(responseBytes) == 0 {
-			responseErrChan <- ErrNoPwns
+		return response.pwnInfo, response.err
+	}
+}
 
-			return
-		}
+// pwnageResponse is what HIBP responded to a breached account request with
+type pwnageResponse struct {
+	pwnInfo    []PwnInfo
+	statusCode int
+	err        error
+}
 
-		err = json.Unmarshal(responseBytes, &pwnInfo)
+func requestPwnage(client *http.Client, pwnageInfoRequest *http.Request) pwnageResponse {
+	resp, err := client.Do(pwnageInfoRequest)
 
-		responseErrChan <- err
-	}()
+	if err != nil {
+		return pwnageResponse{err: err}
+	}
 
-	select {
-	case <-ctx.Done():
-		return pwnInfo, ctx.Err()
-	case err = <-responseErrChan:
-		if err != nil {
-			if err == ErrNoPwns {
-				return pwnInfo, err
-			}
+	defer resp.Body.Close()
 
-			return pwnInfo, err
-		}
+	response := pwnageResponse{statusCode: resp.StatusCode}
+
+	// HIBP responds with HTTP/404 for an email which isn't in any breach
+	if resp.StatusCode == http.StatusNotFound {
+		response.err = ErrNoPwns
+
+		return response
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		response.err = fmt.Errorf("the HIBP breach API responded with HTTP/%d", resp.StatusCode)
+
+		return response
 	}
 
-	return pwnInfo, nil
+	responseBytes, err := ioutil.ReadAll(resp.Body)
+
+	switch {
+	case err != nil:
+		response.err = err
+	case len(responseBytes) == 0:
+		response.err = ErrNoPwns
+	default:
+		response.err = json.Unmarshal(responseBytes, &response.pwnInfo)
+	}
+
+	return response
 }
 
-func notifyEmailOfPwnage(email, title, body string) error {
-	content := mailgun.NewMessage("robot@mail.therileyjohnson.com", title, body, email)
+// notifyEmailOfPwnage emails the title and body, the tags label the email with
+// what it is about for the providers which support them
+func notifyEmailOfPwnage(ctx context.Context, email, title, body string, tags ...string) error {
+	ctx, span := tracer.Start(ctx, "notify.email")
+
+	provider, err := sendEmailWithFailover(ctx, emailMessage{To: email, Subject: title, Body: body, Tags: tags}, time.Now())
+
+	// Which provider delivered the email is recorded, as any of them could have
+	if provider != "" {
+		span.SetAttributes(attribute.String("email.provider", provider))
+		ctx = contextWithLogger(ctx, loggerFromContext(ctx).With("email_provider", provider))
+	}
+
+	recordNotification("email", err)
+	logNotification(ctx, channelEmail, email, title, err)
+	endSpan(span, err)
+
+	return err
+}
+
+func sendPhoneNotification(ctx context.Context, phone, message string) error {
+	ctx, span := tracer.Start(ctx, "notify.sms")
+
+	err := notifyPhoneOfPwnage(phone, message)
 
-	_, _, err := mg.Send(content)
+	recordNotification("sms", err)
+	logNotification(ctx, channelSMS, phone, message, err)
+	endSpan(span, err)
 
 	return err
 }
 
-func notifyOfPwnage(email, phone string, alwaysNotify bool) error {
+// smsProviderConfigured is whether notifyPhoneOfPwnage can text phones, until it can
+// subscribers' phones aren't treated as somewhere they can be notified
+var smsProviderConfigured = false
+
+// notifyPhoneOfPwnage texts the phone, there is no SMS provider to send through yet
+func notifyPhoneOfPwnage(phone, message string) error {
+	return ErrSMSNotConfigured
+}
+
+// logNotification logs the notification with its recipient hashed, since phone numbers in
+// formats other than E.164 wouldn't be recognized by the logger's redaction
+func logNotification(ctx context.Context, channel, to, title string, err error) {
+	recipient := hashPII("email", to)
+
+	if channel == channelSMS {
+		recipient = hashPII("phone", to)
+	}
+
+	if err != nil {
+		loggerFromContext(ctx).Error("notification failed", "channel", channel, "to", recipient, "title", title, "error", err)
+
+		return
+	}
+
+	loggerFromContext(ctx).Info("notification sent", "channel", channel, "to", recipient, "title", title)
+}
+
+func notifyOfPwnage(ctx context.Context, email, phone string, alwaysNotify bool) error {
+	return notifyOfPwnageWithLookup(ctx, email, phone, alwaysNotify, getPwnageForEmail)
+}
+
+func notifyOfPwnageWithLookup(ctx context.Context, email, phone string, alwaysNotify bool, lookup func(context.Context, string) ([]PwnInfo, error)) error {
 	isPwned := false
-	pwnInfo, err := getPwnageForEmail(email)
+	pwnInfo, err := lookup(ctx, email)
 
 	if err != nil && err != ErrNoPwns {
 		return err
@@ -177,32 +327,60 @@ func notifyOfPwnage(email, phone string, alwaysNotify bool) error {
 
 	isPwned = err != ErrNoPwns
 
+	// The phone provided is the one notified, rather than any the subscriber has stored
+	subscriber := subscriberForEmail(email)
+	subscriber.Phone = phone
+
 	if isPwned {
-		err = notifyEmailOfPwnage(email, "YOU HAVE BEEN PWNED :(", "")
+		return notifySubscriberOfBreaches(ctx, subscriber, pwnInfo)
+	} else if alwaysNotify {
+		return notifySubscriber(ctx, subscriber, personalChannels(), notification{Type: notificationNotPwned, Title: "YOU HAVE NOT BEEN PWNED :)"})
+	}
 
-		if err != nil {
-			return err
-		}
+	return nil
+}
 
-		if phone != "" {
-			return notifyPhoneOfPwnage(phone, "YOU HAVE BEEN PWNED :(")
-		}
-	} else if alwaysNotify {
-		err = notifyEmailOfPwnage(email, "YOU HAVE NOT BEEN PWNED :)", "")
+// notifySubscriberOfBreaches notifies the subscriber of the breaches they were found in, through
+// the channels their notification policy routes each of the breaches to, or in their next digest
+func notifySubscriberOfBreaches(ctx context.Context, subscriber Subscriber, pwnInfo []PwnInfo) error {
+	decision := evaluatePolicy(pwnInfo, subscriber.PolicyRules)
 
-		if err != nil {
-			return err
-		}
+	if len(decision.Breaches) == 0 {
+		loggerFromContext(ctx).Info("every breach was ignored by the notification policy", "email", subscriber.Email, "breaches", len(pwnInfo))
 
-		if phone != "" {
-			return notifyPhoneOfPwnage(phone, "YOU HAVE NOT BEEN PWNED :)")
-		}
+		return nil
 	}
 
-	return nil
+	if queued, err := queueForDigest(ctx, subscriber, digestItemsFor(decision, time.Now().UTC())); queued || err != nil {
+		return err
+	}
+
+	ctx = contextWithLogger(ctx, loggerFromContext(ctx).With("severity", worstSeverity(decision.Breaches).String()))
+
+	return notifyDecision(ctx, subscriber, decision, func(breaches []scoredBreach) notification {
+		worst := worstSeverity(breaches)
+
+		return notification{
+			Type:     notificationBreach,
+			Title:    pwnageSubject(worst),
+			Body:     pwnageBody(breaches),
+			Severity: worst,
+			Breaches: breaches,
+		}
+	})
 }
 
 func NotifyOfPwnage(c *gin.Context) {
+	notifyContactsOfPwnage(c, getPwnageForEmail)
+}
+
+// NotifyOfPwnageWithCache is the same as NotifyOfPwnage, except
+// that recently checked emails are answered from the cache
+func NotifyOfPwnageWithCache(c *gin.Context) {
+	notifyContactsOfPwnage(c, getPwnageForEmailWithCache)
+}
+
+func notifyContactsOfPwnage(c *gin.Context, lookup func(context.Context, string) ([]PwnInfo, error)) {
 	notifyList := struct {
 		Contacts []struct {
 			Email string `json:"email"`
@@ -210,21 +388,30 @@ func NotifyOfPwnage(c *gin.Context) {
 		}
 	}{}
 
-	json.NewDecoder(c.Request.Body).Decode(&notifyList)
+	err := json.NewDecoder(c.Request.Body).Decode(&notifyList)
 
-	for _, contact := range notifyList.Contacts {
-		notifyOfPwnage(contact.Email, contact.Phone, true)
-
-		// Need to wait between every function call because
-		// the API only allows one request every 1500ms
-		time.Sleep(1500 * time.Millisecond)
+	if err != nil {
+		loggerFromContext(c.Request.Context()).Warn("could not decode the contacts to notify", "error", err)
 	}
-}
 
-func AddToPwnageCheck(c *gin.Context) {
+	// The job carries on if the client disconnects, but stays part of the request's trace
+	jobLogger := loggerFromContext(c.Request.Context()).With("job_id", newID())
+	ctx := contextWithLogger(context.WithoutCancel(c.Request.Context()), jobLogger)
 
-}
+	jobStart := time.Now()
+	failures := 0
+
+	jobLogger.Info("pwnage notification job started", "contacts", len(notifyList.Contacts))
+
+	for _, contact := range notifyList.Contacts {
+		err = notifyOfPwnageWithLookup(ctx, contact.Email, contact.Phone, true, lookup)
 
-func DeleteFromPwnageCheck(c *gin.Context) {
+		if err != nil {
+			failures++
+
+			jobLogger.Error("could not notify contact of pwnage", "email", contact.Email, "error", err)
+		}
+	}
 
+	jobLogger.Info("pwnage notification job finished", "contacts", len(notifyList.Contacts), "failures", failures, "duration", time.Since(jobStart))
 }
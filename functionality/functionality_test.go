@@ -1,875 +1,267 @@
-package functionality_test
+package functionality
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"io"
-	"io/ioutil"
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/gin-gonic/gin"
-	mailgun "gopkg.in/mailgun/mailgun-go.v1"
+	"github.com/the-rileyj/pwned-api/functionality/hibptest"
 )
 
-type mailgunMock struct {
+// recordingEmailSender is an email backend which keeps the messages it is sent,
+// failing every one with err when it is set
+type recordingEmailSender struct {
+	mu   sync.Mutex
+	sent []emailMessage
+	err  error
 }
 
-func (mM mailgunMock) ApiBase() string {
-}
-
-func (mM mailgunMock) Domain() string {
-}
-
-func (mM mailgunMock) ApiKey() string {
-}
-
-func (mM mailgunMock) PublicApiKey() string {
-}
-
-func (mM mailgunMock) Client() *http.Client {
-}
-
-func (mM mailgunMock) SetClient(client *http.Client) {
-}
-
-func (mM mailgunMock) Send(m *mailgun.Message) (string, string, error) {
-}
-
-func (mM mailgunMock) ValidateEmail(email string) (mailgun.EmailVerification, error) {
-}
-
-func (mM mailgunMock) ParseAddresses(addresses ...string) ([]string, []string, error) {
-}
-
-func (mM mailgunMock) GetBounces(limit, skip int) (int, []mailgun.Bounce, error) {
-}
-
-func (mM mailgunMock) GetSingleBounce(address string) (mailgun.Bounce, error) {
-}
-
-func (mM mailgunMock) AddBounce(address, code, error string) error {
-}
-
-func (mM mailgunMock) DeleteBounce(address string) error {
-}
-
-func (mM mailgunMock) GetStats(limit int, skip int, startDate *time.Time, event ...string) (int, []mailgun.Stat, error) {
-}
-
-func (mM mailgunMock) GetTag(tag string) (mailgun.TagItem, error) {
-}
-
-func (mM mailgunMock) DeleteTag(tag string) error {
-}
-
-func (mM mailgunMock) ListTags(*mailgun.TagOptions) *mailgun.TagIterator {
-}
+func (res *recordingEmailSender) sendEmail(ctx context.Context, message emailMessage) error {
+	res.mu.Lock()
 
-func (mM mailgunMock) GetDomains(limit, skip int) (int, []mailgun.Domain, error) {
-}
-
-func (mM mailgunMock) GetSingleDomain(domain string) (mailgun.Domain, []mailgun.DNSRecord, []mailgun.DNSRecord, error) {
-}
-
-func (mM mailgunMock) CreateDomain(name string, smtpPassword string, spamAction string, wildcard bool) error {
-}
-
-func (mM mailgunMock) DeleteDomain(name string) error {
-}
-
-func (mM mailgunMock) GetCampaigns() (int, []mailgun.Campaign, error) {
-}
-
-func (mM mailgunMock) CreateCampaign(name, id string) error {
-}
-
-func (mM mailgunMock) UpdateCampaign(oldId, name, newId string) error {
-}
-
-func (mM mailgunMock) DeleteCampaign(id string) error {
-}
-
-func (mM mailgunMock) GetComplaints(limit, skip int) (int, []mailgun.Complaint, error) {
-}
-
-func (mM mailgunMock) GetSingleComplaint(address string) (mailgun.Complaint, error) {
-}
-
-func (mM mailgunMock) GetStoredMessage(id string) (mailgun.StoredMessage, error) {
-}
-
-func (mM mailgunMock) GetStoredMessageRaw(id string) (mailgun.StoredMessageRaw, error) {
-}
-
-func (mM mailgunMock) DeleteStoredMessage(id string) error {
-}
-
-func (mM mailgunMock) GetCredentials(limit, skip int) (int, []mailgun.Credential, error) {
-}
-
-func (mM mailgunMock) CreateCredential(login, password string) error {
-}
-
-func (mM mailgunMock) ChangeCredentialPassword(id, password string) error {
-}
-
-func (mM mailgunMock) DeleteCredential(id string) error {
-}
+	defer res.mu.Unlock()
 
-func (mM mailgunMock) GetUnsubscribes(limit, skip int) (int, []mailgun.Unsubscription, error) {
-}
-
-func (mM mailgunMock) GetUnsubscribesByAddress(string) (int, []mailgun.Unsubscription, error) {
-}
-
-func (mM mailgunMock) Unsubscribe(address, tag string) error {
-}
-
-func (mM mailgunMock) RemoveUnsubscribe(string) error {
-}
-
-func (mM mailgunMock) RemoveUnsubscribeWithTag(a, t string) error {
-}
-
-func (mM mailgunMock) CreateComplaint(string) error {
-}
-
-func (mM mailgunMock) DeleteComplaint(string) error {
-}
-
-func (mM mailgunMock) GetRoutes(limit, skip int) (int, []mailgun.Route, error) {
-}
-
-func (mM mailgunMock) GetRouteByID(string) (mailgun.Route, error) {
-}
-
-func (mM mailgunMock) CreateRoute(mailgun.Route) (mailgun.Route, error) {
-}
-
-func (mM mailgunMock) DeleteRoute(string) error {
-}
-
-func (mM mailgunMock) UpdateRoute(string, mailgun.Route) (mailgun.Route, error) {
-}
-
-func (mM mailgunMock) GetWebhooks() (map[string]string, error) {
-}
-
-func (mM mailgunMock) CreateWebhook(kind, url string) error {
-}
-
-func (mM mailgunMock) DeleteWebhook(kind string) error {
-}
-
-func (mM mailgunMock) GetWebhookByType(kind string) (string, error) {
-}
-
-func (mM mailgunMock) UpdateWebhook(kind, url string) error {
-}
-
-func (mM mailgunMock) VerifyWebhookRequest(req *http.Request) (verified bool, err error) {
-}
-
-func (mM mailgunMock) GetLists(limit, skip int, filter string) (int, []mailgun.List, error) {
-}
-
-func (mM mailgunMock) CreateList(mailgun.List) (mailgun.List, error) {
-}
-
-func (mM mailgunMock) DeleteList(string) error {
-}
-
-func (mM mailgunMock) GetListByAddress(string) (mailgun.List, error) {
-}
+	if res.err != nil {
+		return res.err
+	}
 
-func (mM mailgunMock) UpdateList(string, mailgun.List) (mailgun.List, error) {
-}
+	res.sent = append(res.sent, message)
 
-func (mM mailgunMock) GetMembers(limit, skip int, subfilter *bool, address string) (int, []mailgun.Member, error) {
+	return nil
 }
 
-func (mM mailgunMock) GetMemberByAddress(MemberAddr, listAddr string) (mailgun.Member, error) {
-}
+func (res *recordingEmailSender) messages() []emailMessage {
+	res.mu.Lock()
 
-func (mM mailgunMock) CreateMember(merge bool, addr string, prototype mailgun.Member) error {
-}
+	defer res.mu.Unlock()
 
-func (mM mailgunMock) CreateMemberList(subscribed *bool, addr string, newMembers []interface{}) error {
+	return append([]emailMessage(nil), res.sent...)
 }
 
-func (mM mailgunMock) UpdateMember(Member, list string, prototype mailgun.Member) (mailgun.Member, error) {
-}
+// useRecordingEmailSender makes the recording sender the only email backend, until restore is called
+func useRecordingEmailSender() (*recordingEmailSender, func()) {
+	originalBackends, originalMailgun, originalCircuits := emailBackends, mailgunEmail, emailCircuits
+	recorder := &recordingEmailSender{}
 
-func (mM mailgunMock) DeleteMember(Member, list string) error {
-}
+	emailBackends, mailgunEmail, emailCircuits = []string{emailBackendMailgun}, recorder, map[string]*circuitBreaker{}
 
-func (mM mailgunMock) NewMessage(from, subject, text string, to ...string) *mailgun.Message {
+	return recorder, func() {
+		emailBackends, mailgunEmail, emailCircuits = originalBackends, originalMailgun, originalCircuits
+	}
 }
 
-func (mM mailgunMock) NewMIMEMessage(body io.ReadCloser, to ...string) *mailgun.Message {
-}
+// useFakeHIBP points the HIBP and Pwned Passwords requests at a fake serving the fixtures,
+// which requires the API key, and stops spacing the requests out, until restore is called
+func useFakeHIBP(fixtures hibptest.Fixtures) (*hibptest.Server, func()) {
+	originalBaseURL, originalPasswordsBaseURL, originalAPIKey, originalLimiter := hibpBaseURL, pwnedPasswordsBaseURL, hibpAPIKey, hibpLimiter
+	server := hibptest.NewServer(fixtures)
 
-func (mM mailgunMock) NewEventIterator() *mailgun.EventIterator {
-}
+	server.RequireAPIKey("key")
 
-func (mM mailgunMock) ListEvents(*mailgun.EventsOptions) *mailgun.EventIterator {
-}
+	hibpBaseURL, pwnedPasswordsBaseURL, hibpAPIKey, hibpLimiter = server.URL+hibptest.APIPath, server.URL, "key", &rateLimiter{}
 
-func (mM mailgunMock) PollEvents(*mailgun.EventsOptions) *mailgun.EventPoller {
-}
+	return server, func() {
+		server.Close()
 
-func (mM mailgunMock) SetAPIBase(url string) {
+		hibpBaseURL, pwnedPasswordsBaseURL, hibpAPIKey, hibpLimiter = originalBaseURL, originalPasswordsBaseURL, originalAPIKey, originalLimiter
+	}
 }
 
-func init() {
-	gin.SetMode(gin.TestMode)
+var hibpFixtures = hibptest.Fixtures{
+	Breaches: []hibptest.Breach{{Name: "Adobe", Title: "Adobe", Domain: "adobe.com", BreachDate: "2013-10-04", DataClasses: []string{"Email addresses", "Passwords"}, IsVerified: true}},
+	Accounts: map[string][]string{"pwned@example.com": {"Adobe"}},
 }
 
 // Need to test the following:
-// If key does not exist then a HTTP/400 status is returned,
-//     error field is true, the update field is falsed true,
-//	   and the message is the "ErrorKeyDoesNotExist" constant
-// If key exists then key and value is deleted, a HTTP/200 status is returned,
-//     the error field is false, the update field is true, and the message is empty
-func TestHandleDeleteKey(t *testing.T) {
-	var mockResponseJSON Response
+// The breaches HIBP has for the email are returned in full, rather than truncated to their names
+// An email in no breaches (HTTP/404) is ErrNoPwns
+// A missing API key, rate limiting, server errors and timeouts are errors
+// Latency within the timeout is not an error
+func TestGetPwnageForEmail(t *testing.T) {
+	server, restore := useFakeHIBP(hibpFixtures)
 
-	keys.set("TestHandleDeleteKey", "success")
-
-	router := gin.New()
-	router.DELETE("/keys/:key", HandleDeleteKey)
+	defer restore()
 
 	tests := []struct {
-		ExpectedResponse                         Response
-		ExpectedStatusCode                       int
-		ExpectedValue, ExpectedUpdateHeader, Key string
+		Name            string
+		Email           string
+		APIKey          string
+		Fault           hibptest.Fault
+		ExpectedBreach  string
+		ExpectedErr     error
+		ExpectedAnError bool
 	}{
-		{
-			ExpectedResponse: Response{
-				Error:   true,
-				Message: ErrorKeyDoesNotExist,
-			},
-			ExpectedStatusCode:   400,
-			ExpectedValue:        "",
-			ExpectedUpdateHeader: "",
-			Key:                  "idonotexist",
-		},
-		{
-			ExpectedResponse: Response{
-				Error:   false,
-				Message: "",
-			},
-			ExpectedStatusCode:   200,
-			ExpectedValue:        "",
-			ExpectedUpdateHeader: "update",
-			Key:                  "TestHandleDeleteKey",
-		},
+		{Name: "pwned", Email: "pwned@example.com", APIKey: "key", ExpectedBreach: "Adobe"},
+		{Name: "pwned in another case", Email: "PWNED@example.com", APIKey: "key", ExpectedBreach: "Adobe"},
+		{Name: "not pwned", Email: "safe@example.com", APIKey: "key", ExpectedErr: ErrNoPwns},
+		{Name: "without an API key", Email: "pwned@example.com", ExpectedAnError: true},
+		{Name: "rate limited", Email: "pwned@example.com", APIKey: "key", Fault: hibptest.Fault{StatusCode: http.StatusTooManyRequests, RetryAfter: 2 * time.Second}, ExpectedAnError: true},
+		{Name: "HIBP is down", Email: "pwned@example.com", APIKey: "key", Fault: hibptest.Fault{StatusCode: http.StatusServiceUnavailable}, ExpectedAnError: true},
+		{Name: "timing out", Email: "pwned@example.com", APIKey: "key", Fault: hibptest.Fault{Timeout: true}, ExpectedErr: context.DeadlineExceeded},
+		{Name: "slow", Email: "pwned@example.com", APIKey: "key", Fault: hibptest.Fault{Latency: 50 * time.Millisecond}, ExpectedBreach: "Adobe"},
 	}
 
 	for _, test := range tests {
-		mockRequest, err := http.NewRequest("DELETE", fmt.Sprintf("/keys/%s", test.Key), &bytes.Reader{})
-
-		if err != nil {
-			t.Fatal("could not create the mock request")
-		}
-
-		mockResponseWriter := httptest.NewRecorder()
-
-		router.ServeHTTP(mockResponseWriter, mockRequest)
-
-		bodyBytes, err := ioutil.ReadAll(mockResponseWriter.Body)
-
-		if err != nil {
-			t.Error("Could not read the response body into bytes")
-
-			continue
-		}
+		hibpAPIKey = test.APIKey
+		server.SetFault(hibptest.BreachedAccount, test.Fault)
 
-		err = json.Unmarshal(bodyBytes, &mockResponseJSON)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 
-		if err != nil {
-			t.Error("Could not parse the response body bytes into JSON")
+		pwnInfo, err := getPwnageForEmailWithClient(ctx, test.Email, server.Client())
 
-			continue
-		}
+		cancel()
 
-		if value, _ := keys.get(test.Key); mockResponseWriter.Code != test.ExpectedStatusCode || mockResponseJSON != test.ExpectedResponse || value != test.ExpectedValue || mockResponseWriter.Header().Get("update") != test.ExpectedUpdateHeader {
-			t.Errorf(
-				`HandleDeleteKey(context) = Status Code: HTTP/%d, Response: "%v", keys[%s] = "%s", and the update header = "%s"; expected: HTTP/%d, Response: "%v", keys[%s] = "%s", and the update header = "%s"`,
-				mockResponseWriter.Code,
-				mockResponseJSON,
-				test.Key,
-				value,
-				mockResponseWriter.Header().Get("update"),
-				test.ExpectedStatusCode,
-				test.ExpectedResponse,
-				test.Key,
-				test.ExpectedValue,
-				test.ExpectedUpdateHeader,
-			)
+		switch {
+		case test.ExpectedErr != nil && !errors.Is(err, test.ExpectedErr):
+			t.Errorf("getPwnageForEmailWithClient() when %s = %v; expected: %v", test.Name, err, test.ExpectedErr)
+		case test.ExpectedAnError && err == nil:
+			t.Errorf("getPwnageForEmailWithClient() when %s = <nil>; expected: an error", test.Name)
+		case test.ExpectedBreach != "" && (err != nil || len(pwnInfo) != 1 || pwnInfo[0].Name != test.ExpectedBreach || len(pwnInfo[0].DataClasses) == 0):
+			t.Errorf("getPwnageForEmailWithClient() when %s = %+v, %v; expected: the %s breach", test.Name, pwnInfo, err, test.ExpectedBreach)
 		}
 	}
-}
-
-// Need to test the following:
-// If key does not exist then a HTTP/400 status is returned,
-//     error field is true, and the message is the "ErrorKeyDoesNotExist" constant
-// If key exists then the value for the provided key is returned, a HTTP/200 status is returned,
-//     the error field is false, and the message is the value for the key
-func TestHandleGetKey(t *testing.T) {
-	var mockResponseJSON Response
 
-	keys.set("TestHandleGetKey", "success")
-
-	router := gin.New()
-	router.GET("/keys/:key", HandleGetKey)
-
-	tests := []struct {
-		ExpectedResponse   Response
-		ExpectedStatusCode int
-		Key                string
-	}{
-		{
-			ExpectedResponse: Response{
-				Error:   true,
-				Message: ErrorKeyDoesNotExist,
-			},
-			ExpectedStatusCode: 400,
-			Key:                "DoNotTestHandleGetKey",
-		},
-		{
-			ExpectedResponse: Response{
-				Error:   false,
-				Message: "success",
-			},
-			ExpectedStatusCode: 200,
-			Key:                "TestHandleGetKey",
-		},
-	}
-
-	for _, test := range tests {
-		mockRequest, err := http.NewRequest("GET", fmt.Sprintf("/keys/%s", test.Key), &bytes.Reader{})
-
-		if err != nil {
-			t.Fatal("could not create the mock request")
-		}
-
-		mockResponseWriter := httptest.NewRecorder()
-
-		router.ServeHTTP(mockResponseWriter, mockRequest)
-
-		bodyBytes, err := ioutil.ReadAll(mockResponseWriter.Body)
-
-		if err != nil {
-			t.Error("Could not read the response body into bytes")
-
-			continue
-		}
-
-		err = json.Unmarshal(bodyBytes, &mockResponseJSON)
-
-		if err != nil {
-			t.Error("Could not parse the response body bytes into JSON")
-
-			continue
-		}
-
-		if mockResponseWriter.Code != test.ExpectedStatusCode || mockResponseJSON != test.ExpectedResponse {
-			t.Errorf(
-				`HandleGetKey(context) = Status Code: HTTP/%d and Response: "%v", expected HTTP/%d and Response: "%v"`,
-				mockResponseWriter.Code,
-				mockResponseJSON,
-				test.ExpectedStatusCode,
-				test.ExpectedResponse,
-			)
-		}
+	if requests := server.Requests(hibptest.BreachedAccount); requests != len(tests) {
+		t.Errorf("fake HIBP breachedaccount requests = %d; expected: %d", requests, len(tests))
 	}
 }
 
 // Need to test the following:
-// If any of the provided keys do not exist then they are not found in the returned map
-//     in the message field, the error field is false, and a HTTP/200 status is returned
-// If key exists then the value for the provided key can be found in the returned map in
-//     the message field, the error field is false and a HTTP/200 status is returned
-func TestHandleGetManyKeys(t *testing.T) {
-	CheckResponseAgainstExpected := func(response map[string]interface{}, expected map[string]string) bool {
-		for key, value := range expected {
-			if _, exists := response[key]; !exists {
-				return false
-			}
-
-			if value != response[key].(string) {
-				return false
-			}
-		}
+// A pwned email is looked up in HIBP and emailed its breaches, all without leaving the machine
+func TestNotifyOfPwnageOffline(t *testing.T) {
+	_, restoreHIBP := useFakeHIBP(hibpFixtures)
 
-		return true
-	}
+	defer restoreHIBP()
 
-	keys.set("TestHandleGetKey", "success")
-	keys.set("TestHandleGetAnotherKey", "good")
-	keys.set("TestHandleGetAnotherAnotherKey", "great")
+	recorder, restoreEmail := useRecordingEmailSender()
 
-	router := gin.New()
-	router.POST("/keys", HandleGetManyKeys)
+	defer restoreEmail()
 
-	tests := []struct {
-		ExpectedResponse   Response
-		ExpectedStatusCode int
-		Request            RequestMany
-	}{
-		{
-			ExpectedResponse: Response{
-				Error: false,
-				Message: map[string]string{
-					"TestHandleGetKey":        "success",
-					"TestHandleGetAnotherKey": "good",
-				},
-			},
-			ExpectedStatusCode: 200,
-			Request: RequestMany{
-				Keys: []string{
-					"TestHandleGetKey",
-					"TestHandleGetAnotherKey",
-				},
-			},
-		},
-		{
-			ExpectedResponse: Response{
-				Error: false,
-				Message: map[string]string{
-					"TestHandleGetAnotherAnotherKey": "great",
-				},
-			},
-			ExpectedStatusCode: 200,
-			Request: RequestMany{
-				Keys: []string{
-					"TestHandleGetAnotherAnotherKey",
-					"TestNonexistantKey",
-				},
-			},
-		},
+	if err := notifyOfPwnage(context.Background(), "pwned@example.com", "", false); err != nil {
+		t.Fatalf("notifyOfPwnage() = %v; expected: <nil>", err)
 	}
 
-	for _, test := range tests {
-		reader, writer := io.Pipe()
-
-		mockRequest, err := http.NewRequest("POST", "/keys", reader)
-
-		if err != nil {
-			t.Fatal("could not create the mock request")
-		}
-
-		go func() { json.NewEncoder(writer).Encode(test.Request) }()
-
-		mockResponseWriter := httptest.NewRecorder()
-
-		router.ServeHTTP(mockResponseWriter, mockRequest)
-
-		var mockResponseJSON Response
-
-		err = json.NewDecoder(mockResponseWriter.Body).Decode(&mockResponseJSON)
-
-		if err != nil {
-			t.Error("Could not decode the response body into json")
-
-			continue
-		}
-
-		if mockResponseWriter.Code != test.ExpectedStatusCode || mockResponseJSON.Error != test.ExpectedResponse.Error || !CheckResponseAgainstExpected(mockResponseJSON.Message.(map[string]interface{}), test.ExpectedResponse.Message.(map[string]string)) {
-			t.Errorf(
-				`HandleGetKey(context) = Status Code: HTTP/%d and Response: "%v", expected HTTP/%d and Response: "%v"`,
-				mockResponseWriter.Code,
-				mockResponseJSON,
-				test.ExpectedStatusCode,
-				test.ExpectedResponse,
-			)
-		}
+	if messages := recorder.messages(); len(messages) != 1 || !strings.Contains(messages[0].Body, "Adobe") {
+		t.Errorf("notifyOfPwnage() sent %+v; expected: an email about the Adobe breach", messages)
 	}
 }
 
-// Need to test the following:
-// If key already exists then a HTTP/400 status is returned,
-//     error field is true, the update field is false, and the message is the "ErrorKeyAlreadyExists" constant
-// If key has any character which cannot be put into a URL with URL encoding then a HTTP/400 status is returned,
-//     error field is true, the update field is false, and the message is the "ErrorInvalidKey" constant
-// If key does not exist then key and value pair is created, a HTTP/201 status is returned,
-//     the error field is false, the update field is true, and the message field is empty
-func TestHandlePostKey(t *testing.T) {
-	var mockResponseJSON Response
-
-	keys.set("TestHandlePostKey", "success")
-
-	router := gin.New()
-	router.POST("/keys", HandlePostKey)
-
-	tests := []struct {
-		ExpectedResponse                                Response
-		ExpectedStatusCode                              int
-		ExpectedValue, ExpectedUpdateHeader, Key, Value string
-	}{
-		{
-			ExpectedResponse: Response{
-				Error:   true,
-				Message: ErrorKeyAlreadyExists,
-			},
-			ExpectedStatusCode:   400,
-			ExpectedValue:        "success",
-			ExpectedUpdateHeader: "",
-			Key:                  "TestHandlePostKey",
-			Value:                "failure",
-		},
-		{
-			ExpectedResponse: Response{
-				Error:   true,
-				Message: ErrorInvalidKey,
-			},
-			ExpectedStatusCode:   400,
-			ExpectedValue:        "",
-			ExpectedUpdateHeader: "",
-			Key:                  "TestHandlePostKeyFailure?",
-			Value:                "success",
-		},
-		{
-			ExpectedResponse: Response{
-				Error:   false,
-				Message: "",
-			},
-			ExpectedStatusCode:   201,
-			ExpectedValue:        "success",
-			ExpectedUpdateHeader: "update",
-			Key:                  "TestHandlePostKeyFailure",
-			Value:                "success",
-		},
-	}
-
-	for _, test := range tests {
-		requestBytes, err := json.Marshal(RequestSingle{test.Key, test.Value})
-
-		if err != nil {
-			t.Error("Could not read the response body into bytes")
-
-			continue
-		}
-
-		mockRequest, err := http.NewRequest("POST", "/keys", bytes.NewBuffer(requestBytes))
-
-		if err != nil {
-			t.Fatal("could not create the mock request")
-		}
-
-		mockResponseWriter := httptest.NewRecorder()
-
-		router.ServeHTTP(mockResponseWriter, mockRequest)
-
-		bodyBytes, err := ioutil.ReadAll(mockResponseWriter.Body)
-
-		if err != nil {
-			t.Error("Could not read the response body into bytes")
-
-			continue
-		}
-
-		err = json.Unmarshal(bodyBytes, &mockResponseJSON)
-
-		if err != nil {
-			t.Error("Could not parse the response body bytes into JSON")
-
-			continue
-		}
-
-		if value, _ := keys.get(test.Key); mockResponseWriter.Code != test.ExpectedStatusCode || mockResponseJSON != test.ExpectedResponse || value != test.ExpectedValue || mockResponseWriter.Header().Get("update") != test.ExpectedUpdateHeader {
-			t.Errorf(
-				`HandleDeleteKey(context) = Status Code: HTTP/%d, Response: "%v", keys[%s] = "%s", and the update header = "%s"; expected: HTTP/%d, Response: "%v", keys[%s] = "%s", and the update header = "%s"`,
-				mockResponseWriter.Code,
-				mockResponseJSON,
-				test.Key,
-				value,
-				mockResponseWriter.Header().Get("update"),
-				test.ExpectedStatusCode,
-				test.ExpectedResponse,
-				test.Key,
-				test.ExpectedValue,
-				test.ExpectedUpdateHeader,
-			)
-		}
+func lookupReturning(pwnInfo []PwnInfo, err error) func(context.Context, string) ([]PwnInfo, error) {
+	return func(context.Context, string) ([]PwnInfo, error) {
+		return pwnInfo, err
 	}
 }
 
 // Need to test the following:
-// If key already exists then a HTTP/400 status is returned,
-//     error field is true, the update field is false, and the message is the "ErrorKeyAlreadyExists" constant
-// If key exists then the value for the key is updated, a HTTP/200 status is returned,
-//     the error field is false, the update field is true, and the message is empty
-func TestHandlePutKey(t *testing.T) {
-	var mockResponseJSON Response
+// Pwned emails are sent the breaches, tagged as a breach
+// Emails which aren't pwned are only told so when alwaysNotify is set
+// Lookup and email failures are returned
+// Phones aren't notified, or failed, while there is no SMS provider
+func TestNotifyOfPwnage(t *testing.T) {
+	recorder, restore := useRecordingEmailSender()
 
-	keys.set("TestHandlePutKey", "success")
+	defer restore()
 
-	router := gin.New()
-	router.PUT("/keys", HandlePutKey)
+	adobe := PwnInfo{Name: "Adobe", Title: "Adobe", BreachDate: "2013-10-04", DataClasses: []string{"Email addresses", "Passwords"}, IsVerified: true}
+	lookupFailure := errors.New("HIBP is down")
 
 	tests := []struct {
-		ExpectedResponse                                Response
-		ExpectedStatusCode                              int
-		ExpectedValue, ExpectedUpdateHeader, Key, Value string
+		Name             string
+		Phone            string
+		PwnInfo          []PwnInfo
+		LookupErr        error
+		AlwaysNotify     bool
+		SendErr          error
+		ExpectedErr      error
+		ExpectedSubject  string
+		ExpectedInBody   string
+		ExpectedTags     []string
+		ExpectedMessages int
 	}{
-		{
-			ExpectedResponse: Response{
-				Error:   true,
-				Message: ErrorKeyDoesNotExist,
-			},
-			ExpectedStatusCode:   400,
-			ExpectedValue:        "",
-			ExpectedUpdateHeader: "",
-			Key:                  "TestHandlePutKeyFailure",
-			Value:                "success",
-		},
-		{
-			ExpectedResponse: Response{
-				Error:   false,
-				Message: "",
-			},
-			ExpectedStatusCode:   200,
-			ExpectedValue:        "success",
-			ExpectedUpdateHeader: "update",
-			Key:                  "TestHandlePutKey",
-			Value:                "success",
-		},
+		{Name: "pwned", PwnInfo: []PwnInfo{adobe}, ExpectedSubject: "PWNED", ExpectedInBody: "Adobe", ExpectedTags: []string{notificationBreach}, ExpectedMessages: 1},
+		{Name: "pwned with a phone", Phone: "+15558675309", PwnInfo: []PwnInfo{adobe}, ExpectedSubject: "PWNED", ExpectedInBody: "Adobe", ExpectedTags: []string{notificationBreach}, ExpectedMessages: 1},
+		{Name: "not pwned and always notified", LookupErr: ErrNoPwns, AlwaysNotify: true, ExpectedSubject: "YOU HAVE NOT BEEN PWNED :)", ExpectedTags: []string{notificationNotPwned}, ExpectedMessages: 1},
+		{Name: "not pwned", LookupErr: ErrNoPwns},
+		{Name: "lookup failure", LookupErr: lookupFailure, AlwaysNotify: true, ExpectedErr: lookupFailure},
+		{Name: "send failure", PwnInfo: []PwnInfo{adobe}, SendErr: errors.New("mailgun is down"), ExpectedErr: ErrEmailProvidersDown},
 	}
 
 	for _, test := range tests {
-		requestBytes, err := json.Marshal(RequestSingle{test.Key, test.Value})
-
-		if err != nil {
-			t.Error("Could not read the response body into bytes")
-
-			continue
-		}
+		recorder.sent, recorder.err = nil, test.SendErr
+		emailCircuits = map[string]*circuitBreaker{}
 
-		mockRequest, err := http.NewRequest("PUT", "/keys", bytes.NewBuffer(requestBytes))
+		err := notifyOfPwnageWithLookup(context.Background(), "someone@example.com", test.Phone, test.AlwaysNotify, lookupReturning(test.PwnInfo, test.LookupErr))
 
-		if err != nil {
-			t.Fatal("could not create the mock request")
+		if (test.ExpectedErr == nil && err != nil) || (test.ExpectedErr != nil && !errors.Is(err, test.ExpectedErr)) {
+			t.Errorf("notifyOfPwnage() when %s = %v; expected: %v", test.Name, err, test.ExpectedErr)
 		}
 
-		mockResponseWriter := httptest.NewRecorder()
-
-		router.ServeHTTP(mockResponseWriter, mockRequest)
-
-		bodyBytes, err := ioutil.ReadAll(mockResponseWriter.Body)
+		messages := recorder.messages()
 
-		if err != nil {
-			t.Error("Could not read the response body into bytes")
+		if len(messages) != test.ExpectedMessages {
+			t.Errorf("notifyOfPwnage() when %s sent %d emails; expected: %d", test.Name, len(messages), test.ExpectedMessages)
 
 			continue
 		}
 
-		err = json.Unmarshal(bodyBytes, &mockResponseJSON)
-
-		if err != nil {
-			t.Error("Could not parse the response body bytes into JSON")
-
+		if test.ExpectedMessages == 0 {
 			continue
 		}
 
-		if value, _ := keys.get(test.Key); mockResponseWriter.Code != test.ExpectedStatusCode || mockResponseJSON != test.ExpectedResponse || value != test.ExpectedValue || mockResponseWriter.Header().Get("update") != test.ExpectedUpdateHeader {
-			t.Errorf(
-				`HandlePutKey(context) = Status Code: HTTP/%d, Response: "%v", keys[%s] = "%s", and the update header = "%s"; expected: HTTP/%d, Response: "%v", keys[%s] = "%s", and the update header = "%s"`,
-				mockResponseWriter.Code,
-				mockResponseJSON,
-				test.Key,
-				value,
-				mockResponseWriter.Header().Get("update"),
-				test.ExpectedStatusCode,
-				test.ExpectedResponse,
-				test.Key,
-				test.ExpectedValue,
-				test.ExpectedUpdateHeader,
-			)
+		message := messages[0]
+
+		if message.To != "someone@example.com" || !strings.Contains(message.Subject, test.ExpectedSubject) || !strings.Contains(message.Body, test.ExpectedInBody) || strings.Join(message.Tags, ",") != strings.Join(test.ExpectedTags, ",") {
+			t.Errorf("notifyOfPwnage() when %s sent %+v; expected: to someone@example.com with %q in the subject, %q in the body and tags %v", test.Name, message, test.ExpectedSubject, test.ExpectedInBody, test.ExpectedTags)
 		}
 	}
 }
 
 // Need to test the following:
-// If the route does not exist then a HTTP/404 status is returned,
-//     error field is true, the update field is false, and the
-//	   message is the "ErrorBadRequest" constant
-// If the route exists then the route responds as expected
-func TestKeyManagingRouter(t *testing.T) {
-	var router *gin.Engine
-	var mockResponseJSON Response
-
-	tests := []struct {
-		ExpectedStatusCode   int
-		ExpectedResponse     Response
-		ExpectedUpdateHeader string
-		HandlerFuncs         map[string]func(c *gin.Context)
-	}{
-		{
-			ExpectedStatusCode: 404,
-			ExpectedResponse: Response{
-				Error:   true,
-				Message: ErrorBadRequest,
-			},
-			HandlerFuncs: map[string]func(c *gin.Context){},
-		},
-		{
-			ExpectedStatusCode: 200,
-			ExpectedResponse: Response{
-				Error:   false,
-				Message: "",
-			},
-			HandlerFuncs: map[string]func(c *gin.Context){
-				"/test": func(c *gin.Context) {
-					c.JSON(200, Response{false, ""})
-				},
-			},
-		},
-	}
-
-	for _, test := range tests {
-		router = NewKeyManagingRouter()
-
-		for route, handlerFunc := range test.HandlerFuncs {
-			router.GET(route, handlerFunc)
-		}
+// Email is sent through the Mailgun API with the sender, recipient, subject, body and tags
+// Mailgun errors are returned
+func TestMailgunSender(t *testing.T) {
+	var (
+		form       url.Values
+		statusCode = http.StatusOK
+	)
 
-		mockRequest, err := http.NewRequest("GET", "/test", &bytes.Reader{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseMultipartForm(1 << 20)
+		form = r.Form
 
-		if err != nil {
-			t.Fatal("could not create the mock request")
+		if r.URL.Path != "/v3/mail.example.com/messages" {
+			t.Errorf("mailgun request path = %s; expected: /v3/mail.example.com/messages", r.URL.Path)
 		}
 
-		mockResponseWriter := httptest.NewRecorder()
-
-		router.ServeHTTP(mockResponseWriter, mockRequest)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		w.Write([]byte(`{"id": "<message@mail.example.com>", "message": "Queued. Thank you."}`))
+	}))
 
-		bodyBytes, err := ioutil.ReadAll(mockResponseWriter.Body)
-
-		if err != nil {
-			t.Error("Could not read the response body into bytes")
-
-			continue
-		}
+	defer server.Close()
 
-		err = json.Unmarshal(bodyBytes, &mockResponseJSON)
+	sender := newMailgunSender("mail.example.com", "key-example")
+	sender.client.(interface{ SetAPIBase(string) }).SetAPIBase(server.URL + "/v3")
 
-		if err != nil {
-			t.Error("Could not parse the response body bytes into JSON")
+	err := sender.sendEmail(context.Background(), emailMessage{To: "someone@example.com", Subject: "You've been pwned", Body: "Adobe", Tags: []string{notificationBreach}})
 
-			continue
-		}
-
-		if mockResponseWriter.Code != test.ExpectedStatusCode || mockResponseJSON != test.ExpectedResponse {
-			t.Errorf(
-				`router.ServeHTTP(mockResponseWriter, mockRequest) = Status Code: HTTP/%d and Response: "%v"; expected HTTP/%d and Response: "%v"`,
-				mockResponseWriter.Code,
-				mockResponseJSON,
-				test.ExpectedStatusCode,
-				test.ExpectedResponse,
-			)
-		}
-	}
-}
-
-// Need to test the following:
-// If the reader provided does not provide valid JSON then an error is returned
-// If the reader provided does provide valid JSON then the expected key/value pairs exist in keys.keys
-func TestLoadKeyDataKeys(t *testing.T) {
-	tests := []struct {
-		err    bool
-		pairs  map[string]string
-		reader io.Reader
-	}{
-		{
-			err:    true,
-			pairs:  map[string]string{},
-			reader: strings.NewReader(`{"test":"not passed"`),
-		},
-		{
-			err: false,
-			pairs: map[string]string{
-				"test": "passed",
-			},
-			reader: strings.NewReader(`{"test":"passed"}`),
-		},
-	}
-
-	for _, test := range tests {
-		err := LoadKeyDataKeys(test.reader)
-
-		if expectedErr := err != nil; expectedErr != test.err {
-			if test.err {
-				t.Error("Expected an error")
-			} else {
-				t.Error("Did not expected error:", err)
-			}
-
-			continue
-		}
-
-		for key, expectedValue := range test.pairs {
-			if value, exists := keys.get(key); !exists || value != expectedValue {
-				t.Errorf(
-					`LoadKeyDataKeys(test.reader) = %v: expected "%v"`,
-					keys.cloneKeys(), test.pairs,
-				)
-			}
-		}
+	if err != nil {
+		t.Fatalf("mailgunSender.sendEmail() = %v; expected: <nil>", err)
 	}
-}
 
-// Need to test the following:
-// If the reader provided works,
-//     then the key/value pairs that existed in keys.keys were written to the writer,
-//     otherwise an error is returned
-func TestUnloadKeyDataKeys(t *testing.T) {
-	keys.keys = make(map[string]string)
-
-	tests := []struct {
-		expectedBytes []byte
-		err           bool
-		pairs         map[string]string
-		writer        io.Writer
-	}{
-		{
-			expectedBytes: []byte("{\"test\":\"passed\"}\n"),
-			err:           false,
-			pairs: map[string]string{
-				"test": "passed",
-			},
-			writer: &bytes.Buffer{},
-		},
+	if form.Get("from") != defaultEmailFrom || form.Get("to") != "someone@example.com" || form.Get("subject") != "You've been pwned" || form.Get("text") != "Adobe" || form.Get("o:tag") != notificationBreach {
+		t.Errorf("mailgun request form = %v; expected: the sender, recipient, subject, body and tag", form)
 	}
 
-	for _, test := range tests {
-		for key, value := range test.pairs {
-			keys.set(key, value)
-		}
-
-		err := UnloadKeyDataKeys(test.writer)
-
-		if expectedErr := err != nil; expectedErr != test.err {
-			if test.err {
-				t.Error("Expected an error")
-			} else {
-				t.Error("Did not expected error:", err)
-			}
+	statusCode = http.StatusUnauthorized
 
-			continue
-		}
-
-		if (test.writer.(*bytes.Buffer)).String() != string(test.expectedBytes) {
-			t.Errorf(
-				`UnloadKeyDataKeys(test.writer) = "%s": expected "%s"`,
-				(test.writer.(*bytes.Buffer)).Bytes(), test.expectedBytes,
-			)
-		}
+	if err = sender.sendEmail(context.Background(), emailMessage{To: "someone@example.com", Subject: "You've been pwned"}); err == nil {
+		t.Error("mailgunSender.sendEmail() when unauthorized = <nil>; expected: an error")
 	}
 }
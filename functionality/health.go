@@ -0,0 +1,118 @@
+package functionality
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+type readinessCheckResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type readinessResponse struct {
+	Ready  bool                            `json:"ready"`
+	Checks map[string]readinessCheckResult `json:"checks"`
+}
+
+var (
+	readinessChecksMutex sync.Mutex
+	readinessChecks      = map[string]func() error{
+		"data_directory": checkDataDirectoryWritable,
+		"email":          checkEmailConfigured,
+		"hibp_api_key":   checkHIBPAPIKeyPresent,
+	}
+
+	// dataDirectory is where everything the service persists is stored
+	dataDirectory = "./data"
+)
+
+func init() {
+	if directory, exists := os.LookupEnv("dataDirectory"); exists {
+		dataDirectory = directory
+	}
+}
+
+// registerReadinessCheck adds a dependency check to the ones run by Readiness,
+// replacing any existing check with the same name
+func registerReadinessCheck(name string, check func() error) {
+	readinessChecksMutex.Lock()
+
+	defer readinessChecksMutex.Unlock()
+
+	readinessChecks[name] = check
+}
+
+func checkDataDirectoryWritable() error {
+	testFile, err := ioutil.TempFile(dataDirectory, ".readyz")
+
+	if err != nil {
+		return err
+	}
+
+	testFile.Close()
+
+	return os.Remove(testFile.Name())
+}
+
+func checkHIBPAPIKeyPresent() error {
+	if hibpAPIKey == "" {
+		return errors.New("the HIBP API key is not configured")
+	}
+
+	return nil
+}
+
+func runReadinessChecks() readinessResponse {
+	readinessChecksMutex.Lock()
+
+	checks := make(map[string]func() error, len(readinessChecks))
+
+	for name, check := range readinessChecks {
+		checks[name] = check
+	}
+
+	readinessChecksMutex.Unlock()
+
+	response := readinessResponse{
+		Ready:  true,
+		Checks: make(map[string]readinessCheckResult, len(checks)),
+	}
+
+	for name, check := range checks {
+		if err := check(); err != nil {
+			response.Ready = false
+			response.Checks[name] = readinessCheckResult{OK: false, Error: err.Error()}
+
+			continue
+		}
+
+		response.Checks[name] = readinessCheckResult{OK: true}
+	}
+
+	return response
+}
+
+// Health reports that the process is alive, it does not check any dependencies
+func Health(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"alive": true})
+}
+
+// Readiness checks every dependency of the service, responding with
+// HTTP/503 and the breakdown of the checks if any of them fail
+func Readiness(c *gin.Context) {
+	response := runReadinessChecks()
+
+	if !response.Ready {
+		c.JSON(http.StatusServiceUnavailable, response)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
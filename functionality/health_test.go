@@ -0,0 +1,83 @@
+package functionality
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Need to test the following:
+// If every check passes then a HTTP/200 status is returned and ready is true
+// If any check fails then a HTTP/503 status is returned, ready is false,
+// and the failing check has its error in the breakdown
+func TestReadiness(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tempDirectory, err := ioutil.TempDir("", "readyz")
+
+	if err != nil {
+		t.Fatal("could not create the temporary data directory")
+	}
+
+	defer os.RemoveAll(tempDirectory)
+
+	dataDirectory = tempDirectory
+	hibpAPIKey = "key"
+
+	// Only the checks which don't depend on the rest of the package being initialized are kept
+	originalReadinessChecks := readinessChecks
+	readinessChecks = map[string]func() error{
+		"data_directory": checkDataDirectoryWritable,
+		"hibp_api_key":   checkHIBPAPIKeyPresent,
+	}
+
+	defer func() { readinessChecks = originalReadinessChecks }()
+
+	router := gin.New()
+	router.GET("/readyz", Readiness)
+
+	tests := []struct {
+		ExpectedStatusCode int
+		ExpectedReady      bool
+		FailingCheck       string
+	}{
+		{ExpectedStatusCode: 200, ExpectedReady: true},
+		{ExpectedStatusCode: 503, ExpectedReady: false, FailingCheck: "test_dependency"},
+	}
+
+	for _, test := range tests {
+		registerReadinessCheck("test_dependency", func() error {
+			if test.FailingCheck != "" {
+				return errors.New("unavailable")
+			}
+
+			return nil
+		})
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		router.ServeHTTP(mockResponseWriter, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		var response readinessResponse
+
+		if err := json.NewDecoder(mockResponseWriter.Body).Decode(&response); err != nil {
+			t.Error("Could not parse the response body into JSON")
+
+			continue
+		}
+
+		if mockResponseWriter.Code != test.ExpectedStatusCode || response.Ready != test.ExpectedReady {
+			t.Errorf("Readiness(context) = HTTP/%d, ready = %t; expected: HTTP/%d, ready = %t", mockResponseWriter.Code, response.Ready, test.ExpectedStatusCode, test.ExpectedReady)
+		}
+
+		if test.FailingCheck != "" && response.Checks[test.FailingCheck].Error != "unavailable" {
+			t.Errorf(`Readiness(context) check %s = %v; expected the error "unavailable"`, test.FailingCheck, response.Checks[test.FailingCheck])
+		}
+	}
+}
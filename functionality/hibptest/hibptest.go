@@ -0,0 +1,475 @@
+// Package hibptest provides a fake Have I Been Pwned API serving fixture data, so that the
+// pwnage checks can be tested and developed against without reaching the real service
+package hibptest
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoint is one of the HIBP endpoints the fake serves
+type Endpoint string
+
+const (
+	BreachedAccount Endpoint = "breachedaccount"
+	Breaches        Endpoint = "breaches"
+	PasteAccount    Endpoint = "pasteaccount"
+	BreachedDomain  Endpoint = "breacheddomain"
+	Range           Endpoint = "range"
+)
+
+// APIPath is the path the HIBP endpoints are served under, like the real API only v3 is
+// served; the range endpoint is served from the root, like the Pwned Passwords API
+const APIPath = "/api/v3"
+
+// paddedRangeLines is how many lines a range response is padded to when padding is requested
+const paddedRangeLines = 800
+
+var hashPrefixPattern = regexp.MustCompile(`^[0-9A-Fa-f]{5}$`)
+
+// Breach is a breach as HIBP describes it
+type Breach struct {
+	Name         string   `json:"Name"`
+	Title        string   `json:"Title"`
+	Domain       string   `json:"Domain"`
+	BreachDate   string   `json:"BreachDate"`
+	AddedDate    string   `json:"AddedDate"`
+	ModifiedDate string   `json:"ModifiedDate"`
+	PwnCount     int64    `json:"PwnCount"`
+	Description  string   `json:"Description"`
+	LogoPath     string   `json:"LogoPath"`
+	DataClasses  []string `json:"DataClasses"`
+	IsVerified   bool     `json:"IsVerified"`
+	IsFabricated bool     `json:"IsFabricated"`
+	IsSensitive  bool     `json:"IsSensitive"`
+	IsRetired    bool     `json:"IsRetired"`
+	IsSpamList   bool     `json:"IsSpamList"`
+}
+
+// Paste is a paste as HIBP describes it
+type Paste struct {
+	Source     string     `json:"Source"`
+	ID         string     `json:"Id"`
+	Title      string     `json:"Title,omitempty"`
+	Date       *time.Time `json:"Date,omitempty"`
+	EmailCount int64      `json:"EmailCount"`
+}
+
+// Fixtures is the data the fake serves: accounts list the names of the breaches they are in,
+// domains map each breached alias to the names of its breaches and passwords are in plain
+// text with how many times they have been seen, accounts and domains match in any case
+type Fixtures struct {
+	Breaches  []Breach                       `json:"breaches"`
+	Accounts  map[string][]string            `json:"accounts"`
+	Pastes    map[string][]Paste             `json:"pastes"`
+	Domains   map[string]map[string][]string `json:"domains"`
+	Passwords map[string]int64               `json:"passwords"`
+}
+
+// LoadFixtures reads fixtures from JSON
+func LoadFixtures(reader io.Reader) (Fixtures, error) {
+	var fixtures Fixtures
+
+	return fixtures, json.NewDecoder(reader).Decode(&fixtures)
+}
+
+// Fault is injected into an endpoint's responses: Latency delays them, Timeout holds them until
+// the client gives up, and StatusCode replaces them with an error, setting Retry-After for
+// HTTP/429. Times limits the fault to that many requests, zero being every request
+type Fault struct {
+	StatusCode int
+	RetryAfter time.Duration
+	Latency    time.Duration
+	Timeout    bool
+	Times      int
+}
+
+// Server is a fake HIBP and Pwned Passwords API, both are served from the one URL,
+// HIBP under APIPath and Pwned Passwords from the root
+type Server struct {
+	*httptest.Server
+
+	breaches  map[string]Breach
+	accounts  map[string][]string
+	pastes    map[string][]Paste
+	domains   map[string]map[string][]string
+	passwords map[string]int64
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	apiKey   string
+	latency  time.Duration
+	faults   map[Endpoint]*Fault
+	requests map[Endpoint]int
+}
+
+// NewServer starts a fake serving the fixtures, the caller should Close it when finished
+func NewServer(fixtures Fixtures) *Server {
+	server := NewUnstartedServer(fixtures)
+
+	server.Start()
+
+	return server
+}
+
+// NewUnstartedServer returns a fake which isn't listening yet, so that its listener can be
+// replaced before calling Start, the caller should Close it when finished
+func NewUnstartedServer(fixtures Fixtures) *Server {
+	server := &Server{
+		breaches:  make(map[string]Breach, len(fixtures.Breaches)),
+		accounts:  make(map[string][]string, len(fixtures.Accounts)),
+		pastes:    make(map[string][]Paste, len(fixtures.Pastes)),
+		domains:   make(map[string]map[string][]string, len(fixtures.Domains)),
+		passwords: make(map[string]int64, len(fixtures.Passwords)),
+		closed:    make(chan struct{}),
+		faults:    make(map[Endpoint]*Fault),
+		requests:  make(map[Endpoint]int),
+	}
+
+	for _, breach := range fixtures.Breaches {
+		server.breaches[strings.ToLower(breach.Name)] = breach
+	}
+
+	for account, breachNames := range fixtures.Accounts {
+		server.accounts[strings.ToLower(account)] = breachNames
+	}
+
+	for account, pastes := range fixtures.Pastes {
+		server.pastes[strings.ToLower(account)] = pastes
+	}
+
+	for domain, aliases := range fixtures.Domains {
+		server.domains[strings.ToLower(domain)] = aliases
+	}
+
+	for password, count := range fixtures.Passwords {
+		passwordHash := sha1.Sum([]byte(password))
+
+		server.passwords[strings.ToUpper(hex.EncodeToString(passwordHash[:]))] = count
+	}
+
+	server.Server = httptest.NewUnstartedServer(server)
+
+	return server
+}
+
+// Close releases any requests being held by a timeout before shutting the server down
+func (s *Server) Close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+
+	s.Server.Close()
+}
+
+// RequireAPIKey makes the endpoints which need an API key reject requests without this one,
+// an empty key accepts every request
+func (s *Server) RequireAPIKey(apiKey string) {
+	s.mu.Lock()
+
+	defer s.mu.Unlock()
+
+	s.apiKey = apiKey
+}
+
+// SetLatency delays every response
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+
+	defer s.mu.Unlock()
+
+	s.latency = latency
+}
+
+// SetFault injects the fault into the endpoint's responses, replacing any fault already set for it
+func (s *Server) SetFault(endpoint Endpoint, fault Fault) {
+	s.mu.Lock()
+
+	defer s.mu.Unlock()
+
+	s.faults[endpoint] = &fault
+}
+
+// ClearFaults stops injecting faults, responses are served from the fixtures again
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+
+	defer s.mu.Unlock()
+
+	s.faults = make(map[Endpoint]*Fault)
+}
+
+// Requests is how many requests the endpoint has been sent, including rejected ones
+func (s *Server) Requests(endpoint Endpoint) int {
+	s.mu.Lock()
+
+	defer s.mu.Unlock()
+
+	return s.requests[endpoint]
+}
+
+// nextFault counts the request and returns the latency and fault it should be served with
+func (s *Server) nextFault(endpoint Endpoint) (time.Duration, string, Fault) {
+	s.mu.Lock()
+
+	defer s.mu.Unlock()
+
+	s.requests[endpoint]++
+
+	var fault Fault
+
+	if injected, exists := s.faults[endpoint]; exists {
+		fault = *injected
+
+		if injected.Times > 0 {
+			if injected.Times--; injected.Times == 0 {
+				delete(s.faults, endpoint)
+			}
+		}
+	}
+
+	return s.latency + fault.Latency, s.apiKey, fault
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path, isHIBP := r.URL.Path, strings.HasPrefix(r.URL.Path, APIPath+"/")
+
+	if isHIBP {
+		path = strings.TrimPrefix(path, APIPath)
+	}
+
+	parts := strings.SplitN(strings.Trim(path, "/"), "/", 2)
+	endpoint, parameter := Endpoint(parts[0]), ""
+
+	if len(parts) == 2 {
+		parameter = parts[1]
+	}
+
+	// Unversioned and retired API versions' HIBP paths aren't found, as they aren't on HIBP
+	switch {
+	case isHIBP && endpoint == Breaches && parameter == "":
+	case isHIBP && (endpoint == BreachedAccount || endpoint == PasteAccount || endpoint == BreachedDomain) && parameter != "":
+	case !isHIBP && endpoint == Range && parameter != "":
+	default:
+		writeError(w, http.StatusNotFound, "")
+
+		return
+	}
+
+	latency, apiKey, fault := s.nextFault(endpoint)
+
+	if latency > 0 || fault.Timeout {
+		var timeout <-chan time.Time
+
+		if !fault.Timeout {
+			timer := time.NewTimer(latency)
+
+			defer timer.Stop()
+
+			timeout = timer.C
+		}
+
+		select {
+		case <-timeout:
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+
+	// HIBP turns away requests without a user agent
+	if r.UserAgent() == "" {
+		writeError(w, http.StatusForbidden, "Requests must include a user agent.")
+
+		return
+	}
+
+	if apiKey != "" && endpoint != Breaches && endpoint != Range && r.Header.Get("hibp-api-key") != apiKey {
+		writeError(w, http.StatusUnauthorized, "Access denied due to missing or invalid hibp-api-key.")
+
+		return
+	}
+
+	if fault.StatusCode == http.StatusTooManyRequests {
+		retryAfter := int((fault.RetryAfter + time.Second - 1) / time.Second)
+
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeError(w, http.StatusTooManyRequests, fmt.Sprintf("Rate limit is exceeded. Try again in %d seconds.", retryAfter))
+
+		return
+	}
+
+	if fault.StatusCode != 0 {
+		writeError(w, fault.StatusCode, http.StatusText(fault.StatusCode))
+
+		return
+	}
+
+	switch endpoint {
+	case BreachedAccount:
+		s.serveBreachedAccount(w, r, parameter)
+	case Breaches:
+		s.serveBreaches(w, r)
+	case PasteAccount:
+		s.servePastes(w, parameter)
+	case BreachedDomain:
+		s.serveBreachedDomain(w, parameter)
+	case Range:
+		s.serveRange(w, r, parameter)
+	}
+}
+
+// serveBreachedAccount responds like HIBP's breachedaccount, honouring the
+// truncateResponse, domain and includeUnverified parameters; like v3 the
+// breaches are truncated to their names unless truncateResponse is false
+func (s *Server) serveBreachedAccount(w http.ResponseWriter, r *http.Request, account string) {
+	query := r.URL.Query()
+
+	var breaches []Breach
+
+	for _, breachName := range s.accounts[strings.ToLower(account)] {
+		breach, exists := s.breaches[strings.ToLower(breachName)]
+
+		if !exists {
+			breach = Breach{Name: breachName, Title: breachName, IsVerified: true}
+		}
+
+		if domain := query.Get("domain"); domain != "" && !strings.EqualFold(breach.Domain, domain) {
+			continue
+		}
+
+		if query.Get("includeUnverified") == "false" && !breach.IsVerified {
+			continue
+		}
+
+		breaches = append(breaches, breach)
+	}
+
+	if len(breaches) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	if query.Get("truncateResponse") != "false" {
+		names := make([]map[string]string, len(breaches))
+
+		for i, breach := range breaches {
+			names[i] = map[string]string{"Name": breach.Name}
+		}
+
+		writeJSON(w, names)
+
+		return
+	}
+
+	writeJSON(w, breaches)
+}
+
+// serveBreaches responds with every breach, or those of the domain parameter, ordered by name
+func (s *Server) serveBreaches(w http.ResponseWriter, r *http.Request) {
+	domain := r.URL.Query().Get("domain")
+	breaches := []Breach{}
+
+	for _, breach := range s.breaches {
+		if domain == "" || strings.EqualFold(breach.Domain, domain) {
+			breaches = append(breaches, breach)
+		}
+	}
+
+	sort.Slice(breaches, func(i, j int) bool { return breaches[i].Name < breaches[j].Name })
+
+	writeJSON(w, breaches)
+}
+
+func (s *Server) servePastes(w http.ResponseWriter, account string) {
+	pastes := s.pastes[strings.ToLower(account)]
+
+	if len(pastes) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	writeJSON(w, pastes)
+}
+
+func (s *Server) serveBreachedDomain(w http.ResponseWriter, domain string) {
+	aliases, exists := s.domains[strings.ToLower(domain)]
+
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	writeJSON(w, aliases)
+}
+
+// serveRange responds like the Pwned Passwords range API, with lines of SUFFIX:COUNT
+// for every hash starting with the prefix, padded with zero counts when asked to be
+func (s *Server) serveRange(w http.ResponseWriter, r *http.Request, prefix string) {
+	if !hashPrefixPattern.MatchString(prefix) {
+		writeError(w, http.StatusBadRequest, "The hash prefix was not in a valid format")
+
+		return
+	}
+
+	prefix = strings.ToUpper(prefix)
+
+	var lines []string
+
+	for hash, count := range s.passwords {
+		if strings.HasPrefix(hash, prefix) {
+			lines = append(lines, fmt.Sprintf("%s:%d", hash[5:], count))
+		}
+	}
+
+	if r.Header.Get("Add-Padding") == "true" {
+		for i := 0; len(lines) < paddedRangeLines; i++ {
+			padding := sha1.Sum([]byte(prefix + strconv.Itoa(i)))
+
+			lines = append(lines, strings.ToUpper(hex.EncodeToString(padding[:]))[5:]+":0")
+		}
+	}
+
+	sort.Strings(lines)
+
+	w.Header().Set("Content-Type", "text/plain")
+
+	for _, line := range lines {
+		io.WriteString(w, line+"\r\n")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeError responds with the status code and HIBP's error body, or no body without a message
+func writeError(w http.ResponseWriter, statusCode int, message string) {
+	if message == "" {
+		w.WriteHeader(statusCode)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"statusCode": statusCode, "message": message})
+}
@@ -0,0 +1,194 @@
+package hibptest
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, server *Server, path string, headers map[string]string) (*http.Response, string) {
+	request, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+	request.Header.Set("User-Agent", "hibptest")
+
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	resp, err := server.Client().Do(request)
+
+	if err != nil {
+		t.Fatalf("GET %s = %v; expected: a response", path, err)
+	}
+
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	return resp, string(body)
+}
+
+// Need to test the following:
+// Each HIBP endpoint is served from the fixtures under the v3 API path, and only there
+// The range endpoint is served from the root, like the Pwned Passwords API
+// Accounts, pastes and domains which aren't in the fixtures are HTTP/404
+// The breachedaccount parameters filter the breaches, which are truncated unless asked not to be
+// The API key is enforced on the endpoints which need it
+func TestServer(t *testing.T) {
+	passwordHash := sha1.Sum([]byte("password"))
+	hexHash := strings.ToUpper(hex.EncodeToString(passwordHash[:]))
+
+	server := NewServer(Fixtures{
+		Breaches: []Breach{
+			{Name: "Adobe", Domain: "adobe.com", IsVerified: true},
+			{Name: "Unverified", Domain: "unverified.example.com"},
+		},
+		Accounts:  map[string][]string{"Someone@example.com": {"Adobe", "Unverified"}},
+		Pastes:    map[string][]Paste{"someone@example.com": {{Source: "Pastebin", ID: "8Q0BvKD8", EmailCount: 139}}},
+		Domains:   map[string]map[string][]string{"example.com": {"someone": {"Adobe"}}},
+		Passwords: map[string]int64{"password": 9659365},
+	})
+
+	defer server.Close()
+
+	server.RequireAPIKey("key")
+
+	key := map[string]string{"hibp-api-key": "key"}
+
+	tests := []struct {
+		Path               string
+		Headers            map[string]string
+		ExpectedStatusCode int
+		ExpectedInBody     string
+		UnexpectedInBody   string
+	}{
+		{Path: "/api/v3/breachedaccount/someone%40example.com", Headers: key, ExpectedStatusCode: 200, ExpectedInBody: `[{"Name":"Adobe"},{"Name":"Unverified"}]`},
+		{Path: "/api/v3/breachedaccount/SOMEONE@example.com?includeUnverified=false&truncateResponse=false", Headers: key, ExpectedStatusCode: 200, ExpectedInBody: `"Domain":"adobe.com"`, UnexpectedInBody: "Unverified"},
+		{Path: "/api/v3/breachedaccount/someone@example.com?domain=adobe.com", Headers: key, ExpectedStatusCode: 200, ExpectedInBody: `[{"Name":"Adobe"}]`},
+		{Path: "/api/v3/breachedaccount/nobody@example.com", Headers: key, ExpectedStatusCode: 404},
+		{Path: "/api/v3/breachedaccount/someone@example.com", ExpectedStatusCode: 401},
+		{Path: "/api/v3/breachedaccount/someone@example.com", Headers: map[string]string{"hibp-api-key": "wrong"}, ExpectedStatusCode: 401},
+		{Path: "/breachedaccount/someone@example.com", Headers: key, ExpectedStatusCode: 404},
+		{Path: "/api/v2/breachedaccount/someone@example.com", Headers: key, ExpectedStatusCode: 404},
+		{Path: "/api/v3/breaches", ExpectedStatusCode: 200, ExpectedInBody: `"Name":"Unverified"`},
+		{Path: "/api/v3/breaches?domain=adobe.com", ExpectedStatusCode: 200, ExpectedInBody: `"Name":"Adobe"`, UnexpectedInBody: "Unverified"},
+		{Path: "/breaches", ExpectedStatusCode: 404},
+		{Path: "/api/v3/pasteaccount/someone@example.com", Headers: key, ExpectedStatusCode: 200, ExpectedInBody: `"Id":"8Q0BvKD8"`},
+		{Path: "/api/v3/pasteaccount/nobody@example.com", Headers: key, ExpectedStatusCode: 404},
+		{Path: "/api/v3/breacheddomain/EXAMPLE.com", Headers: key, ExpectedStatusCode: 200, ExpectedInBody: `{"someone":["Adobe"]}`},
+		{Path: "/api/v3/breacheddomain/example.org", Headers: key, ExpectedStatusCode: 404},
+		{Path: "/api/v3/breacheddomain/example.com", ExpectedStatusCode: 401},
+		{Path: "/range/" + hexHash[:5], ExpectedStatusCode: 200, ExpectedInBody: hexHash[5:] + ":9659365\r\n"},
+		{Path: "/range/" + strings.ToLower(hexHash[:5]), ExpectedStatusCode: 200, ExpectedInBody: hexHash[5:] + ":9659365\r\n"},
+		{Path: "/range/XYZ", ExpectedStatusCode: 400},
+		{Path: "/api/v3/range/" + hexHash[:5], ExpectedStatusCode: 404},
+		{Path: "/unknown", ExpectedStatusCode: 404},
+	}
+
+	for _, test := range tests {
+		resp, body := get(t, server, test.Path, test.Headers)
+
+		if resp.StatusCode != test.ExpectedStatusCode || !strings.Contains(body, test.ExpectedInBody) || (test.UnexpectedInBody != "" && strings.Contains(body, test.UnexpectedInBody)) {
+			t.Errorf("GET %s = HTTP/%d %s; expected: HTTP/%d with %q and without %q", test.Path, resp.StatusCode, body, test.ExpectedStatusCode, test.ExpectedInBody, test.UnexpectedInBody)
+		}
+	}
+
+	if requests := server.Requests(BreachedAccount); requests != 6 {
+		t.Errorf("Server.Requests(BreachedAccount) = %d; expected: 6", requests)
+	}
+}
+
+// Need to test the following:
+// Range responses are padded with zero counts when padding is requested
+func TestServerRangePadding(t *testing.T) {
+	server := NewServer(Fixtures{})
+
+	defer server.Close()
+
+	_, body := get(t, server, "/range/21BD1", map[string]string{"Add-Padding": "true"})
+
+	lines := strings.Split(strings.TrimSuffix(body, "\r\n"), "\r\n")
+
+	if len(lines) != paddedRangeLines || !strings.HasSuffix(lines[0], ":0") || len(strings.Split(lines[0], ":")[0]) != 35 {
+		t.Errorf("padded range response = %d lines starting %q; expected: %d lines of 35 character suffixes with a count of 0", len(lines), lines[0], paddedRangeLines)
+	}
+}
+
+// Need to test the following:
+// Injected status codes replace the response, with Retry-After for HTTP/429
+// Faults limited to a number of requests stop after them
+// Injected latency delays the response
+// Timeouts hold the response until the client gives up
+// Requests without a user agent are turned away
+func TestServerFaults(t *testing.T) {
+	server := NewServer(Fixtures{Breaches: []Breach{{Name: "Adobe"}}})
+
+	defer server.Close()
+
+	server.SetFault(Breaches, Fault{StatusCode: http.StatusTooManyRequests, RetryAfter: 1500 * time.Millisecond, Times: 1})
+
+	resp, body := get(t, server, APIPath+"/breaches", nil)
+
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "2" || !strings.Contains(body, "Try again in 2 seconds") {
+		t.Errorf("GET /breaches when rate limited = HTTP/%d, Retry-After %s, %s; expected: HTTP/429, Retry-After 2", resp.StatusCode, resp.Header.Get("Retry-After"), body)
+	}
+
+	if resp, _ = get(t, server, APIPath+"/breaches", nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /breaches after the fault's one request = HTTP/%d; expected: HTTP/200", resp.StatusCode)
+	}
+
+	server.SetFault(Breaches, Fault{StatusCode: http.StatusBadGateway})
+
+	for i := 0; i < 2; i++ {
+		if resp, _ = get(t, server, APIPath+"/breaches", nil); resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("GET /breaches with a server error = HTTP/%d; expected: HTTP/502", resp.StatusCode)
+		}
+	}
+
+	server.ClearFaults()
+	server.SetLatency(100 * time.Millisecond)
+
+	start := time.Now()
+
+	if resp, _ = get(t, server, APIPath+"/breaches", nil); resp.StatusCode != http.StatusOK || time.Since(start) < 100*time.Millisecond {
+		t.Errorf("GET /breaches with latency = HTTP/%d after %s; expected: HTTP/200 after 100ms", resp.StatusCode, time.Since(start))
+	}
+
+	server.SetLatency(0)
+	server.SetFault(Breaches, Fault{Timeout: true})
+
+	client := server.Client()
+	client.Timeout = 100 * time.Millisecond
+
+	request, _ := http.NewRequest(http.MethodGet, server.URL+APIPath+"/breaches", nil)
+	request.Header.Set("User-Agent", "hibptest")
+
+	if resp, err := client.Do(request); err == nil {
+		resp.Body.Close()
+
+		t.Errorf("GET /breaches when timing out = HTTP/%d; expected: a timeout", resp.StatusCode)
+	}
+
+	server.ClearFaults()
+
+	request, _ = http.NewRequest(http.MethodGet, server.URL+APIPath+"/breaches", nil)
+
+	// Go's client sends its own user agent unless the header is set to nothing
+	request.Header.Set("User-Agent", "")
+
+	if resp, err := http.DefaultClient.Do(request); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET /breaches without a user agent = %v, %v; expected: HTTP/403", resp, err)
+	}
+
+	var breaches []Breach
+
+	_, body = get(t, server, APIPath+"/breaches", nil)
+
+	if err := json.Unmarshal([]byte(body), &breaches); err != nil || len(breaches) != 1 {
+		t.Errorf("GET /breaches once the faults were cleared = %s; expected: the Adobe breach", body)
+	}
+}
@@ -0,0 +1,157 @@
+package functionality
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type loggerContextKey struct{}
+
+var (
+	// Matches email addresses, including ones which have been query escaped
+	// like they are in the URLs of HIBP requests (and so in their errors)
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+(@|%40)[A-Za-z0-9\-]+(\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`)
+	phonePattern = regexp.MustCompile(`\+[1-9][0-9]{7,14}`)
+
+	// logHashKey keys the hashes which stand in for email addresses and phone numbers,
+	// without it being set the hashes can't be correlated between runs of the service
+	logHashKey = loadLogHashKey()
+
+	logger = newLogger(os.Stdout, logLevelFromEnv())
+)
+
+func loadLogHashKey() []byte {
+	if key, exists := os.LookupEnv("logHashKey"); exists && key != "" {
+		return []byte(key)
+	}
+
+	key := make([]byte, 32)
+
+	rand.Read(key)
+
+	return key
+}
+
+func logLevelFromEnv() slog.Level {
+	var level slog.Level
+
+	if err := level.UnmarshalText([]byte(os.Getenv("logLevel"))); err != nil {
+		return slog.LevelInfo
+	}
+
+	return level
+}
+
+func newLogger(writer io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(writer, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redactAttr,
+	}))
+}
+
+// hashPII replaces a piece of PII with a keyed hash of it, prefixed with
+// the kind of PII it was, so that the same value can be followed through
+// the logs without the value itself being in them
+func hashPII(kind, value string) string {
+	mac := hmac.New(sha256.New, logHashKey)
+
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(value))))
+
+	return kind + "#" + hex.EncodeToString(mac.Sum(nil))[:12]
+}
+
+// redactPII hashes every email address and phone number found in the string
+func redactPII(s string) string {
+	s = emailPattern.ReplaceAllStringFunc(s, func(email string) string {
+		return hashPII("email", strings.Replace(email, "%40", "@", 1))
+	})
+
+	return phonePattern.ReplaceAllStringFunc(s, func(phone string) string {
+		return hashPII("phone", phone)
+	})
+}
+
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		if attr.Key == "phone" {
+			return slog.String(attr.Key, hashPII("phone", attr.Value.String()))
+		}
+
+		return slog.String(attr.Key, redactPII(attr.Value.String()))
+	case slog.KindAny:
+		if err, ok := attr.Value.Any().(error); ok {
+			return slog.String(attr.Key, redactPII(err.Error()))
+		}
+	}
+
+	return attr
+}
+
+func newID() string {
+	id := make([]byte, 8)
+
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+func contextWithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, l)
+}
+
+// loggerFromContext returns the logger carried by the context, which has the request and job IDs
+// attached to it, falling back to the package logger for contexts without one
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return l
+	}
+
+	return logger
+}
+
+// RequestLogger gives every request an ID, taken from the X-Request-ID header when
+// the client provides one, and logs the request once it has been handled
+func RequestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader("X-Request-ID")
+
+		if requestID == "" {
+			requestID = newID()
+		}
+
+		c.Header("X-Request-ID", requestID)
+
+		requestLogger := logger.With("request_id", requestID)
+
+		c.Request = c.Request.WithContext(contextWithLogger(c.Request.Context(), requestLogger))
+
+		start := time.Now()
+
+		c.Next()
+
+		level := slog.LevelInfo
+
+		if c.Writer.Status() >= 500 {
+			level = slog.LevelError
+		}
+
+		requestLogger.Log(c.Request.Context(), level, "handled request",
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"duration", time.Since(start),
+		)
+	}
+}
@@ -0,0 +1,89 @@
+package functionality
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestMain sends the package logger to io.Discard so that go test isn't flooded with what
+// every test logs, tests which check what is logged give their own logger a buffer instead
+func TestMain(m *testing.M) {
+	logger = newLogger(io.Discard, logLevelFromEnv())
+
+	os.Exit(m.Run())
+}
+
+// Need to test the following:
+// Email addresses in messages, attributes and errors are replaced by their hash,
+// including query escaped ones like the ones in HIBP request URLs
+// Phone numbers in attributes named phone and in free text are replaced by their hash
+// Notification recipients are replaced by their hash, whatever format SMS numbers are in
+func TestLoggerRedactsPII(t *testing.T) {
+	var output bytes.Buffer
+
+	testLogger := newLogger(&output, slog.LevelDebug)
+
+	tests := []struct {
+		Log      func()
+		Leaked   string
+		Expected string
+	}{
+		{
+			Log:      func() { testLogger.Info("checking someone@example.com") },
+			Leaked:   "someone@example.com",
+			Expected: hashPII("email", "someone@example.com"),
+		},
+		{
+			Log:      func() { testLogger.Info("lookup", "email", "Someone@Example.com") },
+			Leaked:   "Someone@Example.com",
+			Expected: hashPII("email", "someone@example.com"),
+		},
+		{
+			Log: func() {
+				testLogger.Error("lookup failed", "error", errors.New(`Get "https://haveibeenpwned.com/api/v3/breachedaccount/someone%40example.com?truncateResponse=false": timeout`))
+			},
+			Leaked:   "someone%40example.com",
+			Expected: hashPII("email", "someone@example.com"),
+		},
+		{
+			Log:      func() { testLogger.Info("notification sent", "phone", "555-867-5309") },
+			Leaked:   "867-5309",
+			Expected: hashPII("phone", "555-867-5309"),
+		},
+		{
+			Log: func() {
+				logNotification(contextWithLogger(context.Background(), testLogger), channelSMS, "(555) 867-5309", "YOU'VE BEEN PWNED!", nil)
+			},
+			Leaked:   "867-5309",
+			Expected: hashPII("phone", "(555) 867-5309"),
+		},
+		{
+			Log: func() {
+				logNotification(contextWithLogger(context.Background(), testLogger), channelEmail, "someone@example.com", "YOU'VE BEEN PWNED!", nil)
+			},
+			Leaked:   "someone@example.com",
+			Expected: hashPII("email", "someone@example.com"),
+		},
+		{
+			Log:      func() { testLogger.Info("texting +15558675309") },
+			Leaked:   "+15558675309",
+			Expected: hashPII("phone", "+15558675309"),
+		},
+	}
+
+	for _, test := range tests {
+		output.Reset()
+
+		test.Log()
+
+		if logged := output.String(); strings.Contains(logged, test.Leaked) || !strings.Contains(logged, test.Expected) {
+			t.Errorf("logger wrote %s; expected %q to be replaced by %q", logged, test.Leaked, test.Expected)
+		}
+	}
+}
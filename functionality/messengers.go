@@ -0,0 +1,306 @@
+package functionality
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// The limits of the messaging platforms, messages are cut down to fit them rather than rejected
+const (
+	discordContentLimit    = 2000
+	discordMaxEmbeds       = 10
+	discordEmbedTitleLimit = 256
+	discordFieldNameLimit  = 256
+	discordFieldValueLimit = 1024
+	discordEmbedsLimit     = 6000
+
+	telegramMessageLimit = 4096
+
+	// matrixMessageLimit keeps both bodies of an event within the homeserver's 64KiB event limit,
+	// even when every rune takes 4 bytes
+	matrixMessageLimit = 7000
+)
+
+var (
+	// telegramAPIBaseURL can be changed to point at a local stand-in, like the HIBP base URLs
+	telegramAPIBaseURL = "https://api.telegram.org"
+
+	telegramChatIDPattern = regexp.MustCompile(`^(-?[0-9]+|@[A-Za-z0-9_]{5,})$`)
+	matrixRoomIDPattern   = regexp.MustCompile(`^![^:]+:.+$`)
+
+	severityColours = map[severity]int{
+		severityLow:      0x2ECC71,
+		severityMedium:   0xF1C40F,
+		severityHigh:     0xE67E22,
+		severityCritical: 0xE74C3C,
+	}
+)
+
+func init() {
+	if baseURL, exists := os.LookupEnv("telegramAPIBaseURL"); exists {
+		telegramAPIBaseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// truncate cuts the text down to the limit in runes, marking that it has been cut
+func truncate(text string, limit int) string {
+	if utf8.RuneCountInString(text) <= limit {
+		return text
+	}
+
+	runes := []rune(text)
+
+	return string(runes[:limit-1]) + "…"
+}
+
+// fitChatSections adds as many of the rendered sections to the header as fit in the limit,
+// ending with the note from more about how many were left out
+func fitChatSections(header string, rendered []string, limit int, more func(omitted int) string) string {
+	reserved := 0
+
+	if len(rendered) > 0 {
+		reserved = utf8.RuneCountInString(more(len(rendered)))
+	}
+
+	text := truncate(header, limit-reserved)
+
+	for i, section := range rendered {
+		if utf8.RuneCountInString(text)+utf8.RuneCountInString(section)+reserved > limit {
+			return text + more(len(rendered)-i)
+		}
+
+		text += section
+	}
+
+	return text
+}
+
+func moreBreachesNote(omitted int) string {
+	return fmt.Sprintf("\n…and %d more", omitted)
+}
+
+type discordNotifier struct{}
+
+// recipient is the subscriber's Discord webhook URL
+func (discordNotifier) recipient(subscriber Subscriber) (string, bool) {
+	return subscriber.Chat.DiscordWebhookURL, subscriber.Chat.DiscordWebhookURL != ""
+}
+
+// teamRecipient is the team channel's Discord webhook URL
+func (discordNotifier) teamRecipient() (string, bool) {
+	return chat.DiscordWebhookURL, chat.TeamBreachAlerts && chat.DiscordWebhookURL != ""
+}
+
+func (discordNotifier) deferrable() bool {
+	return true
+}
+
+// discordMessage renders the notification as an embed for each breach or paste, coloured by
+// severity, up to Discord's limit on embeds and their total length; the rest are counted in the content
+func discordMessage(n notification) map[string]interface{} {
+	sections := chatSections(n)
+	embeds := make([]interface{}, 0, len(sections))
+	embedsLength := 0
+
+	for _, section := range sections {
+		if len(embeds) == discordMaxEmbeds {
+			break
+		}
+
+		title := truncate(section.heading, discordEmbedTitleLimit)
+		length := utf8.RuneCountInString(title)
+		fields := make([]interface{}, 0, len(section.facts))
+
+		for _, fact := range section.facts {
+			name, value := truncate(fact.label, discordFieldNameLimit), truncate(fact.value, discordFieldValueLimit)
+
+			if value == "" {
+				value = "-"
+			}
+
+			length += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+			fields = append(fields, map[string]interface{}{"name": name, "value": value, "inline": true})
+		}
+
+		if embedsLength+length > discordEmbedsLimit {
+			break
+		}
+
+		embedsLength += length
+		embeds = append(embeds, map[string]interface{}{"title": title, "color": severityColours[section.severity], "fields": fields})
+	}
+
+	content := n.Title
+
+	if len(sections) == 0 && n.Body != "" {
+		content += "\n" + n.Body
+	}
+
+	if omitted := len(sections) - len(embeds); omitted > 0 {
+		note := moreBreachesNote(omitted)
+
+		content = truncate(content, discordContentLimit-utf8.RuneCountInString(note)) + note
+	}
+
+	return map[string]interface{}{
+		"content": truncate(content, discordContentLimit),
+		"embeds":  embeds,
+		// Breach titles come from HIBP, nobody should be pinged by them
+		"allowed_mentions": map[string]interface{}{"parse": []string{}},
+	}
+}
+
+func (discordNotifier) send(ctx context.Context, n notification) error {
+	ctx, span := tracer.Start(ctx, "notify.discord")
+
+	_, err := postChatJSON(ctx, n.To, "", discordMessage(n))
+
+	recordNotification(channelDiscord, err)
+	logNotification(ctx, channelDiscord, n.Email, n.Title, err)
+	endSpan(span, err)
+
+	return err
+}
+
+type telegramNotifier struct{}
+
+// recipient is the subscriber's Telegram chat, when there is a bot to send from
+func (telegramNotifier) recipient(subscriber Subscriber) (string, bool) {
+	return subscriber.Chat.TelegramChatID, chat.TelegramBotToken != "" && subscriber.Chat.TelegramChatID != ""
+}
+
+// teamRecipient is the team's Telegram chat, when there is a bot to send from
+func (telegramNotifier) teamRecipient() (string, bool) {
+	return chat.TelegramChatID, chat.TeamBreachAlerts && chat.TelegramBotToken != "" && chat.TelegramChatID != ""
+}
+
+func (telegramNotifier) deferrable() bool {
+	return true
+}
+
+// chatHTML renders the notification as the HTML both Telegram and Matrix accept, fitted to the limit
+func chatHTML(n notification, limit int) string {
+	header := "<b>" + html.EscapeString(n.Title) + "</b>\n"
+	sections := chatSections(n)
+
+	if len(sections) == 0 && n.Body != "" {
+		header += html.EscapeString(n.Body)
+	}
+
+	rendered := make([]string, 0, len(sections))
+
+	for _, section := range sections {
+		var sectionHTML strings.Builder
+
+		sectionHTML.WriteString("\n<b>" + html.EscapeString(section.heading) + "</b>\n")
+
+		for _, fact := range section.facts {
+			sectionHTML.WriteString(html.EscapeString(fact.label) + ": " + html.EscapeString(fact.value) + "\n")
+		}
+
+		rendered = append(rendered, sectionHTML.String())
+	}
+
+	return fitChatSections(header, rendered, limit, moreBreachesNote)
+}
+
+func (telegramNotifier) send(ctx context.Context, n notification) error {
+	ctx, span := tracer.Start(ctx, "notify.telegram")
+
+	responseBytes, err := postChatJSON(ctx, telegramAPIBaseURL+"/bot"+chat.TelegramBotToken+"/sendMessage", "", map[string]interface{}{
+		"chat_id":                  n.To,
+		"text":                     chatHTML(n, telegramMessageLimit),
+		"parse_mode":               "HTML",
+		"disable_web_page_preview": true,
+	})
+
+	if responseBytes != nil {
+		telegramResponse := struct {
+			OK          bool   `json:"ok"`
+			Description string `json:"description"`
+		}{}
+
+		if json.Unmarshal(responseBytes, &telegramResponse) == nil && !telegramResponse.OK {
+			err = errors.New("telegram could not send the message: " + telegramResponse.Description)
+		}
+	}
+
+	recordNotification(channelTelegram, err)
+	logNotification(ctx, channelTelegram, n.Email, n.Title, err)
+	endSpan(span, err)
+
+	return err
+}
+
+type matrixNotifier struct{}
+
+// matrixConfigured is whether there is an account to send Matrix events from
+func matrixConfigured() bool {
+	return chat.MatrixHomeserverURL != "" && chat.MatrixAccessToken != ""
+}
+
+// recipient is the subscriber's Matrix room, when there is an account to send from
+func (matrixNotifier) recipient(subscriber Subscriber) (string, bool) {
+	return subscriber.Chat.MatrixRoomID, matrixConfigured() && subscriber.Chat.MatrixRoomID != ""
+}
+
+// teamRecipient is the team's Matrix room, when there is an account to send from
+func (matrixNotifier) teamRecipient() (string, bool) {
+	return chat.MatrixRoomID, chat.TeamBreachAlerts && matrixConfigured() && chat.MatrixRoomID != ""
+}
+
+func (matrixNotifier) deferrable() bool {
+	return true
+}
+
+// chatText renders the notification as plain text, fitted to the limit
+func chatText(n notification, limit int) string {
+	header := n.Title + "\n"
+	sections := chatSections(n)
+
+	if len(sections) == 0 && n.Body != "" {
+		header += n.Body
+	}
+
+	rendered := make([]string, 0, len(sections))
+
+	for _, section := range sections {
+		sectionText := "\n" + section.heading + "\n"
+
+		for _, fact := range section.facts {
+			sectionText += fact.label + ": " + fact.value + "\n"
+		}
+
+		rendered = append(rendered, sectionText)
+	}
+
+	return fitChatSections(header, rendered, limit, moreBreachesNote)
+}
+
+func (matrixNotifier) send(ctx context.Context, n notification) error {
+	ctx, span := tracer.Start(ctx, "notify.matrix")
+
+	// The transaction ID makes retries of the same request idempotent, every notification is a new one
+	sendURL := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s", strings.TrimSuffix(chat.MatrixHomeserverURL, "/"), url.PathEscape(n.To), newID())
+
+	_, err := sendChatJSON(ctx, "PUT", sendURL, chat.MatrixAccessToken, map[string]interface{}{
+		"msgtype":        "m.text",
+		"body":           chatText(n, matrixMessageLimit),
+		"format":         "org.matrix.custom.html",
+		"formatted_body": strings.Replace(chatHTML(n, matrixMessageLimit), "\n", "<br>", -1),
+	})
+
+	recordNotification(channelMatrix, err)
+	logNotification(ctx, channelMatrix, n.Email, n.Title, err)
+	endSpan(span, err)
+
+	return err
+}
@@ -0,0 +1,228 @@
+package functionality
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// manyBreachesNotification is about more breaches than fit in a message on any of the platforms
+func manyBreachesNotification(to string, breachCount int) notification {
+	n := chatTestNotification(to)
+
+	for i := 1; i < breachCount; i++ {
+		n.Breaches = append(n.Breaches, scoredBreach{
+			PwnInfo:  PwnInfo{Name: fmt.Sprint("Breach", i), Title: fmt.Sprintf("Breach <%d> & co", i), BreachDate: "2020-01-01", DataClasses: []string{strings.Repeat("Passwords ", 100)}},
+			Severity: severityLow,
+		})
+	}
+
+	return n
+}
+
+// Need to test the following:
+// Each breach is an embed coloured by its severity, with its date, severity and data classes
+// Breaches past the embed limits are counted in the content instead
+// Nobody is mentioned by the message
+func TestDiscordNotifier(t *testing.T) {
+	var received struct {
+		Content string `json:"content"`
+		Embeds  []struct {
+			Title  string `json:"title"`
+			Color  int    `json:"color"`
+			Fields []struct {
+				Name  string `json:"name"`
+				Value string `json:"value"`
+			} `json:"fields"`
+		} `json:"embeds"`
+		AllowedMentions struct {
+			Parse []string `json:"parse"`
+		} `json:"allowed_mentions"`
+	}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		json.Unmarshal(body, &received)
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	defer server.Close()
+
+	originalClient := chatClient
+	chatClient = server.Client()
+
+	defer func() { chatClient = originalClient }()
+
+	if err := (discordNotifier{}).send(context.Background(), chatTestNotification(server.URL+"/api/webhooks/1/token")); err != nil {
+		t.Fatalf("discordNotifier.send() = %v; expected: <nil>", err)
+	}
+
+	if len(received.Embeds) != 1 || received.Embeds[0].Title != "Adobe" || received.Embeds[0].Color != severityColours[severityHigh] || len(received.Embeds[0].Fields) != 3 {
+		t.Fatalf("discord message = %+v; expected: an orange embed for Adobe with 3 fields", received)
+	}
+
+	if received.Embeds[0].Fields[0].Value != "2013-10-04" || received.Embeds[0].Fields[1].Value != "high" || received.Embeds[0].Fields[2].Value != "Email addresses, Passwords" {
+		t.Errorf("discord embed fields = %+v; expected: the breach date, severity and data classes", received.Embeds[0].Fields)
+	}
+
+	if received.AllowedMentions.Parse == nil || len(received.AllowedMentions.Parse) != 0 {
+		t.Errorf("discord allowed mentions = %v; expected: none", received.AllowedMentions.Parse)
+	}
+
+	if err := (discordNotifier{}).send(context.Background(), manyBreachesNotification(server.URL+"/api/webhooks/1/token", 12)); err != nil {
+		t.Fatalf("discordNotifier.send() = %v; expected: <nil>", err)
+	}
+
+	embedsLength := 0
+
+	for _, embed := range received.Embeds {
+		embedsLength += utf8.RuneCountInString(embed.Title)
+
+		for _, field := range embed.Fields {
+			embedsLength += utf8.RuneCountInString(field.Name) + utf8.RuneCountInString(field.Value)
+		}
+	}
+
+	omitted := 12 - len(received.Embeds)
+
+	if len(received.Embeds) > discordMaxEmbeds || embedsLength > discordEmbedsLimit || !strings.HasSuffix(received.Content, fmt.Sprintf("and %d more", omitted)) {
+		t.Errorf("discord message for 12 breaches = %d embeds of %d runes, %q; expected them within the limits and the rest counted", len(received.Embeds), embedsLength, received.Content)
+	}
+}
+
+// Need to test the following:
+// Messages are sent to the chat through the bot as HTML, with breach titles escaped
+// Messages are cut down to Telegram's limit
+// Telegram errors are an error, without the bot token in them
+func TestTelegramNotifier(t *testing.T) {
+	var (
+		received         map[string]interface{}
+		requestPath      string
+		telegramResponse = `{"ok": true}`
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestPath = r.URL.Path
+
+		body, _ := ioutil.ReadAll(r.Body)
+
+		json.Unmarshal(body, &received)
+
+		w.Write([]byte(telegramResponse))
+	}))
+
+	defer server.Close()
+
+	originalChat, originalBaseURL := chat, telegramAPIBaseURL
+	chat, telegramAPIBaseURL = chatInfo{TelegramBotToken: "123:secret"}, server.URL
+
+	defer func() { chat, telegramAPIBaseURL = originalChat, originalBaseURL }()
+
+	if err := (telegramNotifier{}).send(context.Background(), manyBreachesNotification("-1001234", 40)); err != nil {
+		t.Fatalf("telegramNotifier.send() = %v; expected: <nil>", err)
+	}
+
+	text, _ := received["text"].(string)
+
+	if requestPath != "/bot123:secret/sendMessage" || received["chat_id"] != "-1001234" || received["parse_mode"] != "HTML" {
+		t.Errorf("telegram request = %s, %v; expected: sendMessage to the chat as HTML", requestPath, received)
+	}
+
+	if utf8.RuneCountInString(text) > telegramMessageLimit || !strings.Contains(text, "<b>Adobe</b>") || !strings.Contains(text, "Breach &lt;1&gt; &amp; co") || !strings.Contains(text, "more") {
+		t.Errorf("telegram text = %q; expected: escaped breaches within the limit and the rest counted", text)
+	}
+
+	telegramResponse = `{"ok": false, "description": "Bad Request: chat not found"}`
+
+	if err := (telegramNotifier{}).send(context.Background(), chatTestNotification("-1001234")); err == nil || !strings.Contains(err.Error(), "chat not found") {
+		t.Errorf("telegramNotifier.send() to a missing chat = %v; expected: chat not found", err)
+	}
+
+	server.Close()
+
+	if err := (telegramNotifier{}).send(context.Background(), chatTestNotification("-1001234")); err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("telegramNotifier.send() to an unreachable API = %v; expected: an error without the bot token", err)
+	}
+}
+
+// Need to test the following:
+// Events are PUT into the room with the access token and a transaction ID
+// Events have a plain text body and an HTML formatted body
+// Subscribers can't be reached without a homeserver and access token
+func TestMatrixNotifier(t *testing.T) {
+	var (
+		received      map[string]interface{}
+		requestMethod string
+		requestPath   string
+		authorization string
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestMethod, requestPath, authorization = r.Method, r.URL.EscapedPath(), r.Header.Get("Authorization")
+
+		body, _ := ioutil.ReadAll(r.Body)
+
+		json.Unmarshal(body, &received)
+
+		w.Write([]byte(`{"event_id": "$event"}`))
+	}))
+
+	defer server.Close()
+
+	originalChat := chat
+	chat = chatInfo{TeamBreachAlerts: true, MatrixHomeserverURL: server.URL + "/", MatrixAccessToken: "syt_token", MatrixRoomID: "!team:example.org"}
+
+	defer func() { chat = originalChat }()
+
+	to, reachable := matrixNotifier{}.teamRecipient()
+
+	if err := (matrixNotifier{}).send(context.Background(), chatTestNotification(to)); !reachable || err != nil {
+		t.Fatalf("matrixNotifier.send() to the team room = %t, %v; expected: true, <nil>", reachable, err)
+	}
+
+	if requestMethod != http.MethodPut || !strings.HasPrefix(requestPath, "/_matrix/client/v3/rooms/%21team:example.org/send/m.room.message/") || authorization != "Bearer syt_token" {
+		t.Errorf("matrix request = %s %s, %q; expected: a PUT into the room with the access token", requestMethod, requestPath, authorization)
+	}
+
+	body, _ := received["body"].(string)
+	formattedBody, _ := received["formatted_body"].(string)
+
+	if received["format"] != "org.matrix.custom.html" || !strings.Contains(body, "Breach date: 2013-10-04") || !strings.Contains(formattedBody, "<b>Adobe</b><br>") {
+		t.Errorf("matrix event = %v; expected: plain text and HTML bodies with the breach", received)
+	}
+
+	chat.MatrixAccessToken = ""
+
+	if _, reachable = (matrixNotifier{}).recipient(Subscriber{Chat: chatDestinations{MatrixRoomID: "!own:example.org"}}); reachable {
+		t.Error("matrixNotifier.recipient() without an access token = true; expected: false")
+	}
+}
+
+// Need to test the following:
+// Text within the limit is unchanged
+// Text over the limit is cut down to it, in runes
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		Text     string
+		Limit    int
+		Expected string
+	}{
+		{Text: "Adobe", Limit: 5, Expected: "Adobe"},
+		{Text: "Adobe", Limit: 4, Expected: "Ado…"},
+		{Text: "ÄÖÜßéè", Limit: 3, Expected: "ÄÖ…"},
+	}
+
+	for _, test := range tests {
+		if truncated := truncate(test.Text, test.Limit); truncated != test.Expected {
+			t.Errorf("truncate(%q, %d) = %q; expected: %q", test.Text, test.Limit, truncated, test.Expected)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package functionality
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	hibpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pwned_api",
+		Name:      "hibp_requests_total",
+		Help:      "Requests made to the HIBP API, by response status code.",
+	}, []string{"code"})
+
+	hibpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "pwned_api",
+		Name:      "hibp_request_duration_seconds",
+		Help:      "Latency of requests made to the HIBP API, by response status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"code"})
+
+	pwnageLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pwned_api",
+		Name:      "pwnage_lookups_total",
+		Help:      "Outcome of pwnage lookups, either pwned, not_pwned (ErrNoPwns) or error.",
+	}, []string{"result"})
+
+	pwnageCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pwned_api",
+		Name:      "pwnage_cache_lookups_total",
+		Help:      "Pwnage cache lookups, either hit or miss.",
+	}, []string{"result"})
+
+	hibpRateLimiterWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "pwned_api",
+		Name:      "hibp_rate_limiter_wait_seconds",
+		Help:      "Time spent waiting on the HIBP rate limiter before making a request.",
+		Buckets:   []float64{0, .1, .5, 1, 1.5, 3, 5, 10, 30, 60},
+	})
+
+	notifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pwned_api",
+		Name:      "notifications_total",
+		Help:      "Notifications attempted, by channel and result (sent or failed).",
+	}, []string{"channel", "result"})
+
+	schedulerRunDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "pwned_api",
+		Name:      "scheduler_run_duration_seconds",
+		Help:      "Duration of scheduled job runs, by job and result (succeeded or failed).",
+		Buckets:   []float64{.1, .5, 1, 5, 15, 30, 60, 300, 900, 3600},
+	}, []string{"job", "result"})
+
+	outboxDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "pwned_api",
+		Name:      "outbox_depth",
+		Help:      "Notifications deferred in the outbox, waiting for quiet hours to end.",
+	})
+
+	emailProviderSends = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pwned_api",
+		Name:      "email_provider_sends_total",
+		Help:      "Emails sent through each provider, by result (sent, failed or skipped while its circuit is open).",
+	}, []string{"provider", "result"})
+
+	emailCircuitOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pwned_api",
+		Name:      "email_provider_circuit_open",
+		Help:      "Whether the circuit breaker around each email provider is open (1) or closed (0).",
+	}, []string{"provider"})
+
+	metricsHandler = promhttp.Handler()
+)
+
+func init() {
+	prometheus.MustRegister(
+		hibpRequests,
+		hibpRequestDuration,
+		pwnageLookups,
+		pwnageCacheLookups,
+		hibpRateLimiterWait,
+		notifications,
+		schedulerRunDuration,
+		outboxDepth,
+		emailProviderSends,
+		emailCircuitOpen,
+	)
+}
+
+// statusCodeLabel is the "code" label used for HIBP requests,
+// "error" is used when no response was received at all
+func statusCodeLabel(statusCode int) string {
+	if statusCode == 0 {
+		return "error"
+	}
+
+	return strconv.Itoa(statusCode)
+}
+
+func recordPwnageLookup(err error) {
+	switch err {
+	case nil:
+		pwnageLookups.WithLabelValues("pwned").Inc()
+	case ErrNoPwns:
+		pwnageLookups.WithLabelValues("not_pwned").Inc()
+	default:
+		pwnageLookups.WithLabelValues("error").Inc()
+	}
+}
+
+func recordNotification(channel string, err error) {
+	if err != nil {
+		notifications.WithLabelValues(channel, "failed").Inc()
+
+		return
+	}
+
+	notifications.WithLabelValues(channel, "sent").Inc()
+}
+
+// Metrics serves the Prometheus metrics for the service
+func Metrics(c *gin.Context) {
+	metricsHandler.ServeHTTP(c.Writer, c.Request)
+}
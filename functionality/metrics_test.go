@@ -0,0 +1,82 @@
+package functionality
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// scrapeMetrics is the value of every series /metrics exposes, by its name and labels
+func scrapeMetrics(t *testing.T, router *gin.Engine) map[string]float64 {
+	mockResponseWriter := httptest.NewRecorder()
+
+	router.ServeHTTP(mockResponseWriter, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if mockResponseWriter.Code != http.StatusOK {
+		t.Fatalf("GET /metrics = HTTP/%d; expected: HTTP/200", mockResponseWriter.Code)
+	}
+
+	series := make(map[string]float64)
+	scanner := bufio.NewScanner(mockResponseWriter.Body)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		separator := strings.LastIndex(line, " ")
+
+		if strings.HasPrefix(line, "#") || separator == -1 {
+			continue
+		}
+
+		if value, err := strconv.ParseFloat(line[separator+1:], 64); err == nil {
+			series[line[:separator]] = value
+		}
+	}
+
+	return series
+}
+
+// Need to test the following:
+// A lookup and the notification it leads to are counted in the series /metrics exposes
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	_, restoreHIBP := useFakeHIBP(hibpFixtures)
+
+	defer restoreHIBP()
+
+	_, restoreEmail := useRecordingEmailSender()
+
+	defer restoreEmail()
+
+	router := gin.New()
+	router.GET("/metrics", Metrics)
+
+	before := scrapeMetrics(t, router)
+
+	if err := notifyOfPwnage(context.Background(), "pwned@example.com", "", false); err != nil {
+		t.Fatalf("notifyOfPwnage() = %v; expected: <nil>", err)
+	}
+
+	after := scrapeMetrics(t, router)
+
+	expectedIncreases := []string{
+		`pwned_api_pwnage_lookups_total{result="pwned"}`,
+		`pwned_api_hibp_requests_total{code="200"}`,
+		`pwned_api_hibp_request_duration_seconds_count{code="200"}`,
+		`pwned_api_hibp_rate_limiter_wait_seconds_count`,
+		`pwned_api_notifications_total{channel="email",result="sent"}`,
+		`pwned_api_email_provider_sends_total{provider="mailgun",result="sent"}`,
+	}
+
+	for _, series := range expectedIncreases {
+		if increase := after[series] - before[series]; increase != 1 {
+			t.Errorf("%s increased by %v; expected: 1", series, increase)
+		}
+	}
+}
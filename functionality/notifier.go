@@ -0,0 +1,242 @@
+package functionality
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// The channels a notification can be sent through
+const (
+	channelEmail   = "email"
+	channelSMS     = "sms"
+	channelWebhook = "webhook"
+)
+
+// allChannels are every channel in the order notifications are sent through them,
+// a channel without a registered notifier (like an unconfigured one) is skipped
+var allChannels = []string{channelEmail, channelSMS, channelWebhook, channelSlack, channelTeams, channelDiscord, channelTelegram, channelMatrix, channelNtfy, channelGotify, channelPushover}
+
+// The types of notification, which structured channels like webhooks pass on
+const (
+	notificationBreach   = "breach"
+	notificationPaste    = "paste"
+	notificationNotPwned = "not_pwned"
+	notificationDigest   = "digest"
+)
+
+// notification is a message for a subscriber on one channel, Email is the subscriber's email
+// even when the notification goes elsewhere; the breaches and pastes it is about are kept
+// alongside the rendered title and body for the channels which send them as structured data
+type notification struct {
+	Type         string         `json:"type"`
+	SubscriberID string         `json:"subscriber_id,omitempty"`
+	Email        string         `json:"email"`
+	Channel      string         `json:"channel"`
+	To           string         `json:"to,omitempty"`
+	Title        string         `json:"title"`
+	Body         string         `json:"body,omitempty"`
+	Severity     severity       `json:"severity"`
+	Breaches     []scoredBreach `json:"breaches,omitempty"`
+	Pastes       []PasteInfo    `json:"pastes,omitempty"`
+}
+
+// notifier sends notifications through a channel
+type notifier interface {
+	// recipient is who the subscriber is on the channel, false when they can't be notified through it
+	recipient(subscriber Subscriber) (string, bool)
+
+	// deferrable is whether notifications through the channel wait for quiet hours to end
+	deferrable() bool
+
+	send(ctx context.Context, n notification) error
+}
+
+// teamNotifier is a notifier which can also post to the team's own destination on its channel
+type teamNotifier interface {
+	notifier
+
+	// teamRecipient is the team's destination, false unless the team has opted in to breach alerts on the channel
+	teamRecipient() (string, bool)
+}
+
+var (
+	notifiersMutex sync.RWMutex
+	notifiers      = map[string]notifier{
+		channelEmail: emailNotifier{},
+		channelSMS:   smsNotifier{},
+	}
+)
+
+// registerNotifier adds the notifier for a channel, replacing any existing one
+func registerNotifier(channel string, n notifier) {
+	notifiersMutex.Lock()
+
+	defer notifiersMutex.Unlock()
+
+	notifiers[channel] = n
+}
+
+func notifierFor(channel string) (notifier, bool) {
+	notifiersMutex.RLock()
+
+	defer notifiersMutex.RUnlock()
+
+	n, exists := notifiers[channel]
+
+	return n, exists
+}
+
+type emailNotifier struct{}
+
+func (emailNotifier) recipient(subscriber Subscriber) (string, bool) {
+	return subscriber.Email, subscriber.Email != ""
+}
+
+func (emailNotifier) deferrable() bool {
+	return true
+}
+
+func (emailNotifier) send(ctx context.Context, n notification) error {
+	return notifyEmailOfPwnage(ctx, n.To, n.Title, n.Body, n.Type)
+}
+
+type smsNotifier struct{}
+
+func (smsNotifier) recipient(subscriber Subscriber) (string, bool) {
+	return subscriber.Phone, subscriber.Phone != "" && smsProviderConfigured
+}
+
+func (smsNotifier) deferrable() bool {
+	return true
+}
+
+func (smsNotifier) send(ctx context.Context, n notification) error {
+	return sendPhoneNotification(ctx, n.To, n.Title)
+}
+
+func sendNotification(ctx context.Context, n notification) error {
+	channelNotifier, exists := notifierFor(n.Channel)
+
+	if !exists {
+		return fmt.Errorf("unknown notification channel %q", n.Channel)
+	}
+
+	return channelNotifier.send(ctx, n)
+}
+
+// notifySubscriber delivers the notification through each of the channels the subscriber
+// can be reached on, and breach findings to the team destinations which have opted in to
+// them; a channel failing doesn't stop the others, the first error is returned
+func notifySubscriber(ctx context.Context, subscriber Subscriber, channels map[string]bool, n notification) error {
+	_, err := notifySubscriberOnAny(ctx, subscriber, channels, n)
+
+	return err
+}
+
+// notifySubscriberOnAny is notifySubscriber, also returning whether the notification was
+// delivered (or held for quiet hours) on at least one of the subscriber's own channels
+func notifySubscriberOnAny(ctx context.Context, subscriber Subscriber, channels map[string]bool, n notification) (bool, error) {
+	var firstErr error
+
+	delivered := false
+
+	for _, channel := range allChannels {
+		if !channels[channel] {
+			continue
+		}
+
+		channelNotifier, exists := notifierFor(channel)
+
+		if !exists {
+			continue
+		}
+
+		to, reachable := channelNotifier.recipient(subscriber)
+
+		if !reachable {
+			continue
+		}
+
+		addressed := n
+		addressed.SubscriberID = subscriber.ID
+		addressed.Email = subscriber.Email
+		addressed.Channel = channel
+		addressed.To = to
+
+		err := deliverNotification(ctx, subscriber.subscriberDetails, channelNotifier, addressed)
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		delivered = delivered || err == nil
+	}
+
+	if err := notifyTeam(ctx, subscriber, channels, n); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	return delivered, firstErr
+}
+
+// notifyTeam posts breach findings to the team destinations on the channels, naming the subscriber
+// they are about so the team can act on them; they aren't held for the subscriber's quiet hours
+func notifyTeam(ctx context.Context, subscriber Subscriber, channels map[string]bool, n notification) error {
+	if n.Type != notificationBreach {
+		return nil
+	}
+
+	var firstErr error
+
+	for _, channel := range allChannels {
+		channelNotifier, exists := notifierFor(channel)
+
+		if !exists || !channels[channel] {
+			continue
+		}
+
+		channelTeamNotifier, isTeamNotifier := channelNotifier.(teamNotifier)
+
+		if !isTeamNotifier {
+			continue
+		}
+
+		to, reachable := channelTeamNotifier.teamRecipient()
+
+		if !reachable {
+			continue
+		}
+
+		addressed := n
+		addressed.SubscriberID = subscriber.ID
+		addressed.Email = subscriber.Email
+		addressed.Channel = channel
+		addressed.To = to
+		addressed.Title = fmt.Sprintf("Breach findings for %s (%s severity)", subscriber.Email, n.Severity)
+		addressed.Body = fmt.Sprintf("%s was found in breaches on Have I Been Pwned.", subscriber.Email)
+
+		if err := channelNotifier.send(ctx, addressed); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// personalChannels are the channels which reach the subscriber themselves, for notifications
+// like their email not being pwned which are of no use anywhere else
+func personalChannels() map[string]bool {
+	return map[string]bool{channelEmail: true, channelSMS: true}
+}
+
+// everyChannel is every channel, for notifications which aren't narrowed down by a policy
+func everyChannel() map[string]bool {
+	channels := make(map[string]bool, len(allChannels))
+
+	for _, channel := range allChannels {
+		channels[channel] = true
+	}
+
+	return channels
+}
@@ -0,0 +1,131 @@
+package functionality
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingNotifier is a notifier which keeps the notifications it is sent, reaching
+// subscribers by their email and the team on team when it is set
+type recordingNotifier struct {
+	team string
+
+	mu   *sync.Mutex
+	sent *[]notification
+}
+
+func (rn recordingNotifier) recipient(subscriber Subscriber) (string, bool) {
+	return subscriber.Email, subscriber.Email != ""
+}
+
+func (recordingNotifier) deferrable() bool {
+	return false
+}
+
+func (rn recordingNotifier) send(ctx context.Context, n notification) error {
+	rn.mu.Lock()
+
+	defer rn.mu.Unlock()
+
+	*rn.sent = append(*rn.sent, n)
+
+	return nil
+}
+
+func (rn recordingNotifier) teamRecipient() (string, bool) {
+	return rn.team, rn.team != ""
+}
+
+// failingNotifier is a notifier which fails every notification it is sent
+type failingNotifier struct{}
+
+func (failingNotifier) recipient(subscriber Subscriber) (string, bool) {
+	return subscriber.Email, subscriber.Email != ""
+}
+
+func (failingNotifier) deferrable() bool {
+	return false
+}
+
+func (failingNotifier) send(ctx context.Context, n notification) error {
+	return errors.New("the channel is down")
+}
+
+// useRecordingNotifiers makes recording notifiers the only ones, on the given channels,
+// returning what they have been sent so far; until restore is called
+func useRecordingNotifiers(team string, channels ...string) (func() []notification, func()) {
+	notifiersMutex.Lock()
+
+	originalNotifiers := notifiers
+	mu, sent := &sync.Mutex{}, &[]notification{}
+	notifiers = map[string]notifier{}
+
+	for _, channel := range channels {
+		notifiers[channel] = recordingNotifier{team: team, mu: mu, sent: sent}
+	}
+
+	notifiersMutex.Unlock()
+
+	return func() []notification {
+			mu.Lock()
+
+			defer mu.Unlock()
+
+			return append([]notification(nil), *sent...)
+		}, func() {
+			notifiersMutex.Lock()
+
+			defer notifiersMutex.Unlock()
+
+			notifiers = originalNotifiers
+		}
+}
+
+// Need to test the following:
+// Subscribers are notified on each of the channels
+// Breach findings go to the team destinations too, naming the subscriber
+// Other notifications never go to the team destinations
+// Teams which haven't opted in aren't sent anything
+func TestNotifySubscriber(t *testing.T) {
+	tests := []struct {
+		Team         string
+		Type         string
+		ExpectedTo   []string
+		ExpectedTeam bool
+	}{
+		{Team: "#security", Type: notificationBreach, ExpectedTo: []string{"pwned@example.com", "#security"}, ExpectedTeam: true},
+		{Team: "#security", Type: notificationPaste, ExpectedTo: []string{"pwned@example.com"}},
+		{Team: "#security", Type: notificationNotPwned, ExpectedTo: []string{"pwned@example.com"}},
+		{Type: notificationBreach, ExpectedTo: []string{"pwned@example.com"}},
+	}
+
+	for _, test := range tests {
+		sent, restore := useRecordingNotifiers(test.Team, channelSlack)
+		subscriber := Subscriber{Email: "pwned@example.com"}
+
+		err := notifySubscriber(context.Background(), subscriber, map[string]bool{channelSlack: true}, notification{Type: test.Type, Title: "Your email was found in a breach", Severity: severityHigh})
+
+		restore()
+
+		notifications := sent()
+
+		if err != nil || len(notifications) != len(test.ExpectedTo) {
+			t.Errorf("notifySubscriber() for a %s with team %q sent %d notifications, %v; expected: %d", test.Type, test.Team, len(notifications), err, len(test.ExpectedTo))
+
+			continue
+		}
+
+		for i, n := range notifications {
+			if n.To != test.ExpectedTo[i] || n.Email != "pwned@example.com" {
+				t.Errorf("notification %d for a %s went to %q about %q; expected: %q", i, test.Type, n.To, n.Email, test.ExpectedTo[i])
+			}
+		}
+
+		if test.ExpectedTeam && !strings.Contains(notifications[1].Title, "pwned@example.com") {
+			t.Errorf("team notification title = %q; expected it to name the subscriber", notifications[1].Title)
+		}
+	}
+}
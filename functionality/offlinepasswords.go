@@ -0,0 +1,332 @@
+package functionality
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// The index files built from the Pwned Passwords downloads are laid out as:
+// a header of the magic bytes, the size of the hashes and four reserved bytes,
+// then a fan-out table of 65537 record numbers, where entry N is the first record
+// whose hash starts with the two bytes N (so the last entry is the record count),
+// then the records, each being a hash followed by its count, sorted by hash
+const (
+	passwordIndexMagic      = "PWNDIDX1"
+	passwordIndexHeaderSize = 16
+	passwordIndexFanout     = 1 << 16
+	passwordIndexCountSize  = 4
+)
+
+var (
+	ErrPasswordIndexMalformed  = errors.New("the file is not a Pwned Passwords index")
+	ErrPasswordDatasetUnsorted = errors.New("the Pwned Passwords dataset must be ordered by hash")
+	ErrNoNTLMIndex             = errors.New("NTLM hashes can only be checked against a local NTLM index")
+	ErrMalformedNTLMHash       = errors.New("the NTLM hash must be 32 hexadecimal characters")
+)
+
+// passwordHashType is the kind of hash a Pwned Passwords dataset is made of
+type passwordHashType struct {
+	name string
+	size int
+}
+
+var (
+	passwordHashSHA1 = passwordHashType{name: "sha1", size: sha1.Size}
+	passwordHashNTLM = passwordHashType{name: "ntlm", size: 16}
+
+	// When set, passwords are checked against these instead of the Pwned Passwords API
+	offlineSHA1Index *passwordIndex
+	offlineNTLMIndex *passwordIndex
+)
+
+// passwordIndex is an opened index file, only its fan-out table is held in
+// memory, records are read straight from the file during the binary search
+type passwordIndex struct {
+	file     *os.File
+	hashSize int
+	fanout   []uint64
+}
+
+func passwordHashTypeByName(name string) (passwordHashType, error) {
+	switch strings.ToLower(name) {
+	case passwordHashSHA1.name:
+		return passwordHashSHA1, nil
+	case passwordHashNTLM.name:
+		return passwordHashNTLM, nil
+	default:
+		return passwordHashType{}, fmt.Errorf("unknown hash type %q, expected sha1 or ntlm", name)
+	}
+}
+
+func passwordIndexFileLocation(hashType passwordHashType) string {
+	return filepath.Join(dataDirectory, fmt.Sprintf("pwned-passwords-%s.idx", hashType.name))
+}
+
+// InitializeOfflinePasswords switches password checks to the local indexes in the data
+// directory when the pwnedPasswordsOffline environment variable is "true", the SHA-1
+// index is required in that case, the NTLM one is only used if it is there
+func InitializeOfflinePasswords() error {
+	if os.Getenv("pwnedPasswordsOffline") != "true" {
+		return nil
+	}
+
+	var err error
+
+	offlineSHA1Index, err = openPasswordIndex(passwordIndexFileLocation(passwordHashSHA1))
+
+	registerReadinessCheck("offline_passwords", func() error { return err })
+
+	if err != nil {
+		return err
+	}
+
+	if ntlmIndex, ntlmErr := openPasswordIndex(passwordIndexFileLocation(passwordHashNTLM)); ntlmErr == nil {
+		offlineNTLMIndex = ntlmIndex
+	} else if !os.IsNotExist(ntlmErr) {
+		logger.Warn("could not open the NTLM Pwned Passwords index", "error", ntlmErr)
+	}
+
+	return nil
+}
+
+func openPasswordIndex(fileLocation string) (*passwordIndex, error) {
+	indexFile, err := os.Open(fileLocation)
+
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, passwordIndexHeaderSize+(passwordIndexFanout+1)*8)
+
+	if _, err = io.ReadFull(indexFile, header); err != nil || string(header[:8]) != passwordIndexMagic {
+		indexFile.Close()
+
+		return nil, ErrPasswordIndexMalformed
+	}
+
+	index := &passwordIndex{
+		file:     indexFile,
+		hashSize: int(binary.BigEndian.Uint32(header[8:12])),
+		fanout:   make([]uint64, passwordIndexFanout+1),
+	}
+
+	for i := range index.fanout {
+		index.fanout[i] = binary.BigEndian.Uint64(header[passwordIndexHeaderSize+i*8:])
+	}
+
+	return index, nil
+}
+
+func (pi *passwordIndex) recordSize() int64 {
+	return int64(pi.hashSize + passwordIndexCountSize)
+}
+
+func (pi *passwordIndex) recordsOffset() int64 {
+	return passwordIndexHeaderSize + (passwordIndexFanout+1)*8
+}
+
+// count binary searches the records sharing the hash's first two bytes
+func (pi *passwordIndex) count(hash []byte) (int64, error) {
+	if len(hash) != pi.hashSize {
+		return 0, fmt.Errorf("the hash is %d bytes, the index is of %d byte hashes", len(hash), pi.hashSize)
+	}
+
+	prefix := int(hash[0])<<8 | int(hash[1])
+	low, high := pi.fanout[prefix], pi.fanout[prefix+1]
+	record := make([]byte, pi.recordSize())
+
+	for low < high {
+		middle := low + (high-low)/2
+
+		if _, err := pi.file.ReadAt(record, pi.recordsOffset()+int64(middle)*pi.recordSize()); err != nil {
+			return 0, err
+		}
+
+		switch bytes.Compare(record[:pi.hashSize], hash) {
+		case 0:
+			return int64(binary.BigEndian.Uint32(record[pi.hashSize:])), nil
+		case -1:
+			low = middle + 1
+		default:
+			high = middle
+		}
+	}
+
+	return 0, nil
+}
+
+func offlinePasswordCount(ctx context.Context, password string) (int64, error) {
+	_, span := tracer.Start(ctx, "pwnedpasswords.offline_lookup")
+
+	passwordHash := sha1.Sum([]byte(password))
+
+	count, err := offlineSHA1Index.count(passwordHash[:])
+
+	span.SetAttributes(attribute.Bool("pwned", count > 0))
+	endSpan(span, err)
+
+	return count, err
+}
+
+// PwnedNTLMHashCount returns how many times the password with the
+// hex encoded NTLM hash appears in the local NTLM index
+func PwnedNTLMHashCount(ntlmHash string) (int64, error) {
+	hash, err := hex.DecodeString(ntlmHash)
+
+	if err != nil || len(hash) != passwordHashNTLM.size {
+		return 0, ErrMalformedNTLMHash
+	}
+
+	if offlineNTLMIndex == nil {
+		return 0, ErrNoNTLMIndex
+	}
+
+	return offlineNTLMIndex.count(hash)
+}
+
+// ImportPwnedPasswords builds the index for the hash type in the data directory from a
+// Pwned Passwords download ordered by hash, made up of HASH:COUNT lines, and returns the
+// number of hashes imported; the index is only replaced once it has been fully built
+func ImportPwnedPasswords(dataset io.Reader, hashTypeName string) (uint64, error) {
+	hashType, err := passwordHashTypeByName(hashTypeName)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return buildPasswordIndex(dataset, hashType, passwordIndexFileLocation(hashType))
+}
+
+func buildPasswordIndex(dataset io.Reader, hashType passwordHashType, fileLocation string) (uint64, error) {
+	// Records are written to a temporary file first, since the fan-out
+	// table in front of them isn't known until every hash has been read
+	recordsFile, err := ioutil.TempFile(filepath.Dir(fileLocation), ".pwned-passwords-records")
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer os.Remove(recordsFile.Name())
+	defer recordsFile.Close()
+
+	var (
+		fanoutCounts = make([]uint64, passwordIndexFanout)
+		previousHash []byte
+		recordCount  uint64
+		lineNumber   int
+	)
+
+	recordsWriter := bufio.NewWriter(recordsFile)
+	scanner := bufio.NewScanner(dataset)
+	record := make([]byte, hashType.size+passwordIndexCountSize)
+
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" {
+			continue
+		}
+
+		separator := strings.IndexByte(line, ':')
+
+		if separator != hashType.size*2 {
+			return 0, fmt.Errorf("line %d is not a %s HASH:COUNT line", lineNumber, hashType.name)
+		}
+
+		if _, err = hex.Decode(record[:hashType.size], []byte(line[:separator])); err != nil {
+			return 0, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+
+		count, err := strconv.ParseUint(line[separator+1:], 10, 64)
+
+		if err != nil {
+			return 0, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+
+		if count > math.MaxUint32 {
+			count = math.MaxUint32
+		}
+
+		if previousHash != nil && bytes.Compare(previousHash, record[:hashType.size]) >= 0 {
+			return 0, fmt.Errorf("line %d: %v", lineNumber, ErrPasswordDatasetUnsorted)
+		}
+
+		previousHash = append(previousHash[:0], record[:hashType.size]...)
+
+		binary.BigEndian.PutUint32(record[hashType.size:], uint32(count))
+
+		if _, err = recordsWriter.Write(record); err != nil {
+			return 0, err
+		}
+
+		fanoutCounts[int(record[0])<<8|int(record[1])]++
+		recordCount++
+	}
+
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	if err = recordsWriter.Flush(); err != nil {
+		return 0, err
+	}
+
+	if _, err = recordsFile.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	indexFile, err := ioutil.TempFile(filepath.Dir(fileLocation), ".pwned-passwords-index")
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer os.Remove(indexFile.Name())
+	defer indexFile.Close()
+
+	header := make([]byte, passwordIndexHeaderSize+(passwordIndexFanout+1)*8)
+
+	copy(header, passwordIndexMagic)
+	binary.BigEndian.PutUint32(header[8:12], uint32(hashType.size))
+
+	var firstRecord uint64
+
+	for prefix := 0; prefix <= passwordIndexFanout; prefix++ {
+		binary.BigEndian.PutUint64(header[passwordIndexHeaderSize+prefix*8:], firstRecord)
+
+		if prefix < passwordIndexFanout {
+			firstRecord += fanoutCounts[prefix]
+		}
+	}
+
+	if _, err = indexFile.Write(header); err != nil {
+		return 0, err
+	}
+
+	if _, err = io.Copy(indexFile, recordsFile); err != nil {
+		return 0, err
+	}
+
+	if err = indexFile.Close(); err != nil {
+		return 0, err
+	}
+
+	return recordCount, os.Rename(indexFile.Name(), fileLocation)
+}
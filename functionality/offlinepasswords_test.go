@@ -0,0 +1,70 @@
+package functionality
+
+import (
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Need to test the following:
+// Every hash in the dataset is found with its count, including ones sharing a two byte prefix
+// Hashes not in the dataset, before, between and after the ones in it, have a count of zero
+// A dataset which is not ordered by hash is rejected
+func TestPasswordIndex(t *testing.T) {
+	tempDirectory, err := ioutil.TempDir("", "pwned-passwords")
+
+	if err != nil {
+		t.Fatal("could not create the temporary data directory")
+	}
+
+	defer os.RemoveAll(tempDirectory)
+
+	dataset := strings.Join([]string{
+		"0000000000000000000000000000000000000001:7",
+		"5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493",
+		"5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD9:2",
+		"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF:1",
+	}, "\r\n")
+
+	fileLocation := filepath.Join(tempDirectory, "sha1.idx")
+
+	if imported, err := buildPasswordIndex(strings.NewReader(dataset), passwordHashSHA1, fileLocation); imported != 4 || err != nil {
+		t.Fatalf("buildPasswordIndex(dataset) = %d, %v; expected: 4, <nil>", imported, err)
+	}
+
+	index, err := openPasswordIndex(fileLocation)
+
+	if err != nil {
+		t.Fatalf("openPasswordIndex() = %v; expected: <nil>", err)
+	}
+
+	passwordHash := sha1.Sum([]byte("password"))
+
+	tests := []struct {
+		Hash          []byte
+		ExpectedCount int64
+	}{
+		{Hash: passwordHash[:], ExpectedCount: 3861493},
+		{Hash: append(append([]byte{}, passwordHash[:19]...), 0xD9), ExpectedCount: 2},
+		{Hash: append(append([]byte{}, passwordHash[:19]...), 0xD7), ExpectedCount: 0},
+		{Hash: make([]byte, 20), ExpectedCount: 0},
+		{Hash: append(make([]byte, 19), 1), ExpectedCount: 7},
+		{Hash: []byte(strings.Repeat("\xff", 20)), ExpectedCount: 1},
+		{Hash: append([]byte(strings.Repeat("\xff", 19)), 0xfe), ExpectedCount: 0},
+	}
+
+	for _, test := range tests {
+		if count, err := index.count(test.Hash); count != test.ExpectedCount || err != nil {
+			t.Errorf("passwordIndex.count(%x) = %d, %v; expected: %d, <nil>", test.Hash, count, err, test.ExpectedCount)
+		}
+	}
+
+	unsorted := "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:1\n0000000000000000000000000000000000000001:1\n"
+
+	if _, err = buildPasswordIndex(strings.NewReader(unsorted), passwordHashSHA1, fileLocation); err == nil || !strings.Contains(err.Error(), ErrPasswordDatasetUnsorted.Error()) {
+		t.Errorf("buildPasswordIndex(unsorted dataset) = %v; expected: %v", err, ErrPasswordDatasetUnsorted)
+	}
+}
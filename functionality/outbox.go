@@ -0,0 +1,373 @@
+package functionality
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrOutboxUnavailable = errors.New("the outbox has not been opened")
+
+// maxOutboxAttempts is how many times a deferred notification is tried before it is dropped
+const maxOutboxAttempts = 5
+
+// outboxEntry is a deferred notification, which is encrypted since it is full of PII
+type outboxEntry struct {
+	ID           string    `json:"id"`
+	Notification envelope  `json:"notification"`
+	NotBefore    time.Time `json:"not_before"`
+	CreatedAt    time.Time `json:"created_at"`
+	Attempts     int       `json:"attempts,omitempty"`
+}
+
+// outbox keeps deferred notifications in a JSON file in the data directory until they are due
+type outbox struct {
+	mu           sync.Mutex
+	fileLocation string
+	keyring      *keyring
+	entries      map[string]outboxEntry
+}
+
+var (
+	notificationOutbox *outbox
+	outboxInterval     = time.Minute
+
+	// Notifications which fail are tried again after outboxRetryBackoff doubled for each attempt
+	// so far, plus up to half as long again so retries to the same place are spread out
+	outboxRetryBackoff = time.Minute
+)
+
+func init() {
+	registerKeyringRotation("outbox", func(kr *keyring) error {
+		if notificationOutbox == nil {
+			return nil
+		}
+
+		return notificationOutbox.rotate(kr)
+	})
+}
+
+// InitializeOutbox opens the outbox in the data directory and schedules the notifications
+// in it to be sent once they are due, it needs the subscriber keys file
+func InitializeOutbox() error {
+	kr, err := loadKeyringFromFile(subscriberKeysFileLocation())
+
+	if err == nil {
+		notificationOutbox, err = openOutbox(filepath.Join(dataDirectory, "outbox.json"), kr)
+	}
+
+	registerReadinessCheck("outbox", func() error { return err })
+
+	if err != nil {
+		return err
+	}
+
+	registerScheduledJob("outbox", outboxInterval, func(ctx context.Context) error {
+		return notificationOutbox.sendDue(ctx, time.Now(), sendNotification)
+	})
+
+	registerPersonalDataSource("outbox", personalDataSource{
+		export: func(email string) (interface{}, error) {
+			held, err := notificationOutbox.forEmail(email)
+
+			if err != nil || len(held) == 0 {
+				return nil, err
+			}
+
+			return held, nil
+		},
+		erase: notificationOutbox.eraseEmail,
+	})
+
+	return nil
+}
+
+func openOutbox(fileLocation string, kr *keyring) (*outbox, error) {
+	ob := &outbox{
+		fileLocation: fileLocation,
+		keyring:      kr,
+		entries:      make(map[string]outboxEntry),
+	}
+
+	outboxBytes, err := ioutil.ReadFile(fileLocation)
+
+	if os.IsNotExist(err) {
+		return ob, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(outboxBytes, &ob.entries); err != nil {
+		return nil, err
+	}
+
+	outboxDepth.Set(float64(len(ob.entries)))
+
+	return ob, nil
+}
+
+// save must be called with the lock held
+func (ob *outbox) save() error {
+	outboxDepth.Set(float64(len(ob.entries)))
+
+	outboxBytes, err := json.Marshal(ob.entries)
+
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(ob.fileLocation), ".outbox")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(outboxBytes)
+
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), ob.fileLocation)
+}
+
+func outboxAdditionalData(id string) []byte {
+	return []byte("outbox/" + id)
+}
+
+// decryptEntry must be called with the lock held
+func (ob *outbox) decryptEntry(entry outboxEntry) (notification, error) {
+	var n notification
+
+	notificationBytes, err := ob.keyring.decrypt(entry.Notification, outboxAdditionalData(entry.ID))
+
+	if err != nil {
+		return n, err
+	}
+
+	return n, json.Unmarshal(notificationBytes, &n)
+}
+
+// encryptEntry must be called with the lock held
+func (ob *outbox) encryptEntry(entry outboxEntry, n notification) (outboxEntry, error) {
+	notificationBytes, err := json.Marshal(n)
+
+	if err != nil {
+		return entry, err
+	}
+
+	entry.Notification, err = ob.keyring.encrypt(notificationBytes, outboxAdditionalData(entry.ID))
+
+	return entry, err
+}
+
+// hold puts the notification in the outbox until the time
+func (ob *outbox) hold(n notification, notBefore time.Time) error {
+	ob.mu.Lock()
+
+	defer ob.mu.Unlock()
+
+	entry, err := ob.encryptEntry(outboxEntry{ID: newID(), NotBefore: notBefore.UTC(), CreatedAt: time.Now().UTC()}, n)
+
+	if err != nil {
+		return err
+	}
+
+	ob.entries[entry.ID] = entry
+
+	return ob.save()
+}
+
+// retryAfter is how long after its attempts so far a notification which failed is tried again
+func retryAfter(attempts int) time.Duration {
+	backoff := outboxRetryBackoff << attempts
+
+	return backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+}
+
+// sendDue sends the notifications which are due, the lock isn't held while they are sent
+// so that sending doesn't hold up notifications being deferred; ones which fail are tried
+// again with an exponential backoff, until they have been tried maxOutboxAttempts times, and
+// ones which can't be decrypted are left for when the key they need is back in the keyring
+func (ob *outbox) sendDue(ctx context.Context, now time.Time, send func(context.Context, notification) error) error {
+	log := loggerFromContext(ctx)
+
+	ob.mu.Lock()
+
+	due := make(map[string]notification)
+
+	for id, entry := range ob.entries {
+		if entry.NotBefore.After(now) {
+			continue
+		}
+
+		n, err := ob.decryptEntry(entry)
+
+		if err != nil {
+			log.Error("skipping deferred notification which could not be decrypted", "id", id, "error", err)
+
+			continue
+		}
+
+		due[id] = n
+	}
+
+	ob.mu.Unlock()
+
+	var failed []string
+
+	for id, n := range due {
+		err := send(ctx, n)
+
+		ob.mu.Lock()
+
+		entry, exists := ob.entries[id]
+		entry.Attempts++
+
+		switch {
+		case !exists:
+			// It was erased while it was being sent, so there is nothing to update
+		case err == nil:
+			delete(ob.entries, id)
+		case entry.Attempts >= maxOutboxAttempts:
+			log.Error("dropping deferred notification", "email", n.Email, "channel", n.Channel, "attempts", entry.Attempts, "error", err)
+
+			delete(ob.entries, id)
+		default:
+			entry.NotBefore = now.Add(retryAfter(entry.Attempts)).UTC()
+			ob.entries[id] = entry
+		}
+
+		saveErr := ob.save()
+
+		ob.mu.Unlock()
+
+		if err == nil {
+			err = saveErr
+		}
+
+		if err != nil {
+			failed = append(failed, id)
+		}
+	}
+
+	if len(failed) != 0 {
+		return fmt.Errorf("could not send deferred notifications: %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// forEmail returns the notifications for the email which are in the outbox, ones which
+// can't be decrypted are skipped like they are by sendDue
+func (ob *outbox) forEmail(email string) ([]notification, error) {
+	ob.mu.Lock()
+
+	defer ob.mu.Unlock()
+
+	var held []notification
+
+	for id, entry := range ob.entries {
+		n, err := ob.decryptEntry(entry)
+
+		if err != nil {
+			logger.Error("skipping deferred notification which could not be decrypted", "id", id, "error", err)
+
+			continue
+		}
+
+		if strings.EqualFold(n.Email, email) {
+			held = append(held, n)
+		}
+	}
+
+	return held, nil
+}
+
+func (ob *outbox) eraseEmail(email string) (bool, error) {
+	ob.mu.Lock()
+
+	defer ob.mu.Unlock()
+
+	erased := false
+
+	for id, entry := range ob.entries {
+		n, err := ob.decryptEntry(entry)
+
+		if err != nil {
+			logger.Error("skipping deferred notification which could not be decrypted", "id", id, "error", err)
+
+			continue
+		}
+
+		if strings.EqualFold(n.Email, email) {
+			delete(ob.entries, id)
+
+			erased = true
+		}
+	}
+
+	if !erased {
+		return false, nil
+	}
+
+	return true, ob.save()
+}
+
+// rotate re-encrypts every notification in the outbox with the keyring's active key
+func (ob *outbox) rotate(kr *keyring) error {
+	ob.mu.Lock()
+
+	defer ob.mu.Unlock()
+
+	ob.keyring = kr
+
+	for id, entry := range ob.entries {
+		n, err := ob.decryptEntry(entry)
+
+		if err != nil {
+			return err
+		}
+
+		if ob.entries[id], err = ob.encryptEntry(entry, n); err != nil {
+			return err
+		}
+	}
+
+	return ob.save()
+}
+
+// deliverNotification sends the notification now, unless it is during the subscriber's quiet
+// hours, isn't severe enough to override them and the channel waits for them, in which case
+// it is held in the outbox
+func deliverNotification(ctx context.Context, details subscriberDetails, channelNotifier notifier, n notification) error {
+	notBefore, deferred := details.deferUntil(time.Now(), n.Severity)
+
+	if !deferred || !channelNotifier.deferrable() || notificationOutbox == nil {
+		return channelNotifier.send(ctx, n)
+	}
+
+	err := notificationOutbox.hold(n, notBefore)
+
+	if err == nil {
+		loggerFromContext(ctx).Info("deferred notification until quiet hours end", "email", n.Email, "channel", n.Channel, "not_before", notBefore)
+	}
+
+	return err
+}
@@ -0,0 +1,132 @@
+package functionality
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Need to test the following:
+// Held notifications are encrypted on disk and only sent once they are due
+// Notifications which fail to send are kept until they have been tried maxOutboxAttempts times
+// Each retry waits at least twice as long as the one before, and isn't tried before then
+// Erasing an email removes every notification for it
+// Notifications erased while they are being sent aren't written back
+// Notifications which can't be decrypted are skipped without holding up the others, or exports and erasures
+func TestOutbox(t *testing.T) {
+	tempDirectory, err := ioutil.TempDir("", "outbox")
+
+	if err != nil {
+		t.Fatal("could not create the temporary data directory")
+	}
+
+	defer os.RemoveAll(tempDirectory)
+
+	fileLocation := filepath.Join(tempDirectory, "outbox.json")
+	kr := newTestKeyring(t, "1", map[string]string{"1": newTestKey(t)}, newTestKey(t))
+	ob, _ := openOutbox(fileLocation, kr)
+
+	now := time.Now()
+
+	ob.hold(notification{Email: "due@example.com", Channel: channelEmail, To: "due@example.com", Title: "due"}, now.Add(-time.Minute))
+	ob.hold(notification{Email: "later@example.com", Channel: channelSMS, To: "+15558675309", Title: "later"}, now.Add(30*24*time.Hour))
+	ob.hold(notification{Email: "failing@example.com", Channel: channelEmail, To: "failing@example.com", Title: "failing"}, now.Add(-time.Minute))
+
+	outboxBytes, _ := ioutil.ReadFile(fileLocation)
+
+	if strings.Contains(string(outboxBytes), "example.com") || strings.Contains(string(outboxBytes), "5558675309") {
+		t.Errorf("outbox file = %s; expected no plaintext PII", outboxBytes)
+	}
+
+	var sent []string
+
+	send := func(ctx context.Context, n notification) error {
+		if n.Title == "failing" {
+			return errors.New("could not send")
+		}
+
+		sent = append(sent, n.Title)
+
+		return nil
+	}
+
+	if ob, err = openOutbox(fileLocation, kr); err != nil {
+		t.Fatalf("openOutbox() = %v; expected: <nil>", err)
+	}
+
+	if err = ob.sendDue(context.Background(), now, send); err == nil || !equalStrings(sent, []string{"due"}) || len(ob.entries) != 2 {
+		t.Errorf("outbox.sendDue() = %v, sent %v, %d left; expected: an error, sent [due], 2 left", err, sent, len(ob.entries))
+	}
+
+	failingEntry := func() outboxEntry {
+		for _, entry := range ob.entries {
+			if entry.Attempts != 0 {
+				return entry
+			}
+		}
+
+		return outboxEntry{}
+	}
+
+	retriedAt, previousWait := now, time.Duration(0)
+
+	for attempt := 2; attempt <= maxOutboxAttempts; attempt++ {
+		failing := failingEntry()
+		wait := failing.NotBefore.Sub(retriedAt)
+
+		if wait < outboxRetryBackoff<<(attempt-1) || wait <= previousWait {
+			t.Errorf("wait before attempt %d = %s after %s; expected: at least %s and growing", attempt, wait, previousWait, outboxRetryBackoff<<(attempt-1))
+		}
+
+		if ob.sendDue(context.Background(), failing.NotBefore.Add(-time.Second), send); failingEntry().Attempts != attempt-1 {
+			t.Errorf("attempts before attempt %d was due = %d; expected: %d", attempt, failingEntry().Attempts, attempt-1)
+		}
+
+		retriedAt, previousWait = failing.NotBefore, wait
+
+		ob.sendDue(context.Background(), retriedAt, send)
+	}
+
+	if held, _ := ob.forEmail("failing@example.com"); len(held) != 0 {
+		t.Errorf("outbox.forEmail() after %d attempts = %v; expected: it to be dropped", maxOutboxAttempts, held)
+	}
+
+	if erased, err := ob.eraseEmail("LATER@example.com"); err != nil || !erased || len(ob.entries) != 0 {
+		t.Errorf("outbox.eraseEmail() = %t, %v, %d left; expected: true, <nil>, 0 left", erased, err, len(ob.entries))
+	}
+
+	ob.hold(notification{Email: "erased@example.com", Channel: channelEmail, To: "erased@example.com", Title: "erased"}, now.Add(-time.Minute))
+
+	eraseWhileSending := func(ctx context.Context, n notification) error {
+		ob.eraseEmail(n.Email)
+
+		return nil
+	}
+
+	if err = ob.sendDue(context.Background(), now, eraseWhileSending); err != nil || len(ob.entries) != 0 {
+		t.Errorf("outbox.sendDue() erasing while sending = %v, left %v; expected: <nil>, nothing left", err, ob.entries)
+	}
+
+	ob.entries["undecryptable"] = outboxEntry{ID: "undecryptable", Notification: envelope{KeyID: "2"}, NotBefore: now.Add(-time.Minute)}
+	ob.hold(notification{Email: "due@example.com", Channel: channelEmail, To: "due@example.com", Title: "due"}, now.Add(-time.Minute))
+	sent = nil
+
+	if err = ob.sendDue(context.Background(), now, send); err != nil || !equalStrings(sent, []string{"due"}) || len(ob.entries) != 1 {
+		t.Errorf("outbox.sendDue() with an undecryptable notification = %v, sent %v, left %v; expected: <nil>, sent [due], only the undecryptable one left", err, sent, ob.entries)
+	}
+
+	ob.hold(notification{Email: "later@example.com", Channel: channelEmail, To: "later@example.com", Title: "later"}, now.Add(time.Hour))
+
+	if held, err := ob.forEmail("later@example.com"); err != nil || len(held) != 1 {
+		t.Errorf("outbox.forEmail() with an undecryptable notification = %v, %v; expected: the one for later@example.com, <nil>", held, err)
+	}
+
+	if erased, err := ob.eraseEmail("later@example.com"); err != nil || !erased || len(ob.entries) != 1 {
+		t.Errorf("outbox.eraseEmail() with an undecryptable notification = %t, %v, left %v; expected: true, <nil>, only the undecryptable one left", erased, err, ob.entries)
+	}
+}
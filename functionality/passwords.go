@@ -0,0 +1,142 @@
+package functionality
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var ErrNoPassword = errors.New("a password or an NTLM hash must be provided")
+
+// PwnedPasswordCount returns how many times the password appears in Pwned Passwords,
+// using the local index instead of the API when the service has been set up to
+func PwnedPasswordCount(ctx context.Context, password string) (int64, error) {
+	if offlineSHA1Index != nil {
+		return offlinePasswordCount(ctx, password)
+	}
+
+	return pwnedPasswordCountWithClient(ctx, password, http.DefaultClient)
+}
+
+// pwnedPasswordCountWithClient uses the k-anonymity model: the password is hashed locally
+// and only the first five characters of the hash are sent, padding is requested so that
+// the size of the response doesn't give away how many hashes share the prefix either
+func pwnedPasswordCountWithClient(ctx context.Context, password string, client *http.Client) (count int64, err error) {
+	passwordHash := sha1.Sum([]byte(password))
+	hexHash := strings.ToUpper(hex.EncodeToString(passwordHash[:]))
+	prefix, suffix := hexHash[:5], hexHash[5:]
+
+	ctx, span := tracer.Start(ctx, "pwnedpasswords.range")
+
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, 7*time.Second)
+
+	defer cancel()
+
+	rangeRequest, err := http.NewRequest("GET", fmt.Sprintf("%s/range/%s", pwnedPasswordsBaseURL, prefix), nil)
+
+	if err != nil {
+		return 0, err
+	}
+
+	rangeRequest.Header.Set("User-Agent", "RJ-And-Friends-Nightly-Pwnage-Checker")
+	rangeRequest.Header.Set("Add-Padding", "true")
+
+	resp, err := client.Do(rangeRequest.WithContext(ctx))
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("the Pwned Passwords range API responded with HTTP/%d", resp.StatusCode)
+	}
+
+	count, err = findHashSuffixCount(bufio.NewScanner(resp.Body), suffix)
+
+	span.SetAttributes(attribute.Bool("pwned", count > 0))
+
+	return count, err
+}
+
+// findHashSuffixCount looks through lines of SUFFIX:COUNT for the suffix, padding
+// lines have a count of zero so they are the same as the suffix not being found
+func findHashSuffixCount(scanner *bufio.Scanner, suffix string) (int64, error) {
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		separator := strings.IndexByte(line, ':')
+
+		if separator == -1 || !strings.EqualFold(line[:separator], suffix) {
+			continue
+		}
+
+		return strconv.ParseInt(line[separator+1:], 10, 64)
+	}
+
+	return 0, scanner.Err()
+}
+
+// CheckPassword responds with whether the password has been pwned, and how many times;
+// instead of a password an NTLM hash can be checked when there is a local NTLM index
+func CheckPassword(c *gin.Context) {
+	passwordRequest := struct {
+		Password string `json:"password"`
+		NTLMHash string `json:"ntlm_hash"`
+	}{}
+
+	if err := json.NewDecoder(c.Request.Body).Decode(&passwordRequest); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	}
+
+	if passwordRequest.Password == "" && passwordRequest.NTLMHash == "" {
+		respondWithError(c, http.StatusBadRequest, ErrNoPassword)
+
+		return
+	}
+
+	var (
+		count int64
+		err   error
+	)
+
+	if passwordRequest.Password != "" {
+		count, err = PwnedPasswordCount(c.Request.Context(), passwordRequest.Password)
+	} else if count, err = PwnedNTLMHashCount(passwordRequest.NTLMHash); err == ErrMalformedNTLMHash {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	} else if err == ErrNoNTLMIndex {
+		respondWithError(c, http.StatusNotImplemented, err)
+
+		return
+	}
+
+	if err != nil {
+		loggerFromContext(c.Request.Context()).Error("could not check password", "error", err)
+
+		respondWithError(c, http.StatusBadGateway, err)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"error": false, "pwned": count > 0, "count": count})
+}
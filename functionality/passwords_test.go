@@ -0,0 +1,99 @@
+package functionality
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Need to test the following:
+// Only the first five characters of the SHA-1 of the password are sent, with padding requested
+// A suffix in the response returns its count, case insensitively
+// A suffix only in the response as padding, or not in it at all, returns zero
+func TestPwnedPasswordCount(t *testing.T) {
+	var requestedPath, requestedPadding string
+
+	hashOf := func(password string) string {
+		passwordHash := sha1.Sum([]byte(password))
+
+		return strings.ToUpper(hex.EncodeToString(passwordHash[:]))
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedPath, requestedPadding = r.URL.Path, r.Header.Get("Add-Padding")
+
+		fmt.Fprintf(w, "003D68EB55068C33ACE09247EE4C639306B:3\r\n%s:3861493\r\n%s:0\r\n", strings.ToLower(hashOf("password")[5:]), hashOf("padding")[5:])
+	}))
+
+	defer server.Close()
+
+	originalBaseURL := pwnedPasswordsBaseURL
+	pwnedPasswordsBaseURL = server.URL
+
+	defer func() { pwnedPasswordsBaseURL = originalBaseURL }()
+
+	tests := []struct {
+		Password      string
+		ExpectedCount int64
+	}{
+		{Password: "password", ExpectedCount: 3861493},
+		{Password: "padding", ExpectedCount: 0},
+		{Password: "correct horse battery staple", ExpectedCount: 0},
+	}
+
+	for _, test := range tests {
+		count, err := pwnedPasswordCountWithClient(context.Background(), test.Password, server.Client())
+
+		if err != nil || count != test.ExpectedCount {
+			t.Errorf("pwnedPasswordCountWithClient(%q) = %d, %v; expected: %d, <nil>", test.Password, count, err, test.ExpectedCount)
+		}
+
+		if expectedPath := "/range/" + hashOf(test.Password)[:5]; requestedPath != expectedPath || requestedPadding != "true" {
+			t.Errorf("pwnedPasswordCountWithClient(%q) requested %s with Add-Padding %q; expected: %s with Add-Padding true", test.Password, requestedPath, requestedPadding, expectedPath)
+		}
+	}
+}
+
+// Need to test the following:
+// A request without a password or an NTLM hash is rejected
+// NTLM hashes which aren't hex, or aren't 16 bytes, are rejected rather than treated as an upstream failure
+// A well formed NTLM hash without a local NTLM index is not implemented
+func TestCheckPassword(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	originalNTLMIndex := offlineNTLMIndex
+	offlineNTLMIndex = nil
+
+	defer func() { offlineNTLMIndex = originalNTLMIndex }()
+
+	router := gin.New()
+	router.POST("/password", CheckPassword)
+
+	tests := []struct {
+		Body               string
+		ExpectedStatusCode int
+	}{
+		{Body: `{}`, ExpectedStatusCode: http.StatusBadRequest},
+		{Body: `{"ntlm_hash": "not hex"}`, ExpectedStatusCode: http.StatusBadRequest},
+		{Body: `{"ntlm_hash": "8846F7EAEE8FB117AD06BDD830B758"}`, ExpectedStatusCode: http.StatusBadRequest},
+		{Body: `{"ntlm_hash": "8846F7EAEE8FB117AD06BDD830B7586C"}`, ExpectedStatusCode: http.StatusNotImplemented},
+	}
+
+	for _, test := range tests {
+		mockRequest := httptest.NewRequest(http.MethodPost, "/password", strings.NewReader(test.Body))
+		mockResponseWriter := httptest.NewRecorder()
+
+		router.ServeHTTP(mockResponseWriter, mockRequest)
+
+		if mockResponseWriter.Code != test.ExpectedStatusCode {
+			t.Errorf("POST /password %s = HTTP/%d; expected: HTTP/%d", test.Body, mockResponseWriter.Code, test.ExpectedStatusCode)
+		}
+	}
+}
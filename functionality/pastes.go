@@ -0,0 +1,223 @@
+package functionality
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"text/template"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// PasteInfo is a paste HIBP found an account in, the title and date are not known for every source
+type PasteInfo struct {
+	Source     string     `json:"Source"`
+	ID         string     `json:"Id"`
+	Title      string     `json:"Title,omitempty"`
+	Date       *time.Time `json:"Date,omitempty"`
+	EmailCount int64      `json:"EmailCount"`
+}
+
+// key identifies the paste, IDs are only unique within a source
+func (pi PasteInfo) key() string {
+	return pi.Source + "/" + pi.ID
+}
+
+var (
+	pasteCheckInterval = 24 * time.Hour
+
+	pasteNotificationTitle    = "YOUR ADDRESS APPEARED IN A PASTE :("
+	pasteNotificationTemplate = template.Must(template.New("paste").Parse(
+		`Your email was found in {{len .}} new paste{{if gt (len .) 1}}s{{end}} on Have I Been Pwned:
+{{range .}}
+- {{.Source}} paste {{.ID}}{{if .Title}} "{{.Title}}"{{end}}{{if .Date}} from {{.Date.Format "2006-01-02"}}{{end}}, with {{.EmailCount}} emails in it
+{{- end}}
+
+Pastes are often used to share lists of breached credentials, so change the password of any account using this email.
+`))
+)
+
+func init() {
+	registerScheduledJob("paste_check", pasteCheckInterval, checkSubscribersForPastes)
+}
+
+func getPastesForEmail(ctx context.Context, email string) ([]PasteInfo, error) {
+	return getPastesForEmailWithClient(ctx, email, http.DefaultClient)
+}
+
+// getPastesForEmailWithClient returns the pastes HIBP found the email in, an email without any pastes is not an error
+func getPastesForEmailWithClient(ctx context.Context, email string, client *http.Client) (pastes []PasteInfo, err error) {
+	ctx, span := tracer.Start(ctx, "hibp.pasteaccount")
+
+	span.SetAttributes(attribute.String("email.hash", hashPII("email", email)))
+
+	defer func() { endSpan(span, err) }()
+
+	waited, err := hibpLimiter.Wait(ctx)
+
+	hibpRateLimiterWait.Observe(waited.Seconds())
+
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 7*time.Second)
+
+	defer cancel()
+
+	pastesRequest, err := http.NewRequest("GET", fmt.Sprintf("%s/pasteaccount/%s", hibpBaseURL, url.QueryEscape(email)), nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pastesRequest.Header.Set("User-Agent", "RJ-And-Friends-Nightly-Pwnage-Checker")
+
+	if hibpAPIKey != "" {
+		pastesRequest.Header.Set("hibp-api-key", hibpAPIKey)
+	}
+
+	requestStart := time.Now()
+
+	resp, err := client.Do(pastesRequest.WithContext(ctx))
+
+	statusCode := 0
+
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+
+	hibpRequests.WithLabelValues(statusCodeLabel(statusCode)).Inc()
+	hibpRequestDuration.WithLabelValues(statusCodeLabel(statusCode)).Observe(time.Since(requestStart).Seconds())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the HIBP paste API responded with HTTP/%d", resp.StatusCode)
+	}
+
+	return pastes, json.NewDecoder(resp.Body).Decode(&pastes)
+}
+
+// newPastes returns the pastes which aren't in the ones already seen
+func newPastes(seen, found []PasteInfo) []PasteInfo {
+	seenKeys := make(map[string]bool, len(seen))
+
+	for _, paste := range seen {
+		seenKeys[paste.key()] = true
+	}
+
+	var added []PasteInfo
+
+	for _, paste := range found {
+		if !seenKeys[paste.key()] {
+			added = append(added, paste)
+		}
+	}
+
+	return added
+}
+
+// checkSubscribersForPastes looks every subscriber up in HIBP's pastes, storing the pastes found
+// and notifying the subscriber of the ones which weren't found in the last check; the pastes are
+// stored once the subscriber has been notified on any channel, so they aren't notified again on
+// the channels which worked just because another failed
+func checkSubscribersForPastes(ctx context.Context) error {
+	if subscribers == nil {
+		return ErrSubscriberStoreUnavailable
+	}
+
+	subscriberList, err := subscribers.list()
+
+	if err != nil {
+		return err
+	}
+
+	log := loggerFromContext(ctx)
+	notified, failed := 0, 0
+
+	for _, subscriber := range subscriberList {
+		pastes, err := getPastesForEmail(ctx, subscriber.Email)
+
+		if err != nil {
+			log.Error("could not check subscriber for pastes", "email", subscriber.Email, "error", err)
+
+			failed++
+
+			continue
+		}
+
+		added := newPastes(subscriber.Pastes, pastes)
+
+		if len(added) == 0 {
+			continue
+		}
+
+		delivered, err := notifySubscriberOfPastes(ctx, subscriber, added)
+
+		if err != nil {
+			log.Error("could not notify subscriber of pastes", "email", subscriber.Email, "error", err)
+
+			failed++
+		}
+
+		// The pastes aren't stored unless the subscriber was notified somewhere, so the notification is tried again on the next check
+		if err != nil && !delivered {
+			continue
+		}
+
+		notified++
+
+		err = subscribers.updateDetails(subscriber.ID, func(details *subscriberDetails) { details.Pastes = pastes })
+
+		if err != nil {
+			log.Error("could not store subscriber pastes", "email", subscriber.Email, "error", err)
+		}
+	}
+
+	log.Info("checked subscribers for pastes", "subscribers", len(subscriberList), "notified", notified, "failed", failed)
+
+	return nil
+}
+
+// notifySubscriberOfPastes sends the paste notification, which is a type of its own rather than
+// a breach notification, so it is logged with a notification_type of paste; it returns whether
+// the notification was delivered on, or queued for, any of the subscriber's channels
+func notifySubscriberOfPastes(ctx context.Context, subscriber Subscriber, pastes []PasteInfo) (bool, error) {
+	ctx = contextWithLogger(ctx, loggerFromContext(ctx).With("notification_type", "paste"))
+
+	items := make([]digestItem, 0, len(pastes))
+
+	for i := range pastes {
+		items = append(items, digestItem{DetectedAt: time.Now().UTC(), Paste: &pastes[i]})
+	}
+
+	if queued, err := queueForDigest(ctx, subscriber, items); queued || err != nil {
+		return queued, err
+	}
+
+	var body bytes.Buffer
+
+	if err := pasteNotificationTemplate.Execute(&body, pastes); err != nil {
+		return false, err
+	}
+
+	return notifySubscriberOnAny(ctx, subscriber, everyChannel(), notification{
+		Type:   notificationPaste,
+		Title:  pasteNotificationTitle,
+		Body:   body.String(),
+		Pastes: pastes,
+	})
+}
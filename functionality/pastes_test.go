@@ -0,0 +1,168 @@
+package functionality
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/the-rileyj/pwned-api/functionality/hibptest"
+)
+
+// Need to test the following:
+// The pastes HIBP found the email in are returned
+// An email HIBP has no pastes for (HTTP/404) has no pastes and no error
+// Any other status code is an error
+func TestGetPastesForEmail(t *testing.T) {
+	pasteDate := time.Date(2014, 3, 4, 19, 14, 54, 0, time.UTC)
+
+	hibpPastes := map[string][]PasteInfo{
+		"pasted@example.com": {{Source: "Pastebin", ID: "8Q0BvKD8", Title: "syslog", Date: &pasteDate, EmailCount: 139}},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email := path.Base(r.URL.Path)
+
+		if email == "broken@example.com" {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		pastes, exists := hibpPastes[email]
+
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		json.NewEncoder(w).Encode(pastes)
+	}))
+
+	defer server.Close()
+
+	originalBaseURL := hibpBaseURL
+	hibpBaseURL = server.URL
+
+	defer func() { hibpBaseURL = originalBaseURL }()
+
+	tests := []struct {
+		Email          string
+		ExpectedPastes int
+		ExpectedErr    bool
+	}{
+		{Email: "pasted@example.com", ExpectedPastes: 1},
+		{Email: "unpasted@example.com", ExpectedPastes: 0},
+		{Email: "broken@example.com", ExpectedErr: true},
+	}
+
+	for _, test := range tests {
+		pastes, err := getPastesForEmailWithClient(context.Background(), test.Email, server.Client())
+
+		if len(pastes) != test.ExpectedPastes || (err != nil) != test.ExpectedErr {
+			t.Errorf("getPastesForEmailWithClient(%s) = %d pastes, %v; expected: %d pastes, error: %t", test.Email, len(pastes), err, test.ExpectedPastes, test.ExpectedErr)
+		}
+	}
+}
+
+// Need to test the following:
+// Pastes are only new if no paste with the same source and ID has been seen
+func TestNewPastes(t *testing.T) {
+	seen := []PasteInfo{{Source: "Pastebin", ID: "1"}, {Source: "Pastie", ID: "2"}}
+	found := []PasteInfo{{Source: "Pastebin", ID: "1"}, {Source: "Pastebin", ID: "2"}, {Source: "Pastie", ID: "2"}}
+
+	if added := newPastes(seen, found); len(added) != 1 || added[0].key() != "Pastebin/2" {
+		t.Errorf("newPastes() = %+v; expected: only Pastebin/2", added)
+	}
+
+	if added := newPastes(nil, found); len(added) != 3 {
+		t.Errorf("newPastes() with nothing seen = %d pastes; expected: 3", len(added))
+	}
+}
+
+// Need to test the following:
+// Each paste is listed with its title and date when HIBP knows them
+func TestPasteNotificationTemplate(t *testing.T) {
+	pasteDate := time.Date(2014, 3, 4, 19, 14, 54, 0, time.UTC)
+
+	var body bytes.Buffer
+
+	err := pasteNotificationTemplate.Execute(&body, []PasteInfo{
+		{Source: "Pastebin", ID: "8Q0BvKD8", Title: "syslog", Date: &pasteDate, EmailCount: 139},
+		{Source: "AdHocUrl", ID: "example.com/leak.txt", EmailCount: 12},
+	})
+
+	expectedLines := []string{
+		"found in 2 new pastes",
+		`- Pastebin paste 8Q0BvKD8 "syslog" from 2014-03-04, with 139 emails in it`,
+		"- AdHocUrl paste example.com/leak.txt, with 12 emails in it",
+	}
+
+	for _, expectedLine := range expectedLines {
+		if err != nil || !strings.Contains(body.String(), expectedLine) {
+			t.Errorf("pasteNotificationTemplate = %q, %v; expected it to contain %q", body.String(), err, expectedLine)
+		}
+	}
+}
+
+// Need to test the following:
+// New pastes are stored once the subscriber was notified on any channel, even if another failed
+// New pastes aren't stored when every channel failed, so they are notified again on the next check
+func TestCheckSubscribersForPastes(t *testing.T) {
+	tempDirectory, err := ioutil.TempDir("", "pastes")
+
+	if err != nil {
+		t.Fatal("could not create the temporary data directory")
+	}
+
+	defer os.RemoveAll(tempDirectory)
+
+	_, restoreHIBP := useFakeHIBP(hibptest.Fixtures{
+		Pastes: map[string][]hibptest.Paste{"pasted@example.com": {{Source: "Pastebin", ID: "8Q0BvKD8"}}},
+	})
+
+	defer restoreHIBP()
+
+	tests := []struct {
+		Channels       map[string]notifier
+		ExpectedStored bool
+	}{
+		{Channels: map[string]notifier{channelSMS: failingNotifier{}}, ExpectedStored: true},
+		{Channels: map[string]notifier{channelEmail: failingNotifier{}, channelSMS: failingNotifier{}}, ExpectedStored: false},
+	}
+
+	for i, test := range tests {
+		kr := newTestKeyring(t, "1", map[string]string{"1": newTestKey(t)}, newTestKey(t))
+		subscribers, _ = openSubscriberStore(filepath.Join(tempDirectory, fmt.Sprintf("subscribers-%d.json", i)), kr)
+
+		subscribers.add(Subscriber{Email: "pasted@example.com"})
+
+		_, restoreNotifiers := useRecordingNotifiers("", channelEmail, channelSMS)
+
+		for channel, channelNotifier := range test.Channels {
+			registerNotifier(channel, channelNotifier)
+		}
+
+		err := checkSubscribersForPastes(context.Background())
+
+		restoreNotifiers()
+
+		subscriber, _ := subscribers.get("pasted@example.com")
+
+		if err != nil || (len(subscriber.Pastes) != 0) != test.ExpectedStored {
+			t.Errorf("checkSubscribersForPastes() with %d failing channels = %v, stored %d pastes; expected stored: %t", len(test.Channels), err, len(subscriber.Pastes), test.ExpectedStored)
+		}
+	}
+
+	subscribers = nil
+}
@@ -0,0 +1,279 @@
+package functionality
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The actions a policy rule can take on the breaches it matches
+const (
+	policyActionNotify = "notify"
+	policyActionIgnore = "ignore"
+)
+
+// policyConditions are what a breach has to be for a rule to apply to it, every condition
+// which is set must hold; data classes match when the breach exposed any one of them
+type policyConditions struct {
+	DataClasses    []string `json:"data_classes,omitempty"`
+	IsVerified     *bool    `json:"is_verified,omitempty"`
+	IsFabricated   *bool    `json:"is_fabricated,omitempty"`
+	IsSensitive    *bool    `json:"is_sensitive,omitempty"`
+	IsRetired      *bool    `json:"is_retired,omitempty"`
+	IsSpamList     *bool    `json:"is_spam_list,omitempty"`
+	MinPwnCount    int64    `json:"min_pwn_count,omitempty"`
+	MaxPwnCount    int64    `json:"max_pwn_count,omitempty"`
+	BreachedAfter  string   `json:"breached_after,omitempty"`
+	BreachedBefore string   `json:"breached_before,omitempty"`
+	MinSeverity    string   `json:"min_severity,omitempty"`
+}
+
+// policyRule decides what happens to the breaches matching its conditions: they are either
+// ignored, or notified through its channels (every channel when it has none) with its severity
+// (the scored severity when it has none), which changes the subject line they are notified with
+type policyRule struct {
+	Name     string           `json:"name,omitempty"`
+	When     policyConditions `json:"when"`
+	Action   string           `json:"action"`
+	Channels []string         `json:"channels,omitempty"`
+	Severity string           `json:"severity,omitempty"`
+}
+
+// policyDecision is the outcome of the policy rules for some breaches, Channels are the
+// breaches routed to each channel, most severe first like Breaches
+type policyDecision struct {
+	Breaches []scoredBreach
+	Channels map[string][]scoredBreach
+}
+
+// globalPolicyRules are applied after a subscriber's own rules, from the file in the
+// notificationPolicyFile environment variable, which is not secret so is left in place
+var globalPolicyRules []policyRule
+
+func init() {
+	fileLocation, exists := os.LookupEnv("notificationPolicyFile")
+
+	if !exists {
+		return
+	}
+
+	rules, err := loadPolicyRules(fileLocation)
+
+	registerReadinessCheck("notification_policy", func() error { return err })
+
+	if err != nil {
+		logger.Error("could not load the notification policy", "error", err)
+
+		return
+	}
+
+	globalPolicyRules = rules
+}
+
+func loadPolicyRules(fileLocation string) ([]policyRule, error) {
+	policyFile, err := os.Open(fileLocation)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer policyFile.Close()
+
+	var rules []policyRule
+
+	if err = json.NewDecoder(policyFile).Decode(&rules); err != nil {
+		return nil, err
+	}
+
+	return rules, validatePolicyRules(rules)
+}
+
+func severityByName(name string) (severity, error) {
+	for s := severityLow; s <= severityCritical; s++ {
+		if strings.EqualFold(s.String(), name) {
+			return s, nil
+		}
+	}
+
+	return severityLow, fmt.Errorf("unknown severity %q, expected low, medium, high or critical", name)
+}
+
+func validatePolicyRules(rules []policyRule) error {
+	for i, rule := range rules {
+		if rule.Action != policyActionNotify && rule.Action != policyActionIgnore {
+			return fmt.Errorf("policy rule %d: unknown action %q, expected notify or ignore", i, rule.Action)
+		}
+
+		for _, channel := range rule.Channels {
+			if !containsFold(allChannels, channel) {
+				return fmt.Errorf("policy rule %d: unknown channel %q", i, channel)
+			}
+		}
+
+		for _, name := range []string{rule.Severity, rule.When.MinSeverity} {
+			if _, err := severityByName(name); name != "" && err != nil {
+				return fmt.Errorf("policy rule %d: %v", i, err)
+			}
+		}
+
+		for _, date := range []string{rule.When.BreachedAfter, rule.When.BreachedBefore} {
+			if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+				return fmt.Errorf("policy rule %d: breach dates must be YYYY-MM-DD", i)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (pc policyConditions) matches(breach scoredBreach) bool {
+	if len(pc.DataClasses) != 0 {
+		exposed := false
+
+		for _, dataClass := range pc.DataClasses {
+			exposed = exposed || containsFold(breach.DataClasses, dataClass)
+		}
+
+		if !exposed {
+			return false
+		}
+	}
+
+	flags := []struct {
+		condition *bool
+		value     bool
+	}{
+		{pc.IsVerified, breach.IsVerified},
+		{pc.IsFabricated, breach.IsFabricated},
+		{pc.IsSensitive, breach.IsSensitive},
+		{pc.IsRetired, breach.IsRetired},
+		{pc.IsSpamList, breach.IsSpamList},
+	}
+
+	for _, flag := range flags {
+		if flag.condition != nil && *flag.condition != flag.value {
+			return false
+		}
+	}
+
+	if (pc.MinPwnCount != 0 && breach.PwnCount < pc.MinPwnCount) || (pc.MaxPwnCount != 0 && breach.PwnCount > pc.MaxPwnCount) {
+		return false
+	}
+
+	// BreachDate is YYYY-MM-DD, so the dates compare correctly as strings
+	if (pc.BreachedAfter != "" && breach.BreachDate < pc.BreachedAfter) || (pc.BreachedBefore != "" && breach.BreachDate > pc.BreachedBefore) {
+		return false
+	}
+
+	if minSeverity, err := severityByName(pc.MinSeverity); pc.MinSeverity != "" && (err != nil || breach.Severity < minSeverity) {
+		return false
+	}
+
+	return true
+}
+
+// evaluatePolicy scores the breaches and applies the first matching rule to each, the subscriber's
+// rules before the global ones; breaches no rule matches are notified through every channel
+func evaluatePolicy(pwnInfo []PwnInfo, subscriberRules []policyRule) policyDecision {
+	type routedBreach struct {
+		breach   scoredBreach
+		channels []string
+	}
+
+	var routed []routedBreach
+
+	rules := append(append([]policyRule{}, subscriberRules...), globalPolicyRules...)
+
+	for _, breach := range scoreBreaches(pwnInfo) {
+		channels := allChannels
+
+		for _, rule := range rules {
+			if !rule.When.matches(breach) {
+				continue
+			}
+
+			if rule.Action == policyActionIgnore {
+				channels = nil
+
+				break
+			}
+
+			if len(rule.Channels) != 0 {
+				channels = rule.Channels
+			}
+
+			if ruleSeverity, err := severityByName(rule.Severity); rule.Severity != "" && err == nil {
+				breach.Severity = ruleSeverity
+			}
+
+			break
+		}
+
+		if len(channels) != 0 {
+			routed = append(routed, routedBreach{breach: breach, channels: channels})
+		}
+	}
+
+	// Rules can change the severities, so the most severe breach may no longer be first
+	sort.SliceStable(routed, func(i, j int) bool { return routed[i].breach.Severity > routed[j].breach.Severity })
+
+	decision := policyDecision{Channels: make(map[string][]scoredBreach)}
+
+	for _, r := range routed {
+		decision.Breaches = append(decision.Breaches, r.breach)
+
+		routedTo := make(map[string]bool, len(r.channels))
+
+		for _, channel := range r.channels {
+			channel = strings.ToLower(channel)
+
+			if !routedTo[channel] {
+				routedTo[channel] = true
+				decision.Channels[channel] = append(decision.Channels[channel], r.breach)
+			}
+		}
+	}
+
+	return decision
+}
+
+// notifyDecision notifies the subscriber through each channel the decision routes breaches to,
+// with the notification build makes from only the breaches routed to that channel; a channel
+// failing doesn't stop the others, the first error is returned
+func notifyDecision(ctx context.Context, subscriber Subscriber, decision policyDecision, build func(breaches []scoredBreach) notification) error {
+	var firstErr error
+
+	for _, channel := range allChannels {
+		breaches := decision.Channels[channel]
+
+		if len(breaches) == 0 {
+			continue
+		}
+
+		if err := notifySubscriber(ctx, subscriber, map[string]bool{channel: true}, build(breaches)); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// subscriberForEmail returns the subscriber with the email, emails which aren't subscribed
+// (or can't be looked up) are treated as a subscriber without any settings
+func subscriberForEmail(email string) Subscriber {
+	if subscribers == nil {
+		return Subscriber{Email: email}
+	}
+
+	subscriber, err := subscribers.get(email)
+
+	if err != nil {
+		return Subscriber{Email: email}
+	}
+
+	return subscriber
+}
@@ -0,0 +1,192 @@
+package functionality
+
+import (
+	"context"
+	"testing"
+)
+
+func boolPointer(value bool) *bool {
+	return &value
+}
+
+// Need to test the following:
+// Breaches matching an ignore rule aren't notified
+// The first matching rule applies, with the subscriber's rules before the global ones
+// Breaches no rule matches are notified through every channel
+// Rules can narrow down the channels and change the severity
+// Each channel is only routed the breaches whose rules send them through it
+func TestEvaluatePolicy(t *testing.T) {
+	spamList := PwnInfo{Name: "SpamList", DataClasses: []string{"Email addresses"}, IsSpamList: true, IsVerified: true}
+	unverified := PwnInfo{Name: "Unverified", DataClasses: []string{"Email addresses", "Passwords"}}
+	passwords := PwnInfo{Name: "Passwords", DataClasses: []string{"Email addresses", "Passwords"}, IsVerified: true}
+	sensitive := PwnInfo{Name: "Sensitive", DataClasses: []string{"Email addresses"}, IsVerified: true, IsSensitive: true}
+	names := PwnInfo{Name: "Names", DataClasses: []string{"Email addresses", "Names"}, IsVerified: true}
+
+	originalGlobalPolicyRules := globalPolicyRules
+
+	defer func() { globalPolicyRules = originalGlobalPolicyRules }()
+
+	tests := []struct {
+		Name             string
+		GlobalRules      []policyRule
+		SubscriberRules  []policyRule
+		ExpectedBreaches []string
+		ExpectedChannels []string
+		ExpectedRoutes   map[string][]string
+	}{
+		{
+			Name:             "no rules",
+			ExpectedBreaches: []string{"Passwords", "Unverified", "Sensitive", "Names", "SpamList"},
+			ExpectedChannels: allChannels,
+		},
+		{
+			Name: "ignore spam lists and unverified breaches",
+			GlobalRules: []policyRule{
+				{When: policyConditions{IsSpamList: boolPointer(true)}, Action: policyActionIgnore},
+				{When: policyConditions{IsVerified: boolPointer(false)}, Action: policyActionIgnore},
+			},
+			ExpectedBreaches: []string{"Passwords", "Sensitive", "Names"},
+			ExpectedChannels: allChannels,
+		},
+		{
+			Name: "only passwords, but always sensitive breaches by SMS",
+			SubscriberRules: []policyRule{
+				{When: policyConditions{IsSensitive: boolPointer(true)}, Action: policyActionNotify, Channels: []string{channelSMS}, Severity: "critical"},
+				{When: policyConditions{DataClasses: []string{"passwords"}}, Action: policyActionNotify, Channels: []string{channelEmail}},
+				{Action: policyActionIgnore},
+			},
+			ExpectedBreaches: []string{"Sensitive", "Passwords", "Unverified"},
+			ExpectedChannels: []string{channelEmail, channelSMS},
+			ExpectedRoutes:   map[string][]string{channelEmail: {"Passwords", "Unverified"}, channelSMS: {"Sensitive"}},
+		},
+		{
+			Name:             "subscriber rules before global rules",
+			GlobalRules:      []policyRule{{Action: policyActionIgnore}},
+			SubscriberRules:  []policyRule{{When: policyConditions{DataClasses: []string{"Names"}}, Action: policyActionNotify, Channels: []string{channelEmail}}},
+			ExpectedBreaches: []string{"Names"},
+			ExpectedChannels: []string{channelEmail},
+		},
+	}
+
+	for _, test := range tests {
+		globalPolicyRules = test.GlobalRules
+
+		decision := evaluatePolicy([]PwnInfo{spamList, unverified, passwords, sensitive, names}, test.SubscriberRules)
+
+		breachNames := make([]string, 0, len(decision.Breaches))
+
+		for _, breach := range decision.Breaches {
+			breachNames = append(breachNames, breach.Name)
+		}
+
+		channels := make([]string, 0, len(decision.Channels))
+
+		for _, channel := range allChannels {
+			if len(decision.Channels[channel]) != 0 {
+				channels = append(channels, channel)
+			}
+		}
+
+		if !equalStrings(breachNames, test.ExpectedBreaches) || !equalStrings(channels, test.ExpectedChannels) {
+			t.Errorf("evaluatePolicy() with %s = %v through %v; expected: %v through %v", test.Name, breachNames, channels, test.ExpectedBreaches, test.ExpectedChannels)
+		}
+
+		for channel, expectedRoute := range test.ExpectedRoutes {
+			route := make([]string, 0, len(decision.Channels[channel]))
+
+			for _, breach := range decision.Channels[channel] {
+				route = append(route, breach.Name)
+			}
+
+			if !equalStrings(route, expectedRoute) {
+				t.Errorf("evaluatePolicy() with %s routed %v through %s; expected: %v", test.Name, route, channel, expectedRoute)
+			}
+		}
+	}
+}
+
+// Need to test the following:
+// Each channel is only sent the breaches routed to it, with their own worst severity
+func TestNotifyDecision(t *testing.T) {
+	sent, restore := useRecordingNotifiers("", channelEmail, channelSMS)
+
+	defer restore()
+
+	passwords := scoredBreach{PwnInfo: PwnInfo{Name: "Passwords"}, Severity: severityMedium}
+	sensitive := scoredBreach{PwnInfo: PwnInfo{Name: "Sensitive"}, Severity: severityCritical}
+	decision := policyDecision{
+		Breaches: []scoredBreach{sensitive, passwords},
+		Channels: map[string][]scoredBreach{channelEmail: {passwords}, channelSMS: {sensitive}},
+	}
+
+	err := notifyDecision(context.Background(), Subscriber{Email: "pwned@example.com"}, decision, func(breaches []scoredBreach) notification {
+		return notification{Type: notificationBreach, Severity: worstSeverity(breaches), Breaches: breaches}
+	})
+
+	notifications := sent()
+
+	if err != nil || len(notifications) != 2 {
+		t.Fatalf("notifyDecision() sent %d notifications, %v; expected: 2", len(notifications), err)
+	}
+
+	expected := []struct {
+		Channel  string
+		Breach   string
+		Severity severity
+	}{
+		{channelEmail, "Passwords", severityMedium},
+		{channelSMS, "Sensitive", severityCritical},
+	}
+
+	for i, n := range notifications {
+		if n.Channel != expected[i].Channel || len(n.Breaches) != 1 || n.Breaches[0].Name != expected[i].Breach || n.Severity != expected[i].Severity {
+			t.Errorf("notification %d went through %s with %v at %s; expected: %s with %s at %s", i, n.Channel, n.Breaches, n.Severity, expected[i].Channel, expected[i].Breach, expected[i].Severity)
+		}
+	}
+}
+
+// Need to test the following:
+// Conditions on pwn counts, breach dates and severity all have to hold
+func TestPolicyConditionsMatch(t *testing.T) {
+	breach := scoredBreach{PwnInfo: PwnInfo{PwnCount: 5000, BreachDate: "2019-05-01"}, Severity: severityMedium}
+
+	tests := []struct {
+		Conditions      policyConditions
+		ExpectedMatches bool
+	}{
+		{Conditions: policyConditions{}, ExpectedMatches: true},
+		{Conditions: policyConditions{MinPwnCount: 1000, MaxPwnCount: 10000}, ExpectedMatches: true},
+		{Conditions: policyConditions{MinPwnCount: 10000}, ExpectedMatches: false},
+		{Conditions: policyConditions{BreachedAfter: "2019-01-01", BreachedBefore: "2019-12-31"}, ExpectedMatches: true},
+		{Conditions: policyConditions{BreachedAfter: "2020-01-01"}, ExpectedMatches: false},
+		{Conditions: policyConditions{MinSeverity: "medium"}, ExpectedMatches: true},
+		{Conditions: policyConditions{MinSeverity: "high"}, ExpectedMatches: false},
+	}
+
+	for _, test := range tests {
+		if matches := test.Conditions.matches(breach); matches != test.ExpectedMatches {
+			t.Errorf("policyConditions%+v.matches() = %t; expected: %t", test.Conditions, matches, test.ExpectedMatches)
+		}
+	}
+}
+
+// Need to test the following:
+// Rules with an unknown action, channel or severity, or a malformed date, are invalid
+func TestValidatePolicyRules(t *testing.T) {
+	tests := []struct {
+		Rule          policyRule
+		ExpectedValid bool
+	}{
+		{Rule: policyRule{Action: policyActionNotify, Channels: []string{"EMAIL"}, Severity: "high"}, ExpectedValid: true},
+		{Rule: policyRule{Action: "shout"}, ExpectedValid: false},
+		{Rule: policyRule{Action: policyActionNotify, Channels: []string{"carrier pigeon"}}, ExpectedValid: false},
+		{Rule: policyRule{Action: policyActionNotify, Severity: "apocalyptic"}, ExpectedValid: false},
+		{Rule: policyRule{Action: policyActionIgnore, When: policyConditions{BreachedAfter: "01/01/2019"}}, ExpectedValid: false},
+	}
+
+	for _, test := range tests {
+		if err := validatePolicyRules([]policyRule{test.Rule}); (err == nil) != test.ExpectedValid {
+			t.Errorf("validatePolicyRules(%+v) = %v; expected valid: %t", test.Rule, err, test.ExpectedValid)
+		}
+	}
+}
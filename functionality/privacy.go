@@ -0,0 +1,470 @@
+package functionality
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrInvalidPrivacyAction   = errors.New(`the action must be either "export" or "erase"`)
+	ErrInvalidPrivacyToken    = errors.New("the token is invalid or has expired")
+	ErrAdminNotConfigured     = errors.New("the admin token is not configured")
+	ErrAdminTokenNotProvided  = errors.New("a valid admin token must be provided as a bearer token")
+	ErrTooManyPrivacyRequests = errors.New("too many data requests have been made, try again later")
+)
+
+// personalDataSource is somewhere the service keeps data tied to an email address,
+// every one of them is included when exporting or erasing the data for an address
+type personalDataSource struct {
+	export func(email string) (interface{}, error)
+	erase  func(email string) (bool, error)
+}
+
+type privacyTokenInfo struct {
+	email   string
+	action  string
+	expires time.Time
+}
+
+type adminInfo struct {
+	Token string `json:"token"`
+}
+
+var (
+	personalDataSourcesMutex sync.Mutex
+	personalDataSources      = map[string]personalDataSource{
+		"subscriber": {
+			export: func(email string) (interface{}, error) {
+				if subscribers == nil {
+					return nil, ErrSubscriberStoreUnavailable
+				}
+
+				subscriber, err := subscribers.get(email)
+
+				if err == ErrSubscriberNotFound {
+					return nil, nil
+				}
+
+				return subscriber, err
+			},
+			erase: func(email string) (bool, error) {
+				if subscribers == nil {
+					return false, ErrSubscriberStoreUnavailable
+				}
+
+				err := subscribers.remove(email)
+
+				if err == ErrSubscriberNotFound {
+					return false, nil
+				}
+
+				return err == nil, err
+			},
+		},
+		"pwnage_cache": {
+			export: func(email string) (interface{}, error) {
+				if entry, exists := cache.get(email); exists {
+					return gin.H{"breaches": entry.pwnInfo, "expires": entry.expires}, nil
+				}
+
+				return nil, nil
+			},
+			erase: func(email string) (bool, error) {
+				_, exists := cache.get(email)
+
+				cache.delete(email)
+
+				return exists, nil
+			},
+		},
+		// The logs only ever have keyed hashes of emails and phone numbers in them, so what they
+		// hold for an email is the hashes its log lines can be found by; they can't be erased
+		// from the log output, so they are left to expire with the logs' retention
+		"logs": {
+			export: func(email string) (interface{}, error) {
+				hashes := gin.H{"email_hash": hashPII("email", email)}
+
+				if subscribers != nil {
+					if subscriber, err := subscribers.get(email); err == nil && subscriber.Phone != "" {
+						hashes["phone_hash"] = hashPII("phone", subscriber.Phone)
+					}
+				}
+
+				return hashes, nil
+			},
+			erase: func(string) (bool, error) {
+				return false, nil
+			},
+		},
+	}
+
+	// Tokens sent to people to confirm their requests, keyed by the SHA-256 of the token
+	privacyTokensMutex sync.Mutex
+	privacyTokens      = make(map[string]privacyTokenInfo)
+	privacyTokenTTL    = time.Hour
+
+	// Confirmation emails are limited per address and per client, so RequestPersonalData can't be used to flood inboxes
+	privacyEmailLimiter  = newWindowLimiter(3, time.Hour)
+	privacyClientLimiter = newWindowLimiter(10, time.Hour)
+
+	adminToken string
+)
+
+func init() {
+	loadSecretFile("adminFile", InitializeAdminWithJSON)
+}
+
+// InitializeAdminWithJSON is used for initializing the token required by the admin endpoints
+func InitializeAdminWithJSON(reader io.Reader) error {
+	var adminJSON adminInfo
+
+	err := json.NewDecoder(reader).Decode(&adminJSON)
+
+	if err != nil {
+		return err
+	}
+
+	adminToken = adminJSON.Token
+
+	return nil
+}
+
+// registerPersonalDataSource adds somewhere data tied to an email is kept
+// to the ones exported and erased, replacing any source with the same name
+func registerPersonalDataSource(name string, source personalDataSource) {
+	personalDataSourcesMutex.Lock()
+
+	defer personalDataSourcesMutex.Unlock()
+
+	personalDataSources[name] = source
+}
+
+func copyPersonalDataSources() map[string]personalDataSource {
+	personalDataSourcesMutex.Lock()
+
+	defer personalDataSourcesMutex.Unlock()
+
+	sources := make(map[string]personalDataSource, len(personalDataSources))
+
+	for name, source := range personalDataSources {
+		sources[name] = source
+	}
+
+	return sources
+}
+
+// exportPersonalData collects everything held for the email from every source,
+// sources without anything for the email are left out
+func exportPersonalData(email string) (map[string]interface{}, error) {
+	export := make(map[string]interface{})
+
+	for name, source := range copyPersonalDataSources() {
+		data, err := source.export(email)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+
+		if data != nil {
+			export[name] = data
+		}
+	}
+
+	return export, nil
+}
+
+// erasePersonalData erases the email from every source, carrying on past sources
+// which fail so that as much as possible is erased, and returns which sources held
+// data for the email; only the hash of the email is kept, in the log of the erasure
+func erasePersonalData(email string) ([]string, error) {
+	var (
+		erased []string
+		failed []string
+	)
+
+	for name, source := range copyPersonalDataSources() {
+		held, err := source.erase(email)
+
+		if err != nil {
+			logger.Error("could not erase personal data", "source", name, "email", email, "error", err)
+
+			failed = append(failed, name)
+
+			continue
+		}
+
+		if held {
+			erased = append(erased, name)
+		}
+	}
+
+	logger.Info("erased personal data", "email", email, "sources", erased, "failed_sources", failed)
+
+	if len(failed) != 0 {
+		return erased, fmt.Errorf("could not erase the data held in: %s", strings.Join(failed, ", "))
+	}
+
+	return erased, nil
+}
+
+func hashPrivacyToken(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(tokenHash[:])
+}
+
+func newPrivacyToken(email, action string) string {
+	token := newID() + newID()
+
+	privacyTokensMutex.Lock()
+
+	defer privacyTokensMutex.Unlock()
+
+	for tokenHash, tokenInfo := range privacyTokens {
+		if time.Now().After(tokenInfo.expires) {
+			delete(privacyTokens, tokenHash)
+		}
+	}
+
+	privacyTokens[hashPrivacyToken(token)] = privacyTokenInfo{
+		email:   email,
+		action:  action,
+		expires: time.Now().Add(privacyTokenTTL),
+	}
+
+	return token
+}
+
+// redeemPrivacyToken returns what the token was issued for, a token can only be redeemed once
+func redeemPrivacyToken(token string) (privacyTokenInfo, error) {
+	privacyTokensMutex.Lock()
+
+	defer privacyTokensMutex.Unlock()
+
+	tokenInfo, exists := privacyTokens[hashPrivacyToken(token)]
+
+	delete(privacyTokens, hashPrivacyToken(token))
+
+	if !exists || time.Now().After(tokenInfo.expires) {
+		return tokenInfo, ErrInvalidPrivacyToken
+	}
+
+	return tokenInfo, nil
+}
+
+// publicURL is the URL the service is reached at for the links in confirmation emails, it is
+// never taken from the request since anyone can send a request with the Host of their choosing
+func publicURL() (string, error) {
+	url, exists := os.LookupEnv("publicURL")
+
+	if !exists || url == "" {
+		return "", ErrPublicURLNotSet
+	}
+
+	return strings.TrimSuffix(url, "/"), nil
+}
+
+// RequestPersonalData emails the address a token confirming that its owner wants the data held
+// for it exported or erased; it responds the same whether or not anything is held for the address
+func RequestPersonalData(c *gin.Context) {
+	privacyRequest := struct {
+		Email  string `json:"email"`
+		Action string `json:"action"`
+	}{}
+
+	if err := json.NewDecoder(c.Request.Body).Decode(&privacyRequest); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	}
+
+	if privacyRequest.Action != "export" && privacyRequest.Action != "erase" {
+		respondWithError(c, http.StatusBadRequest, ErrInvalidPrivacyAction)
+
+		return
+	}
+
+	address, err := mail.ParseAddress(privacyRequest.Email)
+
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	}
+
+	baseURL, err := publicURL()
+
+	if err != nil {
+		respondWithError(c, http.StatusServiceUnavailable, err)
+
+		return
+	}
+
+	if !privacyClientLimiter.Allow(c.ClientIP()) || !privacyEmailLimiter.Allow(strings.ToLower(address.Address)) {
+		respondWithError(c, http.StatusTooManyRequests, ErrTooManyPrivacyRequests)
+
+		return
+	}
+
+	token := newPrivacyToken(address.Address, privacyRequest.Action)
+
+	body := fmt.Sprintf(
+		"Someone asked to %s the data we hold for this address. If it was you, confirm it within the next hour by sending {\"token\": \"%s\"} to %s/api/privacy/confirm, otherwise you can ignore this email.",
+		privacyRequest.Action,
+		token,
+		baseURL,
+	)
+
+	if err := notifyEmailOfPwnage(c.Request.Context(), address.Address, "Confirm your data request", body, "privacy_request"); err != nil {
+		respondWithError(c, http.StatusBadGateway, errors.New("the confirmation email could not be sent"))
+
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"error": false})
+}
+
+// ConfirmPersonalDataRequest carries out the export, erasure or unsubscription the token was emailed for
+func ConfirmPersonalDataRequest(c *gin.Context) {
+	confirmRequest := struct {
+		Token string `json:"token"`
+	}{}
+
+	if err := json.NewDecoder(c.Request.Body).Decode(&confirmRequest); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	}
+
+	tokenInfo, err := redeemPrivacyToken(confirmRequest.Token)
+
+	if err != nil {
+		respondWithError(c, http.StatusForbidden, err)
+
+		return
+	}
+
+	if tokenInfo.action == "export" {
+		respondWithPersonalDataExport(c, tokenInfo.email)
+
+		return
+	}
+
+	if tokenInfo.action == "unsubscribe" {
+		respondWithUnsubscription(c, tokenInfo.email)
+
+		return
+	}
+
+	respondWithPersonalDataErasure(c, tokenInfo.email)
+}
+
+func respondWithPersonalDataExport(c *gin.Context, email string) {
+	export, err := exportPersonalData(email)
+
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"error": false, "email": email, "data": export})
+}
+
+func respondWithPersonalDataErasure(c *gin.Context, email string) {
+	erased, err := erasePersonalData(email)
+
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"error": false, "erased": erased})
+}
+
+func respondWithUnsubscription(c *gin.Context, email string) {
+	if subscribers == nil {
+		respondWithError(c, http.StatusServiceUnavailable, ErrSubscriberStoreUnavailable)
+
+		return
+	}
+
+	if err := subscribers.remove(email); err != nil {
+		respondWithError(c, subscriberErrorStatusCode(err), err)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"error": false})
+}
+
+// isAdminRequest is whether the request has the admin token as its bearer token
+func isAdminRequest(c *gin.Context) bool {
+	authorization := c.GetHeader("Authorization")
+	providedToken := strings.TrimPrefix(authorization, "Bearer ")
+
+	return adminToken != "" && strings.HasPrefix(authorization, "Bearer ") && subtle.ConstantTimeCompare([]byte(providedToken), []byte(adminToken)) == 1
+}
+
+// RequireAdmin only lets requests with the admin token as their bearer token through
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if adminToken == "" {
+			respondWithError(c, http.StatusServiceUnavailable, ErrAdminNotConfigured)
+			c.Abort()
+
+			return
+		}
+
+		if !isAdminRequest(c) {
+			respondWithError(c, http.StatusUnauthorized, ErrAdminTokenNotProvided)
+			c.Abort()
+
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func decodeEmailRequest(c *gin.Context) (string, bool) {
+	emailRequest := struct {
+		Email string `json:"email"`
+	}{}
+
+	if err := json.NewDecoder(c.Request.Body).Decode(&emailRequest); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return "", false
+	}
+
+	return emailRequest.Email, true
+}
+
+// ExportPersonalData responds with everything held for an email, for admins
+func ExportPersonalData(c *gin.Context) {
+	if email, ok := decodeEmailRequest(c); ok {
+		respondWithPersonalDataExport(c, email)
+	}
+}
+
+// ErasePersonalData erases everything held for an email, for admins
+func ErasePersonalData(c *gin.Context) {
+	if email, ok := decodeEmailRequest(c); ok {
+		respondWithPersonalDataErasure(c, email)
+	}
+}
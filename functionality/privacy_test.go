@@ -0,0 +1,171 @@
+package functionality
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// usePublicURL sets the publicURL environment variable until the returned function restores it
+func usePublicURL(url string) func() {
+	originalURL, urlSet := os.LookupEnv("publicURL")
+
+	if url == "" {
+		os.Unsetenv("publicURL")
+	} else {
+		os.Setenv("publicURL", url)
+	}
+
+	return func() {
+		if urlSet {
+			os.Setenv("publicURL", originalURL)
+		} else {
+			os.Unsetenv("publicURL")
+		}
+	}
+}
+
+// Need to test the following:
+// Without the admin token, or with it but not as a bearer token, a HTTP/401 status is returned
+// Exporting returns what the cache holds for the email
+// Erasing removes the email from the cache and reports the cache as having held data
+func TestAdminPersonalData(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	adminToken = "admin"
+	cache.set("someone@example.com", []PwnInfo{{Name: "Adobe"}}, nil)
+
+	// The subscriber store isn't opened in this test
+	originalSources := personalDataSources
+	personalDataSources = map[string]personalDataSource{"pwnage_cache": originalSources["pwnage_cache"]}
+
+	defer func() { personalDataSources = originalSources }()
+
+	router := gin.New()
+	adminGroup := router.Group("/admin", RequireAdmin())
+	adminGroup.POST("/export", ExportPersonalData)
+	adminGroup.POST("/erase", ErasePersonalData)
+
+	tests := []struct {
+		Path, Authorization string
+		ExpectedStatusCode  int
+		ExpectedCached      bool
+		ExpectedBody        string
+	}{
+		{Path: "/admin/export", Authorization: "Bearer wrong", ExpectedStatusCode: 401, ExpectedCached: true},
+		{Path: "/admin/export", Authorization: "admin", ExpectedStatusCode: 401, ExpectedCached: true},
+		{Path: "/admin/export", Authorization: "Bearer admin", ExpectedStatusCode: 200, ExpectedCached: true, ExpectedBody: "Adobe"},
+		{Path: "/admin/erase", Authorization: "Bearer admin", ExpectedStatusCode: 200, ExpectedCached: false, ExpectedBody: `"erased":["pwnage_cache"]`},
+	}
+
+	for _, test := range tests {
+		requestBody, _ := json.Marshal(gin.H{"email": "someone@example.com"})
+
+		mockRequest := httptest.NewRequest(http.MethodPost, test.Path, bytes.NewReader(requestBody))
+		mockRequest.Header.Set("Authorization", test.Authorization)
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		router.ServeHTTP(mockResponseWriter, mockRequest)
+
+		_, cached := cache.get("someone@example.com")
+
+		if mockResponseWriter.Code != test.ExpectedStatusCode || cached != test.ExpectedCached || !bytes.Contains(mockResponseWriter.Body.Bytes(), []byte(test.ExpectedBody)) {
+			t.Errorf(
+				"POST %s = HTTP/%d, %s, cached = %t; expected: HTTP/%d, a body containing %s, cached = %t",
+				test.Path,
+				mockResponseWriter.Code,
+				mockResponseWriter.Body.String(),
+				cached,
+				test.ExpectedStatusCode,
+				test.ExpectedBody,
+				test.ExpectedCached,
+			)
+		}
+	}
+}
+
+// Need to test the following:
+// A token redeems for the email and action it was issued for
+// A token can't be redeemed a second time
+func TestRedeemPrivacyToken(t *testing.T) {
+	token := newPrivacyToken("someone@example.com", "erase")
+
+	if tokenInfo, err := redeemPrivacyToken(token); err != nil || tokenInfo.email != "someone@example.com" || tokenInfo.action != "erase" {
+		t.Errorf("redeemPrivacyToken(token) = %+v, %v; expected the email and action it was issued for", tokenInfo, err)
+	}
+
+	if _, err := redeemPrivacyToken(token); err != ErrInvalidPrivacyToken {
+		t.Errorf("redeemPrivacyToken(redeemed token) = %v; expected: %v", err, ErrInvalidPrivacyToken)
+	}
+}
+
+// Need to test the following:
+// Invalid emails are rejected without anything being sent
+// Confirmation emails are limited per address, whatever case it is in
+// Confirmation emails are limited per client, whatever address they are sent to
+// Without publicURL nothing is sent, rather than linking to the Host the request was sent with
+func TestRequestPersonalData(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	recorder, restore := useRecordingEmailSender()
+
+	defer restore()
+
+	restorePublicURL := usePublicURL("")
+
+	defer restorePublicURL()
+
+	originalEmailLimiter, originalClientLimiter := privacyEmailLimiter, privacyClientLimiter
+	privacyEmailLimiter, privacyClientLimiter = newWindowLimiter(2, time.Hour), newWindowLimiter(3, time.Hour)
+
+	defer func() { privacyEmailLimiter, privacyClientLimiter = originalEmailLimiter, originalClientLimiter }()
+
+	router := gin.New()
+	router.POST("/privacy/request", RequestPersonalData)
+
+	requestBody, _ := json.Marshal(gin.H{"email": "someone@example.com", "action": "export"})
+
+	mockRequest := httptest.NewRequest(http.MethodPost, "/privacy/request", bytes.NewReader(requestBody))
+	mockRequest.Host = "attacker.example"
+	mockResponseWriter := httptest.NewRecorder()
+
+	router.ServeHTTP(mockResponseWriter, mockRequest)
+
+	if messages := recorder.messages(); mockResponseWriter.Code != http.StatusServiceUnavailable || len(messages) != 0 {
+		t.Errorf("POST /privacy/request without publicURL = HTTP/%d, %d emails sent; expected: HTTP/%d, none sent", mockResponseWriter.Code, len(messages), http.StatusServiceUnavailable)
+	}
+
+	os.Setenv("publicURL", "https://pwned.example.com/")
+
+	tests := []struct {
+		Email              string
+		ExpectedStatusCode int
+		ExpectedMessages   int
+	}{
+		{Email: "not an email", ExpectedStatusCode: http.StatusBadRequest},
+		{Email: "someone@example.com", ExpectedStatusCode: http.StatusAccepted, ExpectedMessages: 1},
+		{Email: "SOMEONE@example.com", ExpectedStatusCode: http.StatusAccepted, ExpectedMessages: 2},
+		{Email: "someone@example.com", ExpectedStatusCode: http.StatusTooManyRequests, ExpectedMessages: 2},
+		{Email: "anyone@example.com", ExpectedStatusCode: http.StatusTooManyRequests, ExpectedMessages: 2},
+	}
+
+	for _, test := range tests {
+		requestBody, _ := json.Marshal(gin.H{"email": test.Email, "action": "export"})
+
+		mockRequest := httptest.NewRequest(http.MethodPost, "/privacy/request", bytes.NewReader(requestBody))
+		mockResponseWriter := httptest.NewRecorder()
+
+		router.ServeHTTP(mockResponseWriter, mockRequest)
+
+		if messages := recorder.messages(); mockResponseWriter.Code != test.ExpectedStatusCode || len(messages) != test.ExpectedMessages {
+			t.Errorf("POST /privacy/request for %s = HTTP/%d, %d emails sent; expected: HTTP/%d, %d emails sent", test.Email, mockResponseWriter.Code, len(messages), test.ExpectedStatusCode, test.ExpectedMessages)
+		}
+	}
+}
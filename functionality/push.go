@@ -0,0 +1,327 @@
+package functionality
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	channelNtfy     = "ntfy"
+	channelGotify   = "gotify"
+	channelPushover = "pushover"
+)
+
+// The limits of the push services, ntfy's 4096 bytes are kept to by counting 4 per rune
+const (
+	ntfyMessageLimit      = 1024
+	gotifyMessageLimit    = 4096
+	pushoverMessageLimit  = 1024
+	pushoverTitleLimit    = 250
+	pushoverURLLimit      = 512
+	pushoverEmergencyPoll = 300
+	pushoverEmergencyTime = 3600
+)
+
+// pushDestinations are where the subscriber's own phone is sent push notifications,
+// an ntfy topic without a server is on the team's ntfy server
+type pushDestinations struct {
+	NtfyServerURL   string `json:"ntfy_server_url,omitempty"`
+	NtfyTopic       string `json:"ntfy_topic,omitempty"`
+	GotifyServerURL string `json:"gotify_server_url,omitempty"`
+	GotifyAppToken  string `json:"gotify_app_token,omitempty"`
+	PushoverUserKey string `json:"pushover_user_key,omitempty"`
+}
+
+// pushInfo is the push secret file, the team's ntfy server (and token for it), Gotify server and
+// Pushover application, with the team's own topic, token and user key; like the team chat channels,
+// the team's own are only sent breach findings, once TeamBreachAlerts opts the team in to them
+type pushInfo struct {
+	TeamBreachAlerts bool `json:"team_breach_alerts"`
+
+	NtfyServerURL    string `json:"ntfy_server_url"`
+	NtfyToken        string `json:"ntfy_token"`
+	NtfyTopic        string `json:"ntfy_topic"`
+	GotifyServerURL  string `json:"gotify_server_url"`
+	GotifyAppToken   string `json:"gotify_app_token"`
+	PushoverAppToken string `json:"pushover_app_token"`
+	PushoverUserKey  string `json:"pushover_user_key"`
+}
+
+var (
+	push = pushInfo{NtfyServerURL: "https://ntfy.sh"}
+
+	// pushoverAPIBaseURL can be changed to point at a local stand-in, like the HIBP base URLs
+	pushoverAPIBaseURL = "https://api.pushover.net/1"
+
+	// breachDetailsURL is where push notifications click through to, {name} is the breach's name
+	breachDetailsURL = "https://haveibeenpwned.com/PwnedWebsites#{name}"
+
+	ntfyTopicPattern       = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)
+	pushoverUserKeyPattern = regexp.MustCompile(`^[A-Za-z0-9]{30}$`)
+
+	ntfyPriorities     = map[severity]int{severityLow: 2, severityMedium: 3, severityHigh: 4, severityCritical: 5}
+	gotifyPriorities   = map[severity]int{severityLow: 2, severityMedium: 5, severityHigh: 7, severityCritical: 10}
+	pushoverPriorities = map[severity]int{severityLow: -1, severityMedium: 0, severityHigh: 1, severityCritical: 2}
+	ntfyTags           = map[severity]string{severityLow: "lock", severityMedium: "lock", severityHigh: "warning", severityCritical: "rotating_light"}
+)
+
+func init() {
+	loadSecretFile("pushFile", InitializePushWithJSON)
+
+	if baseURL, exists := os.LookupEnv("pushoverAPIBaseURL"); exists {
+		pushoverAPIBaseURL = strings.TrimSuffix(baseURL, "/")
+	}
+
+	if detailsURL, exists := os.LookupEnv("breachDetailsURL"); exists {
+		breachDetailsURL = detailsURL
+	}
+
+	registerNotifier(channelNtfy, ntfyNotifier{})
+	registerNotifier(channelGotify, gotifyNotifier{})
+	registerNotifier(channelPushover, pushoverNotifier{})
+}
+
+// InitializePushWithJSON is used for initializing the team push services for the package
+func InitializePushWithJSON(reader io.Reader) error {
+	return json.NewDecoder(reader).Decode(&push)
+}
+
+func (pd pushDestinations) validate() error {
+	for _, serverURL := range []string{pd.NtfyServerURL, pd.GotifyServerURL} {
+		if serverURL == "" {
+			continue
+		}
+
+		if err := validateWebhookURL(serverURL); err != nil {
+			return err
+		}
+	}
+
+	if pd.NtfyServerURL != "" && pd.NtfyTopic == "" {
+		return errors.New("an ntfy server needs a topic")
+	}
+
+	if pd.NtfyTopic != "" && !ntfyTopicPattern.MatchString(pd.NtfyTopic) {
+		return fmt.Errorf("ntfy topics must be up to 64 letters, numbers, - and _, not %q", pd.NtfyTopic)
+	}
+
+	if (pd.GotifyServerURL == "") != (pd.GotifyAppToken == "") {
+		return errors.New("gotify needs both a server URL and an application token")
+	}
+
+	if pd.PushoverUserKey != "" && !pushoverUserKeyPattern.MatchString(pd.PushoverUserKey) {
+		return errors.New("pushover user keys are 30 letters and numbers")
+	}
+
+	return nil
+}
+
+// clickURL is the details page of the worst breach the notification is about, or the paste
+// when it is on Pastebin, empty when there is nowhere to go
+func clickURL(n notification) string {
+	if len(n.Breaches) > 0 {
+		worst := n.Breaches[0]
+
+		for _, breach := range n.Breaches[1:] {
+			if breach.Severity > worst.Severity {
+				worst = breach
+			}
+		}
+
+		return strings.Replace(breachDetailsURL, "{name}", url.PathEscape(worst.Name), -1)
+	}
+
+	for _, paste := range n.Pastes {
+		if paste.Source == "Pastebin" {
+			return "https://pastebin.com/" + url.PathEscape(paste.ID)
+		}
+	}
+
+	return ""
+}
+
+type ntfyNotifier struct{}
+
+func ntfyTopicURL(serverURL, topic string) (string, bool) {
+	if serverURL == "" || topic == "" {
+		return "", false
+	}
+
+	return strings.TrimSuffix(serverURL, "/") + "/" + topic, true
+}
+
+// recipient is the URL of the subscriber's ntfy topic, on the team's server unless they have their own
+func (ntfyNotifier) recipient(subscriber Subscriber) (string, bool) {
+	serverURL := push.NtfyServerURL
+
+	if subscriber.Push.NtfyServerURL != "" {
+		serverURL = subscriber.Push.NtfyServerURL
+	}
+
+	return ntfyTopicURL(serverURL, subscriber.Push.NtfyTopic)
+}
+
+// teamRecipient is the URL of the team's ntfy topic
+func (ntfyNotifier) teamRecipient() (string, bool) {
+	if !push.TeamBreachAlerts {
+		return "", false
+	}
+
+	return ntfyTopicURL(push.NtfyServerURL, push.NtfyTopic)
+}
+
+func (ntfyNotifier) deferrable() bool {
+	return true
+}
+
+func (ntfyNotifier) send(ctx context.Context, n notification) error {
+	ctx, span := tracer.Start(ctx, "notify.ntfy")
+
+	separator := strings.LastIndex(n.To, "/")
+	serverURL, topic := n.To[:separator], n.To[separator+1:]
+
+	message := map[string]interface{}{
+		"topic":    topic,
+		"title":    n.Title,
+		"message":  chatText(n, ntfyMessageLimit),
+		"priority": ntfyPriorities[n.Severity],
+		"tags":     []string{ntfyTags[n.Severity]},
+	}
+
+	if click := clickURL(n); click != "" {
+		message["click"] = click
+	}
+
+	// The team's token is only sent to the team's server, not to the servers subscribers bring
+	token := ""
+
+	if serverURL == strings.TrimSuffix(push.NtfyServerURL, "/") {
+		token = push.NtfyToken
+	}
+
+	_, err := postChatJSON(ctx, serverURL, token, message)
+
+	recordNotification(channelNtfy, err)
+	logNotification(ctx, channelNtfy, n.Email, n.Title, err)
+	endSpan(span, err)
+
+	return err
+}
+
+type gotifyNotifier struct{}
+
+func gotifyMessageURL(serverURL, appToken string) (string, bool) {
+	if serverURL == "" || appToken == "" {
+		return "", false
+	}
+
+	return strings.TrimSuffix(serverURL, "/") + "/message?token=" + url.QueryEscape(appToken), true
+}
+
+// recipient is the message URL, with the application token, of the subscriber's Gotify server
+func (gotifyNotifier) recipient(subscriber Subscriber) (string, bool) {
+	return gotifyMessageURL(subscriber.Push.GotifyServerURL, subscriber.Push.GotifyAppToken)
+}
+
+// teamRecipient is the message URL, with the application token, of the team's Gotify server
+func (gotifyNotifier) teamRecipient() (string, bool) {
+	if !push.TeamBreachAlerts {
+		return "", false
+	}
+
+	return gotifyMessageURL(push.GotifyServerURL, push.GotifyAppToken)
+}
+
+func (gotifyNotifier) deferrable() bool {
+	return true
+}
+
+func (gotifyNotifier) send(ctx context.Context, n notification) error {
+	ctx, span := tracer.Start(ctx, "notify.gotify")
+
+	extras := map[string]interface{}{
+		"client::display": map[string]interface{}{"contentType": "text/plain"},
+	}
+
+	if click := clickURL(n); click != "" {
+		extras["client::notification"] = map[string]interface{}{"click": map[string]interface{}{"url": click}}
+	}
+
+	_, err := postChatJSON(ctx, n.To, "", map[string]interface{}{
+		"title":    n.Title,
+		"message":  chatText(n, gotifyMessageLimit),
+		"priority": gotifyPriorities[n.Severity],
+		"extras":   extras,
+	})
+
+	recordNotification(channelGotify, err)
+	logNotification(ctx, channelGotify, n.Email, n.Title, err)
+	endSpan(span, err)
+
+	return err
+}
+
+type pushoverNotifier struct{}
+
+// recipient is the subscriber's Pushover user key, when there is an application to send from
+func (pushoverNotifier) recipient(subscriber Subscriber) (string, bool) {
+	return subscriber.Push.PushoverUserKey, push.PushoverAppToken != "" && subscriber.Push.PushoverUserKey != ""
+}
+
+// teamRecipient is the team's Pushover user key, when there is an application to send from
+func (pushoverNotifier) teamRecipient() (string, bool) {
+	return push.PushoverUserKey, push.TeamBreachAlerts && push.PushoverAppToken != "" && push.PushoverUserKey != ""
+}
+
+func (pushoverNotifier) deferrable() bool {
+	return true
+}
+
+func (pushoverNotifier) send(ctx context.Context, n notification) error {
+	ctx, span := tracer.Start(ctx, "notify.pushover")
+
+	message := map[string]interface{}{
+		"token":    push.PushoverAppToken,
+		"user":     n.To,
+		"title":    truncate(n.Title, pushoverTitleLimit),
+		"message":  chatText(n, pushoverMessageLimit),
+		"priority": pushoverPriorities[n.Severity],
+	}
+
+	// Emergency priority keeps alerting until it is acknowledged, which Pushover requires limits for
+	if message["priority"] == 2 {
+		message["retry"] = pushoverEmergencyPoll
+		message["expire"] = pushoverEmergencyTime
+	}
+
+	if click := clickURL(n); click != "" && len(click) <= pushoverURLLimit {
+		message["url"] = click
+		message["url_title"] = "Breach details"
+	}
+
+	responseBytes, err := postChatJSON(ctx, pushoverAPIBaseURL+"/messages.json", "", message)
+
+	if responseBytes != nil {
+		pushoverResponse := struct {
+			Status int      `json:"status"`
+			Errors []string `json:"errors"`
+		}{}
+
+		if json.Unmarshal(responseBytes, &pushoverResponse) == nil && pushoverResponse.Status != 1 {
+			err = errors.New("pushover could not send the message: " + strings.Join(pushoverResponse.Errors, ", "))
+		}
+	}
+
+	recordNotification(channelPushover, err)
+	logNotification(ctx, channelPushover, n.Email, n.Title, err)
+	endSpan(span, err)
+
+	return err
+}
@@ -0,0 +1,187 @@
+package functionality
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type pushRequest struct {
+	Path          string
+	Query         string
+	Authorization string
+	Body          map[string]interface{}
+}
+
+// newPushServer is a stand-in for the push services, recording the requests it is sent
+func newPushServer(t *testing.T, response string) (*httptest.Server, *[]pushRequest) {
+	var requests []pushRequest
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		request := pushRequest{Path: r.URL.Path, Query: r.URL.RawQuery, Authorization: r.Header.Get("Authorization")}
+
+		if err := json.Unmarshal(body, &request.Body); err != nil {
+			t.Errorf("push request body = %s; expected: JSON", body)
+		}
+
+		requests = append(requests, request)
+
+		w.Write([]byte(response))
+	}))
+
+	return server, &requests
+}
+
+// Need to test the following:
+// Messages are published to the topic with the priority from the severity and a click-through URL
+// The team's token is only sent to the team's server
+func TestNtfyNotifier(t *testing.T) {
+	server, requests := newPushServer(t, `{"id": "message"}`)
+
+	defer server.Close()
+
+	originalPush, originalDetailsURL := push, breachDetailsURL
+	push, breachDetailsURL = pushInfo{TeamBreachAlerts: true, NtfyServerURL: server.URL + "/", NtfyToken: "tk_team", NtfyTopic: "team"}, "https://pwned.example.com/breaches/{name}"
+
+	defer func() { push, breachDetailsURL = originalPush, originalDetailsURL }()
+
+	tests := []struct {
+		Team                  bool
+		Destinations          pushDestinations
+		ExpectedTopic         string
+		ExpectedAuthorization string
+	}{
+		{Team: true, ExpectedTopic: "team", ExpectedAuthorization: "Bearer tk_team"},
+		{Destinations: pushDestinations{NtfyTopic: "own-topic"}, ExpectedTopic: "own-topic", ExpectedAuthorization: "Bearer tk_team"},
+		{Destinations: pushDestinations{NtfyServerURL: server.URL + "/self-hosted", NtfyTopic: "own-topic"}, ExpectedTopic: "own-topic"},
+	}
+
+	for _, test := range tests {
+		*requests = nil
+
+		to, reachable := ntfyNotifier{}.recipient(Subscriber{Push: test.Destinations})
+
+		if test.Team {
+			to, reachable = ntfyNotifier{}.teamRecipient()
+		}
+
+		if err := (ntfyNotifier{}).send(context.Background(), chatTestNotification(to)); !reachable || err != nil || len(*requests) != 1 {
+			t.Fatalf("ntfyNotifier.send() for %+v = %t, %v; expected: true, <nil>", test.Destinations, reachable, err)
+		}
+
+		request := (*requests)[0]
+
+		if request.Body["topic"] != test.ExpectedTopic || request.Authorization != test.ExpectedAuthorization {
+			t.Errorf("ntfy request for %+v = %s, %q; expected: %s, %q", test.Destinations, request.Body["topic"], request.Authorization, test.ExpectedTopic, test.ExpectedAuthorization)
+		}
+
+		if request.Body["priority"] != float64(4) || request.Body["click"] != "https://pwned.example.com/breaches/Adobe" || !strings.Contains(request.Body["message"].(string), "Email addresses, Passwords") {
+			t.Errorf("ntfy message = %v; expected: priority 4 with the breach and a click-through to it", request.Body)
+		}
+	}
+}
+
+// Need to test the following:
+// Messages are sent with the subscriber's application token and the priority from the severity
+// The application token isn't in the errors
+func TestGotifyNotifier(t *testing.T) {
+	server, requests := newPushServer(t, `{"id": 1}`)
+
+	originalPush := push
+	push = pushInfo{}
+
+	defer func() { push = originalPush }()
+
+	to, reachable := gotifyNotifier{}.recipient(Subscriber{Push: pushDestinations{GotifyServerURL: server.URL, GotifyAppToken: "AppToken"}})
+
+	if err := (gotifyNotifier{}).send(context.Background(), chatTestNotification(to)); !reachable || err != nil || len(*requests) != 1 {
+		t.Fatalf("gotifyNotifier.send() = %t, %v; expected: true, <nil>", reachable, err)
+	}
+
+	request := (*requests)[0]
+	extras, _ := json.Marshal(request.Body["extras"])
+
+	if request.Path != "/message" || request.Query != "token=AppToken" || request.Body["priority"] != float64(7) || !strings.Contains(string(extras), "PwnedWebsites#Adobe") {
+		t.Errorf("gotify request = %+v; expected: priority 7 with the token and a click-through to the breach", request)
+	}
+
+	server.Close()
+
+	if err := (gotifyNotifier{}).send(context.Background(), chatTestNotification(to)); err == nil || strings.Contains(err.Error(), "AppToken") {
+		t.Errorf("gotifyNotifier.send() to an unreachable server = %v; expected: an error without the token", err)
+	}
+}
+
+// Need to test the following:
+// Critical breaches are sent at emergency priority, with the retry and expiry Pushover requires
+// Pushover errors are an error
+// Subscribers can't be reached without an application to send from
+func TestPushoverNotifier(t *testing.T) {
+	server, requests := newPushServer(t, `{"status": 1}`)
+
+	defer server.Close()
+
+	originalPush, originalBaseURL := push, pushoverAPIBaseURL
+	push, pushoverAPIBaseURL = pushInfo{PushoverAppToken: "app-token"}, server.URL
+
+	defer func() { push, pushoverAPIBaseURL = originalPush, originalBaseURL }()
+
+	n := chatTestNotification("uQiRzpo4DXghDmr9QzzfQu27cmVRsG")
+	n.Severity = severityCritical
+
+	if err := (pushoverNotifier{}).send(context.Background(), n); err != nil || len(*requests) != 1 {
+		t.Fatalf("pushoverNotifier.send() = %v; expected: <nil>", err)
+	}
+
+	request := (*requests)[0]
+
+	if request.Path != "/messages.json" || request.Body["token"] != "app-token" || request.Body["user"] != n.To || request.Body["priority"] != float64(2) || request.Body["retry"] == nil || request.Body["expire"] == nil || request.Body["url"] == nil {
+		t.Errorf("pushover request = %+v; expected: an emergency message to the user with a click-through", request)
+	}
+
+	failingServer, _ := newPushServer(t, `{"status": 0, "errors": ["user identifier is invalid"]}`)
+
+	defer failingServer.Close()
+
+	pushoverAPIBaseURL = failingServer.URL
+
+	if err := (pushoverNotifier{}).send(context.Background(), n); err == nil || !strings.Contains(err.Error(), "user identifier is invalid") {
+		t.Errorf("pushoverNotifier.send() to an invalid user = %v; expected: user identifier is invalid", err)
+	}
+
+	push.PushoverAppToken = ""
+
+	if _, reachable := (pushoverNotifier{}).recipient(Subscriber{Push: pushDestinations{PushoverUserKey: n.To}}); reachable {
+		t.Error("pushoverNotifier.recipient() without an application token = true; expected: false")
+	}
+}
+
+// Need to test the following:
+// Well formed destinations are accepted
+// Gotify needs both its server and token, and ntfy servers need a topic
+// Malformed topics, user keys and server URLs are rejected
+func TestPushDestinationsValidate(t *testing.T) {
+	tests := []struct {
+		Destinations pushDestinations
+		ExpectError  bool
+	}{
+		{Destinations: pushDestinations{NtfyTopic: "rj-pwned", GotifyServerURL: "https://gotify.example.com", GotifyAppToken: "AppToken", PushoverUserKey: "uQiRzpo4DXghDmr9QzzfQu27cmVRsG"}},
+		{Destinations: pushDestinations{GotifyServerURL: "https://gotify.example.com"}, ExpectError: true},
+		{Destinations: pushDestinations{NtfyServerURL: "https://ntfy.example.com"}, ExpectError: true},
+		{Destinations: pushDestinations{NtfyTopic: "rj/pwned"}, ExpectError: true},
+		{Destinations: pushDestinations{NtfyServerURL: "http://ntfy.example.com", NtfyTopic: "rj-pwned"}, ExpectError: true},
+		{Destinations: pushDestinations{PushoverUserKey: "short"}, ExpectError: true},
+		{},
+	}
+
+	for _, test := range tests {
+		if err := test.Destinations.validate(); (err != nil) != test.ExpectError {
+			t.Errorf("pushDestinations.validate() for %+v = %v; expected an error: %t", test.Destinations, err, test.ExpectError)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package functionality
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// quietHours is a daily window in the subscriber's timezone during which notifications are
+// held in the outbox, Start and End are HH:MM and the window wraps past midnight when End is earlier
+type quietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// quietHoursOverrideSeverity is the lowest severity which is sent during quiet hours anyway,
+// from the quietHoursOverrideSeverity environment variable, defaulting to critical
+var quietHoursOverrideSeverity = severityCritical
+
+func init() {
+	name, exists := os.LookupEnv("quietHoursOverrideSeverity")
+
+	if !exists {
+		return
+	}
+
+	overrideSeverity, err := severityByName(name)
+
+	registerReadinessCheck("quiet_hours_override_severity", func() error { return err })
+
+	if err != nil {
+		logger.Error("could not parse the quiet hours override severity", "error", err)
+
+		return
+	}
+
+	quietHoursOverrideSeverity = overrideSeverity
+}
+
+func parseClock(clock string) (int, error) {
+	parsed, err := time.Parse("15:04", clock)
+
+	if err != nil {
+		return 0, fmt.Errorf("quiet hours must be HH:MM, not %q", clock)
+	}
+
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+func (qh quietHours) validate() error {
+	if _, err := parseClock(qh.Start); err != nil {
+		return err
+	}
+
+	_, err := parseClock(qh.End)
+
+	return err
+}
+
+// until returns the end of the quiet hours when the time is in them
+func (qh quietHours) until(now time.Time, location *time.Location) (time.Time, bool) {
+	start, startErr := parseClock(qh.Start)
+	end, endErr := parseClock(qh.End)
+
+	if startErr != nil || endErr != nil || start == end {
+		return time.Time{}, false
+	}
+
+	localNow := now.In(location)
+	minute := localNow.Hour()*60 + localNow.Minute()
+	year, month, day := localNow.Date()
+
+	// The end is built from its clock time rather than added to midnight, which is
+	// an hour out on the days the clocks change
+	endOn := func(day int) time.Time { return time.Date(year, month, day, end/60, end%60, 0, 0, location) }
+
+	switch {
+	case start < end && minute >= start && minute < end:
+		return endOn(day), true
+	case start > end && minute >= start:
+		return endOn(day + 1), true
+	case start > end && minute < end:
+		return endOn(day), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// deferUntil is when a notification of the severity can be sent to the subscriber, which
+// is the end of their quiet hours if it is during them and the severity doesn't override them
+func (sd subscriberDetails) deferUntil(now time.Time, s severity) (time.Time, bool) {
+	if sd.QuietHours == nil || s >= quietHoursOverrideSeverity {
+		return time.Time{}, false
+	}
+
+	return sd.QuietHours.until(now, sd.location())
+}
@@ -0,0 +1,77 @@
+package functionality
+
+import (
+	"testing"
+	"time"
+)
+
+// Need to test the following:
+// Times inside the window are deferred until its end, in the subscriber's timezone
+// Windows which wrap past midnight end on the next day when they started on this one
+// Windows end at their clock time on the days the clocks change
+// Notifications of at least quietHoursOverrideSeverity are never deferred
+func TestDeferUntil(t *testing.T) {
+	chicago, _ := time.LoadLocation("America/Chicago")
+	overnight := &quietHours{Start: "22:00", End: "07:00"}
+
+	tests := []struct {
+		Name              string
+		Details           subscriberDetails
+		Now               time.Time
+		Severity          severity
+		ExpectedDeferred  bool
+		ExpectedNotBefore time.Time
+	}{
+		{
+			Name:              "before midnight in an overnight window",
+			Details:           subscriberDetails{QuietHours: overnight},
+			Now:               time.Date(2024, 6, 3, 23, 30, 0, 0, time.UTC),
+			ExpectedDeferred:  true,
+			ExpectedNotBefore: time.Date(2024, 6, 4, 7, 0, 0, 0, time.UTC),
+		},
+		{
+			Name:              "after midnight in an overnight window, in the subscriber's timezone",
+			Details:           subscriberDetails{QuietHours: overnight, Timezone: "America/Chicago"},
+			Now:               time.Date(2024, 6, 3, 8, 0, 0, 0, time.UTC),
+			ExpectedDeferred:  true,
+			ExpectedNotBefore: time.Date(2024, 6, 3, 7, 0, 0, 0, chicago),
+		},
+		{
+			Name:              "after midnight in an overnight window, on the day the clocks go forward",
+			Details:           subscriberDetails{QuietHours: overnight, Timezone: "America/Chicago"},
+			Now:               time.Date(2024, 3, 10, 8, 30, 0, 0, time.UTC),
+			ExpectedDeferred:  true,
+			ExpectedNotBefore: time.Date(2024, 3, 10, 7, 0, 0, 0, chicago),
+		},
+		{
+			Name:    "outside an overnight window",
+			Details: subscriberDetails{QuietHours: overnight},
+			Now:     time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC),
+		},
+		{
+			Name:              "inside a daytime window",
+			Details:           subscriberDetails{QuietHours: &quietHours{Start: "09:00", End: "17:30"}},
+			Now:               time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC),
+			ExpectedDeferred:  true,
+			ExpectedNotBefore: time.Date(2024, 6, 3, 17, 30, 0, 0, time.UTC),
+		},
+		{
+			Name:     "severe enough to override the window",
+			Details:  subscriberDetails{QuietHours: overnight},
+			Now:      time.Date(2024, 6, 3, 23, 30, 0, 0, time.UTC),
+			Severity: severityCritical,
+		},
+		{
+			Name: "no quiet hours",
+			Now:  time.Date(2024, 6, 3, 23, 30, 0, 0, time.UTC),
+		},
+	}
+
+	for _, test := range tests {
+		notBefore, deferred := test.Details.deferUntil(test.Now, test.Severity)
+
+		if deferred != test.ExpectedDeferred || !notBefore.Equal(test.ExpectedNotBefore) {
+			t.Errorf("deferUntil() %s = %v, %t; expected: %v, %t", test.Name, notBefore, deferred, test.ExpectedNotBefore, test.ExpectedDeferred)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package functionality
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter spaces calls out so that no two of them
+// happen within the interval of each other
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// Need to wait between every request because
+// the API only allows one request every 1500ms
+var hibpLimiter = &rateLimiter{interval: 1500 * time.Millisecond}
+
+// Wait blocks until the caller is allowed to proceed, returning how long it waited; a caller
+// which gives up gives back its slot, as long as nobody has been given one after it
+func (rl *rateLimiter) Wait(ctx context.Context) (time.Duration, error) {
+	rl.mu.Lock()
+
+	now := time.Now()
+
+	if rl.next.Before(now) {
+		rl.next = now
+	}
+
+	reserved := rl.next
+	wait := reserved.Sub(now)
+	rl.next = reserved.Add(rl.interval)
+
+	rl.mu.Unlock()
+
+	if wait <= 0 {
+		return 0, nil
+	}
+
+	timer := time.NewTimer(wait)
+
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		rl.mu.Lock()
+
+		if rl.next.Equal(reserved.Add(rl.interval)) {
+			rl.next = reserved
+		}
+
+		rl.mu.Unlock()
+
+		return time.Since(now), ctx.Err()
+	case <-timer.C:
+		return wait, nil
+	}
+}
+
+// windowLimiter allows each key at most limit calls within any window of time, so that
+// endpoints which send email can't be used to flood an inbox
+type windowLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	calls  map[string][]time.Time
+}
+
+func newWindowLimiter(limit int, window time.Duration) *windowLimiter {
+	return &windowLimiter{limit: limit, window: window, calls: make(map[string][]time.Time)}
+}
+
+// Allow reports whether the key is under its limit, counting the call against it when it is
+func (wl *windowLimiter) Allow(key string) bool {
+	wl.mu.Lock()
+
+	defer wl.mu.Unlock()
+
+	now := time.Now()
+
+	// Calls which have left the window are forgotten, along with keys without any left
+	for otherKey, calls := range wl.calls {
+		for len(calls) != 0 && now.Sub(calls[0]) >= wl.window {
+			calls = calls[1:]
+		}
+
+		if len(calls) == 0 {
+			delete(wl.calls, otherKey)
+		} else {
+			wl.calls[otherKey] = calls
+		}
+	}
+
+	if len(wl.calls[key]) >= wl.limit {
+		return false
+	}
+
+	wl.calls[key] = append(wl.calls[key], now)
+
+	return true
+}
@@ -0,0 +1,66 @@
+package functionality
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Need to test the following:
+// The first call does not wait at all
+// Every following call waits until the interval since the last one has passed
+// A cancelled context stops the wait early with the context's error, giving back the slot it had
+func TestRateLimiterWait(t *testing.T) {
+	interval := 50 * time.Millisecond
+	limiter := &rateLimiter{interval: interval}
+
+	start := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if _, err := limiter.Wait(context.Background()); err != nil {
+			t.Fatalf("rateLimiter.Wait(context) = %v; expected: <nil>", err)
+		}
+
+		if elapsed, expected := time.Since(start), time.Duration(i)*interval; elapsed < expected {
+			t.Errorf("rateLimiter.Wait(context) call %d returned after %v; expected at least %v", i, elapsed, expected)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cancel()
+
+	next := limiter.next
+
+	if _, err := limiter.Wait(ctx); err != context.Canceled {
+		t.Errorf("rateLimiter.Wait(cancelled context) = %v; expected: %v", err, context.Canceled)
+	}
+
+	if !limiter.next.Equal(next) {
+		t.Errorf("next slot after a cancelled wait = %v; expected: %v, the cancelled slot given back", limiter.next, next)
+	}
+}
+
+// Need to test the following:
+// Each key is allowed up to the limit within the window, independently of the others
+// Calls are allowed again once the earlier ones have left the window
+func TestWindowLimiterAllow(t *testing.T) {
+	window := 50 * time.Millisecond
+	limiter := newWindowLimiter(2, window)
+
+	for i, expected := range []bool{true, true, false} {
+		if allowed := limiter.Allow("someone"); allowed != expected {
+			t.Errorf("windowLimiter.Allow(someone) call %d = %t; expected: %t", i, allowed, expected)
+		}
+	}
+
+	if !limiter.Allow("anyone") {
+		t.Error("windowLimiter.Allow(anyone) = false; expected: true, as only someone is over the limit")
+	}
+
+	time.Sleep(window)
+
+	if !limiter.Allow("someone") {
+		t.Error("windowLimiter.Allow(someone) after the window = false; expected: true")
+	}
+}
@@ -0,0 +1,82 @@
+package functionality
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// scheduledJob is run once when the scheduler starts, then every interval after that
+type scheduledJob struct {
+	name     string
+	interval time.Duration
+	run      func(context.Context) error
+}
+
+var (
+	scheduledJobsMutex sync.Mutex
+	scheduledJobs      []scheduledJob
+)
+
+// registerScheduledJob adds a job for StartScheduler to run
+func registerScheduledJob(name string, interval time.Duration, run func(context.Context) error) {
+	scheduledJobsMutex.Lock()
+
+	defer scheduledJobsMutex.Unlock()
+
+	scheduledJobs = append(scheduledJobs, scheduledJob{name: name, interval: interval, run: run})
+}
+
+// StartScheduler runs every registered job on its interval until the context is done,
+// each job has its own goroutine so a slow job doesn't hold the others up
+func StartScheduler(ctx context.Context) {
+	scheduledJobsMutex.Lock()
+
+	defer scheduledJobsMutex.Unlock()
+
+	for _, job := range scheduledJobs {
+		go func(job scheduledJob) {
+			ticker := time.NewTicker(job.interval)
+
+			defer ticker.Stop()
+
+			for {
+				runScheduledJob(ctx, job)
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(job)
+	}
+}
+
+func runScheduledJob(ctx context.Context, job scheduledJob) {
+	jobLogger := logger.With("job", job.name, "job_id", newID())
+
+	ctx, span := tracer.Start(contextWithLogger(ctx, jobLogger), "scheduler."+job.name)
+
+	start := time.Now()
+
+	jobLogger.Info("scheduled job started")
+
+	err := job.run(ctx)
+
+	duration := time.Since(start)
+
+	endSpan(span, err)
+
+	if err != nil {
+		schedulerRunDuration.WithLabelValues(job.name, "failed").Observe(duration.Seconds())
+
+		jobLogger.Error("scheduled job failed", "duration", duration, "error", err)
+
+		return
+	}
+
+	schedulerRunDuration.WithLabelValues(job.name, "succeeded").Observe(duration.Seconds())
+
+	jobLogger.Info("scheduled job finished", "duration", duration)
+}
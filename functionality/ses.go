@@ -0,0 +1,232 @@
+package functionality
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sesInfo is the SES secret file, Endpoint is only needed for SES-compatible APIs other than AWS's own
+type sesInfo struct {
+	Endpoint        string `json:"endpoint"`
+	Region          string `json:"region"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	SessionToken    string `json:"session_token"`
+	From            string `json:"from"`
+}
+
+var sesEmail *sesSender
+
+func init() {
+	loadSecretFile("sesFile", InitializeSESWithJSON)
+}
+
+// InitializeSESWithJSON is used for initializing the SES email backend for the package
+func InitializeSESWithJSON(reader io.Reader) error {
+	var sesJSON sesInfo
+
+	if err := json.NewDecoder(reader).Decode(&sesJSON); err != nil {
+		return err
+	}
+
+	sender, err := newSESSender(sesJSON)
+
+	if err != nil {
+		return err
+	}
+
+	sesEmail = sender
+
+	return nil
+}
+
+// sesSender sends email through the SES v2 SendEmail API, signing requests with AWS Signature Version 4
+type sesSender struct {
+	config sesInfo
+	client *http.Client
+}
+
+func newSESSender(config sesInfo) (*sesSender, error) {
+	if config.Region == "" || config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, errors.New("SES needs a region, access key ID and secret access key")
+	}
+
+	if config.Endpoint == "" {
+		config.Endpoint = "https://email." + config.Region + ".amazonaws.com"
+	}
+
+	if config.From == "" {
+		config.From = defaultEmailFrom
+	}
+
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+
+	return &sesSender{config: config, client: &http.Client{Timeout: smtpTimeout}}, nil
+}
+
+func (ss *sesSender) sendEmail(ctx context.Context, message emailMessage) error {
+	if message.From == "" {
+		message.From = ss.config.From
+	}
+
+	content := func(data string) map[string]string {
+		return map[string]string{"Data": data, "Charset": "UTF-8"}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"FromEmailAddress": message.From,
+		"Destination":      map[string]interface{}{"ToAddresses": []string{message.To}},
+		"Content": map[string]interface{}{
+			"Simple": map[string]interface{}{
+				"Subject": content(message.Subject),
+				"Body":    map[string]interface{}{"Text": content(message.Body)},
+			},
+		},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	sesRequest, err := http.NewRequest("POST", ss.config.Endpoint+"/v2/email/outbound-emails", bytes.NewReader(body))
+
+	if err != nil {
+		return err
+	}
+
+	sesRequest.Header.Set("Content-Type", "application/json")
+
+	signAWSRequest(sesRequest, body, ss.config, "ses", time.Now())
+
+	resp, err := ss.client.Do(sesRequest.WithContext(ctx))
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		sesError := struct {
+			Message string `json:"message"`
+		}{}
+
+		responseBytes, _ := ioutil.ReadAll(resp.Body)
+		json.Unmarshal(responseBytes, &sesError)
+
+		return fmt.Errorf("SES responded with HTTP/%d: %s", resp.StatusCode, sesError.Message)
+	}
+
+	return nil
+}
+
+// signAWSRequest adds the AWS Signature Version 4 headers to the request, signing
+// the host, content type and date headers along with the body
+func signAWSRequest(request *http.Request, body []byte, credentials sesInfo, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	scope := strings.Join([]string{date, credentials.Region, service, "aws4_request"}, "/")
+
+	request.Header.Set("X-Amz-Date", amzDate)
+
+	if credentials.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+
+	for name := range request.Header {
+		lowerName := strings.ToLower(name)
+
+		if lowerName == "content-type" || strings.HasPrefix(lowerName, "x-amz-") {
+			headers[lowerName] = strings.TrimSpace(request.Header.Get(name))
+		}
+	}
+
+	headerNames := make([]string, 0, len(headers))
+
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+
+	sort.Strings(headerNames)
+
+	var canonicalHeaders strings.Builder
+
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalPath := request.URL.EscapedPath()
+
+	if canonicalPath == "" {
+		canonicalPath = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		canonicalPath,
+		canonicalQuery(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	signingKey := []byte("AWS4" + credentials.SecretAccessKey)
+
+	for _, part := range []string{date, credentials.Region, service, "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(query url.Values) string {
+	escape := func(value string) string {
+		return strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+	}
+
+	pairs := make([]string, 0, len(query))
+
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, escape(key)+"="+escape(value))
+		}
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, "&")
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
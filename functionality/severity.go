@@ -0,0 +1,273 @@
+package functionality
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// severityWeights are what a breach is scored by: the weights of the data classes it exposed
+// are summed, scaled down by the multipliers of any flags which make it less credible, then the
+// sensitive and recency bonuses are added; the recency bonus shrinks to nothing over RecencyDays
+type severityWeights struct {
+	DataClasses          map[string]float64 `json:"data_classes"`
+	DefaultDataClass     float64            `json:"default_data_class"`
+	UnverifiedMultiplier float64            `json:"unverified_multiplier"`
+	FabricatedMultiplier float64            `json:"fabricated_multiplier"`
+	SpamListMultiplier   float64            `json:"spam_list_multiplier"`
+	SensitiveBonus       float64            `json:"sensitive_bonus"`
+	RecencyBonus         float64            `json:"recency_bonus"`
+	RecencyDays          float64            `json:"recency_days"`
+
+	// Thresholds are the lowest scores of each severity above low
+	Thresholds struct {
+		Medium   float64 `json:"medium"`
+		High     float64 `json:"high"`
+		Critical float64 `json:"critical"`
+	} `json:"thresholds"`
+}
+
+// severity is how bad a breach (or the worst of several) is for the people in it
+type severity int
+
+const (
+	severityLow severity = iota
+	severityMedium
+	severityHigh
+	severityCritical
+)
+
+func (s severity) String() string {
+	return [...]string{"low", "medium", "high", "critical"}[s]
+}
+
+func (s severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *severity) UnmarshalText(text []byte) (err error) {
+	*s, err = severityByName(string(text))
+
+	return err
+}
+
+// scoredBreach is a breach with its severity score
+type scoredBreach struct {
+	PwnInfo
+	Score    float64  `json:"score"`
+	Severity severity `json:"severity"`
+}
+
+var defaultSeverityWeights = func() severityWeights {
+	weights := severityWeights{
+		DataClasses: map[string]float64{
+			"passwords":                      40,
+			"security questions and answers": 35,
+			"credit cards":                   35,
+			"bank account numbers":           35,
+			"partial credit card data":       20,
+			"auth tokens":                    30,
+			"social security numbers":        35,
+			"government issued ids":          30,
+			"passport numbers":               30,
+			"password hints":                 20,
+			"private messages":               15,
+			"physical addresses":             10,
+			"phone numbers":                  10,
+			"dates of birth":                 10,
+			"names":                          5,
+			"usernames":                      5,
+			"ip addresses":                   3,
+			"email addresses":                2,
+		},
+		DefaultDataClass:     5,
+		UnverifiedMultiplier: 0.6,
+		FabricatedMultiplier: 0.1,
+		SpamListMultiplier:   0.3,
+		SensitiveBonus:       20,
+		RecencyBonus:         15,
+		RecencyDays:          365,
+	}
+
+	weights.Thresholds.Medium = 15
+	weights.Thresholds.High = 35
+	weights.Thresholds.Critical = 60
+
+	return weights
+}()
+
+// severityWeightsInUse are the default weights with any overridden by the file
+// in the severityWeightsFile environment variable, which is not secret so is left in place
+var severityWeightsInUse = defaultSeverityWeights
+
+func init() {
+	fileLocation, exists := os.LookupEnv("severityWeightsFile")
+
+	if !exists {
+		return
+	}
+
+	weights, err := loadSeverityWeights(fileLocation)
+
+	registerReadinessCheck("severity_weights", func() error { return err })
+
+	if err != nil {
+		logger.Error("could not load the severity weights", "error", err)
+
+		return
+	}
+
+	severityWeightsInUse = weights
+}
+
+func loadSeverityWeights(fileLocation string) (severityWeights, error) {
+	weights := defaultSeverityWeights
+
+	weightsFile, err := os.Open(fileLocation)
+
+	if err != nil {
+		return weights, err
+	}
+
+	defer weightsFile.Close()
+
+	// Decoding into a copy of the default data classes merges them with the file's,
+	// so the file only needs the weights it changes
+	weights.DataClasses = make(map[string]float64, len(defaultSeverityWeights.DataClasses))
+
+	for dataClass, weight := range defaultSeverityWeights.DataClasses {
+		weights.DataClasses[dataClass] = weight
+	}
+
+	if err = json.NewDecoder(weightsFile).Decode(&weights); err != nil {
+		return weights, err
+	}
+
+	dataClasses := make(map[string]float64, len(weights.DataClasses))
+
+	for dataClass, weight := range weights.DataClasses {
+		dataClasses[strings.ToLower(dataClass)] = weight
+	}
+
+	weights.DataClasses = dataClasses
+
+	if weights.Thresholds.Medium > weights.Thresholds.High || weights.Thresholds.High > weights.Thresholds.Critical {
+		return weights, errors.New("the severity thresholds must be medium <= high <= critical")
+	}
+
+	return weights, nil
+}
+
+// score rates the breach, the more it exposed, the more credible it is and the more recent it was, the higher
+func (sw severityWeights) score(breach PwnInfo, now time.Time) float64 {
+	score := 0.0
+
+	for _, dataClass := range breach.DataClasses {
+		weight, exists := sw.DataClasses[strings.ToLower(dataClass)]
+
+		if !exists {
+			weight = sw.DefaultDataClass
+		}
+
+		score += weight
+	}
+
+	if !breach.IsVerified {
+		score *= sw.UnverifiedMultiplier
+	}
+
+	if breach.IsFabricated {
+		score *= sw.FabricatedMultiplier
+	}
+
+	if breach.IsSpamList {
+		score *= sw.SpamListMultiplier
+	}
+
+	if breach.IsSensitive {
+		score += sw.SensitiveBonus
+	}
+
+	if breachDate, err := time.Parse("2006-01-02", breach.BreachDate); err == nil && sw.RecencyDays > 0 {
+		age := now.Sub(breachDate).Hours() / 24
+
+		if age < 0 {
+			age = 0
+		}
+
+		if age < sw.RecencyDays {
+			score += sw.RecencyBonus * (1 - age/sw.RecencyDays)
+		}
+	}
+
+	return score
+}
+
+func (sw severityWeights) severity(score float64) severity {
+	switch {
+	case score >= sw.Thresholds.Critical:
+		return severityCritical
+	case score >= sw.Thresholds.High:
+		return severityHigh
+	case score >= sw.Thresholds.Medium:
+		return severityMedium
+	default:
+		return severityLow
+	}
+}
+
+// scoreBreaches scores the breaches with the weights in use, ordered from the most severe
+func scoreBreaches(pwnInfo []PwnInfo) []scoredBreach {
+	now := time.Now()
+	scored := make([]scoredBreach, 0, len(pwnInfo))
+
+	for _, breach := range pwnInfo {
+		score := severityWeightsInUse.score(breach, now)
+
+		scored = append(scored, scoredBreach{PwnInfo: breach, Score: score, Severity: severityWeightsInUse.severity(score)})
+	}
+
+	sort.SliceStable(scored, func(i, j int) bool { return scored[i].Score > scored[j].Score })
+
+	return scored
+}
+
+// worstSeverity is the severity of the subscriber, which is that of the most severe breach they are in
+func worstSeverity(scored []scoredBreach) severity {
+	if len(scored) == 0 {
+		return severityLow
+	}
+
+	return scored[0].Severity
+}
+
+// pwnageSubject is the subject line of a breach notification of the severity
+func pwnageSubject(s severity) string {
+	switch s {
+	case severityCritical:
+		return "URGENT: YOU HAVE BEEN PWNED, CHANGE YOUR PASSWORDS NOW :("
+	case severityHigh:
+		return "YOU HAVE BEEN PWNED :("
+	case severityMedium:
+		return "YOU HAVE BEEN PWNED, SOME OF YOUR DETAILS WERE EXPOSED :("
+	default:
+		return "YOU HAVE BEEN PWNED, BUT IT LOOKS MINOR :/"
+	}
+}
+
+// pwnageBody lists the breaches, most severe first
+func pwnageBody(scored []scoredBreach) string {
+	var body strings.Builder
+
+	body.WriteString("Your email was found in these breaches on Have I Been Pwned, from the most severe:\n")
+
+	for _, breach := range scored {
+		fmt.Fprintf(&body, "\n- %s (%s, %s severity): %s", breach.Title, breach.BreachDate, breach.Severity, strings.Join(breach.DataClasses, ", "))
+	}
+
+	return body.String()
+}
@@ -0,0 +1,95 @@
+package functionality
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Need to test the following:
+// Breaches exposing passwords and other sensitive data classes rate higher
+// Unverified, fabricated and spam list breaches rate lower
+// Sensitive and recent breaches rate higher
+func TestSeverityScore(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		Breach           PwnInfo
+		ExpectedSeverity severity
+	}{
+		{Breach: PwnInfo{Name: "Passwords", BreachDate: "2015-01-01", DataClasses: []string{"Email addresses", "Passwords", "Security questions and answers"}, IsVerified: true}, ExpectedSeverity: severityCritical},
+		{Breach: PwnInfo{Name: "RecentPasswords", BreachDate: "2024-05-01", DataClasses: []string{"Email addresses", "Passwords"}, IsVerified: true}, ExpectedSeverity: severityHigh},
+		{Breach: PwnInfo{Name: "OldPasswords", BreachDate: "2012-01-01", DataClasses: []string{"Email addresses", "Passwords"}, IsVerified: true}, ExpectedSeverity: severityHigh},
+		{Breach: PwnInfo{Name: "Unverified", BreachDate: "2012-01-01", DataClasses: []string{"Email addresses", "Passwords"}}, ExpectedSeverity: severityMedium},
+		{Breach: PwnInfo{Name: "Fabricated", BreachDate: "2012-01-01", DataClasses: []string{"Email addresses", "Passwords"}, IsVerified: true, IsFabricated: true}, ExpectedSeverity: severityLow},
+		{Breach: PwnInfo{Name: "SpamList", BreachDate: "2012-01-01", DataClasses: []string{"Email addresses", "Names"}, IsVerified: true, IsSpamList: true}, ExpectedSeverity: severityLow},
+		{Breach: PwnInfo{Name: "Sensitive", BreachDate: "2012-01-01", DataClasses: []string{"Email addresses", "Names"}, IsVerified: true, IsSensitive: true}, ExpectedSeverity: severityMedium},
+	}
+
+	for _, test := range tests {
+		score := defaultSeverityWeights.score(test.Breach, now)
+
+		if severity := defaultSeverityWeights.severity(score); severity != test.ExpectedSeverity {
+			t.Errorf("severity of %s = %s (%.1f); expected: %s", test.Breach.Name, severity, score, test.ExpectedSeverity)
+		}
+	}
+
+	recent := defaultSeverityWeights.score(tests[1].Breach, now)
+	old := defaultSeverityWeights.score(tests[2].Breach, now)
+
+	if recent <= old {
+		t.Errorf("score of a recent breach = %.1f; expected: more than the %.1f of an old one", recent, old)
+	}
+}
+
+// Need to test the following:
+// Breaches are ordered from the most severe and the subject reflects the worst of them
+func TestScoreBreaches(t *testing.T) {
+	scored := scoreBreaches([]PwnInfo{
+		{Name: "SpamList", DataClasses: []string{"Email addresses"}, IsSpamList: true},
+		{Name: "Passwords", DataClasses: []string{"Email addresses", "Passwords", "Credit cards"}, IsVerified: true},
+	})
+
+	if scored[0].Name != "Passwords" || worstSeverity(scored) != severityCritical {
+		t.Errorf("scoreBreaches() = %+v; expected: Passwords first and critical", scored)
+	}
+
+	if subject := pwnageSubject(worstSeverity(scored)); subject != pwnageSubject(severityCritical) {
+		t.Errorf("pwnageSubject() = %s; expected: %s", subject, pwnageSubject(severityCritical))
+	}
+}
+
+// Need to test the following:
+// The weights file overrides only the weights in it, leaving the rest as the defaults
+// Thresholds which are out of order are an error
+func TestLoadSeverityWeights(t *testing.T) {
+	tempDirectory, err := ioutil.TempDir("", "severity")
+
+	if err != nil {
+		t.Fatal("could not create the temporary directory")
+	}
+
+	defer os.RemoveAll(tempDirectory)
+
+	fileLocation := filepath.Join(tempDirectory, "weights.json")
+
+	ioutil.WriteFile(fileLocation, []byte(`{"data_classes": {"Geographic locations": 25}, "spam_list_multiplier": 0}`), 0600)
+
+	weights, err := loadSeverityWeights(fileLocation)
+
+	if err != nil || weights.DataClasses["geographic locations"] != 25 || weights.DataClasses["passwords"] != 40 || weights.SpamListMultiplier != 0 || weights.SensitiveBonus != defaultSeverityWeights.SensitiveBonus {
+		t.Errorf("loadSeverityWeights() = %+v, %v; expected: the defaults with the file's overrides", weights, err)
+	}
+
+	if _, exists := defaultSeverityWeights.DataClasses["geographic locations"]; exists {
+		t.Error("loadSeverityWeights() changed the default weights")
+	}
+
+	ioutil.WriteFile(fileLocation, []byte(`{"thresholds": {"medium": 50, "high": 40, "critical": 60}}`), 0600)
+
+	if _, err = loadSeverityWeights(fileLocation); err == nil {
+		t.Error("loadSeverityWeights() with out of order thresholds = <nil>; expected: an error")
+	}
+}
@@ -0,0 +1,816 @@
+package functionality
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrSubscriberExists           = errors.New("the email is already being checked for pwnage")
+	ErrSubscriberNotFound         = errors.New("the email is not being checked for pwnage")
+	ErrSubscriberStoreUnavailable = errors.New("the subscriber store has not been opened")
+	ErrDestinationsRequireAdmin   = errors.New("chat and push destinations can only be set with the admin token")
+)
+
+// subscriberDetails is everything about a subscriber which is not PII, so it is stored in plaintext
+type subscriberDetails struct {
+	AlwaysNotify bool      `json:"always_notify"`
+	IsPwned      bool      `json:"is_pwned"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	// MonitoredServices are the domains or breach names of the services the subscriber
+	// uses, so that they are re-checked when one of those services is breached
+	MonitoredServices []string `json:"monitored_services,omitempty"`
+
+	// Pastes are the pastes the subscriber was found in by the last paste check
+	Pastes []PasteInfo `json:"pastes,omitempty"`
+
+	// PolicyRules decide which of the subscriber's breaches they are notified of and
+	// how, they are applied before the global notification policy
+	PolicyRules []policyRule `json:"policy_rules,omitempty"`
+
+	// Digest is the cadence the subscriber gets their findings on, daily or weekly, with the
+	// findings waiting for it in PendingDigest; Timezone is the IANA timezone they are in
+	Digest        string       `json:"digest,omitempty"`
+	Timezone      string       `json:"timezone,omitempty"`
+	PendingDigest []digestItem `json:"pending_digest,omitempty"`
+	LastDigestAt  time.Time    `json:"last_digest_at,omitempty"`
+
+	// DigestedBreaches are the names of the breaches already sent in a digest, since every
+	// check finds every breach the subscriber is in, and only new ones go in the next digest
+	DigestedBreaches []string `json:"digested_breaches,omitempty"`
+
+	// QuietHours is when, in their Timezone, the subscriber is only sent urgent notifications
+	QuietHours *quietHours `json:"quiet_hours,omitempty"`
+
+	// PendingOptIn is set for imported subscribers who haven't confirmed that they want to be
+	// checked yet, they are left out of every check until they redeem the token emailed to them
+	PendingOptIn   bool   `json:"pending_opt_in,omitempty"`
+	OptInTokenHash string `json:"opt_in_token_hash,omitempty"`
+}
+
+// Subscriber is somebody whose email is checked for pwnage
+type Subscriber struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Phone string `json:"phone,omitempty"`
+
+	// Chat is where the subscriber is notified in chat, its webhook URLs are as good as
+	// credentials for posting to the subscriber's channels, so they are encrypted like PII
+	Chat chatDestinations `json:"chat"`
+
+	// Push is where the subscriber's phone is sent push notifications, its topics and
+	// tokens are credentials in the same way
+	Push pushDestinations `json:"push"`
+	subscriberDetails
+}
+
+// storedSubscriber is how a Subscriber is kept on disk, with the
+// PII encrypted and a blind index to look the email up by
+type storedSubscriber struct {
+	ID         string    `json:"id"`
+	EmailIndex string    `json:"email_index"`
+	Email      envelope  `json:"email"`
+	Phone      *envelope `json:"phone,omitempty"`
+	Chat       *envelope `json:"chat,omitempty"`
+	Push       *envelope `json:"push,omitempty"`
+	subscriberDetails
+}
+
+// subscriberStore keeps the subscribers in a JSON file in the data directory,
+// the whole file is rewritten (atomically) every time it changes
+type subscriberStore struct {
+	mu           sync.RWMutex
+	fileLocation string
+	keyring      *keyring
+	subscribers  map[string]storedSubscriber
+}
+
+var (
+	subscribers        *subscriberStore
+	subscriberStoreErr = ErrSubscriberStoreUnavailable
+
+	// keyringRotations re-encrypt everything else which is encrypted with the subscriber keyring
+	keyringRotationsMutex sync.Mutex
+	keyringRotations      = map[string]func(*keyring) error{}
+)
+
+func init() {
+	registerReadinessCheck("subscriber_store", func() error { return subscriberStoreErr })
+}
+
+// registerKeyringRotation adds a store for RotateSubscriberKeys to re-encrypt with the active key,
+// the rotation is given the new keyring and should swap it in while its store is locked
+func registerKeyringRotation(name string, rotate func(*keyring) error) {
+	keyringRotationsMutex.Lock()
+
+	defer keyringRotationsMutex.Unlock()
+
+	keyringRotations[name] = rotate
+}
+
+// subscriberKeysFileLocation is where the subscriber keyring is read from, unlike the
+// other secret files it is never removed since the subscriber store is unreadable without it
+func subscriberKeysFileLocation() string {
+	if fileLocation, exists := os.LookupEnv("subscriberKeysFile"); exists {
+		return fileLocation
+	}
+
+	return "./secret/subscriber-keys.json"
+}
+
+// InitializeSubscriberStore opens the subscriber store in the data directory
+// with the keyring from the subscriber keys file
+func InitializeSubscriberStore() error {
+	kr, err := loadKeyringFromFile(subscriberKeysFileLocation())
+
+	if err != nil {
+		subscriberStoreErr = err
+
+		return err
+	}
+
+	subscribers, err = openSubscriberStore(filepath.Join(dataDirectory, "subscribers.json"), kr)
+
+	subscriberStoreErr = err
+
+	return err
+}
+
+// rotateSubscriberKeys re-encrypts every subscriber in the open store, and everything else
+// encrypted with the subscriber keyring, under the active key of the subscriber keys file; it is
+// done by the running service, with each store locked while it is rotated, so that none of them
+// can write back anything encrypted with a key which is being retired
+func rotateSubscriberKeys() (int, error) {
+	if subscribers == nil {
+		return 0, ErrSubscriberStoreUnavailable
+	}
+
+	kr, err := loadKeyringFromFile(subscriberKeysFileLocation())
+
+	if err != nil {
+		return 0, err
+	}
+
+	keyringRotationsMutex.Lock()
+
+	defer keyringRotationsMutex.Unlock()
+
+	rotated, err := subscribers.rotate(kr)
+
+	if err != nil {
+		return rotated, err
+	}
+
+	for name, rotate := range keyringRotations {
+		if err = rotate(kr); err != nil {
+			return rotated, fmt.Errorf("could not rotate the %s keys: %v", name, err)
+		}
+	}
+
+	return rotated, nil
+}
+
+// RotateSubscriberKeys re-encrypts everything held for subscribers under the active key of the
+// subscriber keys file, which has to still have the keys being retired, and recomputes their blind
+// indexes with its index key; keys which are no longer active can be removed from the file after it responds
+func RotateSubscriberKeys(c *gin.Context) {
+	rotated, err := rotateSubscriberKeys()
+
+	if err != nil {
+		respondWithError(c, subscriberErrorStatusCode(err), err)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"error": false, "rotated": rotated})
+}
+
+func openSubscriberStore(fileLocation string, kr *keyring) (*subscriberStore, error) {
+	store := &subscriberStore{
+		fileLocation: fileLocation,
+		keyring:      kr,
+		subscribers:  make(map[string]storedSubscriber),
+	}
+
+	storeBytes, err := ioutil.ReadFile(fileLocation)
+
+	if os.IsNotExist(err) {
+		return store, store.save()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var storedSubscribers []storedSubscriber
+
+	err = json.Unmarshal(storeBytes, &storedSubscribers)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stored := range storedSubscribers {
+		store.subscribers[stored.ID] = stored
+	}
+
+	return store, nil
+}
+
+// save must be called with the lock held
+func (ss *subscriberStore) save() error {
+	storedSubscribers := make([]storedSubscriber, 0, len(ss.subscribers))
+
+	for _, stored := range ss.subscribers {
+		storedSubscribers = append(storedSubscribers, stored)
+	}
+
+	storeBytes, err := json.Marshal(storedSubscribers)
+
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(ss.fileLocation), ".subscribers")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(storeBytes)
+
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), ss.fileLocation)
+}
+
+func subscriberAdditionalData(id, field string) []byte {
+	return []byte(id + "/" + field)
+}
+
+func (ss *subscriberStore) encryptSubscriber(subscriber Subscriber) (storedSubscriber, error) {
+	stored := storedSubscriber{
+		ID:                subscriber.ID,
+		EmailIndex:        ss.keyring.blindIndex(subscriber.Email),
+		subscriberDetails: subscriber.subscriberDetails,
+	}
+
+	var err error
+
+	stored.Email, err = ss.keyring.encrypt([]byte(subscriber.Email), subscriberAdditionalData(subscriber.ID, "email"))
+
+	if err != nil {
+		return stored, err
+	}
+
+	if subscriber.Phone != "" {
+		phone, err := ss.keyring.encrypt([]byte(subscriber.Phone), subscriberAdditionalData(subscriber.ID, "phone"))
+
+		if err != nil {
+			return stored, err
+		}
+
+		stored.Phone = &phone
+	}
+
+	if subscriber.Chat != (chatDestinations{}) {
+		chatBytes, err := json.Marshal(subscriber.Chat)
+
+		if err != nil {
+			return stored, err
+		}
+
+		chat, err := ss.keyring.encrypt(chatBytes, subscriberAdditionalData(subscriber.ID, "chat"))
+
+		if err != nil {
+			return stored, err
+		}
+
+		stored.Chat = &chat
+	}
+
+	if subscriber.Push != (pushDestinations{}) {
+		pushBytes, err := json.Marshal(subscriber.Push)
+
+		if err != nil {
+			return stored, err
+		}
+
+		push, err := ss.keyring.encrypt(pushBytes, subscriberAdditionalData(subscriber.ID, "push"))
+
+		if err != nil {
+			return stored, err
+		}
+
+		stored.Push = &push
+	}
+
+	return stored, nil
+}
+
+func (ss *subscriberStore) decryptSubscriber(stored storedSubscriber) (Subscriber, error) {
+	subscriber := Subscriber{
+		ID:                stored.ID,
+		subscriberDetails: stored.subscriberDetails,
+	}
+
+	email, err := ss.keyring.decrypt(stored.Email, subscriberAdditionalData(stored.ID, "email"))
+
+	if err != nil {
+		return subscriber, err
+	}
+
+	subscriber.Email = string(email)
+
+	if stored.Phone != nil {
+		phone, err := ss.keyring.decrypt(*stored.Phone, subscriberAdditionalData(stored.ID, "phone"))
+
+		if err != nil {
+			return subscriber, err
+		}
+
+		subscriber.Phone = string(phone)
+	}
+
+	if stored.Chat != nil {
+		chatBytes, err := ss.keyring.decrypt(*stored.Chat, subscriberAdditionalData(stored.ID, "chat"))
+
+		if err != nil {
+			return subscriber, err
+		}
+
+		if err = json.Unmarshal(chatBytes, &subscriber.Chat); err != nil {
+			return subscriber, err
+		}
+	}
+
+	if stored.Push != nil {
+		pushBytes, err := ss.keyring.decrypt(*stored.Push, subscriberAdditionalData(stored.ID, "push"))
+
+		if err != nil {
+			return subscriber, err
+		}
+
+		if err = json.Unmarshal(pushBytes, &subscriber.Push); err != nil {
+			return subscriber, err
+		}
+	}
+
+	return subscriber, nil
+}
+
+// findByEmail must be called with the lock held
+func (ss *subscriberStore) findByEmail(email string) (storedSubscriber, bool) {
+	emailIndex := ss.keyring.blindIndex(email)
+
+	for _, stored := range ss.subscribers {
+		if stored.EmailIndex == emailIndex {
+			return stored, true
+		}
+	}
+
+	return storedSubscriber{}, false
+}
+
+// insert must be called with the lock held, the store still needs to be saved afterwards
+func (ss *subscriberStore) insert(subscriber Subscriber) (Subscriber, error) {
+	if _, exists := ss.findByEmail(subscriber.Email); exists {
+		return subscriber, ErrSubscriberExists
+	}
+
+	subscriber.ID = newID()
+	subscriber.CreatedAt = time.Now().UTC()
+
+	stored, err := ss.encryptSubscriber(subscriber)
+
+	if err != nil {
+		return subscriber, err
+	}
+
+	ss.subscribers[stored.ID] = stored
+
+	return subscriber, nil
+}
+
+func (ss *subscriberStore) add(subscriber Subscriber) (Subscriber, error) {
+	ss.mu.Lock()
+
+	defer ss.mu.Unlock()
+
+	subscriber, err := ss.insert(subscriber)
+
+	if err != nil {
+		return subscriber, err
+	}
+
+	return subscriber, ss.save()
+}
+
+// addMany adds the subscribers, saving the store once rather than for every one of them,
+// the errors are those of each subscriber in turn, nil for the ones which were added
+func (ss *subscriberStore) addMany(newSubscribers []Subscriber) ([]Subscriber, []error, error) {
+	ss.mu.Lock()
+
+	defer ss.mu.Unlock()
+
+	added := make([]Subscriber, len(newSubscribers))
+	errs := make([]error, len(newSubscribers))
+
+	for i, subscriber := range newSubscribers {
+		added[i], errs[i] = ss.insert(subscriber)
+	}
+
+	return added, errs, ss.save()
+}
+
+func (ss *subscriberStore) get(email string) (Subscriber, error) {
+	ss.mu.RLock()
+
+	defer ss.mu.RUnlock()
+
+	stored, exists := ss.findByEmail(email)
+
+	if !exists {
+		return Subscriber{}, ErrSubscriberNotFound
+	}
+
+	return ss.decryptSubscriber(stored)
+}
+
+// list returns the subscribers being checked, which leaves out those who are yet to opt in and
+// those who can't be decrypted, so that one subscriber whose key is missing doesn't stop every check
+func (ss *subscriberStore) list() ([]Subscriber, error) {
+	ss.mu.RLock()
+
+	defer ss.mu.RUnlock()
+
+	subscriberList := make([]Subscriber, 0, len(ss.subscribers))
+
+	for _, stored := range ss.subscribers {
+		if stored.PendingOptIn {
+			continue
+		}
+
+		subscriber, err := ss.decryptSubscriber(stored)
+
+		if err != nil {
+			logger.Error("skipping subscriber who could not be decrypted", "id", stored.ID, "error", err)
+
+			continue
+		}
+
+		subscriberList = append(subscriberList, subscriber)
+	}
+
+	return subscriberList, nil
+}
+
+// updateDetails changes the details of the subscriber with the ID while the store is locked, so
+// that changes made from copies of the subscriber which were listed earlier don't undo each other
+func (ss *subscriberStore) updateDetails(id string, change func(*subscriberDetails)) error {
+	ss.mu.Lock()
+
+	defer ss.mu.Unlock()
+
+	stored, exists := ss.subscribers[id]
+
+	if !exists {
+		return ErrSubscriberNotFound
+	}
+
+	change(&stored.subscriberDetails)
+
+	ss.subscribers[id] = stored
+
+	return ss.save()
+}
+
+// confirmOptIn starts checking the subscriber who was emailed the opt-in token with the hash
+func (ss *subscriberStore) confirmOptIn(tokenHash string) error {
+	ss.mu.Lock()
+
+	defer ss.mu.Unlock()
+
+	for id, stored := range ss.subscribers {
+		if !stored.PendingOptIn || subtle.ConstantTimeCompare([]byte(stored.OptInTokenHash), []byte(tokenHash)) != 1 {
+			continue
+		}
+
+		stored.PendingOptIn, stored.OptInTokenHash = false, ""
+
+		ss.subscribers[id] = stored
+
+		return ss.save()
+	}
+
+	return ErrInvalidOptInToken
+}
+
+func (ss *subscriberStore) remove(email string) error {
+	ss.mu.Lock()
+
+	defer ss.mu.Unlock()
+
+	stored, exists := ss.findByEmail(email)
+
+	if !exists {
+		return ErrSubscriberNotFound
+	}
+
+	delete(ss.subscribers, stored.ID)
+
+	return ss.save()
+}
+
+// rotate re-encrypts every subscriber with the keyring's active key and index key, the keyring
+// only replaces the store's once every subscriber has been decrypted with the store's own
+func (ss *subscriberStore) rotate(kr *keyring) (int, error) {
+	ss.mu.Lock()
+
+	defer ss.mu.Unlock()
+
+	decrypted := make([]Subscriber, 0, len(ss.subscribers))
+
+	for _, stored := range ss.subscribers {
+		subscriber, err := ss.decryptSubscriber(stored)
+
+		if err != nil {
+			return 0, err
+		}
+
+		decrypted = append(decrypted, subscriber)
+	}
+
+	previousKeyring := ss.keyring
+	ss.keyring = kr
+
+	rotated := make(map[string]storedSubscriber, len(decrypted))
+
+	for _, subscriber := range decrypted {
+		stored, err := ss.encryptSubscriber(subscriber)
+
+		if err != nil {
+			ss.keyring = previousKeyring
+
+			return 0, err
+		}
+
+		rotated[subscriber.ID] = stored
+	}
+
+	ss.subscribers = rotated
+
+	return len(rotated), ss.save()
+}
+
+func respondWithError(c *gin.Context, statusCode int, err error) {
+	c.JSON(statusCode, gin.H{"error": true, "message": err.Error()})
+}
+
+func subscriberErrorStatusCode(err error) int {
+	switch err {
+	case ErrSubscriberExists:
+		return http.StatusConflict
+	case ErrSubscriberNotFound:
+		return http.StatusNotFound
+	case ErrSubscriberStoreUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// AddToPwnageCheck adds an email, and optionally a phone number to text, to the subscribers checked for pwnage;
+// unless it is added by an admin the email is sent a token to opt in with, and isn't checked until it has been
+// confirmed; their own chat and push destinations can only be set by admins, since the service posts to them with
+// the team's bot tokens and would otherwise POST to any URL anyone gave it
+func AddToPwnageCheck(c *gin.Context) {
+	addRequest := struct {
+		Email             string           `json:"email"`
+		Phone             string           `json:"phone"`
+		AlwaysNotify      bool             `json:"always_notify"`
+		MonitoredServices []string         `json:"monitored_services"`
+		PolicyRules       []policyRule     `json:"policy_rules"`
+		Digest            string           `json:"digest"`
+		Timezone          string           `json:"timezone"`
+		QuietHours        *quietHours      `json:"quiet_hours"`
+		Chat              chatDestinations `json:"chat"`
+		Push              pushDestinations `json:"push"`
+	}{}
+
+	if err := json.NewDecoder(c.Request.Body).Decode(&addRequest); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	}
+
+	if err := validateDigestSettings(addRequest.Digest, addRequest.Timezone); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	}
+
+	if addRequest.QuietHours != nil {
+		if err := addRequest.QuietHours.validate(); err != nil {
+			respondWithError(c, http.StatusBadRequest, err)
+
+			return
+		}
+	}
+
+	if (addRequest.Chat != chatDestinations{} || addRequest.Push != pushDestinations{}) && !isAdminRequest(c) {
+		respondWithError(c, http.StatusForbidden, ErrDestinationsRequireAdmin)
+
+		return
+	}
+
+	if err := addRequest.Chat.validate(); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	}
+
+	if err := addRequest.Push.validate(); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	}
+
+	if err := validatePolicyRules(addRequest.PolicyRules); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	}
+
+	address, err := mail.ParseAddress(addRequest.Email)
+
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	}
+
+	if subscribers == nil {
+		respondWithError(c, http.StatusServiceUnavailable, ErrSubscriberStoreUnavailable)
+
+		return
+	}
+
+	admin := isAdminRequest(c)
+	baseURL, token := "", ""
+
+	if !admin {
+		if baseURL, err = publicURL(); err != nil {
+			respondWithError(c, http.StatusServiceUnavailable, err)
+
+			return
+		}
+
+		if !privacyClientLimiter.Allow(c.ClientIP()) || !privacyEmailLimiter.Allow(strings.ToLower(address.Address)) {
+			respondWithError(c, http.StatusTooManyRequests, ErrTooManyPrivacyRequests)
+
+			return
+		}
+
+		token = newID() + newID()
+	}
+
+	subscriber, err := subscribers.add(Subscriber{
+		Email: address.Address,
+		Phone: addRequest.Phone,
+		Chat:  addRequest.Chat,
+		Push:  addRequest.Push,
+		subscriberDetails: subscriberDetails{
+			AlwaysNotify:      addRequest.AlwaysNotify,
+			MonitoredServices: addRequest.MonitoredServices,
+			PolicyRules:       addRequest.PolicyRules,
+			Digest:            addRequest.Digest,
+			Timezone:          addRequest.Timezone,
+			QuietHours:        addRequest.QuietHours,
+			PendingOptIn:      !admin,
+			OptInTokenHash:    optInTokenHash(token),
+		},
+	})
+
+	if err != nil {
+		loggerFromContext(c.Request.Context()).Warn("could not add subscriber", "email", addRequest.Email, "error", err)
+
+		respondWithError(c, subscriberErrorStatusCode(err), err)
+
+		return
+	}
+
+	if admin {
+		c.JSON(http.StatusOK, gin.H{"error": false, "id": subscriber.ID})
+
+		return
+	}
+
+	if err = sendOptInEmail(c.Request.Context(), address.Address, token, baseURL); err != nil {
+		// The subscriber is removed so that they can be added again once the email can be sent
+		subscribers.remove(address.Address)
+
+		respondWithError(c, http.StatusBadGateway, errors.New("the opt-in email could not be sent"))
+
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"error": false})
+}
+
+func optInTokenHash(token string) string {
+	if token == "" {
+		return ""
+	}
+
+	return hashPrivacyToken(token)
+}
+
+// DeleteFromPwnageCheck stops an email from being checked for pwnage, unless it is deleted by an admin
+// the email is sent a token to confirm it with; it responds the same whether or not the email is checked
+func DeleteFromPwnageCheck(c *gin.Context) {
+	deleteRequest := struct {
+		Email string `json:"email"`
+	}{}
+
+	if err := json.NewDecoder(c.Request.Body).Decode(&deleteRequest); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	}
+
+	address, err := mail.ParseAddress(deleteRequest.Email)
+
+	if err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	}
+
+	if subscribers == nil {
+		respondWithError(c, http.StatusServiceUnavailable, ErrSubscriberStoreUnavailable)
+
+		return
+	}
+
+	if isAdminRequest(c) {
+		if err = subscribers.remove(address.Address); err != nil {
+			respondWithError(c, subscriberErrorStatusCode(err), err)
+
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"error": false})
+
+		return
+	}
+
+	baseURL, err := publicURL()
+
+	if err != nil {
+		respondWithError(c, http.StatusServiceUnavailable, err)
+
+		return
+	}
+
+	if !privacyClientLimiter.Allow(c.ClientIP()) || !privacyEmailLimiter.Allow(strings.ToLower(address.Address)) {
+		respondWithError(c, http.StatusTooManyRequests, ErrTooManyPrivacyRequests)
+
+		return
+	}
+
+	if _, err = subscribers.get(address.Address); err == nil {
+		body := fmt.Sprintf(
+			"Someone asked for this address to stop being checked for pwnage. If it was you, confirm it within the next hour by sending {\"token\": \"%s\"} to %s/api/privacy/confirm, otherwise you can ignore this email.",
+			newPrivacyToken(address.Address, "unsubscribe"),
+			baseURL,
+		)
+
+		if err = notifyEmailOfPwnage(c.Request.Context(), address.Address, "Confirm you want to stop being checked", body, "unsubscribe_request"); err != nil {
+			loggerFromContext(c.Request.Context()).Error("could not send the unsubscribe confirmation", "email", address.Address, "error", err)
+		}
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"error": false})
+}
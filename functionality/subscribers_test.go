@@ -0,0 +1,301 @@
+package functionality
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Need to test the following:
+// Added subscribers can be found by their email, case insensitively, after reopening the store
+// Adding an email twice returns ErrSubscriberExists
+// Neither the email nor the phone number are written to disk in plaintext
+// Rotating to a new key and index key keeps every subscriber readable without the old key
+// Removed subscribers can't be found
+// Subscribers who can't be decrypted are left out of the list without hiding the others
+func TestSubscriberStore(t *testing.T) {
+	tempDirectory, err := ioutil.TempDir("", "subscribers")
+
+	if err != nil {
+		t.Fatal("could not create the temporary data directory")
+	}
+
+	defer os.RemoveAll(tempDirectory)
+
+	fileLocation := filepath.Join(tempDirectory, "subscribers.json")
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+
+	store, err := openSubscriberStore(fileLocation, newTestKeyring(t, "old", map[string]string{"old": oldKey}, newTestKey(t)))
+
+	if err != nil {
+		t.Fatalf("openSubscriberStore() = %v; expected: <nil>", err)
+	}
+
+	added, err := store.add(Subscriber{Email: "Someone@Example.com", Phone: "+15558675309"})
+
+	if err != nil {
+		t.Fatalf("subscriberStore.add(subscriber) = %v; expected: <nil>", err)
+	}
+
+	if _, err = store.add(Subscriber{Email: "someone@example.com"}); err != ErrSubscriberExists {
+		t.Errorf("subscriberStore.add(existing subscriber) = %v; expected: %v", err, ErrSubscriberExists)
+	}
+
+	storeBytes, err := ioutil.ReadFile(fileLocation)
+
+	if err != nil {
+		t.Fatal("could not read the subscriber store file")
+	}
+
+	if strings.Contains(strings.ToLower(string(storeBytes)), "someone@example.com") || strings.Contains(string(storeBytes), "5558675309") {
+		t.Errorf("subscriber store file = %s; expected no plaintext PII", storeBytes)
+	}
+
+	rotatedKeyring := newTestKeyring(t, "new", map[string]string{"old": oldKey, "new": newKey}, newTestKey(t))
+
+	if store, err = openSubscriberStore(fileLocation, rotatedKeyring); err != nil {
+		t.Fatalf("openSubscriberStore() = %v; expected: <nil>", err)
+	}
+
+	if rotated, err := store.rotate(rotatedKeyring); rotated != 1 || err != nil {
+		t.Fatalf("subscriberStore.rotate() = %d, %v; expected: 1, <nil>", rotated, err)
+	}
+
+	rotatedKeyring.keys = map[string][]byte{"new": rotatedKeyring.keys["new"]}
+
+	if store, err = openSubscriberStore(fileLocation, rotatedKeyring); err != nil {
+		t.Fatalf("openSubscriberStore() = %v; expected: <nil>", err)
+	}
+
+	found, err := store.get("SOMEONE@example.com")
+
+	if err != nil || found.ID != added.ID || found.Email != "Someone@Example.com" || found.Phone != "+15558675309" {
+		t.Errorf(`subscriberStore.get("SOMEONE@example.com") = %+v, %v; expected: %+v, <nil>`, found, err, added)
+	}
+
+	if err = store.remove("someone@example.com"); err != nil {
+		t.Errorf(`subscriberStore.remove("someone@example.com") = %v; expected: <nil>`, err)
+	}
+
+	if _, err = store.get("someone@example.com"); err != ErrSubscriberNotFound {
+		t.Errorf(`subscriberStore.get(removed subscriber) = %v; expected: %v`, err, ErrSubscriberNotFound)
+	}
+
+	store.add(Subscriber{Email: "listed@example.com"})
+	store.subscribers["undecryptable"] = storedSubscriber{ID: "undecryptable", Email: envelope{KeyID: "old"}}
+
+	if subscriberList, err := store.list(); err != nil || len(subscriberList) != 1 || subscriberList[0].Email != "listed@example.com" {
+		t.Errorf("subscriberStore.list() with an undecryptable subscriber = %+v, %v; expected: only listed@example.com, <nil>", subscriberList, err)
+	}
+}
+
+// Need to test the following:
+// Anyone can add an email, but it isn't checked until the opt-in token emailed to it has been confirmed
+// Emails added with the admin token are checked straight away
+// Chat and push destinations can only be given with the admin token, as they are posted to with the team's tokens
+// Anyone can ask for an email to stop being checked, but it is only removed once the emailed token is confirmed
+func TestAddToPwnageCheck(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tempDirectory, err := ioutil.TempDir("", "subscribers")
+
+	if err != nil {
+		t.Fatal("could not create the temporary data directory")
+	}
+
+	defer os.RemoveAll(tempDirectory)
+
+	kr := newTestKeyring(t, "1", map[string]string{"1": newTestKey(t)}, newTestKey(t))
+
+	subscribers, _ = openSubscriberStore(filepath.Join(tempDirectory, "subscribers.json"), kr)
+
+	defer func() { subscribers = nil }()
+
+	originalAdminToken := adminToken
+	adminToken = "admin"
+
+	defer func() { adminToken = originalAdminToken }()
+
+	originalEmailLimiter, originalClientLimiter := privacyEmailLimiter, privacyClientLimiter
+	privacyEmailLimiter, privacyClientLimiter = newWindowLimiter(3, time.Hour), newWindowLimiter(10, time.Hour)
+
+	defer func() { privacyEmailLimiter, privacyClientLimiter = originalEmailLimiter, originalClientLimiter }()
+
+	recorder, restore := useRecordingEmailSender()
+
+	defer restore()
+
+	restorePublicURL := usePublicURL("https://pwned.example.com")
+
+	defer restorePublicURL()
+
+	router := gin.New()
+	router.POST("/add-to-pwnage-check", AddToPwnageCheck)
+	router.POST("/delete-from-pwnage-check", DeleteFromPwnageCheck)
+	router.POST("/opt-in/confirm", ConfirmOptIn)
+	router.POST("/privacy/confirm", ConfirmPersonalDataRequest)
+
+	post := func(path, body, authorization string) (int, string) {
+		mockRequest := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		mockRequest.Header.Set("Authorization", authorization)
+
+		mockResponseWriter := httptest.NewRecorder()
+
+		router.ServeHTTP(mockResponseWriter, mockRequest)
+
+		return mockResponseWriter.Code, mockResponseWriter.Body.String()
+	}
+
+	isChecked := func(email string) bool {
+		subscriberList, _ := subscribers.list()
+
+		for _, subscriber := range subscriberList {
+			if subscriber.Email == email {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	emailedToken := func() string {
+		messages := recorder.messages()
+		token := regexp.MustCompile(`"token": "([0-9a-f]+)"`).FindStringSubmatch(messages[len(messages)-1].Body)
+
+		if len(token) != 2 {
+			t.Fatalf("emails sent = %+v; expected: the last to have a token", messages)
+		}
+
+		return `{"token": "` + token[1] + `"}`
+	}
+
+	tests := []struct {
+		Body, Authorization string
+		ExpectedStatusCode  int
+		ExpectedChecked     bool
+	}{
+		{Body: `{"email": "someone@example.com"}`, ExpectedStatusCode: http.StatusAccepted},
+		{Body: `{"email": "admin@example.com"}`, Authorization: "Bearer admin", ExpectedStatusCode: http.StatusOK, ExpectedChecked: true},
+		{Body: `{"email": "slack@example.com", "chat": {"slack_channel": "C0123456789"}}`, ExpectedStatusCode: http.StatusForbidden},
+		{Body: `{"email": "ntfy@example.com", "push": {"ntfy_server_url": "https://169.254.169.254", "ntfy_topic": "pwned"}}`, Authorization: "Bearer wrong", ExpectedStatusCode: http.StatusForbidden},
+		{Body: `{"email": "slack@example.com", "chat": {"slack_channel": "C0123456789"}}`, Authorization: "Bearer admin", ExpectedStatusCode: http.StatusOK, ExpectedChecked: true},
+	}
+
+	for _, test := range tests {
+		statusCode, body := post("/add-to-pwnage-check", test.Body, test.Authorization)
+
+		if statusCode != test.ExpectedStatusCode {
+			t.Errorf("POST /add-to-pwnage-check %s with %q = HTTP/%d %s; expected: HTTP/%d", test.Body, test.Authorization, statusCode, body, test.ExpectedStatusCode)
+		}
+
+		if email := strings.Split(test.Body, `"`)[3]; isChecked(email) != test.ExpectedChecked {
+			t.Errorf("%s being checked after POST /add-to-pwnage-check with %q = %t; expected: %t", email, test.Authorization, !test.ExpectedChecked, test.ExpectedChecked)
+		}
+	}
+
+	if statusCode, body := post("/opt-in/confirm", emailedToken(), ""); statusCode != http.StatusOK || !isChecked("someone@example.com") {
+		t.Errorf("POST /opt-in/confirm = HTTP/%d %s; expected: HTTP/200 with someone@example.com checked", statusCode, body)
+	}
+
+	if statusCode, body := post("/delete-from-pwnage-check", `{"email": "someone@example.com"}`, ""); statusCode != http.StatusAccepted || !isChecked("someone@example.com") {
+		t.Errorf("POST /delete-from-pwnage-check = HTTP/%d %s; expected: HTTP/202 with someone@example.com still checked", statusCode, body)
+	}
+
+	if statusCode, body := post("/privacy/confirm", emailedToken(), ""); statusCode != http.StatusOK || isChecked("someone@example.com") {
+		t.Errorf("POST /privacy/confirm of the unsubscribe token = HTTP/%d %s; expected: HTTP/200 with someone@example.com no longer checked", statusCode, body)
+	}
+
+	if statusCode, body := post("/delete-from-pwnage-check", `{"email": "admin@example.com"}`, "Bearer admin"); statusCode != http.StatusOK || isChecked("admin@example.com") {
+		t.Errorf("POST /delete-from-pwnage-check with the admin token = HTTP/%d %s; expected: HTTP/200 with admin@example.com no longer checked", statusCode, body)
+	}
+}
+
+// Need to test the following:
+// The running service's stores are re-encrypted with the new active key, so they can be read without the old one
+// Subscribers added after rotating are encrypted with the new active key
+func TestRotateSubscriberKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tempDirectory, err := ioutil.TempDir("", "rotation")
+
+	if err != nil {
+		t.Fatal("could not create the temporary data directory")
+	}
+
+	defer os.RemoveAll(tempDirectory)
+
+	oldKey, newKey, indexKey := newTestKey(t), newTestKey(t), newTestKey(t)
+	oldKeyring := newTestKeyring(t, "old", map[string]string{"old": oldKey}, indexKey)
+
+	subscribers, _ = openSubscriberStore(filepath.Join(tempDirectory, "subscribers.json"), oldKeyring)
+	notificationOutbox, _ = openOutbox(filepath.Join(tempDirectory, "outbox.json"), oldKeyring)
+
+	defer func() { subscribers, notificationOutbox = nil, nil }()
+
+	subscribers.add(Subscriber{Email: "before@example.com"})
+	notificationOutbox.hold(notification{Email: "before@example.com", Channel: channelEmail, To: "before@example.com"}, time.Now().Add(time.Hour))
+
+	keysFileLocation := filepath.Join(tempDirectory, "subscriber-keys.json")
+	keysJSON := fmt.Sprintf(`{"active_key": "new", "keys": {"old": %q, "new": %q}, "index_key": %q}`, oldKey, newKey, indexKey)
+
+	if err = ioutil.WriteFile(keysFileLocation, []byte(keysJSON), 0600); err != nil {
+		t.Fatal("could not write the subscriber keys file")
+	}
+
+	originalKeysFile, keysFileSet := os.LookupEnv("subscriberKeysFile")
+	os.Setenv("subscriberKeysFile", keysFileLocation)
+
+	defer func() {
+		if keysFileSet {
+			os.Setenv("subscriberKeysFile", originalKeysFile)
+		} else {
+			os.Unsetenv("subscriberKeysFile")
+		}
+	}()
+
+	router := gin.New()
+	router.POST("/rotate-subscriber-keys", RotateSubscriberKeys)
+
+	mockResponseWriter := httptest.NewRecorder()
+
+	router.ServeHTTP(mockResponseWriter, httptest.NewRequest(http.MethodPost, "/rotate-subscriber-keys", nil))
+
+	if mockResponseWriter.Code != http.StatusOK || !strings.Contains(mockResponseWriter.Body.String(), `"rotated":1`) {
+		t.Fatalf("POST /rotate-subscriber-keys = HTTP/%d %s; expected: HTTP/200 with 1 rotated", mockResponseWriter.Code, mockResponseWriter.Body.String())
+	}
+
+	subscribers.add(Subscriber{Email: "after@example.com"})
+
+	newKeyring := newTestKeyring(t, "new", map[string]string{"new": newKey}, indexKey)
+
+	store, err := openSubscriberStore(filepath.Join(tempDirectory, "subscribers.json"), newKeyring)
+
+	if err != nil {
+		t.Fatalf("openSubscriberStore() with only the new key = %v; expected: <nil>", err)
+	}
+
+	for _, email := range []string{"before@example.com", "after@example.com"} {
+		if _, err = store.get(email); err != nil {
+			t.Errorf("subscriberStore.get(%q) with only the new key = %v; expected: <nil>", email, err)
+		}
+	}
+
+	ob, err := openOutbox(filepath.Join(tempDirectory, "outbox.json"), newKeyring)
+
+	if err != nil {
+		t.Fatalf("openOutbox() with only the new key = %v; expected: <nil>", err)
+	}
+
+	if held, err := ob.forEmail("before@example.com"); err != nil || len(held) != 1 {
+		t.Errorf("outbox.forEmail() with only the new key = %v, %v; expected: the held notification, <nil>", held, err)
+	}
+}
@@ -0,0 +1,69 @@
+package functionality
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "pwned-api"
+
+// Until InitializeTracing sets up an exporter the global
+// tracer provider is a no-op, and so are these spans
+var tracer = otel.Tracer("github.com/the-rileyj/pwned-api/functionality")
+
+// InitializeTracing exports spans over OTLP/HTTP to the endpoint in the otlpEndpoint
+// environment variable (like http://collector:4318), tracing stays a no-op without it;
+// the returned function flushes any remaining spans and should be called on shutdown
+func InitializeTracing(ctx context.Context) (func(context.Context) error, error) {
+	endpoint, exists := os.LookupEnv("otlpEndpoint")
+
+	if !exists || endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+
+	if err != nil {
+		return nil, err
+	}
+
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return tracerProvider.Shutdown, nil
+}
+
+// Tracing starts a span for every request, continuing any trace propagated by the client
+func Tracing() gin.HandlerFunc {
+	return otelgin.Middleware(serviceName)
+}
+
+// endSpan records the error on the span, if there is one, before ending it;
+// like in the logs any email addresses or phone numbers in the error are hashed
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		redactedErr := errors.New(redactPII(err.Error()))
+
+		span.RecordError(redactedErr)
+		span.SetStatus(codes.Error, redactedErr.Error())
+	}
+
+	span.End()
+}
@@ -0,0 +1,261 @@
+package functionality
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// useSpanRecorder records the spans from the package's tracer and the global tracer provider,
+// which the Tracing middleware uses, and propagates trace context like InitializeTracing does;
+// until restore is called
+func useSpanRecorder() (*tracetest.SpanRecorder, func()) {
+	originalTracer, originalProvider, originalPropagator := tracer, otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	tracer = provider.Tracer("github.com/the-rileyj/pwned-api/functionality")
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return recorder, func() {
+		tracer = originalTracer
+
+		otel.SetTracerProvider(originalProvider)
+		otel.SetTextMapPropagator(originalPropagator)
+	}
+}
+
+// spanAttributes are the attributes of the span by their keys
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attributes := make(map[attribute.Key]attribute.Value)
+
+	for _, kv := range span.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+
+	return attributes
+}
+
+// Need to test the following:
+// Tracing stays a no-op without an OTLP endpoint
+// With an endpoint, spans are exported over OTLP/HTTP to it when the returned function flushes them
+func TestInitializeTracing(t *testing.T) {
+	originalEndpoint, endpointSet := os.LookupEnv("otlpEndpoint")
+	originalProvider, originalPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+
+	defer func() {
+		if endpointSet {
+			os.Setenv("otlpEndpoint", originalEndpoint)
+		} else {
+			os.Unsetenv("otlpEndpoint")
+		}
+
+		otel.SetTracerProvider(originalProvider)
+		otel.SetTextMapPropagator(originalPropagator)
+	}()
+
+	os.Unsetenv("otlpEndpoint")
+
+	shutdown, err := InitializeTracing(context.Background())
+
+	if err != nil || shutdown == nil || otel.GetTracerProvider() != originalProvider {
+		t.Fatalf("InitializeTracing() without an endpoint = %v; expected: <nil>, and the no-op tracer provider left in place", err)
+	}
+
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+
+		defer mu.Unlock()
+
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.Header.Get("Content-Type"))
+	}))
+
+	defer collector.Close()
+
+	os.Setenv("otlpEndpoint", collector.URL+"/v1/traces")
+
+	if shutdown, err = InitializeTracing(context.Background()); err != nil {
+		t.Fatalf("InitializeTracing() with an endpoint = %v; expected: <nil>", err)
+	}
+
+	_, span := otel.Tracer("test").Start(context.Background(), "hibp.breachedaccount")
+
+	span.End()
+
+	if err = shutdown(context.Background()); err != nil {
+		t.Fatalf("shutting down tracing = %v; expected: <nil>", err)
+	}
+
+	mu.Lock()
+
+	defer mu.Unlock()
+
+	if len(requests) != 1 || requests[0] != "POST /v1/traces application/x-protobuf" {
+		t.Errorf("requests to the collector = %v; expected: the span POSTed to /v1/traces as protobuf", requests)
+	}
+
+	if fields := otel.GetTextMapPropagator().Fields(); !containsFold(fields, "traceparent") {
+		t.Errorf("propagated fields = %v; expected: traceparent", fields)
+	}
+}
+
+// Need to test the following:
+// Errors are recorded on the span and set its status, with any email addresses in them hashed
+// Spans without an error are ended with their status left unset
+func TestEndSpan(t *testing.T) {
+	recorder, restore := useSpanRecorder()
+
+	defer restore()
+
+	_, failed := tracer.Start(context.Background(), "notify.email")
+
+	endSpan(failed, errors.New("could not email someone@example.com"))
+
+	_, succeeded := tracer.Start(context.Background(), "notify.email")
+
+	endSpan(succeeded, nil)
+
+	ended := recorder.Ended()
+
+	if len(ended) != 2 {
+		t.Fatalf("ended spans = %d; expected: 2", len(ended))
+	}
+
+	status := ended[0].Status()
+
+	if status.Code != codes.Error || strings.Contains(status.Description, "someone@example.com") || !strings.Contains(status.Description, hashPII("email", "someone@example.com")) {
+		t.Errorf("status of the failed span = %+v; expected: an error with the email hashed", status)
+	}
+
+	if events := ended[0].Events(); len(events) != 1 || events[0].Name != "exception" {
+		t.Errorf("events of the failed span = %+v; expected: the error recorded as an exception", events)
+	}
+
+	for _, event := range ended[0].Events() {
+		for _, kv := range event.Attributes {
+			if strings.Contains(kv.Value.Emit(), "someone@example.com") {
+				t.Errorf("failed span event attribute %s = %s; expected: the email hashed", kv.Key, kv.Value.Emit())
+			}
+		}
+	}
+
+	if status = ended[1].Status(); status.Code != codes.Unset || len(ended[1].Events()) != 0 {
+		t.Errorf("status of the successful span = %+v with %d events; expected: unset, without events", status, len(ended[1].Events()))
+	}
+}
+
+// Need to test the following:
+// Requests get a server span from the Tracing middleware, continuing the trace propagated by the client
+// The lookup and notification are spans in the request's trace, with the email hashed in their attributes
+func TestTracingLookup(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	recorder, restoreTracing := useSpanRecorder()
+
+	defer restoreTracing()
+
+	_, restoreHIBP := useFakeHIBP(hibpFixtures)
+
+	defer restoreHIBP()
+
+	_, restoreEmail := useRecordingEmailSender()
+
+	defer restoreEmail()
+
+	router := gin.New()
+	router.Use(Tracing())
+	router.POST("/api/notify-pwnage", NotifyOfPwnage)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	request := httptest.NewRequest(http.MethodPost, "/api/notify-pwnage", strings.NewReader(`{"contacts": [{"email": "pwned@example.com"}]}`))
+	request.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	router.ServeHTTP(httptest.NewRecorder(), request)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+
+	for _, span := range recorder.Ended() {
+		// otelgin's name for the server span differs between versions, so it is found by its kind
+		if span.SpanKind() == trace.SpanKindServer {
+			spans["server"] = span
+		} else {
+			spans[span.Name()] = span
+		}
+
+		if span.SpanContext().TraceID().String() != traceID {
+			t.Errorf("span %s is in trace %s; expected: the client's trace %s", span.Name(), span.SpanContext().TraceID(), traceID)
+		}
+
+		for _, kv := range span.Attributes() {
+			if strings.Contains(kv.Value.Emit(), "pwned@example.com") {
+				t.Errorf("span %s attribute %s = %s; expected: no plaintext email", span.Name(), kv.Key, kv.Value.Emit())
+			}
+		}
+	}
+
+	tests := []struct {
+		Name               string
+		ExpectedAttributes map[attribute.Key]attribute.Value
+	}{
+		{
+			Name: "server",
+			ExpectedAttributes: map[attribute.Key]attribute.Value{
+				"http.route":       attribute.StringValue("/api/notify-pwnage"),
+				"http.status_code": attribute.IntValue(http.StatusOK),
+			},
+		},
+		{Name: "hibp.rate_limit_wait"},
+		{
+			Name: "hibp.breachedaccount",
+			ExpectedAttributes: map[attribute.Key]attribute.Value{
+				"email.hash":                attribute.StringValue(hashPII("email", "pwned@example.com")),
+				"pwned":                     attribute.BoolValue(true),
+				"http.response.status_code": attribute.IntValue(http.StatusOK),
+			},
+		},
+		{
+			Name:               "notify.email",
+			ExpectedAttributes: map[attribute.Key]attribute.Value{"email.provider": attribute.StringValue(emailBackendMailgun)},
+		},
+	}
+
+	for _, test := range tests {
+		span, exists := spans[test.Name]
+
+		if !exists {
+			t.Errorf("spans = %v; expected: a %s span", recorder.Ended(), test.Name)
+
+			continue
+		}
+
+		attributes := spanAttributes(span)
+
+		for key, expected := range test.ExpectedAttributes {
+			if attributes[key] != expected {
+				t.Errorf("span %s attribute %s = %s; expected: %s", test.Name, key, attributes[key].Emit(), expected.Emit())
+			}
+		}
+	}
+}
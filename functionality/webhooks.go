@@ -0,0 +1,692 @@
+package functionality
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrWebhookNotFound          = errors.New("there is no webhook with the ID provided")
+	ErrWebhookStoreUnavailable  = errors.New("the webhook store has not been opened")
+	ErrInvalidWebhookURL        = errors.New("the webhook URL must be an absolute http or https URL")
+	ErrWebhookDeliveriesFailing = errors.New("the webhook could not be delivered to every endpoint")
+	ErrWebhookRetryQueued       = errors.New("the webhook could not be delivered to every endpoint, so it was queued to be retried")
+)
+
+// webhookPayloadVersion is bumped whenever the payload changes in a way receivers could trip over
+const webhookPayloadVersion = 1
+
+// The headers each delivery is sent with, the signature is the hex HMAC-SHA256 of
+// "<timestamp>.<body>" with the endpoint's secret, so receivers can reject replays
+const (
+	webhookSignatureHeader = "X-Pwned-Api-Signature"
+	webhookTimestampHeader = "X-Pwned-Api-Timestamp"
+	webhookEventHeader     = "X-Pwned-Api-Event"
+	webhookDeliveryHeader  = "X-Pwned-Api-Delivery"
+)
+
+// webhookPayload is what is POSTed to the endpoints, it has the subscriber's ID rather than their PII
+type webhookPayload struct {
+	Version      int            `json:"version"`
+	ID           string         `json:"id"`
+	Type         string         `json:"type"`
+	CreatedAt    time.Time      `json:"created_at"`
+	SubscriberID string         `json:"subscriber_id,omitempty"`
+	Severity     severity       `json:"severity"`
+	Breaches     []scoredBreach `json:"breaches,omitempty"`
+	Pastes       []PasteInfo    `json:"pastes,omitempty"`
+}
+
+// webhookDelivery is one attempt at delivering an event to an endpoint, with
+// the blind index of the email it was about for exporting and erasing it
+type webhookDelivery struct {
+	EventID    string    `json:"event_id"`
+	EventType  string    `json:"event_type"`
+	EmailIndex string    `json:"email_index,omitempty"`
+	Attempt    int       `json:"attempt"`
+	At         time.Time `json:"at"`
+	DurationMS int64     `json:"duration_ms"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Succeeded  bool      `json:"succeeded"`
+}
+
+// webhookEndpoint is a registered URL, with its signing secret encrypted
+// and the most recent maxWebhookDeliveries attempts to deliver to it
+type webhookEndpoint struct {
+	ID         string            `json:"id"`
+	URL        string            `json:"url"`
+	Secret     envelope          `json:"secret"`
+	CreatedAt  time.Time         `json:"created_at"`
+	Deliveries []webhookDelivery `json:"deliveries,omitempty"`
+}
+
+// webhookStore keeps the webhook endpoints in a JSON file in the data directory
+type webhookStore struct {
+	mu           sync.Mutex
+	fileLocation string
+	keyring      *keyring
+	endpoints    map[string]webhookEndpoint
+}
+
+var (
+	webhooks *webhookStore
+
+	maxWebhookDeliveries = 100
+	webhookClient        = &http.Client{Timeout: 10 * time.Second}
+)
+
+func init() {
+	registerKeyringRotation("webhooks", func(kr *keyring) error {
+		if webhooks == nil {
+			return nil
+		}
+
+		return webhooks.rotate(kr)
+	})
+}
+
+// InitializeWebhooks opens the webhook store in the data directory and adds the webhook
+// notification channel, it needs the subscriber keys file for the signing secrets
+func InitializeWebhooks() error {
+	kr, err := loadKeyringFromFile(subscriberKeysFileLocation())
+
+	if err == nil {
+		webhooks, err = openWebhookStore(filepath.Join(dataDirectory, "webhooks.json"), kr)
+	}
+
+	registerReadinessCheck("webhook_store", func() error { return err })
+
+	if err != nil {
+		return err
+	}
+
+	registerNotifier(channelWebhook, webhookNotifier{store: webhooks})
+
+	registerPersonalDataSource("webhook_deliveries", personalDataSource{
+		export: func(email string) (interface{}, error) {
+			if deliveries := webhooks.deliveriesForEmail(email); len(deliveries) != 0 {
+				return deliveries, nil
+			}
+
+			return nil, nil
+		},
+		erase: webhooks.eraseEmail,
+	})
+
+	return nil
+}
+
+func openWebhookStore(fileLocation string, kr *keyring) (*webhookStore, error) {
+	store := &webhookStore{
+		fileLocation: fileLocation,
+		keyring:      kr,
+		endpoints:    make(map[string]webhookEndpoint),
+	}
+
+	storeBytes, err := ioutil.ReadFile(fileLocation)
+
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return store, json.Unmarshal(storeBytes, &store.endpoints)
+}
+
+// save must be called with the lock held
+func (ws *webhookStore) save() error {
+	storeBytes, err := json.Marshal(ws.endpoints)
+
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(ws.fileLocation), ".webhooks")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(storeBytes)
+
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempFile.Name(), ws.fileLocation)
+}
+
+func webhookAdditionalData(id string) []byte {
+	return []byte("webhook/" + id)
+}
+
+// add registers the URL, returning the endpoint and its newly generated signing secret
+func (ws *webhookStore) add(endpointURL string) (webhookEndpoint, string, error) {
+	parsedURL, err := url.Parse(endpointURL)
+
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+		return webhookEndpoint{}, "", ErrInvalidWebhookURL
+	}
+
+	secretBytes := make([]byte, 32)
+
+	if _, err = rand.Read(secretBytes); err != nil {
+		return webhookEndpoint{}, "", err
+	}
+
+	secret := hex.EncodeToString(secretBytes)
+	endpoint := webhookEndpoint{ID: newID(), URL: parsedURL.String(), CreatedAt: time.Now().UTC()}
+
+	if endpoint.Secret, err = ws.keyring.encrypt([]byte(secret), webhookAdditionalData(endpoint.ID)); err != nil {
+		return endpoint, "", err
+	}
+
+	ws.mu.Lock()
+
+	defer ws.mu.Unlock()
+
+	ws.endpoints[endpoint.ID] = endpoint
+
+	return endpoint, secret, ws.save()
+}
+
+func (ws *webhookStore) remove(id string) error {
+	ws.mu.Lock()
+
+	defer ws.mu.Unlock()
+
+	if _, exists := ws.endpoints[id]; !exists {
+		return ErrWebhookNotFound
+	}
+
+	delete(ws.endpoints, id)
+
+	return ws.save()
+}
+
+func (ws *webhookStore) get(id string) (webhookEndpoint, error) {
+	ws.mu.Lock()
+
+	defer ws.mu.Unlock()
+
+	endpoint, exists := ws.endpoints[id]
+
+	if !exists {
+		return endpoint, ErrWebhookNotFound
+	}
+
+	return endpoint, nil
+}
+
+func (ws *webhookStore) list() []webhookEndpoint {
+	ws.mu.Lock()
+
+	defer ws.mu.Unlock()
+
+	endpoints := make([]webhookEndpoint, 0, len(ws.endpoints))
+
+	for _, endpoint := range ws.endpoints {
+		endpoints = append(endpoints, endpoint)
+	}
+
+	sort.Slice(endpoints, func(i, j int) bool { return endpoints[i].CreatedAt.Before(endpoints[j].CreatedAt) })
+
+	return endpoints
+}
+
+func (ws *webhookStore) secret(endpoint webhookEndpoint) ([]byte, error) {
+	return ws.keyring.decrypt(endpoint.Secret, webhookAdditionalData(endpoint.ID))
+}
+
+// recordDelivery adds the attempt to the endpoint's deliveries, keeping only the most recent ones
+func (ws *webhookStore) recordDelivery(id string, delivery webhookDelivery) error {
+	ws.mu.Lock()
+
+	defer ws.mu.Unlock()
+
+	endpoint, exists := ws.endpoints[id]
+
+	if !exists {
+		return ErrWebhookNotFound
+	}
+
+	endpoint.Deliveries = append(endpoint.Deliveries, delivery)
+
+	if len(endpoint.Deliveries) > maxWebhookDeliveries {
+		endpoint.Deliveries = endpoint.Deliveries[len(endpoint.Deliveries)-maxWebhookDeliveries:]
+	}
+
+	ws.endpoints[id] = endpoint
+
+	return ws.save()
+}
+
+// attemptsAt is how many attempts have been recorded at delivering the event to the endpoint
+func (ws *webhookStore) attemptsAt(id, eventID string) int {
+	ws.mu.Lock()
+
+	defer ws.mu.Unlock()
+
+	attempts := 0
+
+	for _, delivery := range ws.endpoints[id].Deliveries {
+		if delivery.EventID == eventID {
+			attempts++
+		}
+	}
+
+	return attempts
+}
+
+// deliveriesForEmail returns the delivery attempts of events about the email, by the ID of their endpoint
+func (ws *webhookStore) deliveriesForEmail(email string) map[string][]webhookDelivery {
+	ws.mu.Lock()
+
+	defer ws.mu.Unlock()
+
+	emailIndex := ws.keyring.blindIndex(email)
+	deliveries := make(map[string][]webhookDelivery)
+
+	for id, endpoint := range ws.endpoints {
+		for _, delivery := range endpoint.Deliveries {
+			if delivery.EmailIndex == emailIndex {
+				deliveries[id] = append(deliveries[id], delivery)
+			}
+		}
+	}
+
+	return deliveries
+}
+
+// eraseEmail removes the delivery attempts of events about the email from every endpoint
+func (ws *webhookStore) eraseEmail(email string) (bool, error) {
+	ws.mu.Lock()
+
+	defer ws.mu.Unlock()
+
+	emailIndex := ws.keyring.blindIndex(email)
+	erased := false
+
+	for id, endpoint := range ws.endpoints {
+		kept := endpoint.Deliveries[:0]
+
+		for _, delivery := range endpoint.Deliveries {
+			if delivery.EmailIndex != emailIndex {
+				kept = append(kept, delivery)
+			}
+		}
+
+		erased = erased || len(kept) != len(endpoint.Deliveries)
+		endpoint.Deliveries = kept
+		ws.endpoints[id] = endpoint
+	}
+
+	if !erased {
+		return false, nil
+	}
+
+	return true, ws.save()
+}
+
+// rotate re-encrypts the signing secret of every endpoint with the keyring's active key
+func (ws *webhookStore) rotate(kr *keyring) error {
+	ws.mu.Lock()
+
+	defer ws.mu.Unlock()
+
+	ws.keyring = kr
+
+	for id, endpoint := range ws.endpoints {
+		secret, err := ws.secret(endpoint)
+
+		if err != nil {
+			return err
+		}
+
+		if endpoint.Secret, err = ws.keyring.encrypt(secret, webhookAdditionalData(id)); err != nil {
+			return err
+		}
+
+		ws.endpoints[id] = endpoint
+	}
+
+	return ws.save()
+}
+
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver POSTs the payload about the email to the endpoint once, and records the attempt
+func (ws *webhookStore) deliver(ctx context.Context, endpoint webhookEndpoint, email string, payload webhookPayload, body []byte) error {
+	secret, err := ws.secret(endpoint)
+
+	if err != nil {
+		return err
+	}
+
+	log := loggerFromContext(ctx).With("webhook_id", endpoint.ID, "event_id", payload.ID)
+
+	delivery := ws.attempt(ctx, endpoint, secret, payload, body)
+	delivery.Attempt = ws.attemptsAt(endpoint.ID, payload.ID) + 1
+	delivery.EmailIndex = ws.keyring.blindIndex(email)
+
+	if recordErr := ws.recordDelivery(endpoint.ID, delivery); recordErr != nil {
+		log.Warn("could not record webhook delivery", "error", recordErr)
+	}
+
+	if delivery.Succeeded {
+		return nil
+	}
+
+	log.Warn("webhook delivery failed", "attempt", delivery.Attempt, "status", delivery.StatusCode, "error", delivery.Error)
+
+	return fmt.Errorf("webhook %s failed on attempt %d: %s", endpoint.ID, delivery.Attempt, delivery.Error)
+}
+
+func (ws *webhookStore) attempt(ctx context.Context, endpoint webhookEndpoint, secret []byte, payload webhookPayload, body []byte) (delivery webhookDelivery) {
+	start := time.Now()
+	delivery = webhookDelivery{EventID: payload.ID, EventType: payload.Type, At: start.UTC()}
+
+	defer func() { delivery.DurationMS = time.Since(start).Milliseconds() }()
+
+	deliveryRequest, err := http.NewRequest("POST", endpoint.URL, bytes.NewReader(body))
+
+	if err != nil {
+		delivery.Error = err.Error()
+
+		return delivery
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	deliveryRequest.Header.Set("Content-Type", "application/json")
+	deliveryRequest.Header.Set("User-Agent", "RJ-And-Friends-Nightly-Pwnage-Checker")
+	deliveryRequest.Header.Set(webhookTimestampHeader, timestamp)
+	deliveryRequest.Header.Set(webhookSignatureHeader, signWebhook(secret, timestamp, body))
+	deliveryRequest.Header.Set(webhookEventHeader, payload.Type)
+	deliveryRequest.Header.Set(webhookDeliveryHeader, payload.ID)
+
+	resp, err := webhookClient.Do(deliveryRequest.WithContext(ctx))
+
+	if err != nil {
+		delivery.Error = err.Error()
+
+		return delivery
+	}
+
+	defer resp.Body.Close()
+
+	io.Copy(ioutil.Discard, resp.Body)
+
+	delivery.StatusCode = resp.StatusCode
+	delivery.Succeeded = resp.StatusCode >= 200 && resp.StatusCode < 300
+
+	if !delivery.Succeeded {
+		delivery.Error = fmt.Sprintf("the endpoint responded with HTTP/%d", resp.StatusCode)
+	}
+
+	return delivery
+}
+
+// webhookNotifier sends breach and paste notifications to every registered endpoint, deliveries
+// which fail are held in the outbox and retried on its later runs rather than waited on; they
+// are held addressed To their endpoint with the payload as their Body, so the same event is redelivered
+type webhookNotifier struct {
+	store *webhookStore
+}
+
+// recipient is always reachable, since the endpoints are registered for every subscriber
+func (webhookNotifier) recipient(Subscriber) (string, bool) {
+	return "", true
+}
+
+// deferrable is false, since quiet hours are for people rather than security tooling
+func (webhookNotifier) deferrable() bool {
+	return false
+}
+
+func (wn webhookNotifier) send(ctx context.Context, n notification) error {
+	if n.To != "" {
+		return wn.retry(ctx, n)
+	}
+
+	if n.Type != notificationBreach && n.Type != notificationPaste {
+		return nil
+	}
+
+	payload := webhookPayload{
+		Version:      webhookPayloadVersion,
+		ID:           newID(),
+		Type:         n.Type,
+		CreatedAt:    time.Now().UTC(),
+		SubscriberID: n.SubscriberID,
+		Severity:     n.Severity,
+		Breaches:     n.Breaches,
+		Pastes:       n.Pastes,
+	}
+
+	body, err := json.Marshal(payload)
+
+	if err != nil {
+		return err
+	}
+
+	ctx, span := tracer.Start(ctx, "notify.webhook")
+
+	var failed, queued bool
+
+	for _, endpoint := range wn.store.list() {
+		err := wn.store.deliver(ctx, endpoint, n.Email, payload, body)
+
+		recordNotification(channelWebhook, err)
+
+		if err == nil {
+			continue
+		}
+
+		if err = wn.holdForRetry(ctx, endpoint, n, body, err); err != nil {
+			failed = true
+		} else {
+			queued = true
+		}
+	}
+
+	// A delivery queued to be retried hasn't been delivered yet, so it is still an error
+	switch {
+	case failed:
+		err = ErrWebhookDeliveriesFailing
+	case queued:
+		err = ErrWebhookRetryQueued
+	}
+
+	endSpan(span, err)
+
+	return err
+}
+
+// holdForRetry puts the failed delivery to the endpoint in the outbox, to be retried after the
+// outbox's backoff; the delivery's error is returned when there is no outbox to hold it in
+func (wn webhookNotifier) holdForRetry(ctx context.Context, endpoint webhookEndpoint, n notification, body []byte, deliveryErr error) error {
+	if notificationOutbox == nil {
+		return deliveryErr
+	}
+
+	held := n
+	held.Channel = channelWebhook
+	held.To = endpoint.ID
+	held.Body = string(body)
+
+	if err := notificationOutbox.hold(held, time.Now().Add(retryAfter(0))); err != nil {
+		return err
+	}
+
+	loggerFromContext(ctx).Info("held webhook delivery to be retried", "webhook_id", endpoint.ID)
+
+	return nil
+}
+
+// retry redelivers a delivery held in the outbox to its endpoint, the outbox keeps it until it
+// succeeds or has been tried maxOutboxAttempts times; endpoints which have since been removed are skipped
+func (wn webhookNotifier) retry(ctx context.Context, n notification) error {
+	endpoint, err := wn.store.get(n.To)
+
+	if err != nil {
+		return nil
+	}
+
+	var payload webhookPayload
+
+	if err = json.Unmarshal([]byte(n.Body), &payload); err != nil {
+		return err
+	}
+
+	ctx, span := tracer.Start(ctx, "notify.webhook")
+
+	err = wn.store.deliver(ctx, endpoint, n.Email, payload, []byte(n.Body))
+
+	recordNotification(channelWebhook, err)
+
+	endSpan(span, err)
+
+	return err
+}
+
+func availableWebhookStore(c *gin.Context) (*webhookStore, bool) {
+	if webhooks == nil {
+		respondWithError(c, http.StatusServiceUnavailable, ErrWebhookStoreUnavailable)
+
+		return nil, false
+	}
+
+	return webhooks, true
+}
+
+// AddWebhook registers a URL for breach and paste events to be POSTed to, responding with the
+// secret deliveries to it are signed with, which is only ever shown in this response
+func AddWebhook(c *gin.Context) {
+	store, ok := availableWebhookStore(c)
+
+	if !ok {
+		return
+	}
+
+	webhookRequest := struct {
+		URL string `json:"url"`
+	}{}
+
+	if err := json.NewDecoder(c.Request.Body).Decode(&webhookRequest); err != nil {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	}
+
+	endpoint, secret, err := store.add(webhookRequest.URL)
+
+	if err == ErrInvalidWebhookURL {
+		respondWithError(c, http.StatusBadRequest, err)
+
+		return
+	}
+
+	if err != nil {
+		respondWithError(c, http.StatusInternalServerError, err)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"error": false, "id": endpoint.ID, "url": endpoint.URL, "secret": secret})
+}
+
+// ListWebhooks responds with the registered webhooks, without their secrets or deliveries
+func ListWebhooks(c *gin.Context) {
+	store, ok := availableWebhookStore(c)
+
+	if !ok {
+		return
+	}
+
+	listed := make([]gin.H, 0)
+
+	for _, endpoint := range store.list() {
+		listed = append(listed, gin.H{"id": endpoint.ID, "url": endpoint.URL, "created_at": endpoint.CreatedAt})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"error": false, "webhooks": listed})
+}
+
+// DeleteWebhook stops events being delivered to the webhook with the ID in the path
+func DeleteWebhook(c *gin.Context) {
+	store, ok := availableWebhookStore(c)
+
+	if !ok {
+		return
+	}
+
+	if err := store.remove(c.Param("id")); err != nil {
+		respondWithError(c, http.StatusNotFound, err)
+
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"error": false})
+}
+
+// ListWebhookDeliveries responds with the most recent delivery attempts to the webhook with the ID in the path
+func ListWebhookDeliveries(c *gin.Context) {
+	store, ok := availableWebhookStore(c)
+
+	if !ok {
+		return
+	}
+
+	endpoint, err := store.get(c.Param("id"))
+
+	if err != nil {
+		respondWithError(c, http.StatusNotFound, err)
+
+		return
+	}
+
+	deliveries := endpoint.Deliveries
+
+	if deliveries == nil {
+		deliveries = []webhookDelivery{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"error": false, "deliveries": deliveries})
+}
@@ -0,0 +1,193 @@
+package functionality
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Need to test the following:
+// Deliveries are signed with the endpoint's secret over the timestamp and body
+// The payload has the subscriber's ID, breaches and severity, and not their email
+// Failed deliveries are held in the outbox and retried with its backoff until they succeed, as the same event
+// A delivery queued to be retried is still an error, so it isn't counted as delivered
+// Every attempt is recorded
+// Without an outbox to hold them in, failed deliveries are an error straight away
+// The deliveries about an email can be exported and erased by it, leaving the others
+func TestWebhookNotifier(t *testing.T) {
+	tempDirectory, err := ioutil.TempDir("", "webhooks")
+
+	if err != nil {
+		t.Fatal("could not create the temporary data directory")
+	}
+
+	defer os.RemoveAll(tempDirectory)
+
+	notificationOutbox, _ = openOutbox(filepath.Join(tempDirectory, "outbox.json"), newTestKeyring(t, "1", map[string]string{"1": newTestKey(t)}, newTestKey(t)))
+
+	defer func() { notificationOutbox = nil }()
+
+	store, _ := openWebhookStore(filepath.Join(tempDirectory, "webhooks.json"), newTestKeyring(t, "1", map[string]string{"1": newTestKey(t)}, newTestKey(t)))
+
+	var (
+		secret    string
+		failures  = 2
+		delivered []webhookPayload
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if r.Header.Get(webhookSignatureHeader) != signWebhook([]byte(secret), r.Header.Get(webhookTimestampHeader), body) {
+			t.Errorf("webhook signature = %s; expected it to be signed with the endpoint's secret", r.Header.Get(webhookSignatureHeader))
+		}
+
+		if strings.Contains(string(body), "someone@example.com") {
+			t.Errorf("webhook payload = %s; expected no email", body)
+		}
+
+		if failures > 0 {
+			failures--
+
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		var payload webhookPayload
+
+		json.Unmarshal(body, &payload)
+
+		delivered = append(delivered, payload)
+	}))
+
+	defer server.Close()
+
+	endpoint, secret, err := store.add(server.URL + "/hooks/pwned")
+
+	if err != nil {
+		t.Fatalf("webhookStore.add() = %v; expected: <nil>", err)
+	}
+
+	notifier := webhookNotifier{store: store}
+	breach := scoredBreach{PwnInfo: PwnInfo{Name: "Adobe"}, Severity: severityHigh}
+
+	err = notifier.send(context.Background(), notification{
+		Type:         notificationBreach,
+		SubscriberID: "subscriber-id",
+		Email:        "someone@example.com",
+		Severity:     severityHigh,
+		Breaches:     []scoredBreach{breach},
+	})
+
+	if err != ErrWebhookRetryQueued || len(delivered) != 0 || len(notificationOutbox.entries) != 1 {
+		t.Fatalf("webhookNotifier.send() = %v, %d deliveries, %d held; expected: %v, no deliveries, 1 held", err, len(delivered), len(notificationOutbox.entries), ErrWebhookRetryQueued)
+	}
+
+	for run := 1; run <= 2; run++ {
+		notificationOutbox.sendDue(context.Background(), time.Now().Add(time.Duration(run)*time.Hour), notifier.send)
+	}
+
+	if len(delivered) != 1 || len(notificationOutbox.entries) != 0 {
+		t.Fatalf("webhook deliveries after retrying = %d, %d held; expected: 1 delivery, nothing held", len(delivered), len(notificationOutbox.entries))
+	}
+
+	payload := delivered[0]
+
+	if payload.Version != webhookPayloadVersion || payload.SubscriberID != "subscriber-id" || payload.Severity != severityHigh || len(payload.Breaches) != 1 || payload.Breaches[0].Name != "Adobe" {
+		t.Errorf("webhook payload = %+v; expected: the subscriber ID, Adobe and high severity", payload)
+	}
+
+	endpoint, _ = store.get(endpoint.ID)
+
+	if len(endpoint.Deliveries) != 3 || endpoint.Deliveries[0].StatusCode != http.StatusServiceUnavailable || !endpoint.Deliveries[2].Succeeded || endpoint.Deliveries[2].Attempt != 3 || endpoint.Deliveries[2].EventID != endpoint.Deliveries[0].EventID {
+		t.Errorf("webhook deliveries = %+v; expected: 2 failed attempts, then a successful third of the same event", endpoint.Deliveries)
+	}
+
+	failures, notificationOutbox = 1, nil
+
+	if err = notifier.send(context.Background(), notification{Type: notificationBreach}); err != ErrWebhookDeliveriesFailing {
+		t.Errorf("webhookNotifier.send() to a failing endpoint = %v; expected: %v", err, ErrWebhookDeliveriesFailing)
+	}
+
+	if err = notifier.send(context.Background(), notification{Type: notificationNotPwned}); err != nil || len(delivered) != 1 {
+		t.Errorf("webhookNotifier.send() of a not pwned notification = %v, %d deliveries; expected: nothing delivered", err, len(delivered))
+	}
+
+	if deliveries := store.deliveriesForEmail("Someone@example.com"); len(deliveries[endpoint.ID]) != 3 {
+		t.Errorf("webhookStore.deliveriesForEmail() = %+v; expected: the 3 attempts at delivering the breach", deliveries)
+	}
+
+	if erased, err := store.eraseEmail("someone@example.com"); !erased || err != nil {
+		t.Errorf("webhookStore.eraseEmail() = %t, %v; expected: true, <nil>", erased, err)
+	}
+
+	if endpoint, _ = store.get(endpoint.ID); len(endpoint.Deliveries) != 1 || len(store.deliveriesForEmail("someone@example.com")) != 0 {
+		t.Errorf("webhook deliveries after erasing the email = %+v; expected: only the attempt without an email", endpoint.Deliveries)
+	}
+}
+
+// Need to test the following:
+// Only absolute http and https URLs can be registered
+// The secret is only in the response to registering the webhook
+func TestAddWebhook(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tempDirectory, err := ioutil.TempDir("", "webhooks")
+
+	if err != nil {
+		t.Fatal("could not create the temporary data directory")
+	}
+
+	defer os.RemoveAll(tempDirectory)
+
+	webhooks, _ = openWebhookStore(filepath.Join(tempDirectory, "webhooks.json"), newTestKeyring(t, "1", map[string]string{"1": newTestKey(t)}, newTestKey(t)))
+
+	defer func() { webhooks = nil }()
+
+	router := gin.New()
+	router.POST("/webhooks", AddWebhook)
+	router.GET("/webhooks", ListWebhooks)
+
+	tests := []struct {
+		URL                string
+		ExpectedStatusCode int
+	}{
+		{URL: "https://security.example.com/hooks/pwned", ExpectedStatusCode: 200},
+		{URL: "ftp://security.example.com/hooks", ExpectedStatusCode: 400},
+		{URL: "/hooks/pwned", ExpectedStatusCode: 400},
+	}
+
+	for _, test := range tests {
+		mockResponseWriter := httptest.NewRecorder()
+
+		router.ServeHTTP(mockResponseWriter, httptest.NewRequest(http.MethodPost, "/webhooks", strings.NewReader(`{"url": "`+test.URL+`"}`)))
+
+		response := struct {
+			Secret string `json:"secret"`
+		}{}
+
+		json.Unmarshal(mockResponseWriter.Body.Bytes(), &response)
+
+		if mockResponseWriter.Code != test.ExpectedStatusCode || (test.ExpectedStatusCode == 200 && len(response.Secret) != 64) {
+			t.Errorf("POST /webhooks %s = HTTP/%d, %s; expected: HTTP/%d", test.URL, mockResponseWriter.Code, mockResponseWriter.Body, test.ExpectedStatusCode)
+		}
+	}
+
+	mockResponseWriter := httptest.NewRecorder()
+
+	router.ServeHTTP(mockResponseWriter, httptest.NewRequest(http.MethodGet, "/webhooks", nil))
+
+	if strings.Contains(mockResponseWriter.Body.String(), "secret") || !strings.Contains(mockResponseWriter.Body.String(), "security.example.com") {
+		t.Errorf("GET /webhooks = %s; expected: the webhook without its secret", mockResponseWriter.Body)
+	}
+}
@@ -1,12 +1,80 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+
 	"github.com/gin-gonic/gin"
 	"github.com/the-rileyj/pwned-api/functionality"
+	"github.com/the-rileyj/pwned-api/functionality/hibptest"
 )
 
 func main() {
-	router := gin.Default()
+	if len(os.Args) > 1 && os.Args[1] == "import-pwned-passwords" {
+		importPwnedPasswords(os.Args[2:])
+
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "import-contacts" {
+		importContacts(os.Args[2:])
+
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "fake-hibp" {
+		serveFakeHIBP(os.Args[2:])
+
+		return
+	}
+
+	shutdownTracing, err := functionality.InitializeTracing(context.Background())
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer shutdownTracing(context.Background())
+
+	if err = functionality.InitializeSubscriberStore(); err != nil {
+		log.Printf("could not open the subscriber store: %v", err)
+	}
+
+	if err = functionality.InitializeOutbox(); err != nil {
+		log.Printf("could not open the outbox: %v", err)
+	}
+
+	if err = functionality.InitializeWebhooks(); err != nil {
+		log.Printf("could not open the webhook store: %v", err)
+	}
+
+	if err = functionality.InitializeOfflinePasswords(); err != nil {
+		log.Printf("could not open the offline Pwned Passwords index: %v", err)
+	}
+
+	if err = functionality.InitializeBreachCatalogue(); err != nil {
+		log.Printf("could not open the breach catalogue: %v", err)
+	}
+
+	if err = functionality.InitializeDomainSearch(); err != nil {
+		log.Printf("could not open the domain store: %v", err)
+	}
+
+	functionality.StartScheduler(context.Background())
+
+	router := gin.New()
+
+	router.Use(functionality.Tracing(), functionality.RequestLogger(), gin.Recovery())
+
+	router.GET("/metrics", functionality.Metrics)
+
+	router.GET("/healthz", functionality.Health)
+
+	router.GET("/readyz", functionality.Readiness)
 
 	apiGroup := router.Group("/api")
 
@@ -14,11 +82,179 @@ func main() {
 
 	apiGroup.POST("/notify-pwnage-without-cache", functionality.NotifyOfPwnage)
 
-	apiGroup.POST("/notify-pwnage-with-cache", functionality.NotifyOfPwnage)
+	apiGroup.POST("/notify-pwnage-with-cache", functionality.NotifyOfPwnageWithCache)
 
 	apiGroup.POST("/add-to-pwnage-check", functionality.AddToPwnageCheck)
 
 	apiGroup.POST("/delete-from-pwnage-check", functionality.DeleteFromPwnageCheck)
 
+	apiGroup.POST("/opt-in/confirm", functionality.ConfirmOptIn)
+
+	apiGroup.POST("/check-password", functionality.CheckPassword)
+
+	apiGroup.GET("/breaches", functionality.ListBreaches)
+
+	apiGroup.GET("/breaches/:name", functionality.GetBreach)
+
+	apiGroup.POST("/privacy/request", functionality.RequestPersonalData)
+
+	apiGroup.POST("/privacy/confirm", functionality.ConfirmPersonalDataRequest)
+
+	adminGroup := apiGroup.Group("/admin", functionality.RequireAdmin())
+
+	adminGroup.POST("/export-personal-data", functionality.ExportPersonalData)
+
+	adminGroup.POST("/erase-personal-data", functionality.ErasePersonalData)
+
+	adminGroup.POST("/import-to-pwnage-check", functionality.ImportToPwnageCheck)
+
+	adminGroup.POST("/domains", functionality.RegisterDomain)
+
+	adminGroup.POST("/domains/:domain/verify", functionality.VerifyDomain)
+
+	adminGroup.GET("/domains/:domain/report", functionality.DomainReport)
+
+	adminGroup.POST("/webhooks", functionality.AddWebhook)
+
+	adminGroup.GET("/webhooks", functionality.ListWebhooks)
+
+	adminGroup.DELETE("/webhooks/:id", functionality.DeleteWebhook)
+
+	adminGroup.GET("/webhooks/:id/deliveries", functionality.ListWebhookDeliveries)
+
+	adminGroup.POST("/rotate-subscriber-keys", functionality.RotateSubscriberKeys)
+
 	router.Run(":80")
 }
+
+// importPwnedPasswords builds the offline index from a Pwned Passwords download:
+// gogram import-pwned-passwords -type ntlm pwned-passwords-ntlm-ordered-by-hash.txt
+func importPwnedPasswords(args []string) {
+	flags := flag.NewFlagSet("import-pwned-passwords", flag.ExitOnError)
+	hashType := flags.String("type", "sha1", "the hash type of the dataset, sha1 or ntlm")
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		log.Fatal("the dataset to import must be provided")
+	}
+
+	dataset, err := os.Open(flags.Arg(0))
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer dataset.Close()
+
+	imported, err := functionality.ImportPwnedPasswords(dataset, *hashType)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("imported %d %s hashes\n", imported, *hashType)
+}
+
+// importContacts adds the contacts in a CSV, JSON Lines or vCard file to the subscribers,
+// the format is taken from the file extension unless it is given:
+// gogram import-contacts -email-column "E-mail Address" -opt-in contacts.csv
+func importContacts(args []string) {
+	flags := flag.NewFlagSet("import-contacts", flag.ExitOnError)
+	format := flags.String("format", "", "the format of the file, csv, jsonl or vcard")
+	emailColumn := flags.String("email-column", functionality.DefaultContactColumns.Email, "the CSV column with the email")
+	phoneColumn := flags.String("phone-column", functionality.DefaultContactColumns.Phone, "the CSV column with the phone number")
+	alwaysNotifyColumn := flags.String("always-notify-column", functionality.DefaultContactColumns.AlwaysNotify, "the CSV column with whether to always notify")
+	optIn := flags.Bool("opt-in", false, "email new subscribers a token to confirm with before they are checked")
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		log.Fatal("the contacts to import must be provided")
+	}
+
+	contactFormat, err := functionality.ContactFormat(*format, flags.Arg(0), "")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err = functionality.InitializeSubscriberStore(); err != nil {
+		log.Fatal(err)
+	}
+
+	contacts, err := os.Open(flags.Arg(0))
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer contacts.Close()
+
+	columns := functionality.ContactColumns{Email: *emailColumn, Phone: *phoneColumn, AlwaysNotify: *alwaysNotifyColumn}
+
+	result, err := functionality.ImportContacts(context.Background(), contacts, contactFormat, columns, *optIn)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, rowErr := range result.Errors {
+		if rowErr.Email != "" {
+			fmt.Printf("line %d (%s): %s\n", rowErr.Line, rowErr.Email, rowErr.Error)
+		} else {
+			fmt.Printf("line %d: %s\n", rowErr.Line, rowErr.Error)
+		}
+	}
+
+	fmt.Printf("imported %d contacts, skipped %d duplicates, %d existing subscribers and %d invalid rows, sent %d opt-in emails\n", result.Imported, result.Duplicates, result.Existing, result.Invalid, result.OptInsSent)
+}
+
+// serveFakeHIBP serves fixtures as a local HIBP and Pwned Passwords API, so the service can be
+// run offline with hibpBaseURL and pwnedPasswordsBaseURL set to the URLs it prints:
+// gogram fake-hibp -addr 127.0.0.1:8081 -api-key key fixtures.json
+func serveFakeHIBP(args []string) {
+	flags := flag.NewFlagSet("fake-hibp", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:8081", "the address to listen on")
+	apiKey := flags.String("api-key", "", "the hibp-api-key requests must have, any is accepted when empty")
+	latency := flags.Duration("latency", 0, "how long to delay every response")
+
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		log.Fatal("the fixtures to serve must be provided")
+	}
+
+	fixturesFile, err := os.Open(flags.Arg(0))
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fixtures, err := hibptest.LoadFixtures(fixturesFile)
+
+	fixturesFile.Close()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	server := hibptest.NewUnstartedServer(fixtures)
+
+	server.Listener.Close()
+	server.Listener = listener
+
+	server.RequireAPIKey(*apiKey)
+	server.SetLatency(*latency)
+	server.Start()
+
+	fmt.Printf("serving a fake HIBP at %s and Pwned Passwords at %s\n", server.URL+hibptest.APIPath, server.URL)
+
+	select {}
+}